@@ -0,0 +1,91 @@
+// Package analytics records who uses the server and how as metrics that
+// can be shared broadly: users are recorded under a keyed hash of their
+// name, and of what they searched for only the shape is kept, such as the
+// number of words and the filters the generated query uses, never the text.
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+
+	"github.com/nlsearch/backend/metrics"
+	"github.com/nlsearch/backend/query"
+)
+
+// Anonymous is the pseudonym of unauthenticated callers, who can't be told
+// apart.
+const Anonymous = "anonymous"
+
+// wordBuckets bound the histogram of request lengths, in words.
+var wordBuckets = []float64{2, 4, 6, 8, 12, 16, 24, 32, 64}
+
+// Recorder records anonymized usage in a metrics registry.
+type Recorder struct {
+	key []byte
+
+	translations *metrics.CounterVec
+	words        *metrics.HistogramVec
+	filters      *metrics.CounterVec
+	feedback     *metrics.CounterVec
+}
+
+// New returns a Recorder registering its metrics in registry. User names
+// are hashed keyed by salt, which should be secret, so pseudonyms can't be
+// reversed by hashing likely names, and shared by every replica, so a user
+// has the same pseudonym on each.
+func New(registry *metrics.Registry, salt string) *Recorder {
+	return &Recorder{
+		key:          []byte(salt),
+		translations: registry.Counter("nlsearch_analytics_translations_total", "Translations by pseudonymous user and outcome.", "user", "outcome"),
+		words:        registry.Histogram("nlsearch_analytics_request_words", "Length of translated requests in words.", wordBuckets),
+		filters:      registry.Counter("nlsearch_analytics_query_filters_total", "Filters used by generated queries, by filter name.", "filter"),
+		feedback:     registry.Counter("nlsearch_analytics_feedback_total", "Feedback by pseudonymous user and label.", "user", "label"),
+	}
+}
+
+// User returns the pseudonym user is recorded under.
+func (r *Recorder) User(user string) string {
+	if user == "" {
+		return Anonymous
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Translation records a translation of request for user, which ended in
+// outcome, such as "translated" or an error code. Of request only the
+// number of words is kept, and of the generated query, which is empty if
+// the translation failed, only the names of the filters it uses.
+func (r *Recorder) Translation(user, outcome, request, generated string) {
+	r.translations.Inc(r.User(user), outcome)
+	r.words.Observe(float64(len(strings.Fields(request))))
+	for _, filter := range Filters(generated) {
+		r.filters.Inc(filter)
+	}
+}
+
+// Feedback records feedback labeled label from user.
+func (r *Recorder) Feedback(user, label string) {
+	r.feedback.Inc(r.User(user), label)
+}
+
+// Filters returns the names of the Sourcegraph filters q uses, each once.
+// Unknown field names are left out, since they may be words of the
+// request that happen to precede a colon.
+func Filters(q string) []string {
+	parsed, err := query.Parse(q)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, tok := range parsed.Tokens {
+		if tok.Kind == query.Field && query.KnownField(tok.Field) && !slices.Contains(names, tok.Field) {
+			names = append(names, tok.Field)
+		}
+	}
+	return names
+}
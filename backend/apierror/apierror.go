@@ -0,0 +1,111 @@
+// Package apierror defines the JSON error envelope returned by every nlsearch
+// endpoint:
+//
+//	{"error": {"code": "rate_limited", "message": "...", "request_id": "..."}}
+//
+// Clients should branch on code, which is stable, rather than on message.
+package apierror
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Code is a machine-readable error code.
+type Code string
+
+const (
+	InvalidRequest   Code = "invalid_request"
+	Unauthorized     Code = "unauthorized"
+	Forbidden        Code = "forbidden"
+	NotFound         Code = "not_found"
+	MethodNotAllowed Code = "method_not_allowed"
+	RateLimited      Code = "rate_limited"
+	Internal         Code = "internal_error"
+	UpstreamError    Code = "upstream_error"
+	Unavailable      Code = "unavailable"
+	Timeout          Code = "timeout"
+	// NeedsClarification is only sent by endpoints that can't express a
+	// clarifying question any other way, such as /query/raw.
+	NeedsClarification Code = "needs_clarification"
+	// PolicyViolation means the generated query uses filters the caller's
+	// query policy doesn't allow, and the policy rejects rather than
+	// rewrites such queries.
+	PolicyViolation Code = "policy_violation"
+)
+
+var statuses = map[Code]int{
+	InvalidRequest:     http.StatusBadRequest,
+	Unauthorized:       http.StatusUnauthorized,
+	Forbidden:          http.StatusForbidden,
+	NotFound:           http.StatusNotFound,
+	MethodNotAllowed:   http.StatusMethodNotAllowed,
+	RateLimited:        http.StatusTooManyRequests,
+	Internal:           http.StatusInternalServerError,
+	UpstreamError:      http.StatusBadGateway,
+	Unavailable:        http.StatusServiceUnavailable,
+	Timeout:            http.StatusGatewayTimeout,
+	NeedsClarification: http.StatusUnprocessableEntity,
+	PolicyViolation:    http.StatusForbidden,
+}
+
+// Status returns the HTTP status that goes with c.
+func (c Code) Status() int {
+	if status, ok := statuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is the body of the envelope.
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+	// Details carries optional structured context, such as the field that
+	// failed validation.
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+
+	// RetryAfter, if set, is sent as a Retry-After header.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	copy := *e
+	copy.Details = details
+	return &copy
+}
+
+// ForRequest returns a copy of e stamped with requestID.
+func (e *Error) ForRequest(requestID string) *Error {
+	copy := *e
+	copy.RequestID = requestID
+	return &copy
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// Envelope wraps an error for the wire.
+type Envelope struct {
+	Error *Error `json:"error"`
+}
+
+// Write sends e with its status code, stamped with requestID.
+func Write(w http.ResponseWriter, requestID string, e *Error) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Code.Status())
+	json.NewEncoder(w).Encode(Envelope{Error: e.ForRequest(requestID)})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/output"
+	"github.com/nlsearch/backend/translate"
+)
+
+// Values of batch's -output flag.
+const (
+	batchOutputJSONL = "jsonl"
+	batchOutputTSV   = "tsv"
+)
+
+var batchOutputs = []string{batchOutputJSONL, batchOutputTSV}
+
+// batchResult is one line of `batch -output jsonl`.
+type batchResult struct {
+	// Line is the request's line number in the input, counting from 1.
+	Line       int    `json:"line"`
+	Request    string `json:"request"`
+	Answer     string `json:"answer,omitempty"`
+	Output     string `json:"output,omitempty"`
+	Extraction string `json:"extraction,omitempty"`
+	Fallback   bool   `json:"fallback,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// batchRequest is one request read from the input.
+type batchRequest struct {
+	line    int
+	request string
+}
+
+func newBatchCommand() *command {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	concurrency := fs.Int("concurrency", 5, "number of requests to translate at once")
+	timeout := fs.Duration("timeout", 60*time.Second, "maximum time to wait for each translation")
+	format := fs.String("format", output.Query, "output format of the queries: "+strings.Join(output.Formats, ", "))
+	out := fs.String("output", batchOutputJSONL, "format of the results: "+strings.Join(batchOutputs, ", "))
+	outFile := fs.String("out", "", "file to append results to, skipping requests it already has results for; stdout if empty")
+	addConfigFlags(fs)
+
+	return &command{
+		name:    "batch",
+		args:    "<file>|-",
+		summary: "Translate one request per line of a file, resuming where an earlier run stopped",
+		flags:   fs,
+		run: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("batch takes one file of requests, or - for stdin")
+			}
+			if *concurrency < 1 {
+				return errors.New("-concurrency must be at least 1")
+			}
+			if _, err := output.Format("", *format); err != nil {
+				return err
+			}
+			if *out != batchOutputJSONL && *out != batchOutputTSV {
+				return fmt.Errorf("unknown output %q (want one of %s)", *out, strings.Join(batchOutputs, ", "))
+			}
+			requests, err := readBatch(args[0])
+			if err != nil {
+				return err
+			}
+
+			w := io.Writer(os.Stdout)
+			if *outFile != "" {
+				done, err := batchDone(*outFile, *out)
+				if err != nil {
+					return err
+				}
+				requests = pending(requests, done)
+				f, err := openResults(*outFile)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			if len(requests) == 0 {
+				slog.Info("Every request already has a result")
+				return nil
+			}
+
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			setupLogging(config)
+			translator, err := newCLITranslator(&config)
+			if err != nil {
+				return err
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			b := &batch{translator: translator, timeout: *timeout, format: *format, output: *out, w: w}
+			return b.run(ctx, requests, *concurrency)
+		},
+	}
+}
+
+// batch translates requests with bounded parallelism, writing each result
+// as it comes.
+type batch struct {
+	translator translate.Strategy
+	timeout    time.Duration
+	format     string
+	output     string
+
+	mu     sync.Mutex
+	w      io.Writer
+	failed int
+}
+
+func (b *batch) run(ctx context.Context, requests []batchRequest, concurrency int) error {
+	queue := make(chan batchRequest)
+	var wg sync.WaitGroup
+	for range min(concurrency, len(requests)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				b.translate(ctx, req)
+			}
+		}()
+	}
+	start := time.Now()
+	for _, req := range requests {
+		select {
+		case queue <- req:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	slog.Info("Batch finished", "requests", len(requests), "failed", b.failed, "elapsed", time.Since(start).Round(time.Second))
+	if ctx.Err() != nil {
+		return errors.New("interrupted; run again with the same -out to translate the rest")
+	}
+	if b.failed > 0 {
+		return fmt.Errorf("%d of %d requests failed; run again with the same -out to retry them", b.failed, len(requests))
+	}
+	return nil
+}
+
+// translate translates req and writes its result. Requests cut short by an
+// interrupt are left unwritten, so a rerun picks them up.
+func (b *batch) translate(ctx context.Context, req batchRequest) {
+	if ctx.Err() != nil {
+		return
+	}
+	tctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	translation, err := b.translator.Translate(tctx, req.request, nil)
+	if ctx.Err() != nil {
+		return
+	}
+
+	result := batchResult{Line: req.line, Request: req.request}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Answer, result.Extraction, result.Fallback = translation.Query, translation.Extraction, translation.Fallback
+		if formatted, _ := output.Format(translation.Query, b.format); formatted != translation.Query {
+			result.Output = formatted
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.failed++
+		slog.Warn("Request failed", "line", req.line, "err", err)
+	}
+	switch {
+	case b.output == batchOutputJSONL:
+		line, _ := json.Marshal(result)
+		fmt.Fprintf(b.w, "%s\n", line)
+	case err == nil:
+		// TSV has no room for errors, which only go to the log.
+		query := result.Answer
+		if result.Output != "" {
+			query = result.Output
+		}
+		fmt.Fprintf(b.w, "%s\t%s\n", batchKey(req.request), batchKey(query))
+	}
+}
+
+// readBatch reads the requests in the file at path, or stdin for "-", one
+// per line. Blank lines, lines starting with # and repeats are skipped.
+func readBatch(path string) ([]batchRequest, error) {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var requests []batchRequest
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		request := strings.TrimSpace(scanner.Text())
+		if request == "" || strings.HasPrefix(request, "#") || seen[batchKey(request)] {
+			continue
+		}
+		seen[batchKey(request)] = true
+		requests = append(requests, batchRequest{line: line, request: request})
+	}
+	return requests, scanner.Err()
+}
+
+// batchDone returns the requests the results file at path, in format out,
+// has successful results for. A missing file has none.
+func batchDone(path, out string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if out == batchOutputTSV {
+			request, _, _ := strings.Cut(scanner.Text(), "\t")
+			done[batchKey(request)] = true
+			continue
+		}
+		var result batchResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			// A run killed mid-write leaves a partial last line, which is
+			// retried like a failure.
+			slog.Warn("Skipping unreadable result", "file", path, "line", n, "err", err)
+			continue
+		}
+		if result.Error == "" {
+			done[batchKey(result.Request)] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// openResults opens the results file at path for appending, first ending
+// the partial line a killed run may have left, so the next result doesn't
+// run into it.
+func openResults(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			_, err = f.Write([]byte("\n"))
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// pending returns the requests that aren't done.
+func pending(requests []batchRequest, done map[string]bool) []batchRequest {
+	var left []batchRequest
+	for _, req := range requests {
+		if !done[batchKey(req.request)] {
+			left = append(left, req)
+		}
+	}
+	if skipped := len(requests) - len(left); skipped > 0 {
+		slog.Info("Resuming batch", "done", skipped, "left", len(left))
+	}
+	return left
+}
+
+// batchKey identifies a request however its whitespace differs, and keeps
+// it on one TSV field.
+func batchKey(request string) string {
+	return strings.Join(strings.Fields(request), " ")
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/server"
+	"github.com/nlsearch/backend/translate"
+)
+
+// Values of bench's -output flag.
+const (
+	benchOutputText = "text"
+	benchOutputJSON = "json"
+)
+
+var benchOutputs = []string{benchOutputText, benchOutputJSON}
+
+// benchPercentiles are the latency percentiles bench reports.
+var benchPercentiles = []float64{50, 90, 95, 99}
+
+// benchReport is what `bench -output json` prints. Latencies are in
+// milliseconds, over the requests that succeeded.
+type benchReport struct {
+	Target     string         `json:"target"`
+	Duration   float64        `json:"duration_seconds"`
+	Rate       float64        `json:"rate"`
+	Sent       int            `json:"sent"`
+	Skipped    int            `json:"skipped"`
+	Succeeded  int            `json:"succeeded"`
+	Failed     int            `json:"failed"`
+	ErrorRate  float64        `json:"error_rate"`
+	Errors     map[string]int `json:"errors,omitempty"`
+	Cached     int            `json:"cached"`
+	Fallback   int            `json:"fallback"`
+	Throughput float64        `json:"throughput"`
+	Latency    map[string]int `json:"latency_ms,omitempty"`
+}
+
+func newBenchCommand() *command {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	target := fs.String("url", "http://localhost:8080", "address of the server to load")
+	token := fs.String("token", "", "API key to send, if the server requires one; defaults to $NLSEARCH_API_KEY")
+	rate := fs.Float64("rate", 5, "requests to send per second")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send requests for")
+	concurrency := fs.Int("concurrency", 50, "most requests in flight at once; requests due while this many are waiting are skipped")
+	timeout := fs.Duration("timeout", 60*time.Second, "maximum time to wait for each response")
+	noStore := fs.Bool("no-store", true, "send no_store, so every request is translated instead of answered from the cache, and the history is left alone")
+	mock := fs.Bool("mock", false, "load a server started in this process, whose translations take -mock-latency and need no Sourcegraph, instead of -url")
+	mockLatency := fs.Duration("mock-latency", time.Second, "how long each translation takes with -mock")
+	out := fs.String("output", benchOutputText, "report format: "+strings.Join(benchOutputs, ", "))
+
+	return &command{
+		name:    "bench",
+		args:    "<file>|-",
+		summary: "Replay requests from a file against a server at a steady rate and report latency and errors",
+		flags:   fs,
+		run: func(args []string) error {
+			if len(args) != 1 {
+				return errors.New("bench takes one file of requests, or - for stdin")
+			}
+			if *rate <= 0 || *duration <= 0 || *concurrency < 1 {
+				return errors.New("-rate, -duration and -concurrency must be positive")
+			}
+			if *out != benchOutputText && *out != benchOutputJSON {
+				return fmt.Errorf("unknown output %q (want one of %s)", *out, strings.Join(benchOutputs, ", "))
+			}
+			corpus, err := readBatch(args[0])
+			if err != nil {
+				return err
+			}
+			if len(corpus) == 0 {
+				return errors.New("no requests to replay")
+			}
+			if *token == "" {
+				*token = os.Getenv("NLSEARCH_API_KEY")
+			}
+
+			if *mock {
+				addr, stop, err := serveMock(*mockLatency)
+				if err != nil {
+					return err
+				}
+				defer stop()
+				*target, *token = "http://"+addr, ""
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+			b := &bench{
+				endpoint: strings.TrimSuffix(*target, "/") + "/api/v1/query",
+				token:    *token,
+				noStore:  *noStore,
+				client:   &http.Client{Timeout: *timeout},
+			}
+			slog.Info("Sending requests", "url", b.endpoint, "rate", *rate, "duration", *duration)
+			report := b.run(ctx, corpus, *rate, *duration, *concurrency)
+			report.Target = *target
+			if *out == benchOutputJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(report)
+			}
+			printBench(os.Stdout, report)
+			return nil
+		},
+	}
+}
+
+// bench sends translation requests and tallies their outcomes.
+type bench struct {
+	endpoint string
+	token    string
+	noStore  bool
+	client   *http.Client
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    map[string]int
+	failed    int
+	cached    int
+	fallback  int
+}
+
+// run sends rate requests a second for duration, cycling through corpus,
+// and waits for the last of them. A request due while concurrency are in
+// flight is skipped rather than delayed, so a server that can't keep up
+// shows as skips instead of a lower rate.
+func (b *bench) run(ctx context.Context, corpus []batchRequest, rate float64, duration time.Duration, concurrency int) benchReport {
+	b.errors = make(map[string]int)
+	interval := time.Duration(float64(time.Second) / rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	sent, skipped := 0, 0
+	start := time.Now()
+	send := func() {
+		select {
+		case slots <- struct{}{}:
+		default:
+			skipped++
+			return
+		}
+		request := corpus[(sent+skipped)%len(corpus)].request
+		sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			b.send(ctx, request)
+		}()
+	}
+	send()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			send()
+		case <-deadline:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	elapsed := time.Since(start)
+	wg.Wait()
+
+	report := benchReport{
+		Duration:  elapsed.Seconds(),
+		Rate:      rate,
+		Sent:      sent,
+		Skipped:   skipped,
+		Succeeded: len(b.latencies),
+		Failed:    b.failed,
+		Errors:    b.errors,
+		Cached:    b.cached,
+		Fallback:  b.fallback,
+	}
+	if sent > 0 {
+		report.ErrorRate = float64(b.failed) / float64(sent)
+	}
+	report.Throughput = float64(len(b.latencies)) / elapsed.Seconds()
+	if len(b.latencies) > 0 {
+		slices.Sort(b.latencies)
+		report.Latency = make(map[string]int)
+		for _, p := range benchPercentiles {
+			report.Latency[fmt.Sprintf("p%g", p)] = int(percentile(b.latencies, p).Milliseconds())
+		}
+		report.Latency["max"] = int(b.latencies[len(b.latencies)-1].Milliseconds())
+	}
+	return report
+}
+
+// send sends one request and records its outcome: its latency if it
+// succeeded, or else the code of the API error it got, its status if it
+// had none, or "network" if no response came.
+func (b *bench) send(ctx context.Context, request string) {
+	body, _ := json.Marshal(server.QueryRequest{Query: request, NoStore: b.noStore})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		b.fail("network")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	start := time.Now()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Debug("Request failed", "err", err)
+		}
+		b.fail("network")
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	latency := time.Since(start)
+	if err != nil {
+		b.fail("network")
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		var envelope apierror.Envelope
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error != nil {
+			b.fail(string(envelope.Error.Code))
+		} else {
+			b.fail(fmt.Sprintf("status %d", resp.StatusCode))
+		}
+		return
+	}
+	var result server.QueryResponse
+	json.Unmarshal(data, &result)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latencies = append(b.latencies, latency)
+	if result.Cached {
+		b.cached++
+	}
+	if result.Fallback {
+		b.fallback++
+	}
+}
+
+func (b *bench) fail(code string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed++
+	b.errors[code]++
+}
+
+// percentile returns the pth percentile of sorted by the nearest-rank
+// method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// printBench prints report for people.
+func printBench(w io.Writer, report benchReport) {
+	fmt.Fprintf(w, "Target:      %s\n", report.Target)
+	fmt.Fprintf(w, "Requests:    %d sent in %.1fs at %g/s", report.Sent, report.Duration, report.Rate)
+	if report.Skipped > 0 {
+		fmt.Fprintf(w, ", %d skipped at the concurrency limit", report.Skipped)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Succeeded:   %d (%d cached, %d fallback), %.2f/s\n", report.Succeeded, report.Cached, report.Fallback, report.Throughput)
+	fmt.Fprintf(w, "Failed:      %d (%.1f%%)", report.Failed, report.ErrorRate*100)
+	codes := make([]string, 0, len(report.Errors))
+	for code := range report.Errors {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for i, code := range codes {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(w, "%s%d %s", sep, report.Errors[code], code)
+	}
+	fmt.Fprintln(w)
+	if report.Latency == nil {
+		return
+	}
+	fmt.Fprint(w, "Latency:    ")
+	for _, p := range benchPercentiles {
+		name := fmt.Sprintf("p%g", p)
+		fmt.Fprintf(w, " %s %s", name, time.Duration(report.Latency[name])*time.Millisecond)
+	}
+	fmt.Fprintf(w, " max %s\n", time.Duration(report.Latency["max"])*time.Millisecond)
+}
+
+// serveMock serves the API on a free local port with translations made by
+// the offline rules after latency, standing in for Sourcegraph, so the
+// server's own overhead can be measured. It returns the address and a
+// function that stops the server.
+func serveMock(latency time.Duration) (string, func(), error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	// The server logs every request, which would bury the report.
+	slog.SetLogLoggerLevel(slog.LevelWarn)
+	srv := server.New(server.Options{Translator: mockTranslator{rules: translate.NewRules(), latency: latency}})
+	httpServer := &http.Server{Handler: srv.Handler()}
+	go httpServer.Serve(ln)
+	return ln.Addr().String(), func() { httpServer.Close() }, nil
+}
+
+// mockTranslator translates with rules after a fixed delay, like an
+// upstream that always takes the same time.
+type mockTranslator struct {
+	rules   *translate.Rules
+	latency time.Duration
+}
+
+func (m mockTranslator) Translate(ctx context.Context, request string, progress func(translate.Progress)) (*translate.Translation, error) {
+	select {
+	case <-time.After(m.latency):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	translation, err := m.rules.Translate(ctx, request, progress)
+	if err != nil {
+		return nil, err
+	}
+	// Answers from the stand-in upstream aren't fallbacks.
+	mocked := *translation
+	mocked.Fallback = false
+	return &mocked, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/sourcegraph"
+)
+
+func newCheckConfigCommand() *command {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	ping := fs.Bool("ping", false, "also verify SOURCEGRAPH_TOKEN against the instance and detect the APIs it offers")
+	addConfigFlags(fs)
+
+	return &command{
+		name:    "check-config",
+		summary: "Validate the configuration and print a report",
+		flags:   fs,
+		run: func(args []string) error {
+			return checkConfig(os.Stdout, *ping)
+		},
+	}
+}
+
+// configReport prints the result of each check and counts the problems.
+type configReport struct {
+	w        io.Writer
+	problems int
+}
+
+func (r *configReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.w, "  ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *configReport) warn(format string, args ...any) {
+	fmt.Fprintf(r.w, "  warn  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (r *configReport) fail(format string, args ...any) {
+	r.problems++
+	fmt.Fprintf(r.w, "  FAIL  %s\n", fmt.Sprintf(format, args...))
+}
+
+// checkConfig loads the configuration the way serve does and reports what
+// it found, so mistakes surface in CI or during setup rather than at
+// startup. With ping it also checks the token and the instance's APIs. It
+// fails if any check does.
+func checkConfig(w io.Writer, ping bool) error {
+	r := &configReport{w: w}
+	// Load first: it reads the .env and config files.
+	config, err := loadConfig()
+
+	fmt.Fprintln(w, "Settings:")
+	for _, v := range configVars {
+		value, source, set := lookupSetting(v.name)
+		switch {
+		case set && isSecretVar(v.name):
+			r.ok("%s is set by the %s (%s)", v.name, source, maskSecret(value))
+		case set:
+			r.ok("%s=%s (%s)", v.name, value, source)
+		}
+	}
+
+	fmt.Fprintln(w, "\nConfiguration:")
+	if err != nil {
+		r.fail("%v", err)
+		return r.result()
+	}
+	r.ok("Configuration is valid")
+	checkSourcegraphURL(r, getEnv("SOURCEGRAPH_URL", defaultSourcegraphURL), config.SourcegraphURL)
+	checkUpstreamTLS(r, config)
+	if len(config.APIKeys) == 0 && len(config.ProxyAuth.Trusted) == 0 {
+		r.warn("API_KEYS is not set, so anyone who can reach port %s can use the API", config.Port)
+	}
+
+	if ping {
+		fmt.Fprintln(w, "\nSourcegraph:")
+		pingSourcegraph(r, config)
+	}
+	return r.result()
+}
+
+func (r *configReport) result() error {
+	switch r.problems {
+	case 0:
+		fmt.Fprintln(r.w, "\nNo problems found.")
+		return nil
+	case 1:
+		return errors.New("1 problem found")
+	default:
+		return fmt.Errorf("%d problems found", r.problems)
+	}
+}
+
+// checkSourcegraphURL warns about parts of SOURCEGRAPH_URL that loadConfig
+// accepts but are probably mistakes.
+func checkSourcegraphURL(r *configReport, raw, resolved string) {
+	r.ok("Using Sourcegraph at %s", resolved)
+	u, err := url.Parse(raw)
+	if err != nil {
+		return
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		r.warn("SOURCEGRAPH_URL has a path or query, which is ignored; set it to %s", resolved)
+	}
+	if u.Scheme == "http" && !isLoopback(u.Hostname()) {
+		r.warn("SOURCEGRAPH_URL uses http, so the access token is sent unencrypted; use https")
+	}
+}
+
+// checkUpstreamTLS warns about TLS settings for Sourcegraph that weaken or
+// don't affect its connections.
+func checkUpstreamTLS(r *configReport, config Config) {
+	switch {
+	case config.UpstreamTLS == nil:
+	case strings.HasPrefix(config.SourcegraphURL, "http://"):
+		r.warn("SOURCEGRAPH_URL uses http, so the SOURCEGRAPH_CA_FILE, client certificate and SOURCEGRAPH_INSECURE_SKIP_VERIFY settings have no effect")
+	case config.UpstreamTLS.InsecureSkipVerify:
+		r.warn("SOURCEGRAPH_INSECURE_SKIP_VERIFY is set, so Sourcegraph's certificate isn't verified and the access token can be intercepted; use SOURCEGRAPH_CA_FILE instead")
+	}
+}
+
+// pingSourcegraph verifies the token and reports which translation
+// providers the instance supports, like serve's preflight does.
+func pingSourcegraph(r *configReport, config Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	client := sourcegraph.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(upstreamTransport(config)).WithAuth(config.UpstreamAuth)
+	identity, err := client.CurrentUser(ctx)
+	switch {
+	case errors.Is(err, sourcegraph.ErrInvalidToken):
+		r.fail("SOURCEGRAPH_TOKEN was rejected: %v; create a new access token under Settings > Access tokens", err)
+		return
+	case err != nil:
+		r.fail("Could not reach %s: %v; check SOURCEGRAPH_URL and the network", config.SourcegraphURL, err)
+		return
+	}
+	version := identity.ProductVersion
+	if version == "" {
+		version = "unknown version"
+	}
+	r.ok("Signed in as %s (Sourcegraph %s)", identity.Username, version)
+
+	caps, err := client.DetectCapabilities(ctx)
+	if err != nil {
+		r.warn("Could not detect the APIs Sourcegraph offers: %v", err)
+		return
+	}
+	r.ok("Sourcegraph offers %s", caps)
+	api, ok := deepsearch.LookupAPI(config.DeepSearchAPI)
+	if !ok {
+		api, ok = caps.API()
+	}
+	switch {
+	case !ok:
+	case api == deepsearch.APIv1 && !caps.DeepSearch, api == deepsearch.APIv2 && !caps.DeepSearchV2:
+		r.warn("DEEPSEARCH_API is %s, which Sourcegraph doesn't appear to offer", api.Name)
+	default:
+		r.ok("Speaking Deep Search API %s", api.Name)
+	}
+
+	providers := config.Providers
+	if config.autoProviders() {
+		providers = splitList(defaultProviders)
+	}
+	var available []string
+	for _, name := range providers {
+		if providerCapabilities[name](caps) {
+			available = append(available, name)
+		} else if !config.autoProviders() {
+			r.warn("TRANSLATION_PROVIDERS includes %s, which Sourcegraph doesn't appear to offer", name)
+		}
+	}
+	if len(available) == 0 {
+		r.fail("None of the translation providers (%s) is available; enable Deep Search or Cody on the instance", strings.Join(providers, ", "))
+		return
+	}
+	r.ok("Translating with %s", strings.Join(available, " → "))
+}
+
+// isSecretVar reports whether variable name holds credentials that must
+// not be printed, or given as flags.
+func isSecretVar(name string) bool {
+	if name == "QUEUE_URL" || name == "STATE_URL" {
+		// It may include the Redis password.
+		return true
+	}
+	for _, suffix := range []string{"_TOKEN", "_KEYS", "_SECRET", "_DSN", "_SALT"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecret shows just enough of a secret to tell which one is set.
+func maskSecret(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + "…" + s[len(s)-4:]
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,166 @@
+// Package cody is a client for Sourcegraph's OpenAI-compatible Cody chat
+// completions API, available on many instances that don't have Deep Search.
+package cody
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+)
+
+type Client struct {
+	baseURL     string
+	accessToken string
+	auth        deepsearch.Auth
+	httpClient  *http.Client
+
+	mu    sync.Mutex
+	model string
+}
+
+// NewClient returns a client using model, or the instance's first available
+// model if model is empty.
+func NewClient(baseURL, accessToken, model string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		accessToken: accessToken,
+		httpClient:  &http.Client{Timeout: 2 * time.Minute},
+		model:       model,
+	}
+}
+
+// WithTransport sends the client's requests through rt, e.g. to share an
+// outbound rate limit. It returns c for chaining.
+func (c *Client) WithTransport(rt http.RoundTripper) *Client {
+	c.httpClient.Transport = rt
+	return c
+}
+
+// WithAuth sets how the client's requests carry the access token. It
+// returns c for chaining.
+func (c *Client) WithAuth(auth deepsearch.Auth) *Client {
+	c.auth = auth
+	return c
+}
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatRequest struct {
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+}
+
+// Usage reports token counts for a completion.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type Completion struct {
+	Model   string
+	Content string
+	Usage   Usage
+}
+
+type chatResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message Message `json:"message"`
+	} `json:"choices"`
+	Usage Usage `json:"usage"`
+}
+
+const maxTokens = 1000
+
+// Complete sends messages to the chat completions endpoint.
+func (c *Client) Complete(ctx context.Context, messages []Message) (*Completion, error) {
+	model, err := c.Model(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp chatResponse
+	if err := c.do(ctx, http.MethodPost, "/.api/llm/chat/completions", chatRequest{Model: model, Messages: messages, MaxTokens: maxTokens}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("completion has no choices")
+	}
+	if resp.Model == "" {
+		resp.Model = model
+	}
+	return &Completion{Model: resp.Model, Content: resp.Choices[0].Message.Content, Usage: resp.Usage}, nil
+}
+
+// Model returns the configured model, or looks up the instance's first
+// available model and remembers it.
+func (c *Client) Model(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.model != "" {
+		return c.model, nil
+	}
+
+	var resp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/.api/llm/models", nil, &resp); err != nil {
+		return "", fmt.Errorf("list models: %w", err)
+	}
+	if len(resp.Data) == 0 {
+		return "", fmt.Errorf("list models: the instance offers no chat models")
+	}
+	c.model = resp.Data[0].ID
+	return c.model, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", deepsearch.ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return deepsearch.NewStatusError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
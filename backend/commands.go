@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a node in the CLI command tree. Leaf commands have a run
+// function; group commands only dispatch to their subcommands.
+type command struct {
+	name        string
+	args        string   // synopsis of positional arguments, e.g. "<file>"
+	validArgs   []string // fixed set of positional arguments, used for completion
+	summary     string
+	flags       *flag.FlagSet
+	run         func(args []string) error
+	subcommands []*command
+	parent      *command
+}
+
+func newRootCommand() *command {
+	root := &command{
+		name:    "nlsearch",
+		summary: "Convert natural language to Sourcegraph code search queries",
+	}
+	root.subcommands = []*command{
+		newServeCommand(),
+		newWorkerCommand(),
+		newTUICommand(),
+		newQueryCommand(),
+		newBatchCommand(),
+		newBenchCommand(),
+		newCheckConfigCommand(),
+		newCompletionCommand(),
+		newDocsCommand(),
+	}
+	root.link()
+	return root
+}
+
+// link sets the parent pointers of the whole subtree below c.
+func (c *command) link() {
+	for _, sub := range c.subcommands {
+		sub.parent = c
+		sub.link()
+	}
+}
+
+func newServeCommand() *command {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	skipPreflight := fs.Bool("skip-preflight", false, "don't verify SOURCEGRAPH_TOKEN or detect available APIs at startup")
+	addConfigFlags(fs)
+
+	return &command{
+		name:    "serve",
+		summary: "Run the HTTP API and web frontend (default)",
+		flags:   fs,
+		run: func(args []string) error {
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			logLevel := setupLogging(config)
+			if *skipPreflight {
+				err = resolveProviders(&config, nil)
+			} else {
+				err = preflight(&config, upstreamTransport(config))
+			}
+			if err != nil {
+				return err
+			}
+			return runServer(config, logLevel)
+		},
+	}
+}
+
+func newWorkerCommand() *command {
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	skipPreflight := fs.Bool("skip-preflight", false, "don't verify SOURCEGRAPH_TOKEN or detect available APIs at startup")
+	addConfigFlags(fs)
+
+	return &command{
+		name:    "worker",
+		summary: "Run jobs from the QUEUE_URL queue without serving HTTP",
+		flags:   fs,
+		run: func(args []string) error {
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			logLevel := setupLogging(config)
+			if *skipPreflight {
+				err = resolveProviders(&config, nil)
+			} else {
+				err = preflight(&config, upstreamTransport(config))
+			}
+			if err != nil {
+				return err
+			}
+			return runWorker(config, logLevel)
+		},
+	}
+}
+
+// execute dispatches args to the matching subcommand. With no arguments the
+// default subcommand (serve) is run so that `go run .` starts the server.
+func (c *command) execute(args []string) error {
+	if len(c.subcommands) > 0 {
+		if len(args) == 0 {
+			if c.parent == nil {
+				return c.subcommands[0].execute(nil)
+			}
+			c.printUsage(os.Stderr)
+			return fmt.Errorf("missing command")
+		}
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			c.printUsage(os.Stdout)
+			return nil
+		}
+		for _, sub := range c.subcommands {
+			if sub.name == args[0] {
+				return sub.execute(args[1:])
+			}
+		}
+		c.printUsage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return c.runLeaf(args)
+}
+
+func (c *command) runLeaf(args []string) error {
+	if c.flags != nil {
+		c.flags.Usage = func() { c.printUsage(c.flags.Output()) }
+		if err := c.flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil
+			}
+			return err
+		}
+		args = c.flags.Args()
+		applyConfigFlags(c.flags)
+	}
+	return c.run(args)
+}
+
+func (c *command) printUsage(w io.Writer) {
+	fmt.Fprintf(w, "%s\n\nUsage:\n  %s\n", c.summary, c.synopsis())
+	if len(c.subcommands) > 0 {
+		fmt.Fprintln(w, "\nCommands:")
+		for _, sub := range c.subcommands {
+			fmt.Fprintf(w, "  %-12s %s\n", sub.name, sub.summary)
+		}
+	}
+	if c.flags != nil && hasFlags(c.flags) {
+		fmt.Fprintln(w, "\nFlags:")
+		c.flags.SetOutput(w)
+		c.flags.PrintDefaults()
+	}
+}
+
+func (c *command) synopsis() string {
+	parts := []string{c.path()}
+	if len(c.subcommands) > 0 {
+		parts = append(parts, "<command>")
+	}
+	if c.flags != nil && hasFlags(c.flags) {
+		parts = append(parts, "[flags]")
+	}
+	if c.args != "" {
+		parts = append(parts, c.args)
+	} else if len(c.validArgs) > 0 {
+		parts = append(parts, strings.Join(c.validArgs, "|"))
+	}
+	return strings.Join(parts, " ")
+}
+
+// path returns the full command path, e.g. "nlsearch tui".
+func (c *command) path() string {
+	if c.parent == nil {
+		return c.name
+	}
+	return c.parent.path() + " " + c.name
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/output"
+)
+
+func newCompletionCommand() *command {
+	return &command{
+		name:      "completion",
+		summary:   "Print a shell completion script",
+		validArgs: []string{"bash", "zsh", "fish"},
+		flags:     flag.NewFlagSet("completion", flag.ContinueOnError),
+		run: func(args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("usage: nlsearch completion bash|zsh|fish")
+			}
+			root := newRootCommand()
+			switch args[0] {
+			case "bash":
+				return writeBashCompletion(os.Stdout, root)
+			case "zsh":
+				return writeZshCompletion(os.Stdout, root)
+			case "fish":
+				return writeFishCompletion(os.Stdout, root)
+			default:
+				return fmt.Errorf("unsupported shell %q (want bash, zsh or fish)", args[0])
+			}
+		},
+	}
+}
+
+func newDocsCommand() *command {
+	manFlags := flag.NewFlagSet("man", flag.ContinueOnError)
+	output := manFlags.String("o", "", "write the man page to this file instead of stdout")
+
+	return &command{
+		name:    "docs",
+		summary: "Generate documentation for the CLI",
+		subcommands: []*command{{
+			name:    "man",
+			summary: "Print a man page (roff) for nlsearch",
+			flags:   manFlags,
+			run: func(args []string) error {
+				w := io.Writer(os.Stdout)
+				if *output != "" {
+					f, err := os.Create(*output)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					w = f
+				}
+				return writeManPage(w, newRootCommand(), time.Now())
+			},
+		}},
+	}
+}
+
+// completionNode is a flattened view of one command for the generators.
+type completionNode struct {
+	path  string   // e.g. "nlsearch docs"
+	words []string // subcommand names or valid positional arguments
+	flags []*flag.Flag
+	cmd   *command
+}
+
+func completionNodes(root *command) []completionNode {
+	var nodes []completionNode
+	var walk func(c *command)
+	walk = func(c *command) {
+		n := completionNode{path: c.path(), cmd: c}
+		for _, sub := range c.subcommands {
+			n.words = append(n.words, sub.name)
+		}
+		n.words = append(n.words, c.validArgs...)
+		if c.flags != nil {
+			c.flags.VisitAll(func(f *flag.Flag) { n.flags = append(n.flags, f) })
+		}
+		nodes = append(nodes, n)
+		for _, sub := range c.subcommands {
+			walk(sub)
+		}
+	}
+	walk(root)
+	return nodes
+}
+
+func writeBashCompletion(w io.Writer, root *command) error {
+	nodes := completionNodes(root)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n\n", root.name)
+	fmt.Fprintf(&b, "_%s() {\n", root.name)
+	b.WriteString("    local cur path i\n")
+	b.WriteString("    cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(&b, "    path=%q\n", root.name)
+	b.WriteString("    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("        case \"$path ${COMP_WORDS[i]}\" in\n")
+	var groups []string
+	for _, n := range nodes {
+		if n.cmd.parent != nil {
+			groups = append(groups, fmt.Sprintf("%q", n.path))
+		}
+	}
+	fmt.Fprintf(&b, "            %s) path=\"$path ${COMP_WORDS[i]}\" ;;\n", strings.Join(groups, "|"))
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n\n")
+	b.WriteString("    case \"$path\" in\n")
+	for _, n := range nodes {
+		words := append([]string{}, n.words...)
+		for _, f := range n.flags {
+			words = append(words, "-"+f.Name)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "        %q) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", n.path, strings.Join(words, " "))
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "complete -F _%s %s\n", root.name, root.name)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeZshCompletion(w io.Writer, root *command) error {
+	nodes := completionNodes(root)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n", root.name)
+	fmt.Fprintf(&b, "_%s() {\n", root.name)
+	b.WriteString("    local words_path i\n")
+	fmt.Fprintf(&b, "    words_path=%q\n", root.name)
+	b.WriteString("    for ((i = 2; i < CURRENT; i++)); do\n")
+	b.WriteString("        case \"$words_path ${words[i]}\" in\n")
+	var groups []string
+	for _, n := range nodes {
+		if n.cmd.parent != nil {
+			groups = append(groups, fmt.Sprintf("%q", n.path))
+		}
+	}
+	fmt.Fprintf(&b, "            %s) words_path=\"$words_path ${words[i]}\" ;;\n", strings.Join(groups, "|"))
+	b.WriteString("        esac\n")
+	b.WriteString("    done\n\n")
+	b.WriteString("    case \"$words_path\" in\n")
+	for _, n := range nodes {
+		if len(n.words) == 0 && len(n.flags) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "        %q)\n", n.path)
+		if len(n.cmd.subcommands) > 0 {
+			b.WriteString("            local -a commands\n")
+			b.WriteString("            commands=(\n")
+			for _, sub := range n.cmd.subcommands {
+				fmt.Fprintf(&b, "                %s\n", output.ShellQuote(sub.name+":"+sub.summary))
+			}
+			b.WriteString("            )\n")
+			b.WriteString("            _describe 'command' commands\n")
+		} else {
+			for _, f := range n.flags {
+				fmt.Fprintf(&b, "            compadd -X %s -- -%s\n", output.ShellQuote(f.Usage), f.Name)
+			}
+			if len(n.words) > 0 {
+				fmt.Fprintf(&b, "            compadd -- %s\n", strings.Join(n.words, " "))
+			}
+		}
+		b.WriteString("            ;;\n")
+	}
+	b.WriteString("    esac\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(&b, "compdef _%s %s\n", root.name, root.name)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFishCompletion(w io.Writer, root *command) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n\n", root.name)
+	fmt.Fprintf(&b, "complete -c %s -f\n", root.name)
+
+	for _, n := range completionNodes(root) {
+		condition := fishCondition(n.cmd)
+		for _, sub := range n.cmd.subcommands {
+			fmt.Fprintf(&b, "complete -c %s -n %s -a %s -d %s\n", root.name, fishQuote(condition), sub.name, fishQuote(sub.summary))
+		}
+		for _, arg := range n.cmd.validArgs {
+			fmt.Fprintf(&b, "complete -c %s -n %s -a %s\n", root.name, fishQuote(condition), arg)
+		}
+		for _, f := range n.flags {
+			fmt.Fprintf(&b, "complete -c %s -n %s -o %s -d %s\n", root.name, fishQuote(condition), f.Name, fishQuote(f.Usage))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// fishCondition builds a condition that holds when the command line is
+// positioned at c: all of its ancestors have been typed, and none of its
+// own subcommands yet.
+func fishCondition(c *command) string {
+	var parts []string
+	var ancestors []*command
+	for p := c; p.parent != nil; p = p.parent {
+		ancestors = append([]*command{p}, ancestors...)
+	}
+	if len(ancestors) == 0 {
+		parts = append(parts, "__fish_use_subcommand")
+	}
+	for _, a := range ancestors {
+		parts = append(parts, "__fish_seen_subcommand_from "+a.name)
+	}
+	if len(c.subcommands) > 0 && len(ancestors) > 0 {
+		var names []string
+		for _, sub := range c.subcommands {
+			names = append(names, sub.name)
+		}
+		parts = append(parts, "not __fish_seen_subcommand_from "+strings.Join(names, " "))
+	}
+	return strings.Join(parts, "; and ")
+}
+
+func writeManPage(w io.Writer, root *command, now time.Time) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, ".TH %s 1 %q %q \"User Commands\"\n", strings.ToUpper(root.name), now.Format("January 2006"), deepsearch.ClientIdentifier)
+	b.WriteString(".SH NAME\n")
+	fmt.Fprintf(&b, "%s \\- %s\n", root.name, roffEscape(strings.ToLower(root.summary[:1])+root.summary[1:]))
+	b.WriteString(".SH SYNOPSIS\n")
+	fmt.Fprintf(&b, ".B %s\n", root.name)
+	b.WriteString("[\\fIcommand\\fR] [\\fIflags\\fR] [\\fIargs\\fR]\n")
+	b.WriteString(".SH DESCRIPTION\n")
+	fmt.Fprintf(&b, "%s converts natural language requests into Sourcegraph code search queries using the Deep Search API. ", root.name)
+	b.WriteString("Without a command it runs the HTTP server that backs the web frontend.\n")
+
+	b.WriteString(".SH COMMANDS\n")
+	for _, n := range completionNodes(root) {
+		if n.cmd.run == nil {
+			continue
+		}
+		b.WriteString(".TP\n")
+		fmt.Fprintf(&b, ".B %s\n", roffEscape(n.cmd.synopsis()))
+		fmt.Fprintf(&b, "%s\n", roffEscape(n.cmd.summary))
+		for _, f := range n.flags {
+			if isConfigFlag(f.Name) {
+				continue // documented under ENVIRONMENT
+			}
+			b.WriteString(".RS\n.TP\n")
+			fmt.Fprintf(&b, ".BI \\-%s\n", roffEscape(f.Name))
+			usage := f.Usage
+			if f.DefValue != "" && f.DefValue != "false" {
+				usage += fmt.Sprintf(" (default %s)", f.DefValue)
+			}
+			fmt.Fprintf(&b, "%s\n.RE\n", roffEscape(usage))
+		}
+	}
+
+	b.WriteString(".SH ENVIRONMENT\n")
+	b.WriteString("Every variable but the secrets, such as SOURCEGRAPH_TOKEN and API_KEYS, can also be given as a flag to serve, worker, tui, query, batch and check-config, named in lower case with dashes, such as \\-sourcegraph\\-url for SOURCEGRAPH_URL, and every variable in the JSON file named by CONFIG_FILE. Flags take precedence over the environment, which takes precedence over the file.\n")
+	vars := append([]configVar{}, configVars...)
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].required && !vars[j].required })
+	for _, v := range vars {
+		b.WriteString(".TP\n")
+		fmt.Fprintf(&b, ".B %s\n", v.name)
+		desc := v.description
+		switch {
+		case v.required:
+			desc += " Required."
+		case v.defaultValue != "":
+			desc += fmt.Sprintf(" Defaults to %s.", v.defaultValue)
+		}
+		fmt.Fprintf(&b, "%s\n", roffEscape(desc))
+	}
+	b.WriteString(".SH FILES\n")
+	b.WriteString(".TP\n.I ../.env\nOptional file of environment variables, loaded relative to the working directory. Set ENV_FILE to read another.\n")
+	b.WriteString(".TP\n.I CONFIG_FILE\nOptional JSON object of settings keyed by variable name; lists may be given as arrays of strings.\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,1125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/cody"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/errreport"
+	"github.com/nlsearch/backend/examples"
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/policy"
+	"github.com/nlsearch/backend/query"
+	"github.com/nlsearch/backend/ratelimit"
+	"github.com/nlsearch/backend/redis"
+	"github.com/nlsearch/backend/rewrite"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/server"
+	"github.com/nlsearch/backend/sourcegraph"
+	"github.com/nlsearch/backend/translate"
+)
+
+const (
+	defaultSourcegraphURL  = "https://sourcegraph.com"
+	defaultPort            = "8080"
+	defaultFrontendDir     = "../frontend"
+	defaultTimeoutSeconds  = 60
+	maxTimeoutSeconds      = 300
+	defaultMaxResults      = 1000
+	defaultCacheTTL        = 0
+	translationCacheSize   = 1000
+	defaultSearchCacheTTL  = 120
+	defaultFailureTTL      = 30
+	searchCacheSize        = 500
+	defaultRateLimitBurst  = 10
+	defaultUpstreamRPS     = 10
+	defaultUpstreamBurst   = 20
+	defaultPollRPS         = 5
+	defaultBestOfN         = 3
+	maxBestOfN             = 10
+	defaultFewShot         = 5
+	trackedConversations   = 500
+	storedJobs             = 1000
+	storedHistory          = 1000
+	defaultQueueWorkers    = 4
+	defaultQueueVisibility = 60
+	defaultRetentionDays   = 90
+	janitorInterval        = time.Hour
+	defaultReloadInterval  = 2
+	defaultShutdownTimeout = 25
+	defaultHSTSMaxAge      = 365 * 24 * 60 * 60
+	defaultDrainDelay      = 5
+	defaultStreamKeepAlive = 15
+	minAnalyticsSalt       = 16
+)
+
+// The security headers sent by default. The policy allows the frontend's
+// own scripts and styles and the web font it loads, and nothing else.
+const (
+	defaultCSP            = "default-src 'self'; style-src 'self' https://fonts.googleapis.com; font-src https://fonts.gstatic.com; object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+	defaultReferrerPolicy = "no-referrer"
+)
+
+// Translation strategies selectable with TRANSLATION_STRATEGY.
+const (
+	strategySingle   = "single"
+	strategyBestOf   = "best-of-n"
+	strategyEnsemble = "ensemble"
+)
+
+// providersAuto, the TRANSLATION_PROVIDERS default, picks providers from
+// what the instance offers at startup (see resolveProviders). When that
+// can't be detected, defaultProviders is tried in order: Deep Search where
+// the instance has it, otherwise Cody.
+const (
+	providersAuto    = "auto"
+	defaultProviders = "deepsearch,cody"
+)
+
+// providerFactories builds each translation provider by name. The single and
+// best-of-n strategies try the configured providers in order, falling back
+// when one is unavailable on the instance; ensemble asks all of them.
+var providerFactories = map[string]func(config Config, up upstream) translate.Backend{
+	"deepsearch": func(config Config, up upstream) translate.Backend {
+		return translate.NewDeepSearch(up.deepSearch(config)).WithCleanup(config.DeepSearchCleanup)
+	},
+	"cody": func(config Config, up upstream) translate.Backend {
+		return translate.NewCody(cody.NewClient(config.SourcegraphURL, config.SourcegraphToken, config.CodyModel).WithTransport(up.transport).WithAuth(config.UpstreamAuth))
+	},
+}
+
+type configVar struct {
+	name         string
+	description  string
+	defaultValue string
+	required     bool
+}
+
+// configVars documents the variables read by loadConfig. It is used to
+// generate the man page and the configuration flags, so keep it in sync
+// when adding settings.
+var configVars = []configVar{
+	{name: "SOURCEGRAPH_TOKEN", description: "Sourcegraph access token used for Deep Search requests.", required: true},
+	{name: "SOURCEGRAPH_TOKEN_FILE", description: "File to read the Sourcegraph access token from instead of SOURCEGRAPH_TOKEN, such as a mounted secret."},
+	{name: "SOURCEGRAPH_URL", description: "Sourcegraph instance URL.", defaultValue: defaultSourcegraphURL},
+	{name: "SOURCEGRAPH_AUTH_SCHEME", description: "How requests to Sourcegraph carry the access token in their Authorization header: token (\"token TOKEN\", what Sourcegraph expects), bearer (\"Bearer TOKEN\", for proxies that expect it) or token-sudo, which makes every request as SOURCEGRAPH_SUDO_USER with a site admin's token.", defaultValue: deepsearch.SchemeToken},
+	{name: "SOURCEGRAPH_SUDO_USER", description: "User requests to Sourcegraph are made as with SOURCEGRAPH_AUTH_SCHEME=token-sudo, so translations only see the repositories that user can."},
+	{name: "SOURCEGRAPH_CA_FILE", description: "PEM file of CA certificates trusted for Sourcegraph's TLS certificate in addition to the system's, for instances with a certificate from a private CA."},
+	{name: "SOURCEGRAPH_CLIENT_CERT_FILE", description: "PEM file of the client certificate presented to Sourcegraph, for instances behind a proxy requiring mutual TLS. Needs SOURCEGRAPH_CLIENT_KEY_FILE."},
+	{name: "SOURCEGRAPH_CLIENT_KEY_FILE", description: "PEM file of the private key of SOURCEGRAPH_CLIENT_CERT_FILE."},
+	{name: "SOURCEGRAPH_INSECURE_SKIP_VERIFY", description: "Don't verify Sourcegraph's TLS certificate at all. Anyone who can intercept the connection can then read the access token, so it is logged as a warning at startup; prefer SOURCEGRAPH_CA_FILE.", defaultValue: "false"},
+	{name: "ENV_FILE", description: "File of NAME=value lines to read settings from, for local development. Variables already in the environment take precedence. Optional unless set.", defaultValue: defaultEnvFile},
+	{name: "CONFIG_FILE", description: "JSON file of settings keyed by variable name. Flags and environment variables take precedence over it."},
+	{name: "CONFIG_DIR", description: "Directory of files named after variables and holding their values, such as a mounted Kubernetes ConfigMap or Secret. It takes precedence over CONFIG_FILE, and flags and environment variables over it."},
+	{name: "SOURCEGRAPH_MAX_RPS", description: "Server-wide limit on requests per second to Sourcegraph, covering Deep Search creation, polling and searches; 0 disables the limit.", defaultValue: strconv.Itoa(defaultUpstreamRPS)},
+	{name: "SOURCEGRAPH_BURST", description: "Burst size allowed above SOURCEGRAPH_MAX_RPS.", defaultValue: strconv.Itoa(defaultUpstreamBurst)},
+	{name: "DEEPSEARCH_POLL_RPS", description: "Polls per second shared by all the Deep Search conversations being waited on, spaced out evenly; with more conversations than that allows, each is polled less often. 0 lets each poll on its own schedule.", defaultValue: strconv.Itoa(defaultPollRPS)},
+	{name: "PORT", description: "Port the HTTP server listens on.", defaultValue: defaultPort},
+	{name: "FRONTEND_DIR", description: "Directory of the web frontend served at /.", defaultValue: defaultFrontendDir},
+	{name: "DEFAULT_TIMEOUT_SECONDS", description: "Translation timeout used when a request does not set timeout_seconds.", defaultValue: strconv.Itoa(defaultTimeoutSeconds)},
+	{name: "MAX_TIMEOUT_SECONDS", description: "Upper bound for the timeout_seconds a request may ask for.", defaultValue: strconv.Itoa(maxTimeoutSeconds)},
+	{name: "MAX_RESULTS", description: "Upper bound for the max_results a request may ask for; larger values are rejected.", defaultValue: strconv.Itoa(defaultMaxResults)},
+	{name: "STREAM_KEEPALIVE_SECONDS", description: "How long /api/v1/query/stream, and /api/v1/query with keepalive=true, may go without sending anything before sending keepalive bytes, so proxies don't close idle connections; 0 disables keepalives.", defaultValue: strconv.Itoa(defaultStreamKeepAlive)},
+	{name: "TRANSLATION_CACHE_TTL_SECONDS", description: "How long translations are cached in memory; 0 disables the cache.", defaultValue: strconv.Itoa(defaultCacheTTL)},
+	{name: "OFFLINE_FALLBACK", description: "Answer with a rule-based query, marked \"fallback\": true, when every translation provider fails.", defaultValue: "true"},
+	{name: "CLARIFY_BELOW_CONFIDENCE", description: "Confidence, between 0 and 1, below which translations are answered with needs_clarification and a question to ask the user instead of the query; 0 always returns the query.", defaultValue: "0"},
+	{name: "FAILURE_CACHE_TTL_SECONDS", description: "How long translations that failed persistently (Deep Search disabled, token rejected, question failed) are remembered so identical requests fail fast; 0 disables.", defaultValue: strconv.Itoa(defaultFailureTTL)},
+	{name: "SEARCH_CACHE_TTL_SECONDS", description: "How long /api/v1/search results are cached in memory, keyed by normalized query; 0 disables the cache.", defaultValue: strconv.Itoa(defaultSearchCacheTTL)},
+	{name: "RETENTION_DAYS", description: "How many days translation history and tracked Deep Search conversations are kept before an hourly janitor prunes them; 0 keeps them until evicted by size.", defaultValue: strconv.Itoa(defaultRetentionDays)},
+	{name: "FEW_SHOT_EXAMPLES", description: "How many curated examples similar to each request are included in the prompt; 0 uses the static syntax guidance instead.", defaultValue: strconv.Itoa(defaultFewShot)},
+	{name: "EXAMPLES_FILE", description: "JSON file of {\"request\", \"query\"} pairs to draw few-shot examples from, replacing the built-in set."},
+	{name: "PROMPT_FILE", description: "File holding the prompt template, with %s where the request goes, replacing the built-in prompt."},
+	{name: "RELOAD_INTERVAL_SECONDS", description: "How often serve checks PROMPT_FILE, EXAMPLES_FILE, CONFIG_FILE and CONFIG_DIR for changes and reloads them; 0 disables reloading. LOG_LEVEL changes take effect at once; other settings need a restart.", defaultValue: strconv.Itoa(defaultReloadInterval)},
+	{name: "JOBS_FILE", description: "File to keep /api/v1/jobs in, so jobs unfinished when the server stops are resumed when it starts again. Kept in memory only when unset."},
+	{name: "STATE_URL", description: "Redis (6.2 or later) to keep all state in, as redis://[:password@]host[:port][/db] or rediss:// for TLS: the caches, history, rate limit counters and, unless QUEUE_URL says otherwise, queued jobs, so replicas are interchangeable behind a load balancer. State is kept in each process when unset."},
+	{name: "QUEUE_URL", description: "Redis (6.2 or later) to queue /api/v1/jobs in and keep their state, as redis://[:password@]host[:port][/db] or rediss:// for TLS, so every replica sharing it can accept jobs and work on them. Defaults to STATE_URL; jobs run in the process that accepted them when both are unset."},
+	{name: "QUEUE_WORKERS", description: "How many queued jobs serve, and each worker process, runs at once; 0 makes serve only accept jobs, for separate worker processes to run.", defaultValue: strconv.Itoa(defaultQueueWorkers)},
+	{name: "QUEUE_VISIBILITY_TIMEOUT_SECONDS", description: "How long a queued job's worker may go without checking in, such as after it crashed, before the job is given to another worker.", defaultValue: strconv.Itoa(defaultQueueVisibility)},
+	{name: "SHUTDOWN_TIMEOUT_SECONDS", description: "How long serve and worker may take to finish in-flight requests and jobs after SIGTERM or SIGINT before exiting anyway. Keep it below the pod's terminationGracePeriodSeconds on Kubernetes.", defaultValue: strconv.Itoa(defaultShutdownTimeout)},
+	{name: "DRAIN_DELAY_SECONDS", description: "How long serve keeps accepting requests after SIGTERM, with /readyz answering 503, so load balancers stop routing to it before it stops listening; 0 stops at once. Counts towards SHUTDOWN_TIMEOUT_SECONDS.", defaultValue: strconv.Itoa(defaultDrainDelay)},
+	{name: "LEADER_ELECTION_LEASE", description: "Name of a Kubernetes Lease in the pod's namespace that replicas elect a leader with, so only the leader prunes the state they share. Needs permission to get, create and update leases. Every replica prunes when unset."},
+	{name: "EXAMPLES_INDEX_PATH", description: "File to persist the embedded few-shot examples in, so restarts reuse them until the examples change. Kept in memory only when unset."},
+	{name: "DEEPSEARCH_EXTRACTION_STRATEGIES", description: "Comma-separated extraction strategies tried in order on Deep Search answers (json, fenced, backtick, last-line).", defaultValue: "json,fenced,backtick,last-line"},
+	{name: "DEEPSEARCH_API", description: "Revision of the Deep Search API to speak: v1, v2, or auto to use v1 where the instance offers it and otherwise v2, as detected at startup. v1 when detection is skipped or fails.", defaultValue: providersAuto},
+	{name: "DEEPSEARCH_CLEANUP", description: "Delete Deep Search conversations from the instance once their answer has been read. Skipped on instances that can't delete conversations.", defaultValue: "true"},
+	{name: "DEFAULT_REPO_SCOPE", description: "Repository name prefix, such as github.com/acme-corp/, that queries are limited to with a repo: filter unless they name repositories or a search context themselves, so results don't come from public forks and unrelated code. Every repository is searched when unset."},
+	{name: "DEFAULT_FILTERS", description: "Filters, such as fork:no archived:no count:50, added to every generated query that doesn't already have a filter for the same field."},
+	{name: "DEFAULT_TIMEZONE", description: "IANA time zone, such as Europe/Berlin, in which dates relative to today in requests, such as \"since yesterday\", are resolved when the request gives none with its timezone field or X-Timezone header. The server's local time zone when unset."},
+	{name: "QUERY_REWRITE_RULES", description: "JSON array of rules applied in order to every generated query before it is validated: {\"remove\": \"timeout\"} removes a field's filters, or those of a field:value; {\"replace\": \"type:repository\", \"with\": \"select:repo\"} maps one filter to another; {\"set\": \"patterntype:keyword\"} replaces a field's filters or adds one; {\"add\": \"repo:^github\\\\.com/acme/\"} adds a filter. \"tenants\": [names] limits a rule to those callers. May be written as a list in CONFIG_FILE."},
+	{name: "RESOLVE_REPOS", description: "Check the repo: filters of generated queries against the instance's repositories, and replace those naming one partly or by a made-up path, such as acme/widgets for github.com/acme/widgets, with its exact name. Lookups are cached for 10 minutes.", defaultValue: "true"},
+	{name: "FAULT_INJECTION", description: "JSON object of faults to inject into Deep Search requests, for resilience testing only: {\"delay_rate\": 0.2, \"max_delay_seconds\": 5, \"error_rate\": 0.05, \"rate_limit_rate\": 0.05, \"truncate_rate\": 0.1}. Each rate is the chance, between 0 and 1, that a request is delayed by up to max_delay_seconds, answered with a 500 or a 429, or has its answer cut in half. May be written as an object in CONFIG_FILE."},
+	{name: "TRANSLATION_STRATEGY", description: "How translations are run: single; best-of-n to make several attempts in parallel and keep the best-scoring query; or ensemble to ask every provider in TRANSLATION_PROVIDERS and return the consensus.", defaultValue: strategySingle},
+	{name: "TRANSLATION_PROVIDERS", description: "Comma-separated translation providers (deepsearch, cody), tried in order when one is unavailable on the instance, or auto to use whichever the instance offers. Ensembles ask all of them, and may list a provider more than once to vote across repeated attempts.", defaultValue: providersAuto},
+	{name: "CODY_MODEL", description: "Model used by the cody provider, e.g. anthropic::2023-06-01::claude-3.5-sonnet. Defaults to the first model the instance offers."},
+	{name: "ENSEMBLE_QUORUM", description: "Votes an ensemble answer needs to count as consensus; 0 means a majority of providers.", defaultValue: "0"},
+	{name: "BEST_OF_N", description: "Number of parallel attempts made by the best-of-n strategy.", defaultValue: strconv.Itoa(defaultBestOfN)},
+	{name: "BEST_OF_N_DRY_RUN", description: "Whether best-of-n dry-runs valid candidates with count:1 and prefers ones that match something.", defaultValue: "true"},
+	{name: "EXTENSION_ORIGINS", description: "Comma-separated browser extension origins allowed by CORS."},
+	{name: "EXTENSION_SECRET", description: "Pairing secret browser extensions exchange for short-lived tokens."},
+	{name: "ADMIN_API_KEYS", description: "Comma-separated API keys with the admin role, in the same form as API_KEYS, accepted on the admin API under /api/v1/admin and every other route. The admin API is disabled when unset."},
+	{name: "API_KEYS", description: "Comma-separated API keys, each optionally prefixed with a name as name:key. When set, API requests must send one as a Bearer token or X-API-Key header."},
+	{name: "CONTENT_SECURITY_POLICY", description: "Content-Security-Policy sent with every response, the web frontend's included, or off to send none. /api/docs replaces it with one allowing Swagger UI from unpkg.com.", defaultValue: defaultCSP},
+	{name: "HSTS_MAX_AGE_SECONDS", description: "max-age of the Strict-Transport-Security header sent with HTTPS responses, including those a proxy says in X-Forwarded-Proto were made over HTTPS; 0 sends none.", defaultValue: strconv.Itoa(defaultHSTSMaxAge)},
+	{name: "REFERRER_POLICY", description: "Referrer-Policy sent with every response, or off to send none.", defaultValue: defaultReferrerPolicy},
+	{name: "IP_ALLOWLIST", description: "Comma-separated CIDRs or addresses that are the only ones allowed to use the server, except for /health and /readyz. Every address is allowed when unset."},
+	{name: "IP_DENYLIST", description: "Comma-separated CIDRs or addresses refused by the server, even within IP_ALLOWLIST, except for /health and /readyz."},
+	{name: "FORWARDED_PROXIES", description: "Comma-separated CIDRs or addresses of load balancers and reverse proxies in front of the server. The X-Forwarded-For header of requests from them, and from no others, gives the client address that IP_ALLOWLIST and IP_DENYLIST are checked against."},
+	{name: "TRUSTED_PROXIES", description: "Comma-separated CIDRs or addresses of SSO proxies such as oauth2-proxy. Requests from them are attributed to the user named in PROXY_AUTH_HEADERS. Proxy authentication is disabled when unset."},
+	{name: "PROXY_AUTH_HEADERS", description: "Comma-separated headers a trusted proxy puts the signed-in user in, checked in order.", defaultValue: strings.Join(middleware.DefaultProxyHeaders, ",")},
+	{name: "PROXY_ADMIN_USERS", description: "Comma-separated users authenticated by a trusted proxy who have the admin role."},
+	{name: "LOG_FORMAT", description: "Log output format: text or json.", defaultValue: logFormatText},
+	{name: "LOG_LEVEL", description: "Minimum level logged: debug, info, warn or error. debug also logs the method, path, status and duration of every request to Sourcegraph. Admins can change it at runtime.", defaultValue: "info"},
+	{name: "LOG_SAMPLE_RATE", description: "Fraction of successful requests logged, between 0 and 1. Failed requests are always logged.", defaultValue: "1"},
+	{name: "LOG_SAMPLE_ROUTES", description: "Comma-separated per-route overrides of LOG_SAMPLE_RATE, as route=rate, e.g. /health=0,/api/v1/history=0.1."},
+	{name: "DEBUG_ADDR", description: "Address such as localhost:6060 of a separate listener serving pprof profiles under /debug/pprof/ and expvar variables at /debug/vars. It has no authentication, so keep it off public interfaces. Disabled when unset."},
+	{name: "HEALTH_WINDOW_SECONDS", description: "How far back /health and /readyz count failed translation calls to Sourcegraph.", defaultValue: "300"},
+	{name: "HEALTH_DEGRADED_ERROR_RATE", description: "Fraction of failed translation calls at which /health reports the server degraded.", defaultValue: "0.5"},
+	{name: "HEALTH_UNHEALTHY_ERROR_RATE", description: "Fraction of failed translation calls at which the server reports itself unhealthy and /readyz answers 503.", defaultValue: "0.9"},
+	{name: "SENTRY_DSN", description: "DSN of a Sentry-compatible service, as https://key@host/project, that server errors and panics are reported to with the request they happened in. Disabled when unset."},
+	{name: "SENTRY_ENVIRONMENT", description: "Environment, such as production or staging, attached to reported errors."},
+	{name: "ANALYTICS_SALT", description: "Secret of at least 16 characters that enables anonymized usage metrics on /metrics: translations and feedback per user, under a keyed hash of their name, and the length and filters of requests, never their text. Set the same value on every replica."},
+	{name: "RATE_LIMIT_RPS", description: "Requests per second allowed per client on API routes; 0 disables rate limiting.", defaultValue: "0"},
+	{name: "RATE_LIMIT_BURST", description: "Burst size allowed above RATE_LIMIT_RPS.", defaultValue: strconv.Itoa(defaultRateLimitBurst)},
+	{name: "TENANT_LIMITS", description: "JSON object of limits per tenant, keyed by API key name or proxy user, with \"default\" for everyone else: {\"default\": {\"rps\": 2, \"daily_quota\": 1000}, \"search-team\": {\"rps\": 10, \"burst\": 40, \"concurrency\": 8}}. Each sets any of rps, burst, daily_quota (requests per UTC day) and concurrency (requests in flight per replica), where 0 is unlimited; unset fields come from the default, whose own come from RATE_LIMIT_RPS and RATE_LIMIT_BURST. May be written as an object in CONFIG_FILE."},
+	{name: "NO_STORE_TENANTS", description: "Comma-separated tenants, by API key name or proxy user, whose requests are all handled as if they set no_store: their text and generated queries are kept out of the history, the translation cache and Deep Search. \"*\" applies it to everyone."},
+	{name: "REQUEST_SECRETS", description: "What is done with requests containing what looks like a credential, such as a private key or an access token in a pasted error log, before they reach the language model or are stored: redact masks it, reject refuses the request, and allow leaves it.", defaultValue: server.SecretsRedact},
+	{name: "QUERY_POLICY", description: "JSON object of query policies per tenant, keyed by API key name or proxy user, with \"default\" for everyone else: {\"default\": {\"deny\": [\"type:diff\"]}, \"acme\": {\"allow_repos\": [\"github.com/acme/\"], \"action\": \"reject\"}}. deny lists fields or field:value filters queries may not use; allow_repos lists the repository name prefixes queries may search; action is rewrite (the default), which removes the filters a policy doesn't allow, or reject, which fails the request with policy_violation. Unset fields come from the default. Applies to translations and to /api/v1/search, and the default policy to the translations of the query, batch and tui commands. May be written as an object in CONFIG_FILE."},
+}
+
+type Config struct {
+	SourcegraphURL   string
+	SourcegraphToken string
+	Port             string
+	FrontendDir      string
+	// UpstreamRPS and UpstreamBurst bound the requests the whole server
+	// sends to Sourcegraph.
+	UpstreamRPS   float64
+	UpstreamBurst int
+	// UpstreamAuth is how requests to Sourcegraph carry the access token.
+	UpstreamAuth deepsearch.Auth
+	// UpstreamTLS is how connections to Sourcegraph are secured, or nil for
+	// Go's defaults.
+	UpstreamTLS *tls.Config
+	// PollRPS is the rate at which Deep Search conversations are polled,
+	// across all of them; zero leaves it unbounded.
+	PollRPS        float64
+	DefaultTimeout time.Duration
+	MaxTimeout     time.Duration
+	MaxResults     int
+	// StreamKeepAlive is the idle time after which event streams send a
+	// keepalive comment; zero disables them.
+	StreamKeepAlive time.Duration
+	CacheTTL        time.Duration
+	SearchCacheTTL  time.Duration
+	FailureTTL      time.Duration
+	// Retention is how long history and tracked conversations are kept;
+	// zero keeps them until evicted by size.
+	Retention time.Duration
+	// DeepSearchExtraction lists the extraction strategies applied to Deep
+	// Search answers, in order.
+	DeepSearchExtraction []string
+	// FewShotExamples is how many examples from ExamplesFile, or the
+	// built-in set if it is empty, go into each prompt.
+	FewShotExamples   int
+	ExamplesFile      string
+	ExamplesIndexPath string
+	// JobsFile persists async jobs; they are kept in memory when it is
+	// empty.
+	JobsFile string
+	// StateURL is the Redis the caches, history and rate limits are kept
+	// in; they are kept in memory when it is empty.
+	StateURL string
+	// QueueURL is the Redis jobs are queued in, to be run by QueueWorkers
+	// workers in each process; jobs run where they were accepted when it
+	// is empty.
+	QueueURL        string
+	QueueWorkers    int
+	QueueVisibility time.Duration
+	// ShutdownTimeout bounds a graceful shutdown, including DrainDelay,
+	// during which a server told to stop by SIGTERM still serves requests
+	// but reports itself draining.
+	ShutdownTimeout time.Duration
+	DrainDelay      time.Duration
+	// LeaderLease is the Kubernetes Lease replicas elect a leader with;
+	// leader election is disabled when it is empty.
+	LeaderLease string
+	// PromptFile holds the prompt template; the built-in one is used when
+	// it is empty.
+	PromptFile string
+	// ReloadInterval is how often PromptFile and ExamplesFile are checked
+	// for changes; they aren't reloaded when it is zero.
+	ReloadInterval time.Duration
+	// DeepSearchAPI names the revision of the Deep Search API spoken, or is
+	// providersAuto until resolveProviders picks one.
+	DeepSearchAPI string
+	// DeepSearchCleanup deletes answered conversations from the instance.
+	DeepSearchCleanup bool
+	// RepoScope is the repository name prefix queries naming no
+	// repositories are limited to, if set.
+	RepoScope string
+	// DefaultFilters are added to generated queries lacking their fields.
+	DefaultFilters string
+	// Timezone is where requests that give no time zone are made from, or
+	// nil for the server's.
+	Timezone *time.Location
+	// Rewrites rewrites generated queries, if QUERY_REWRITE_RULES is set.
+	Rewrites *rewrite.Engine
+	// ResolveRepos replaces the repo: filters of generated queries with
+	// the exact names of the repositories they mean.
+	ResolveRepos bool
+	// Faults are injected into Deep Search requests for resilience testing.
+	Faults deepsearch.Faults
+	// Strategy selects how translations are run; BestOfN and BestOfDryRun
+	// configure the best-of-n strategy.
+	Strategy     string
+	BestOfN      int
+	BestOfDryRun bool
+	// OfflineFallback enables the rule-based translator when every
+	// provider fails.
+	OfflineFallback bool
+	// ClarifyBelow is the confidence below which translations are
+	// answered with a clarifying question; zero disables it.
+	ClarifyBelow float64
+	// Providers lists translation providers by name; EnsembleQuorum is
+	// the number of agreeing providers the ensemble strategy requires.
+	Providers []string
+	// CodyModel is the model used by the cody provider; empty picks the
+	// instance default.
+	CodyModel        string
+	EnsembleQuorum   int
+	ExtensionOrigins []string
+	ExtensionSecret  string
+	// APIKeys maps each accepted API key to its name; AdminKeys does the
+	// same for the admin API.
+	APIKeys   map[string]string
+	AdminKeys map[string]string
+	// SecurityHeaders are sent with every response.
+	SecurityHeaders middleware.SecurityHeaders
+	// IPFilter refuses the client addresses it doesn't allow.
+	IPFilter middleware.IPFilter
+	// ProxyAuth attributes requests from trusted SSO proxies to the user
+	// they name; it is disabled without trusted networks.
+	ProxyAuth      middleware.ProxyAuth
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// TenantLimits applies RateLimitRPS and RateLimitBurst, or the limits
+	// TENANT_LIMITS sets, to each caller.
+	TenantLimits middleware.TenantLimits
+	// NoStoreTenants are the tenants whose requests are never stored.
+	NoStoreTenants []string
+	// RequestSecrets is what is done with requests with credentials in
+	// them, one of server.SecretsRedact, SecretsReject and SecretsAllow.
+	RequestSecrets string
+	// QueryPolicies limits the filters of each tenant's queries, as
+	// QUERY_POLICY sets.
+	QueryPolicies policy.Policies
+	// LogFormat and LogLevel configure log output.
+	LogFormat string
+	LogLevel  slog.Level
+	// LogSampler picks the successful requests that are logged; nil logs
+	// them all.
+	LogSampler *middleware.LogSampler
+	// DebugAddr is where the pprof and expvar listener listens; it is
+	// disabled when empty.
+	DebugAddr string
+	// Health sets when failing translations mark the server degraded or
+	// unhealthy.
+	Health server.HealthOptions
+	// SentryDSN is where errors are reported; reporting is disabled when
+	// it is empty.
+	SentryDSN         string
+	SentryEnvironment string
+	// AnalyticsSalt keys the hash users are recorded under in the
+	// anonymized usage metrics, which are disabled when it is empty.
+	AnalyticsSalt string
+}
+
+func loadConfig() (Config, error) {
+	if err := loadEnvFile(); err != nil {
+		return Config{}, err
+	}
+	if err := loadConfigFile(); err != nil {
+		return Config{}, err
+	}
+	if err := loadConfigDir(); err != nil {
+		return Config{}, err
+	}
+
+	config := Config{
+		SourcegraphURL:       getEnv("SOURCEGRAPH_URL", defaultSourcegraphURL),
+		SourcegraphToken:     getEnv("SOURCEGRAPH_TOKEN", ""),
+		Port:                 getEnv("PORT", defaultPort),
+		FrontendDir:          getEnv("FRONTEND_DIR", defaultFrontendDir),
+		DeepSearchExtraction: splitList(getEnv("DEEPSEARCH_EXTRACTION_STRATEGIES", "")),
+		ExamplesFile:         getEnv("EXAMPLES_FILE", ""),
+		ExamplesIndexPath:    getEnv("EXAMPLES_INDEX_PATH", ""),
+		JobsFile:             getEnv("JOBS_FILE", ""),
+		StateURL:             getEnv("STATE_URL", ""),
+		QueueURL:             getEnv("QUEUE_URL", getEnv("STATE_URL", "")),
+		LeaderLease:          getEnv("LEADER_ELECTION_LEASE", ""),
+		PromptFile:           getEnv("PROMPT_FILE", ""),
+		Strategy:             getEnv("TRANSLATION_STRATEGY", strategySingle),
+		Providers:            splitList(getEnv("TRANSLATION_PROVIDERS", providersAuto)),
+		CodyModel:            getEnv("CODY_MODEL", ""),
+		ExtensionOrigins:     splitList(getEnv("EXTENSION_ORIGINS", "")),
+		ExtensionSecret:      getEnv("EXTENSION_SECRET", ""),
+	}
+
+	var err error
+	if config.DefaultTimeout, err = getEnvSeconds("DEFAULT_TIMEOUT_SECONDS", defaultTimeoutSeconds); err != nil {
+		return config, err
+	}
+	if config.MaxTimeout, err = getEnvSeconds("MAX_TIMEOUT_SECONDS", maxTimeoutSeconds); err != nil {
+		return config, err
+	}
+	if config.MaxResults, err = getEnvCount("MAX_RESULTS", defaultMaxResults); err != nil {
+		return config, err
+	}
+	if v := getEnv("STREAM_KEEPALIVE_SECONDS", strconv.Itoa(defaultStreamKeepAlive)); v != "0" {
+		if config.StreamKeepAlive, err = getEnvSeconds("STREAM_KEEPALIVE_SECONDS", defaultStreamKeepAlive); err != nil {
+			return config, err
+		}
+	}
+	if v := getEnv("TRANSLATION_CACHE_TTL_SECONDS", strconv.Itoa(defaultCacheTTL)); v == "0" {
+		config.CacheTTL = 0
+	} else if config.CacheTTL, err = getEnvSeconds("TRANSLATION_CACHE_TTL_SECONDS", defaultCacheTTL); err != nil {
+		return config, err
+	}
+	if v := getEnv("FAILURE_CACHE_TTL_SECONDS", strconv.Itoa(defaultFailureTTL)); v == "0" {
+		config.FailureTTL = 0
+	} else if config.FailureTTL, err = getEnvSeconds("FAILURE_CACHE_TTL_SECONDS", defaultFailureTTL); err != nil {
+		return config, err
+	}
+	if v := getEnv("SEARCH_CACHE_TTL_SECONDS", strconv.Itoa(defaultSearchCacheTTL)); v == "0" {
+		config.SearchCacheTTL = 0
+	} else if config.SearchCacheTTL, err = getEnvSeconds("SEARCH_CACHE_TTL_SECONDS", defaultSearchCacheTTL); err != nil {
+		return config, err
+	}
+	if config.DefaultTimeout > config.MaxTimeout {
+		return config, fmt.Errorf("DEFAULT_TIMEOUT_SECONDS (%s) must not exceed MAX_TIMEOUT_SECONDS (%s)", config.DefaultTimeout, config.MaxTimeout)
+	}
+
+	if config.UpstreamRPS, err = getEnvRate("SOURCEGRAPH_MAX_RPS", defaultUpstreamRPS); err != nil {
+		return config, err
+	}
+	if config.UpstreamBurst, err = getEnvCount("SOURCEGRAPH_BURST", defaultUpstreamBurst); err != nil {
+		return config, err
+	}
+	if config.PollRPS, err = getEnvRate("DEEPSEARCH_POLL_RPS", defaultPollRPS); err != nil {
+		return config, err
+	}
+	if config.APIKeys, err = parseAPIKeys("API_KEYS", getEnv("API_KEYS", "")); err != nil {
+		return config, err
+	}
+	if config.AdminKeys, err = parseAPIKeys("ADMIN_API_KEYS", getEnv("ADMIN_API_KEYS", "")); err != nil {
+		return config, err
+	}
+	config.SecurityHeaders.ContentSecurityPolicy = getEnv("CONTENT_SECURITY_POLICY", defaultCSP)
+	config.SecurityHeaders.ReferrerPolicy = getEnv("REFERRER_POLICY", defaultReferrerPolicy)
+	if config.SecurityHeaders.ContentSecurityPolicy == "off" {
+		config.SecurityHeaders.ContentSecurityPolicy = ""
+	}
+	if config.SecurityHeaders.ReferrerPolicy == "off" {
+		config.SecurityHeaders.ReferrerPolicy = ""
+	}
+	if v := getEnv("HSTS_MAX_AGE_SECONDS", strconv.Itoa(defaultHSTSMaxAge)); v != "0" {
+		if config.SecurityHeaders.HSTSMaxAge, err = getEnvSeconds("HSTS_MAX_AGE_SECONDS", defaultHSTSMaxAge); err != nil {
+			return config, err
+		}
+	}
+	if config.IPFilter.Allow, err = parsePrefixes("IP_ALLOWLIST", getEnv("IP_ALLOWLIST", "")); err != nil {
+		return config, err
+	}
+	if config.IPFilter.Deny, err = parsePrefixes("IP_DENYLIST", getEnv("IP_DENYLIST", "")); err != nil {
+		return config, err
+	}
+	if config.IPFilter.Proxies, err = parsePrefixes("FORWARDED_PROXIES", getEnv("FORWARDED_PROXIES", "")); err != nil {
+		return config, err
+	}
+	if config.ProxyAuth.Trusted, err = parsePrefixes("TRUSTED_PROXIES", getEnv("TRUSTED_PROXIES", "")); err != nil {
+		return config, err
+	}
+	config.ProxyAuth.Headers = splitList(getEnv("PROXY_AUTH_HEADERS", strings.Join(middleware.DefaultProxyHeaders, ",")))
+	config.ProxyAuth.Admins = splitList(getEnv("PROXY_ADMIN_USERS", ""))
+	config.DebugAddr = getEnv("DEBUG_ADDR", "")
+	if config.Health.Window, err = getEnvSeconds("HEALTH_WINDOW_SECONDS", 300); err != nil {
+		return config, err
+	}
+	if config.Health.DegradedRate, err = parseRate("HEALTH_DEGRADED_ERROR_RATE", getEnv("HEALTH_DEGRADED_ERROR_RATE", "0.5")); err != nil {
+		return config, err
+	}
+	if config.Health.UnhealthyRate, err = parseRate("HEALTH_UNHEALTHY_ERROR_RATE", getEnv("HEALTH_UNHEALTHY_ERROR_RATE", "0.9")); err != nil {
+		return config, err
+	}
+	if config.Health.DegradedRate > config.Health.UnhealthyRate {
+		return config, fmt.Errorf("invalid HEALTH_DEGRADED_ERROR_RATE: %v exceeds HEALTH_UNHEALTHY_ERROR_RATE", config.Health.DegradedRate)
+	}
+	config.SentryDSN = getEnv("SENTRY_DSN", "")
+	config.SentryEnvironment = getEnv("SENTRY_ENVIRONMENT", "")
+	if config.SentryDSN != "" {
+		if _, err := errreport.New(config.SentryDSN, "", ""); err != nil {
+			return config, fmt.Errorf("invalid SENTRY_DSN: %w", err)
+		}
+	}
+	if config.AnalyticsSalt = getEnv("ANALYTICS_SALT", ""); config.AnalyticsSalt != "" && len(config.AnalyticsSalt) < minAnalyticsSalt {
+		return config, fmt.Errorf("invalid ANALYTICS_SALT: must be at least %d characters, so pseudonyms can't be reversed", minAnalyticsSalt)
+	}
+	switch config.LogFormat = getEnv("LOG_FORMAT", logFormatText); config.LogFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return config, fmt.Errorf("invalid LOG_FORMAT: %q is not %s or %s", config.LogFormat, logFormatText, logFormatJSON)
+	}
+	if config.LogLevel, err = parseLogLevel(getEnv("LOG_LEVEL", "info")); err != nil {
+		return config, err
+	}
+	if config.LogSampler, err = parseLogSampling(getEnv("LOG_SAMPLE_RATE", "1"), getEnv("LOG_SAMPLE_ROUTES", "")); err != nil {
+		return config, err
+	}
+	if config.RateLimitRPS, err = getEnvRate("RATE_LIMIT_RPS", 0); err != nil {
+		return config, err
+	}
+	if config.RateLimitBurst, err = getEnvCount("RATE_LIMIT_BURST", defaultRateLimitBurst); err != nil {
+		return config, err
+	}
+	defaultLimit := middleware.TenantLimit{RPS: config.RateLimitRPS, Burst: config.RateLimitBurst}
+	if config.TenantLimits, err = parseTenantLimits(getEnv("TENANT_LIMITS", ""), defaultLimit); err != nil {
+		return config, err
+	}
+	config.NoStoreTenants = splitList(getEnv("NO_STORE_TENANTS", ""))
+	switch config.RequestSecrets = getEnv("REQUEST_SECRETS", server.SecretsRedact); config.RequestSecrets {
+	case server.SecretsRedact, server.SecretsReject, server.SecretsAllow:
+	default:
+		return config, fmt.Errorf("invalid REQUEST_SECRETS: %q is not %s, %s or %s", config.RequestSecrets, server.SecretsRedact, server.SecretsReject, server.SecretsAllow)
+	}
+	if policies := getEnv("QUERY_POLICY", ""); policies != "" {
+		if config.QueryPolicies, err = policy.Parse(policies); err != nil {
+			return config, fmt.Errorf("invalid QUERY_POLICY: %w", err)
+		}
+	}
+
+	switch config.Strategy {
+	case strategySingle, strategyBestOf, strategyEnsemble:
+	default:
+		return config, fmt.Errorf("invalid TRANSLATION_STRATEGY: %q (want %s, %s or %s)", config.Strategy, strategySingle, strategyBestOf, strategyEnsemble)
+	}
+	if v := getEnv("ENSEMBLE_QUORUM", "0"); v != "0" {
+		if config.EnsembleQuorum, err = getEnvCount("ENSEMBLE_QUORUM", 0); err != nil {
+			return config, err
+		}
+	}
+	if !config.autoProviders() {
+		if err := config.validateProviders(); err != nil {
+			return config, err
+		}
+	}
+	if config.BestOfN, err = getEnvCount("BEST_OF_N", defaultBestOfN); err != nil {
+		return config, err
+	}
+	if config.BestOfN > maxBestOfN {
+		return config, fmt.Errorf("invalid BEST_OF_N: %d exceeds the maximum of %d", config.BestOfN, maxBestOfN)
+	}
+	if config.BestOfDryRun, err = strconv.ParseBool(getEnv("BEST_OF_N_DRY_RUN", "true")); err != nil {
+		return config, fmt.Errorf("invalid BEST_OF_N_DRY_RUN: %w", err)
+	}
+	if config.OfflineFallback, err = strconv.ParseBool(getEnv("OFFLINE_FALLBACK", "true")); err != nil {
+		return config, fmt.Errorf("invalid OFFLINE_FALLBACK: %w", err)
+	}
+	if config.ClarifyBelow, err = parseRate("CLARIFY_BELOW_CONFIDENCE", getEnv("CLARIFY_BELOW_CONFIDENCE", "0")); err != nil {
+		return config, err
+	}
+	if config.DeepSearchAPI = getEnv("DEEPSEARCH_API", providersAuto); config.DeepSearchAPI != providersAuto {
+		if _, ok := deepsearch.LookupAPI(config.DeepSearchAPI); !ok {
+			return config, fmt.Errorf("invalid DEEPSEARCH_API: %q is not %s, %s or %s", config.DeepSearchAPI, providersAuto, deepsearch.APIv1.Name, deepsearch.APIv2.Name)
+		}
+	}
+	if config.DeepSearchCleanup, err = strconv.ParseBool(getEnv("DEEPSEARCH_CLEANUP", "true")); err != nil {
+		return config, fmt.Errorf("invalid DEEPSEARCH_CLEANUP: %w", err)
+	}
+	config.RepoScope = repoScope(getEnv("DEFAULT_REPO_SCOPE", ""))
+	if config.DefaultFilters, err = translate.ParseDefaultFilters(getEnv("DEFAULT_FILTERS", "")); err != nil {
+		return config, fmt.Errorf("invalid DEFAULT_FILTERS: %w", err)
+	}
+	if name := getEnv("DEFAULT_TIMEZONE", ""); name != "" {
+		if config.Timezone, err = time.LoadLocation(name); err != nil {
+			return config, fmt.Errorf("invalid DEFAULT_TIMEZONE: %w", err)
+		}
+	}
+	if rules := getEnv("QUERY_REWRITE_RULES", ""); rules != "" {
+		if config.Rewrites, err = rewrite.Parse(rules); err != nil {
+			return config, fmt.Errorf("invalid QUERY_REWRITE_RULES: %w", err)
+		}
+	}
+	if config.ResolveRepos, err = strconv.ParseBool(getEnv("RESOLVE_REPOS", "true")); err != nil {
+		return config, fmt.Errorf("invalid RESOLVE_REPOS: %w", err)
+	}
+	if config.Faults, err = parseFaults(getEnv("FAULT_INJECTION", "")); err != nil {
+		return config, err
+	}
+
+	if _, err := translate.NewExtractor(config.DeepSearchExtraction); err != nil {
+		return config, fmt.Errorf("invalid DEEPSEARCH_EXTRACTION_STRATEGIES: %w", err)
+	}
+	if v := getEnv("RETENTION_DAYS", strconv.Itoa(defaultRetentionDays)); v != "0" {
+		days, err := getEnvCount("RETENTION_DAYS", defaultRetentionDays)
+		if err != nil {
+			return config, err
+		}
+		config.Retention = time.Duration(days) * 24 * time.Hour
+	}
+	if config.FewShotExamples, err = getEnvCount("FEW_SHOT_EXAMPLES", defaultFewShot); err != nil {
+		return config, err
+	}
+	if config.ExamplesFile != "" {
+		if _, err := examples.Load(config.ExamplesFile); err != nil {
+			return config, fmt.Errorf("invalid EXAMPLES_FILE: %w", err)
+		}
+	}
+	if _, err := newPrompt(config); err != nil {
+		return config, err
+	}
+	if config.StateURL != "" {
+		if _, err := redis.Open(config.StateURL); err != nil {
+			return config, fmt.Errorf("invalid STATE_URL: %w", err)
+		}
+	}
+	if config.QueueURL != "" {
+		if config.JobsFile != "" {
+			return config, fmt.Errorf("JOBS_FILE can't be used with QUEUE_URL or STATE_URL; queued jobs are kept in the queue's Redis")
+		}
+		if _, err := redis.Open(config.QueueURL); err != nil {
+			return config, fmt.Errorf("invalid QUEUE_URL: %w", err)
+		}
+	}
+	if v := getEnv("QUEUE_WORKERS", strconv.Itoa(defaultQueueWorkers)); v != "0" {
+		if config.QueueWorkers, err = getEnvCount("QUEUE_WORKERS", defaultQueueWorkers); err != nil {
+			return config, err
+		}
+	}
+	if config.QueueVisibility, err = getEnvSeconds("QUEUE_VISIBILITY_TIMEOUT_SECONDS", defaultQueueVisibility); err != nil {
+		return config, err
+	}
+	if config.ShutdownTimeout, err = getEnvSeconds("SHUTDOWN_TIMEOUT_SECONDS", defaultShutdownTimeout); err != nil {
+		return config, err
+	}
+	if v := getEnv("DRAIN_DELAY_SECONDS", strconv.Itoa(defaultDrainDelay)); v != "0" {
+		if config.DrainDelay, err = getEnvSeconds("DRAIN_DELAY_SECONDS", defaultDrainDelay); err != nil {
+			return config, err
+		}
+	}
+	if config.DrainDelay >= config.ShutdownTimeout {
+		return config, fmt.Errorf("DRAIN_DELAY_SECONDS must be less than SHUTDOWN_TIMEOUT_SECONDS, which it counts towards")
+	}
+	if v := getEnv("RELOAD_INTERVAL_SECONDS", strconv.Itoa(defaultReloadInterval)); v != "0" {
+		if config.ReloadInterval, err = getEnvSeconds("RELOAD_INTERVAL_SECONDS", defaultReloadInterval); err != nil {
+			return config, err
+		}
+	}
+
+	if path := getEnv("SOURCEGRAPH_TOKEN_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, fmt.Errorf("invalid SOURCEGRAPH_TOKEN_FILE: %w", err)
+		}
+		config.SourcegraphToken = strings.TrimSpace(string(data))
+	}
+	if config.SourcegraphToken == "" {
+		return config, fmt.Errorf("SOURCEGRAPH_TOKEN is required; set it, or SOURCEGRAPH_TOKEN_FILE, in the environment, a flag or the config file")
+	}
+
+	if config.SourcegraphURL, err = parseSourcegraphURL(config.SourcegraphURL); err != nil {
+		return config, err
+	}
+	if config.UpstreamAuth, err = upstreamAuth(); err != nil {
+		return config, err
+	}
+	if config.UpstreamTLS, err = upstreamTLS(); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// upstreamAuth reads how requests to Sourcegraph are authorized.
+func upstreamAuth() (deepsearch.Auth, error) {
+	auth := deepsearch.Auth{Scheme: getEnv("SOURCEGRAPH_AUTH_SCHEME", deepsearch.SchemeToken), SudoUser: getEnv("SOURCEGRAPH_SUDO_USER", "")}
+	switch auth.Scheme {
+	case deepsearch.SchemeToken, deepsearch.SchemeBearer, deepsearch.SchemeTokenSudo:
+	default:
+		return auth, fmt.Errorf("invalid SOURCEGRAPH_AUTH_SCHEME: %q is not %s, %s or %s", auth.Scheme, deepsearch.SchemeToken, deepsearch.SchemeBearer, deepsearch.SchemeTokenSudo)
+	}
+	switch {
+	case auth.Scheme == deepsearch.SchemeTokenSudo && auth.SudoUser == "":
+		return auth, fmt.Errorf("SOURCEGRAPH_SUDO_USER is required with SOURCEGRAPH_AUTH_SCHEME=%s", deepsearch.SchemeTokenSudo)
+	case auth.Scheme != deepsearch.SchemeTokenSudo && auth.SudoUser != "":
+		return auth, fmt.Errorf("SOURCEGRAPH_SUDO_USER is only used with SOURCEGRAPH_AUTH_SCHEME=%s", deepsearch.SchemeTokenSudo)
+	case strings.ContainsAny(auth.SudoUser, "\",\\ \t"):
+		return auth, fmt.Errorf("invalid SOURCEGRAPH_SUDO_USER: %q is not a user name", auth.SudoUser)
+	}
+	return auth, nil
+}
+
+// upstreamTLS reads the TLS settings for connections to Sourcegraph, or
+// returns nil if there are none.
+func upstreamTLS() (*tls.Config, error) {
+	caFile := getEnv("SOURCEGRAPH_CA_FILE", "")
+	certFile, keyFile := getEnv("SOURCEGRAPH_CLIENT_CERT_FILE", ""), getEnv("SOURCEGRAPH_CLIENT_KEY_FILE", "")
+	insecure, err := strconv.ParseBool(getEnv("SOURCEGRAPH_INSECURE_SKIP_VERIFY", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOURCEGRAPH_INSECURE_SKIP_VERIFY: %w", err)
+	}
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCEGRAPH_CA_FILE: %w", err)
+		}
+		// The private CA is trusted as well as the public ones, so a proxy
+		// in front of Sourcegraph can use either.
+		if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid SOURCEGRAPH_CA_FILE: no PEM certificates in %s", caFile)
+		}
+	}
+	switch {
+	case certFile != "" && keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCEGRAPH_CLIENT_CERT_FILE or SOURCEGRAPH_CLIENT_KEY_FILE: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case certFile != "" || keyFile != "":
+		return nil, fmt.Errorf("SOURCEGRAPH_CLIENT_CERT_FILE and SOURCEGRAPH_CLIENT_KEY_FILE must be set together")
+	}
+	return config, nil
+}
+
+// parseSourcegraphURL checks that raw is an http or https URL and reduces
+// it to the scheme and host, which is all the clients use.
+func parseSourcegraphURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid SOURCEGRAPH_URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid SOURCEGRAPH_URL: %q is not an http or https URL such as https://sourcegraph.example.com", raw)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// autoProviders reports whether the providers are still to be picked by
+// resolveProviders.
+func (c Config) autoProviders() bool {
+	return len(c.Providers) == 1 && c.Providers[0] == providersAuto
+}
+
+// validateProviders checks the provider list against the strategy. It runs
+// once the list is known: in loadConfig if it was configured explicitly, or
+// after resolveProviders picks it.
+func (c Config) validateProviders() error {
+	if len(c.Providers) == 0 {
+		return fmt.Errorf("TRANSLATION_PROVIDERS must name at least one provider")
+	}
+	for _, name := range c.Providers {
+		if _, ok := providerFactories[name]; !ok {
+			return fmt.Errorf("invalid TRANSLATION_PROVIDERS: unknown provider %q", name)
+		}
+	}
+	if c.Strategy == strategyEnsemble {
+		if len(c.Providers) < 2 {
+			return fmt.Errorf("TRANSLATION_STRATEGY=ensemble needs at least two TRANSLATION_PROVIDERS")
+		}
+		if c.EnsembleQuorum > len(c.Providers) {
+			return fmt.Errorf("invalid ENSEMBLE_QUORUM: %d exceeds the %d configured providers", c.EnsembleQuorum, len(c.Providers))
+		}
+	}
+	return nil
+}
+
+// upstreamIdleConns is how many idle connections to Sourcegraph are kept
+// for reuse; Go's default of 2 would reopen them constantly with several
+// conversations being polled at once.
+const upstreamIdleConns = 32
+
+// upstreamTransport returns the transport for requests to Sourcegraph,
+// enforcing the server-wide request budget. Every client talking to
+// Sourcegraph must share the one it returns.
+func upstreamTransport(config Config) http.RoundTripper {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.MaxIdleConnsPerHost = upstreamIdleConns
+	if config.UpstreamTLS != nil {
+		base.TLSClientConfig = config.UpstreamTLS
+	}
+	transport := logTransport{base: traceTransport{base: base}}
+	if config.UpstreamRPS == 0 {
+		return transport
+	}
+	return ratelimit.Transport(transport, ratelimit.NewLimiter(config.UpstreamRPS, config.UpstreamBurst))
+}
+
+// upstream is what every client talking to Sourcegraph shares: the request
+// budget, the polling schedule, and the record of the Deep Search
+// conversations created.
+type upstream struct {
+	transport     http.RoundTripper
+	poller        *deepsearch.Poller
+	conversations *deepsearch.Tracker
+}
+
+func newUpstream(config Config) upstream {
+	up := upstream{
+		transport:     upstreamTransport(config),
+		conversations: deepsearch.NewTracker(trackedConversations),
+	}
+	if config.PollRPS > 0 {
+		up.poller = deepsearch.NewPoller(time.Duration(float64(time.Second) / config.PollRPS))
+	}
+	if config.UpstreamAuth.Scheme == deepsearch.SchemeTokenSudo {
+		slog.Info("Making requests to Sourcegraph as another user", "user", config.UpstreamAuth.SudoUser)
+	}
+	if config.UpstreamTLS != nil && config.UpstreamTLS.InsecureSkipVerify {
+		slog.Warn("Not verifying the TLS certificate of Sourcegraph, so anyone who can intercept the connection can read the access token; SOURCEGRAPH_INSECURE_SKIP_VERIFY is for testing only, use SOURCEGRAPH_CA_FILE for a private CA", "url", config.SourcegraphURL)
+	}
+	if config.Faults.Enabled() {
+		f := config.Faults
+		slog.Warn("Injecting faults into Deep Search requests; FAULT_INJECTION is for testing only", "delay_rate", f.DelayRate, "max_delay", f.MaxDelay, "error_rate", f.ErrorRate, "rate_limit_rate", f.RateLimitRate, "truncate_rate", f.TruncateRate)
+	}
+	return up
+}
+
+func (up upstream) deepSearch(config Config) *deepsearch.Client {
+	// An unresolved auto speaks the default, v1.
+	api, _ := deepsearch.LookupAPI(config.DeepSearchAPI)
+	return deepsearch.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(up.transport).WithAuth(config.UpstreamAuth).WithAPI(api).WithTracker(up.conversations).WithPoller(up.poller).WithFaults(config.Faults)
+}
+
+// newTranslator builds the translation strategy described by config,
+// prompting with prompt and examples from retriever where they are non-nil.
+func newTranslator(config Config, up upstream, prompt *translate.Prompt, retriever translate.ExampleRetriever) translate.Strategy {
+	extractor, _ := translate.NewExtractor(config.DeepSearchExtraction) // validated by loadConfig
+	var repos *sourcegraph.RepoCache
+	if config.ResolveRepos {
+		repos = sourcegraph.NewRepoCache(sourcegraph.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(up.transport).WithAuth(config.UpstreamAuth))
+	}
+	newSingle := func(backend translate.Backend) *translate.Translator {
+		t := translate.New(backend, extractor)
+		if prompt != nil {
+			t = t.WithLivePrompt(prompt)
+		}
+		if retriever != nil {
+			t = t.WithExamples(retriever, config.FewShotExamples)
+		}
+		if repos != nil {
+			t = t.WithRepoResolver(repos)
+		}
+		t = t.WithRepoScope(config.RepoScope).WithDefaultFilters(config.DefaultFilters)
+		if config.Rewrites != nil {
+			t = t.WithRewriter(config.Rewrites)
+		}
+		return t
+	}
+
+	switch config.Strategy {
+	case strategyBestOf:
+		var dryRun translate.DryRunFunc
+		if config.BestOfDryRun {
+			dryRun = newDryRun(search.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(up.transport).WithAuth(config.UpstreamAuth))
+		}
+		return translate.NewBestOf(newSingle(newFallback(config, up)), config.BestOfN, dryRun)
+	case strategyEnsemble:
+		var providers []translate.Provider
+		count := map[string]int{}
+		for _, name := range config.Providers {
+			count[name]++
+			label := name
+			if count[name] > 1 {
+				label = fmt.Sprintf("%s#%d", name, count[name])
+			}
+			backend := providerFactories[name](config, up)
+			providers = append(providers, translate.Provider{Name: label, Strategy: newSingle(backend)})
+		}
+		return translate.NewEnsemble(providers, config.EnsembleQuorum)
+	default:
+		return newSingle(newFallback(config, up))
+	}
+}
+
+// newExampleStore opens the few-shot example index, or returns nil if
+// examples are disabled.
+func newExampleStore(config Config) (*examples.Store, error) {
+	if config.FewShotExamples == 0 {
+		return nil, nil
+	}
+	load := func() ([]examples.Example, error) {
+		if config.ExamplesFile == "" {
+			return examples.Builtin(), nil
+		}
+		return examples.Load(config.ExamplesFile)
+	}
+	store, err := examples.OpenStore(context.Background(), config.ExamplesIndexPath, examples.HashEmbedder{}, load)
+	if err != nil {
+		return nil, fmt.Errorf("load few-shot examples: %w", err)
+	}
+	return store, nil
+}
+
+// newFallback chains the configured providers, which validateProviders has
+// checked, in order.
+func newFallback(config Config, up upstream) *translate.Fallback {
+	var backends []translate.NamedBackend
+	for _, name := range config.Providers {
+		backends = append(backends, translate.NamedBackend{Name: name, Backend: providerFactories[name](config, up)})
+	}
+	return translate.NewFallback(backends...)
+}
+
+// repoScope normalizes a DEFAULT_REPO_SCOPE value into a repository name
+// prefix: without a URL scheme, and ending in a slash so it covers an
+// organization's repositories and not others whose names start the same.
+func repoScope(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "://"); i >= 0 {
+		value = value[i+3:]
+	}
+	if value == "" || strings.HasSuffix(value, "/") {
+		return value
+	}
+	return value + "/"
+}
+
+// newDryRun returns a DryRunFunc that runs candidates with count:1, which is
+// enough to tell a query that matches something from one that doesn't.
+func newDryRun(searcher *search.Client) translate.DryRunFunc {
+	return func(ctx context.Context, q string) (int, error) {
+		result, err := searcher.Search(ctx, query.WithFilter(q, "count", "1"), search.Options{DisplayLimit: 1}, nil)
+		if err != nil {
+			return 0, err
+		}
+		if result.Alert != nil {
+			return 0, fmt.Errorf("alert: %s", result.Alert.Title)
+		}
+		return result.Progress.MatchCount, nil
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, _, ok := lookupSetting(key); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvSeconds(key string, defaultValue int) (time.Duration, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return time.Duration(defaultValue) * time.Second, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a positive number of seconds", key, value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// getEnvRate reads a non-negative requests-per-second value.
+func getEnvRate(key string, defaultValue float64) (float64, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue, nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a non-negative number", key, value)
+	}
+	return rate, nil
+}
+
+// getEnvCount reads a positive integer.
+func getEnvCount(key string, defaultValue int) (int, error) {
+	value := getEnv(key, "")
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a positive integer", key, value)
+	}
+	return n, nil
+}
+
+// parseRate parses value, from variable key, as a rate between 0 and 1.
+func parseRate(key, value string) (float64, error) {
+	r, err := strconv.ParseFloat(value, 64)
+	if err != nil || r < 0 || r > 1 {
+		return 0, fmt.Errorf("invalid %s: %q is not a rate between 0 and 1", key, value)
+	}
+	return r, nil
+}
+
+// parseLogSampling parses LOG_SAMPLE_RATE and LOG_SAMPLE_ROUTES. It returns
+// nil when every request is logged.
+func parseLogSampling(rate, routes string) (*middleware.LogSampler, error) {
+	sampler := &middleware.LogSampler{Routes: map[string]float64{}}
+	var err error
+	if sampler.Rate, err = parseRate("LOG_SAMPLE_RATE", rate); err != nil {
+		return nil, err
+	}
+	for _, entry := range splitList(routes) {
+		route, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid LOG_SAMPLE_ROUTES: %q is not of the form /route=rate", entry)
+		}
+		if sampler.Routes[route], err = parseRate("LOG_SAMPLE_ROUTES", value); err != nil {
+			return nil, err
+		}
+	}
+	if sampler.Rate == 1 && len(sampler.Routes) == 0 {
+		return nil, nil
+	}
+	return sampler, nil
+}
+
+// parseTenantLimits parses TENANT_LIMITS. The fields a tenant doesn't set
+// are taken from the default entry, and those it doesn't set from def.
+func parseTenantLimits(value string, def middleware.TenantLimit) (middleware.TenantLimits, error) {
+	limits := middleware.TenantLimits{Default: def}
+	if value == "" {
+		return limits, nil
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return limits, fmt.Errorf("invalid TENANT_LIMITS: not a JSON object of limits keyed by tenant")
+	}
+	parse := func(name string, limit *middleware.TenantLimit) error {
+		dec := json.NewDecoder(bytes.NewReader(raw[name]))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(limit); err != nil {
+			return fmt.Errorf("invalid TENANT_LIMITS: %s: %w", name, err)
+		}
+		if limit.RPS < 0 || limit.Burst < 0 || limit.DailyQuota < 0 || limit.Concurrency < 0 {
+			return fmt.Errorf("invalid TENANT_LIMITS: %s: limits must not be negative", name)
+		}
+		return nil
+	}
+	if _, ok := raw["default"]; ok {
+		if err := parse("default", &limits.Default); err != nil {
+			return limits, err
+		}
+	}
+	limits.Tenants = map[string]middleware.TenantLimit{}
+	for name := range raw {
+		if name == "default" {
+			continue
+		}
+		limit := limits.Default
+		if err := parse(name, &limit); err != nil {
+			return limits, err
+		}
+		limits.Tenants[name] = limit
+	}
+	return limits, nil
+}
+
+// parseFaults parses FAULT_INJECTION.
+func parseFaults(value string) (deepsearch.Faults, error) {
+	if value == "" {
+		return deepsearch.Faults{}, nil
+	}
+	var raw struct {
+		DelayRate       float64 `json:"delay_rate"`
+		MaxDelaySeconds float64 `json:"max_delay_seconds"`
+		ErrorRate       float64 `json:"error_rate"`
+		RateLimitRate   float64 `json:"rate_limit_rate"`
+		TruncateRate    float64 `json:"truncate_rate"`
+	}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return deepsearch.Faults{}, fmt.Errorf("invalid FAULT_INJECTION: %w", err)
+	}
+	for _, rate := range []float64{raw.DelayRate, raw.ErrorRate, raw.RateLimitRate, raw.TruncateRate} {
+		if rate < 0 || rate > 1 {
+			return deepsearch.Faults{}, fmt.Errorf("invalid FAULT_INJECTION: rates must be between 0 and 1")
+		}
+	}
+	if raw.ErrorRate+raw.RateLimitRate > 1 {
+		return deepsearch.Faults{}, fmt.Errorf("invalid FAULT_INJECTION: error_rate and rate_limit_rate add up to more than 1")
+	}
+	if raw.MaxDelaySeconds < 0 {
+		return deepsearch.Faults{}, fmt.Errorf("invalid FAULT_INJECTION: max_delay_seconds must not be negative")
+	}
+	return deepsearch.Faults{
+		DelayRate:     raw.DelayRate,
+		MaxDelay:      time.Duration(raw.MaxDelaySeconds * float64(time.Second)),
+		ErrorRate:     raw.ErrorRate,
+		RateLimitRate: raw.RateLimitRate,
+		TruncateRate:  raw.TruncateRate,
+	}, nil
+}
+
+// parsePrefixes parses the networks in variable key, given as CIDRs or
+// single addresses.
+func parsePrefixes(key, value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range splitList(value) {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q is not a CIDR or IP address", key, entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseAPIKeys parses the entries of the API key list in variable key, of
+// the form name:key or key. Unnamed keys are named by their position so logs
+// never contain the key itself.
+func parseAPIKeys(key, value string) (map[string]string, error) {
+	keys := map[string]string{}
+	for i, entry := range splitList(value) {
+		name, apiKey, ok := strings.Cut(entry, ":")
+		if !ok {
+			name, apiKey = fmt.Sprintf("key%d", i+1), entry
+		}
+		if name == "" || apiKey == "" {
+			return nil, fmt.Errorf("invalid %s entry %d: expected name:key or key", key, i+1)
+		}
+		if _, dup := keys[apiKey]; dup {
+			return nil, fmt.Errorf("invalid %s: key %q is listed twice", key, name)
+		}
+		keys[apiKey] = name
+	}
+	return keys, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,103 @@
+package deepsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// API is a revision of the Deep Search API, which instances offer
+// depending on their version. Requests are the same in each, but under the
+// revision's path; responses are read in any revision's vocabulary by
+// decodeConversation.
+type API struct {
+	// Name is how the revision is configured, such as v1.
+	Name string
+	// Path is where the revision's conversations are on the instance.
+	Path string
+}
+
+// The revisions of the Deep Search API the client speaks.
+var (
+	APIv1 = API{Name: "v1", Path: "/.api/deepsearch/v1"}
+	APIv2 = API{Name: "v2", Path: "/.api/deepsearch/v2"}
+)
+
+// LookupAPI returns the revision named name.
+func LookupAPI(name string) (API, bool) {
+	for _, api := range []API{APIv1, APIv2} {
+		if api.Name == name {
+			return api, true
+		}
+	}
+	return API{}, false
+}
+
+// The statuses of a question, as Question.Status reports them whatever the
+// instance calls them. Any other status means it is still being answered.
+const (
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// statusAliases maps the terminal statuses instances have reported under
+// other names to the ones Question uses.
+var statusAliases = map[string]string{
+	"complete":  StatusCompleted,
+	"succeeded": StatusCompleted,
+	"success":   StatusCompleted,
+	"done":      StatusCompleted,
+	"error":     StatusFailed,
+	"errored":   StatusFailed,
+	"canceled":  StatusCancelled,
+}
+
+// normalizeStatus returns status in the vocabulary of the constants above.
+func normalizeStatus(status string) string {
+	status = strings.ToLower(status)
+	if alias, ok := statusAliases[status]; ok {
+		return alias
+	}
+	return status
+}
+
+// wireQuestion is a question as any revision sends it: with snake_case or
+// camelCase field names, and the status as status or state.
+type wireQuestion struct {
+	Question
+	ConversationIDCamel int    `json:"conversationId"`
+	State               string `json:"state"`
+}
+
+// wireConversation is a conversation as any revision sends it.
+type wireConversation struct {
+	ID        int            `json:"id"`
+	Questions []wireQuestion `json:"questions"`
+}
+
+// decodeConversation reads a conversation from a response body, whichever
+// revision of the API sent it.
+func decodeConversation(r io.Reader) (*Conversation, error) {
+	var wire wireConversation
+	if err := json.NewDecoder(r).Decode(&wire); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	conv := &Conversation{ID: wire.ID, Questions: make([]Question, len(wire.Questions))}
+	for i, w := range wire.Questions {
+		q := w.Question
+		if q.ConversationID == 0 {
+			q.ConversationID = w.ConversationIDCamel
+		}
+		if q.ConversationID == 0 {
+			q.ConversationID = wire.ID
+		}
+		if q.Status == "" {
+			q.Status = w.State
+		}
+		q.Status = normalizeStatus(q.Status)
+		conv.Questions[i] = q
+	}
+	return conv, nil
+}
@@ -0,0 +1,36 @@
+package deepsearch
+
+import "fmt"
+
+// Authorization schemes for the access token, for instances and the proxies
+// in front of them that expect one other than Sourcegraph's own.
+const (
+	// SchemeToken sends "token TOKEN", which Sourcegraph expects.
+	SchemeToken = "token"
+	// SchemeBearer sends "Bearer TOKEN", for proxies that only pass on
+	// OAuth-style credentials.
+	SchemeBearer = "bearer"
+	// SchemeTokenSudo sends the token of a site admin with the name of the
+	// user the requests are made as, so they only see what that user can.
+	SchemeTokenSudo = "token-sudo"
+)
+
+// Auth is how requests to Sourcegraph carry the access token. The zero Auth
+// uses SchemeToken.
+type Auth struct {
+	Scheme string
+	// SudoUser is the user requests are made as with SchemeTokenSudo.
+	SudoUser string
+}
+
+// Header returns the Authorization header that sends token.
+func (a Auth) Header(token string) string {
+	switch a.Scheme {
+	case SchemeBearer:
+		return "Bearer " + token
+	case SchemeTokenSudo:
+		return fmt.Sprintf(`token-sudo user="%s",token="%s"`, a.SudoUser, token)
+	default:
+		return "token " + token
+	}
+}
@@ -0,0 +1,399 @@
+// Package deepsearch is a client for the Sourcegraph Deep Search API.
+package deepsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ClientIdentifier is sent as X-Requested-With on every request to Sourcegraph.
+const ClientIdentifier = "nlsearch 1.0.0"
+
+type Client struct {
+	baseURL     string
+	accessToken string
+	auth        Auth
+	api         API
+	httpClient  *http.Client
+	tracker     *Tracker
+	poller      *Poller
+	faults      Faults
+}
+
+type CreateConversationRequest struct {
+	Question string `json:"question"`
+}
+
+type Question struct {
+	ID             int                      `json:"id"`
+	ConversationID int                      `json:"conversation_id"`
+	Question       string                   `json:"question"`
+	Status         string                   `json:"status"`
+	Answer         string                   `json:"answer,omitempty"`
+	Sources        []map[string]interface{} `json:"sources,omitempty"`
+	Stats          map[string]interface{}   `json:"stats"`
+}
+
+type Conversation struct {
+	ID        int        `json:"id"`
+	Questions []Question `json:"questions"`
+}
+
+// Asked returns the ID of the question in c asking question, the last one
+// with its text, or else the newest, since the instance may add questions
+// of its own or list them in another order. It returns 0 if c has none.
+func (c *Conversation) Asked(question string) int {
+	question = strings.TrimSpace(question)
+	newest := 0
+	for i := len(c.Questions) - 1; i >= 0; i-- {
+		if strings.TrimSpace(c.Questions[i].Question) == question {
+			return c.Questions[i].ID
+		}
+		newest = max(newest, c.Questions[i].ID)
+	}
+	return newest
+}
+
+// Find returns the question of c with id, or its last question if id is 0.
+// It returns nil if there is no such question.
+func (c *Conversation) Find(id int) *Question {
+	for i := len(c.Questions) - 1; i >= 0; i-- {
+		if id == 0 || c.Questions[i].ID == id {
+			return &c.Questions[i]
+		}
+	}
+	return nil
+}
+
+func NewClient(baseURL, accessToken string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		accessToken: accessToken,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// WithTransport sends the client's requests through rt, e.g. to share an
+// outbound rate limit. It returns c for chaining.
+func (c *Client) WithTransport(rt http.RoundTripper) *Client {
+	c.httpClient.Transport = rt
+	return c
+}
+
+// WithAuth sets how the client's requests carry the access token. It
+// returns c for chaining.
+func (c *Client) WithAuth(auth Auth) *Client {
+	c.auth = auth
+	return c
+}
+
+// WithAPI speaks revision api of the Deep Search API, rather than APIv1.
+// It returns c for chaining.
+func (c *Client) WithAPI(api API) *Client {
+	c.api = api
+	return c
+}
+
+// endpoint returns the URL of path under the Deep Search API.
+func (c *Client) endpoint(path string) string {
+	api := c.api
+	if api.Path == "" {
+		api = APIv1
+	}
+	return c.baseURL + api.Path + path
+}
+
+// WithTracker records the conversations the client creates, and their
+// progress, in t. It returns c for chaining.
+func (c *Client) WithTracker(t *Tracker) *Client {
+	c.tracker = t
+	return c
+}
+
+// WithPoller schedules the client's polls with p, which may be shared with
+// other clients. It returns c for chaining.
+func (c *Client) WithPoller(p *Poller) *Client {
+	c.poller = p
+	return c
+}
+
+func (c *Client) CreateConversation(ctx context.Context, question string) (*Conversation, error) {
+	reqBody := CreateConversationRequest{Question: question}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	apiURL := c.endpoint("")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(string(jsonData)))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, sendError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, NewStatusError(resp)
+	}
+
+	conv, err := decodeConversation(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tracker != nil {
+		c.tracker.created(conv.ID, conv.Asked(question), question, ownerFrom(ctx), IsPrivate(ctx))
+	}
+	return conv, nil
+}
+
+// AddQuestion asks a follow-up question in an existing conversation, which
+// Deep Search answers with the earlier questions and answers as context.
+// Wait for the answer with WaitForCompletion, passing the question's ID from
+// the returned conversation's Asked.
+func (c *Client) AddQuestion(ctx context.Context, conversationID int, question string) (*Conversation, error) {
+	jsonData, err := json.Marshal(CreateConversationRequest{Question: question})
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
+	}
+
+	apiURL := c.endpoint(fmt.Sprintf("/%d/questions", conversationID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(string(jsonData)))
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, sendError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, NewStatusError(resp)
+	}
+
+	conv, err := decodeConversation(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tracker != nil {
+		c.tracker.update(conversationID, func(t *TrackedConversation) {
+			t.QuestionID, t.Status, t.Answer, t.Error = conv.Asked(question), "created", "", ""
+			if IsPrivate(ctx) {
+				t.Question, t.Private = "", true
+			}
+		})
+	}
+	return conv, nil
+}
+
+func (c *Client) GetConversation(ctx context.Context, conversationID int) (*Conversation, error) {
+	apiURL := c.endpoint(fmt.Sprintf("/%d", conversationID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, sendError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewStatusError(resp)
+	}
+
+	conv, err := decodeConversation(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// DeleteConversation deletes a conversation from the instance. It fails with
+// ErrDeleteUnsupported on instances without a delete API.
+func (c *Client) DeleteConversation(ctx context.Context, conversationID int) error {
+	apiURL := c.endpoint(fmt.Sprintf("/%d", conversationID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		err = sendError(err)
+	} else {
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			// Callers delete conversations they have just read, so a 404
+			// means the route is missing rather than the conversation.
+			err = fmt.Errorf("%w (status %d)", ErrDeleteUnsupported, resp.StatusCode)
+		default:
+			err = NewStatusError(resp)
+		}
+	}
+
+	if c.tracker != nil {
+		c.tracker.update(conversationID, func(t *TrackedConversation) {
+			t.Deleted = err == nil
+			if err != nil {
+				t.CleanupError = err.Error()
+			}
+		})
+	}
+	return err
+}
+
+// maxPollFailures is how many consecutive retryable errors WaitForCompletion
+// tolerates before giving up.
+const maxPollFailures = 3
+
+// defaultRateLimitWait is how long to pause polling after a 429 that did not
+// say how long to wait.
+const defaultRateLimitWait = 5 * time.Second
+
+// WaitForCompletion polls the conversation until the question with
+// questionID, as Conversation.Asked finds it, reaches a terminal status.
+// Questions the instance adds to the conversation are ignored. With
+// questionID 0, as for waits resumed without one, the latest question is
+// followed instead. onPoll, if non-nil, is called with the question after
+// every poll so callers can report intermediate status and stats.
+func (c *Client) WaitForCompletion(ctx context.Context, conversationID, questionID int, maxWait time.Duration, onPoll func(Question)) (*Question, error) {
+	if c.tracker == nil {
+		return c.waitForCompletion(ctx, conversationID, questionID, maxWait, func(_ *Conversation, q Question) {
+			if onPoll != nil {
+				onPoll(q)
+			}
+		})
+	}
+
+	c.tracker.update(conversationID, func(t *TrackedConversation) { t.QuestionID, t.Waiting = questionID, true })
+	q, err := c.waitForCompletion(ctx, conversationID, questionID, maxWait, func(conv *Conversation, q Question) {
+		c.tracker.update(conversationID, func(t *TrackedConversation) {
+			t.Status, t.Stats = q.Status, q.Stats
+			t.Questions = make([]QuestionStatus, len(conv.Questions))
+			for i, q := range conv.Questions {
+				t.Questions[i] = QuestionStatus{ID: q.ID, Status: q.Status}
+			}
+			t.Polls++
+		})
+		if onPoll != nil {
+			onPoll(q)
+		}
+	})
+	c.tracker.update(conversationID, func(t *TrackedConversation) {
+		t.Waiting = false
+		if q != nil && !t.Private {
+			t.Answer = q.Answer
+		}
+		if err != nil {
+			t.Error = err.Error()
+			if t.Status != StatusFailed && t.Status != StatusCancelled {
+				t.Status = "error"
+			}
+		}
+	})
+	return q, err
+}
+
+func (c *Client) waitForCompletion(ctx context.Context, conversationID, questionID int, maxWait time.Duration, onPoll func(*Conversation, Question)) (*Question, error) {
+	deadline := time.Now().Add(maxWait)
+	backoff := newPollBackoff()
+
+	failures, missing := 0, 0
+	for {
+		if err := c.poller.wait(ctx, backoff.next()); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%w waiting for response", ErrTimeout)
+			}
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for response", ErrTimeout)
+		}
+
+		conv, err := c.GetConversation(ctx, conversationID)
+		if err != nil {
+			if errors.Is(err, ErrRateLimited) {
+				// Back off for as long as Sourcegraph asks, unless that
+				// would take us past the deadline anyway.
+				wait := RetryAfter(err)
+				if wait == 0 {
+					wait = defaultRateLimitWait
+				}
+				if time.Now().Add(wait).After(deadline) {
+					return nil, err
+				}
+				select {
+				case <-ctx.Done():
+					return nil, err
+				case <-time.After(wait):
+				}
+				continue
+			}
+			// A single failed poll shouldn't lose an answer that is
+			// still being computed; keep polling through transient errors.
+			if failures++; IsRetryable(err) && failures < maxPollFailures && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		failures = 0
+
+		found := conv.Find(questionID)
+		if found == nil {
+			// The question may not be listed yet, but if it stays missing
+			// it was removed along with its answer.
+			if missing++; questionID != 0 && missing >= maxPollFailures {
+				return nil, fmt.Errorf("%w: question %d is no longer in conversation %d", ErrNotFound, questionID, conversationID)
+			}
+			continue
+		}
+		missing = 0
+
+		q := *found
+		c.faults.truncate(&q)
+		onPoll(conv, q)
+		switch q.Status {
+		case StatusCompleted:
+			return &q, nil
+		case StatusFailed:
+			return nil, ErrQuestionFailed
+		case StatusCancelled:
+			return nil, fmt.Errorf("question was cancelled")
+		}
+		backoff.observe(q)
+	}
+}
@@ -0,0 +1,121 @@
+package deepsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nlsearch/backend/redact"
+)
+
+// Errors returned by the client, and by the other Sourcegraph API clients
+// built on StatusError, can be tested with errors.Is against these
+// sentinels to decide how to report or retry them.
+var (
+	// ErrUnauthorized means Sourcegraph rejected the access token.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRateLimited means Sourcegraph asked us to slow down.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrNotFound means the conversation, or the question waited on in it,
+	// does not exist, or the instance does not have Deep Search enabled.
+	ErrNotFound = errors.New("not found")
+	// ErrTimeout means the request or the wait for an answer timed out.
+	ErrTimeout = errors.New("timeout")
+	// ErrQuestionFailed means Deep Search gave up on the question.
+	ErrQuestionFailed = errors.New("question processing failed")
+	// ErrDeleteUnsupported means the instance has no API for deleting
+	// conversations.
+	ErrDeleteUnsupported = errors.New("deleting conversations is not supported")
+)
+
+// StatusError is returned for unexpected HTTP responses. It unwraps to the
+// matching sentinel, if any.
+type StatusError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is how long Sourcegraph asked us to wait before retrying,
+	// from the Retry-After header. Zero if it sent none.
+	RetryAfter time.Duration
+}
+
+// NewStatusError builds a StatusError from an unexpected response, reading
+// its body. Other clients of Sourcegraph's APIs use it too, so callers can
+// handle all upstream errors the same way.
+func NewStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(resp.Body)
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Body:       redact.String(string(body)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// RetryAfter returns the delay requested by a rate-limited response in err's
+// chain, or zero.
+func RetryAfter(err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter accepts both forms allowed by RFC 9110: delay-seconds and
+// an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrTimeout
+	}
+	return nil
+}
+
+// IsRetryable reports whether err is likely transient: timeouts, rate limits
+// and server-side failures.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrRateLimited) {
+		return true
+	}
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode >= 500
+}
+
+// sendError wraps a transport error, marking timeouts with ErrTimeout.
+func sendError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("send request: %w: %w", ErrTimeout, err)
+	}
+	return fmt.Errorf("send request: %w", err)
+}
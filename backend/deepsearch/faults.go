@@ -0,0 +1,105 @@
+package deepsearch
+
+import (
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Faults are failures the client injects into its own requests, so retries,
+// error handling and clients further down can be tested against a healthy
+// instance. Each rate is the chance, between 0 and 1, that a request or
+// answer is hit. The zero value injects nothing.
+type Faults struct {
+	// DelayRate is the chance a request is held back for a random time up
+	// to MaxDelay before being sent.
+	DelayRate float64
+	MaxDelay  time.Duration
+	// ErrorRate and RateLimitRate are the chances a request isn't sent but
+	// answered with a 500, or a 429 asking to retry in a second.
+	ErrorRate     float64
+	RateLimitRate float64
+	// TruncateRate is the chance a completed answer is cut to half its
+	// length, as if the model had stopped early.
+	TruncateRate float64
+}
+
+// Enabled reports whether f injects anything.
+func (f Faults) Enabled() bool {
+	return f.DelayRate > 0 && f.MaxDelay > 0 || f.ErrorRate > 0 || f.RateLimitRate > 0 || f.TruncateRate > 0
+}
+
+// WithFaults injects f into the client's requests and answers. Call it after
+// WithTransport, whose transport it wraps. It returns c for chaining.
+func (c *Client) WithFaults(f Faults) *Client {
+	if !f.Enabled() {
+		return c
+	}
+	next := c.httpClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c.httpClient.Transport = faultTransport{next: next, faults: f}
+	c.faults = f
+	return c
+}
+
+// truncate cuts q's answer short with the chance f.TruncateRate, if q is
+// complete.
+func (f Faults) truncate(q *Question) {
+	if q.Status != StatusCompleted || q.Answer == "" || rand.Float64() >= f.TruncateRate {
+		return
+	}
+	slog.Debug("Injecting fault", "fault", "truncate", "conversation", q.ConversationID)
+	q.Answer = strings.ToValidUTF8(q.Answer[:len(q.Answer)/2], "")
+}
+
+// faultTransport delays and fails requests as its faults say before
+// passing them to next.
+type faultTransport struct {
+	next   http.RoundTripper
+	faults Faults
+}
+
+func (t faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.faults.MaxDelay > 0 && rand.Float64() < t.faults.DelayRate {
+		delay := rand.N(t.faults.MaxDelay)
+		slog.DebugContext(req.Context(), "Injecting fault", "fault", "delay", "delay", delay, "path", req.URL.Path)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	status := 0
+	switch r := rand.Float64(); {
+	case r < t.faults.ErrorRate:
+		status = http.StatusInternalServerError
+	case r < t.faults.ErrorRate+t.faults.RateLimitRate:
+		status = http.StatusTooManyRequests
+	default:
+		return t.next.RoundTrip(req)
+	}
+	slog.DebugContext(req.Context(), "Injecting fault", "fault", status, "path", req.URL.Path)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	resp := &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("injected fault")),
+		Request:    req,
+	}
+	if status == http.StatusTooManyRequests {
+		resp.Header.Set("Retry-After", "1")
+	}
+	return resp, nil
+}
@@ -0,0 +1,89 @@
+package deepsearch
+
+import (
+	"context"
+	"math/rand/v2"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Polling starts fast, since many answers arrive within seconds, and slows
+// down while nothing changes, since a question that is still thinking after
+// a while will usually keep thinking.
+const (
+	minPollInterval = 1 * time.Second
+	maxPollInterval = 4 * time.Second
+	pollGrowth      = 1.5
+	// pollJitter spreads polls by up to this fraction either way, so
+	// conversations started together don't poll in lockstep.
+	pollJitter = 0.2
+)
+
+// pollBackoff chooses how long to wait before each poll of a conversation.
+type pollBackoff struct {
+	interval  time.Duration
+	lastStats map[string]interface{}
+}
+
+func newPollBackoff() *pollBackoff {
+	return &pollBackoff{interval: minPollInterval}
+}
+
+// next returns the wait before the next poll.
+func (b *pollBackoff) next() time.Duration {
+	spread := float64(b.interval) * pollJitter
+	return b.interval + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// observe slows polling down after a poll that showed no progress. While
+// the question's stats keep changing, such as tool calls being made, the
+// interval is held so progress is still reported promptly.
+func (b *pollBackoff) observe(q Question) {
+	changed := !reflect.DeepEqual(q.Stats, b.lastStats)
+	b.lastStats = q.Stats
+	if changed && q.Stats != nil {
+		return
+	}
+	b.interval = min(time.Duration(float64(b.interval)*pollGrowth), maxPollInterval)
+}
+
+// Poller is a schedule shared by every conversation being waited on, which
+// spaces their polls out evenly instead of letting them fire in the same
+// instant, as they tend to when many requests arrive together. Polls take
+// turns in the order they come due, so under load each waits a little
+// longer rather than Sourcegraph seeing bursts.
+type Poller struct {
+	spacing time.Duration
+
+	mu   sync.Mutex
+	next time.Time // when the next free turn starts
+}
+
+// NewPoller returns a Poller that sends at most one poll every spacing.
+func NewPoller(spacing time.Duration) *Poller {
+	return &Poller{spacing: spacing}
+}
+
+// wait blocks until the poll due after delay may be sent, or ctx is done.
+// A nil Poller just waits for delay.
+func (p *Poller) wait(ctx context.Context, delay time.Duration) error {
+	due := time.Now().Add(delay)
+	if p != nil {
+		p.mu.Lock()
+		if due.Before(p.next) {
+			due = p.next
+		}
+		p.next = due.Add(p.spacing)
+		p.mu.Unlock()
+	}
+
+	timer := time.NewTimer(time.Until(due))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,180 @@
+package deepsearch
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TrackedConversation is a conversation created through a Client, as last
+// seen by it.
+type TrackedConversation struct {
+	ID int `json:"id"`
+	// Question is the prompt the conversation was created with.
+	Question string `json:"question"`
+	// Owner is the user the conversation was created for, as WithOwner
+	// says, so it can be deleted with the rest of their data.
+	Owner string `json:"owner,omitempty"`
+	// QuestionID is the question waited on: the one the latest request
+	// asked in the conversation.
+	QuestionID int `json:"question_id,omitempty"`
+	// Status is the status of QuestionID seen while polling, "created"
+	// before the first poll, or "error" if waiting failed for any reason
+	// other than the question failing.
+	Status string `json:"status"`
+	// Questions are the statuses of every question in the conversation at
+	// the last poll, including any the instance added itself.
+	Questions []QuestionStatus       `json:"questions,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	Polls     int                    `json:"polls"`
+	Stats     map[string]interface{} `json:"stats,omitempty"`
+	// Answer is the raw answer, kept so it can still be inspected once the
+	// conversation is deleted from the instance.
+	Answer string `json:"answer,omitempty"`
+	// Private is set for conversations created with a Private context,
+	// whose question and answer aren't kept.
+	Private bool `json:"private,omitempty"`
+	// Deleted is set once the conversation has been deleted from the
+	// instance; CleanupError says why deleting it failed.
+	Deleted      bool   `json:"deleted"`
+	CleanupError string `json:"cleanup_error,omitempty"`
+	// Waiting is set while a caller is still polling for the answer.
+	Waiting   bool      `json:"waiting"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// QuestionStatus is the status of one question in a conversation.
+type QuestionStatus struct {
+	ID     int    `json:"id"`
+	Status string `json:"status"`
+}
+
+// Tracker remembers the most recent conversations created through the
+// clients it is attached to, for debugging stuck or expensive ones. It is
+// safe for concurrent use.
+type Tracker struct {
+	mu    sync.Mutex
+	limit int
+	order []int // oldest first
+	byID  map[int]*TrackedConversation
+}
+
+// NewTracker returns a tracker that remembers at most limit conversations.
+func NewTracker(limit int) *Tracker {
+	return &Tracker{limit: limit, byID: map[int]*TrackedConversation{}}
+}
+
+// List returns the tracked conversations, most recent first.
+func (t *Tracker) List() []TrackedConversation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]TrackedConversation, 0, len(t.order))
+	for i := len(t.order) - 1; i >= 0; i-- {
+		out = append(out, *t.byID[t.order[i]])
+	}
+	return out
+}
+
+// Get returns the tracked conversation with id.
+func (t *Tracker) Get(id int) (TrackedConversation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.byID[id]
+	if !ok {
+		return TrackedConversation{}, false
+	}
+	return *c, true
+}
+
+// Prune forgets the conversations last updated before cutoff, except those
+// still being waited on, and returns how many it forgot.
+func (t *Tracker) Prune(cutoff time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	kept := t.order[:0]
+	for _, id := range t.order {
+		if c := t.byID[id]; c.UpdatedAt.Before(cutoff) && !c.Waiting {
+			delete(t.byID, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	removed := len(t.order) - len(kept)
+	t.order = kept
+	return removed
+}
+
+// Forget forgets the conversations of owner and returns them, for
+// deleting a user's data.
+func (t *Tracker) Forget(owner string) []TrackedConversation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var forgotten []TrackedConversation
+	kept := t.order[:0]
+	for _, id := range t.order {
+		if c := t.byID[id]; c.Owner == owner {
+			forgotten = append(forgotten, *c)
+			delete(t.byID, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	t.order = kept
+	return forgotten
+}
+
+func (t *Tracker) created(id, questionID int, question, owner string, private bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now().UTC()
+	if _, ok := t.byID[id]; !ok {
+		t.order = append(t.order, id)
+	}
+	if private {
+		question = ""
+	}
+	t.byID[id] = &TrackedConversation{ID: id, Question: question, Owner: owner, QuestionID: questionID, Private: private, Status: "created", CreatedAt: now, UpdatedAt: now}
+	if len(t.order) > t.limit {
+		delete(t.byID, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+func (t *Tracker) update(id int, f func(c *TrackedConversation)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.byID[id]; ok {
+		f(c)
+		c.UpdatedAt = time.Now().UTC()
+	}
+}
+
+type privateKey struct{}
+
+// Private returns a context in which the conversations a Client creates
+// are tracked without their question and answer, for requests whose text
+// mustn't be kept.
+func Private(ctx context.Context) context.Context {
+	return context.WithValue(ctx, privateKey{}, true)
+}
+
+// IsPrivate reports whether ctx came from Private.
+func IsPrivate(ctx context.Context) bool {
+	private, _ := ctx.Value(privateKey{}).(bool)
+	return private
+}
+
+type ownerKey struct{}
+
+// WithOwner returns a context in which the conversations a Client creates
+// are tracked as owner's, so Tracker.Forget can find them.
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// ownerFrom returns the owner ctx has from WithOwner, or "".
+func ownerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return owner
+}
@@ -0,0 +1,207 @@
+// Package errreport sends errors and panics to a Sentry-compatible service
+// (Sentry, GlitchTip and others) through its store API, without an SDK.
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/redact"
+)
+
+const (
+	sendTimeout = 10 * time.Second
+	// maxInFlight bounds the events being sent at once; more are dropped
+	// rather than piling up while the service is slow.
+	maxInFlight = 10
+)
+
+// Event is one error or panic to report.
+type Event struct {
+	// Level is "error", or "fatal" for panics.
+	Level   string
+	Message string
+	Err     error
+	// Stack is the goroutine stack of a panic, if any.
+	Stack []byte
+	// Request is the request being served, if any. Only its method, path
+	// and a few harmless headers are sent; never its query string,
+	// credentials or body.
+	Request   *http.Request
+	RequestID string
+	User      string
+	Tags      map[string]string
+}
+
+// Client reports events to the project a DSN names. It is safe for
+// concurrent use.
+type Client struct {
+	endpoint    string
+	auth        string
+	environment string
+	release     string
+	serverName  string
+	httpClient  *http.Client
+	inFlight    chan struct{}
+}
+
+// New returns a client for dsn, of the form https://key@host/project_id.
+// environment and release are attached to every event and may be empty.
+func New(dsn, environment, release string) (*Client, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid DSN: expected https://key@host/project_id")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	project := path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("invalid DSN: missing project ID")
+	}
+
+	hostname, _ := os.Hostname()
+	return &Client{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:i], project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=nlsearch/1.0, sentry_key=%s", u.User.Username()),
+		environment: environment,
+		release:     release,
+		serverName:  hostname,
+		httpClient:  &http.Client{Timeout: sendTimeout},
+		inFlight:    make(chan struct{}, maxInFlight),
+	}, nil
+}
+
+// Capture sends e in the background, so callers never wait on the service.
+// Events that can't be sent are logged and dropped.
+func (c *Client) Capture(e Event) {
+	select {
+	case c.inFlight <- struct{}{}:
+	default:
+		slog.Warn("Dropping error report; too many in flight", "message", e.Message)
+		return
+	}
+	body, err := json.Marshal(c.payload(e))
+	if err != nil {
+		<-c.inFlight
+		slog.Warn("Error encoding error report", "err", err)
+		return
+	}
+	go func() {
+		defer func() { <-c.inFlight }()
+		if err := c.send(body); err != nil {
+			slog.Warn("Error sending error report", "err", err)
+		}
+	}()
+}
+
+func (c *Client) send(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", c.auth)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// payload builds the event in Sentry's store API format.
+func (c *Client) payload(e Event) map[string]any {
+	id := make([]byte, 16)
+	rand.Read(id)
+	level := e.Level
+	if level == "" {
+		level = "error"
+	}
+
+	event := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"level":       level,
+		"logger":      "nlsearch",
+		"server_name": c.serverName,
+		"message":     redact.String(e.Message),
+	}
+	if c.environment != "" {
+		event["environment"] = c.environment
+	}
+	if c.release != "" {
+		event["release"] = c.release
+	}
+	if e.Err != nil {
+		event["exception"] = map[string]any{"values": []any{map[string]any{
+			"type":  errorType(e.Err),
+			"value": redact.String(e.Err.Error()),
+		}}}
+	}
+
+	tags := map[string]string{}
+	for k, v := range e.Tags {
+		tags[k] = v
+	}
+	if e.RequestID != "" {
+		tags["request_id"] = e.RequestID
+	}
+	if e.Request != nil {
+		if e.Request.Pattern != "" {
+			tags["route"] = e.Request.Pattern
+		}
+		// Only headers that can't carry credentials or user content are
+		// sent, and the URL without its query string.
+		headers := map[string]string{}
+		for _, name := range []string{"User-Agent", "Origin"} {
+			if v := e.Request.Header.Get(name); v != "" {
+				headers[name] = v
+			}
+		}
+		event["request"] = map[string]any{
+			"method":  e.Request.Method,
+			"url":     e.Request.URL.Path,
+			"headers": headers,
+		}
+	}
+	event["tags"] = tags
+	if e.User != "" {
+		event["user"] = map[string]string{"id": e.User}
+	}
+	if len(e.Stack) > 0 {
+		event["extra"] = map[string]string{"stack": string(e.Stack)}
+	}
+	return event
+}
+
+// genericTypes are error types that say nothing about what went wrong.
+var genericTypes = map[string]bool{"*errors.errorString": true, "*fmt.wrapError": true, "*fmt.wrapErrors": true}
+
+// errorType names the first error in err's chain with a telling type, e.g.
+// *deepsearch.StatusError rather than *fmt.wrapError, so reports of the same
+// failure group together.
+func errorType(err error) string {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if t := fmt.Sprintf("%T", e); !genericTypes[t] {
+			return t
+		}
+	}
+	return "error"
+}
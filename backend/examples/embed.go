@@ -0,0 +1,122 @@
+package examples
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Embedder maps texts to vectors whose cosine similarity reflects how alike
+// the texts are.
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// HashEmbedder embeds text locally by hashing its words, word pairs and
+// character trigrams into a fixed number of dimensions. It knows nothing of
+// meaning, only spelling, but needs no model and is plenty to match requests
+// against a few dozen examples.
+type HashEmbedder struct {
+	Dims int
+}
+
+// DefaultDims is the HashEmbedder size used when Dims is zero.
+const DefaultDims = 512
+
+func (h HashEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = h.embed(text)
+	}
+	return vectors, nil
+}
+
+// Feature weights: whole words and pairs say more about a request than the
+// trigrams, which are there to catch inflections (commit, commits).
+const (
+	wordWeight    = 1.0
+	pairWeight    = 0.7
+	trigramWeight = 0.3
+)
+
+func (h HashEmbedder) embed(text string) []float32 {
+	dims := h.Dims
+	if dims <= 0 {
+		dims = DefaultDims
+	}
+	v := make([]float32, dims)
+	add := func(feature string, weight float32) {
+		f := fnv.New64a()
+		f.Write([]byte(feature))
+		sum := f.Sum64()
+		// The top bit picks a sign so unrelated features that collide tend
+		// to cancel out rather than add up.
+		if sum>>63 == 1 {
+			weight = -weight
+		}
+		v[sum%uint64(dims)] += weight
+	}
+
+	words := tokenize(text)
+	for i, w := range words {
+		add("w:"+w, wordWeight)
+		if i > 0 {
+			add("p:"+words[i-1]+" "+w, pairWeight)
+		}
+		padded := "^" + w + "$"
+		for j := 0; j+3 <= len(padded); j++ {
+			add("t:"+padded[j:j+3], trigramWeight)
+		}
+	}
+	normalize(v)
+	return v
+}
+
+// stopWords carry no information about what a request is looking for.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "of": true, "in": true, "on": true, "to": true,
+	"for": true, "with": true, "that": true, "which": true, "is": true, "are": true,
+	"and": true, "or": true, "me": true, "show": true, "find": true, "all": true,
+	"where": true, "what": true, "do": true, "we": true, "i": true, "any": true,
+}
+
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	words := fields[:0]
+	for _, w := range fields {
+		if !stopWords[w] {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func normalize(v []float32) {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+}
+
+// cosine returns the cosine similarity of two normalized vectors.
+func cosine(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot float32
+	for i := range a {
+		dot += a[i] * b[i]
+	}
+	return dot
+}
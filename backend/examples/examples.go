@@ -0,0 +1,59 @@
+// Package examples retrieves curated request/query pairs similar to an
+// incoming request, for use as few-shot examples in translation prompts.
+package examples
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Example is a natural language request and the query it should produce.
+type Example struct {
+	Request string `json:"request"`
+	Query   string `json:"query"`
+}
+
+//go:embed examples.json
+var builtin []byte
+
+// Builtin returns the curated examples shipped with the server.
+func Builtin() []Example {
+	examples, err := parse(builtin)
+	if err != nil {
+		panic(fmt.Sprintf("examples.json: %v", err))
+	}
+	return examples
+}
+
+// Load reads examples from a JSON file holding an array of
+// {"request", "query"} objects.
+func Load(path string) ([]Example, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	examples, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return examples, nil
+}
+
+func parse(data []byte) ([]Example, error) {
+	var examples []Example
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&examples); err != nil {
+		return nil, err
+	}
+	for i, e := range examples {
+		if strings.TrimSpace(e.Request) == "" || strings.TrimSpace(e.Query) == "" {
+			return nil, fmt.Errorf("example %d needs both a request and a query", i+1)
+		}
+	}
+	return examples, nil
+}
@@ -0,0 +1,65 @@
+package examples
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// minSimilarity is the cosine similarity below which an example is not
+// worth showing: it shares little more than noise with the request.
+const minSimilarity = 0.1
+
+// Index finds the examples most similar to a request.
+type Index struct {
+	embedder Embedder
+	examples []Example
+	vectors  [][]float32
+}
+
+// NewIndex embeds examples for searching.
+func NewIndex(ctx context.Context, embedder Embedder, examples []Example) (*Index, error) {
+	texts := make([]string, len(examples))
+	for i, e := range examples {
+		texts[i] = e.Request
+	}
+	vectors, err := embedder.Embed(ctx, texts)
+	if err != nil {
+		return nil, fmt.Errorf("embed examples: %w", err)
+	}
+	return &Index{embedder: embedder, examples: examples, vectors: vectors}, nil
+}
+
+// Len returns the number of indexed examples.
+func (x *Index) Len() int {
+	return len(x.examples)
+}
+
+// Similar returns up to k examples most similar to request, best first.
+func (x *Index) Similar(ctx context.Context, request string, k int) ([]Example, error) {
+	vectors, err := x.embedder.Embed(ctx, []string{request})
+	if err != nil {
+		return nil, fmt.Errorf("embed request: %w", err)
+	}
+
+	type scored struct {
+		i          int
+		similarity float32
+	}
+	var matches []scored
+	for i, v := range x.vectors {
+		if s := cosine(vectors[0], v); s >= minSimilarity {
+			matches = append(matches, scored{i, s})
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].similarity > matches[b].similarity })
+	if len(matches) > k {
+		matches = matches[:k]
+	}
+
+	out := make([]Example, len(matches))
+	for i, m := range matches {
+		out[i] = x.examples[m.i]
+	}
+	return out, nil
+}
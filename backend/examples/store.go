@@ -0,0 +1,193 @@
+package examples
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// indexVersion is bumped when the index file format changes.
+const indexVersion = 1
+
+// Status describes the live index.
+type Status struct {
+	Examples  int       `json:"examples"`
+	Embedder  string    `json:"embedder"`
+	Path      string    `json:"path,omitempty"`
+	IndexedAt time.Time `json:"indexed_at"`
+}
+
+// Store keeps the example index current. It persists the embedded examples
+// to path, if set, so restarts reuse them while the examples and embedder
+// are unchanged, and rebuilds the index on Reindex. It is safe for
+// concurrent use.
+type Store struct {
+	path     string
+	embedder Embedder
+	load     func() ([]Example, error)
+
+	mu     sync.RWMutex
+	index  *Index
+	status Status
+}
+
+// indexFile is the on-disk form of an index.
+type indexFile struct {
+	Version     int            `json:"version"`
+	Fingerprint string         `json:"fingerprint"`
+	Embedder    string         `json:"embedder"`
+	IndexedAt   time.Time      `json:"indexed_at"`
+	Entries     []indexedEntry `json:"entries"`
+}
+
+type indexedEntry struct {
+	Example
+	Vector []float32 `json:"vector"`
+}
+
+// OpenStore loads the index from path if it matches the examples load
+// returns, and builds it otherwise. An empty path keeps the index in memory
+// only.
+func OpenStore(ctx context.Context, path string, embedder Embedder, load func() ([]Example, error)) (*Store, error) {
+	s := &Store{path: path, embedder: embedder, load: load}
+	examples, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		if index, status, err := s.read(examples); err == nil {
+			s.index, s.status = index, status
+			return s, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			slog.Info("Rebuilding example index", "path", path, "reason", err)
+		}
+	}
+	if err := s.build(ctx, examples); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Similar implements translate.ExampleRetriever over the live index.
+func (s *Store) Similar(ctx context.Context, request string, k int) ([]Example, error) {
+	s.mu.RLock()
+	index := s.index
+	s.mu.RUnlock()
+	return index.Similar(ctx, request, k)
+}
+
+// Status describes the live index.
+func (s *Store) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.status
+}
+
+// Reindex reloads and re-embeds the examples, replacing the live index once
+// the new one is ready. The old index stays live if anything fails.
+func (s *Store) Reindex(ctx context.Context) (Status, error) {
+	examples, err := s.load()
+	if err != nil {
+		return Status{}, err
+	}
+	if err := s.build(ctx, examples); err != nil {
+		return Status{}, err
+	}
+	return s.Status(), nil
+}
+
+func (s *Store) build(ctx context.Context, examples []Example) error {
+	index, err := NewIndex(ctx, s.embedder, examples)
+	if err != nil {
+		return err
+	}
+	status := Status{Examples: index.Len(), Embedder: embedderID(s.embedder), Path: s.path, IndexedAt: time.Now().UTC()}
+	if s.path != "" {
+		if err := s.write(index, status.IndexedAt); err != nil {
+			return fmt.Errorf("save example index: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	s.index, s.status = index, status
+	s.mu.Unlock()
+	return nil
+}
+
+// read loads the index file, failing if it was built from other examples or
+// by another embedder.
+func (s *Store) read(examples []Example) (*Index, Status, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, Status{}, err
+	}
+	var f indexFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, Status{}, err
+	}
+	if f.Version != indexVersion || f.Embedder != embedderID(s.embedder) || f.Fingerprint != fingerprint(examples) {
+		return nil, Status{}, errors.New("examples or embedder have changed")
+	}
+
+	index := &Index{embedder: s.embedder}
+	for _, e := range f.Entries {
+		index.examples = append(index.examples, e.Example)
+		index.vectors = append(index.vectors, e.Vector)
+	}
+	return index, Status{Examples: index.Len(), Embedder: f.Embedder, Path: s.path, IndexedAt: f.IndexedAt}, nil
+}
+
+// write saves index to a temporary file and renames it into place, so a
+// crash never leaves a truncated index behind.
+func (s *Store) write(index *Index, indexedAt time.Time) error {
+	f := indexFile{
+		Version:     indexVersion,
+		Fingerprint: fingerprint(index.examples),
+		Embedder:    embedderID(s.embedder),
+		IndexedAt:   indexedAt,
+	}
+	for i, e := range index.examples {
+		f.Entries = append(f.Entries, indexedEntry{Example: e, Vector: index.vectors[i]})
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// embedderID identifies an embedder and its settings, since vectors from
+// different embedders can't be compared.
+func embedderID(e Embedder) string {
+	return fmt.Sprintf("%T%+v", e, e)
+}
+
+func fingerprint(examples []Example) string {
+	h := sha256.New()
+	for _, e := range examples {
+		fmt.Fprintf(h, "%q %q\n", e.Request, e.Query)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
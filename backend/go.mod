@@ -2,4 +2,16 @@ module github.com/nlsearch/backend
 
 go 1.23
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require (
+	github.com/alecthomas/chroma/v2 v2.20.0
+	github.com/joho/godotenv v1.5.1
+	github.com/microcosm-cc/bluemonday v1.0.27
+	github.com/yuin/goldmark v1.8.6
+)
+
+require (
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/dlclark/regexp2 v1.11.5 // indirect
+	github.com/gorilla/css v1.0.1 // indirect
+	golang.org/x/net v0.26.0 // indirect
+)
@@ -0,0 +1,73 @@
+// Package highlight renders code as HTML with syntax highlighting, so
+// clients can show snippets and search results without bundling a
+// highlighter, and all of them look alike. The HTML is styled with classes,
+// so a Content-Security-Policy needn't allow inline styles; pages showing it
+// include the stylesheet CSS returns.
+package highlight
+
+import (
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// Style is the color scheme of the HTML.
+const Style = "github"
+
+// Language returns the name of the language of the file at path, such as
+// "Go", or "" if it isn't recognized.
+func Language(path string) string {
+	if lexer := lexers.Match(path); lexer != nil {
+		return lexer.Config().Name
+	}
+	return ""
+}
+
+// Block returns code as a <pre> block highlighted as language, a name or
+// alias such as "Go" or "go", or as plain text if it is unknown. With
+// firstLine above 0 the lines are numbered from it.
+func Block(code, language string, firstLine int) (string, error) {
+	opts := []html.Option{html.WithClasses(true), html.TabWidth(4)}
+	if firstLine > 0 {
+		opts = append(opts, html.WithLineNumbers(true), html.BaseLineNumber(firstLine))
+	}
+	return format(code, language, opts...)
+}
+
+// Line returns one line of code highlighted as language, in a <span>
+// rather than a <pre>, for lines shown apart from the rest of their file.
+func Line(code, language string) (string, error) {
+	line, err := format(code, language, html.WithClasses(true), html.PreventSurroundingPre(true))
+	if err != nil {
+		return "", err
+	}
+	return `<span class="chroma">` + line + "</span>", nil
+}
+
+// CSS returns the stylesheet for the classes of the HTML Block and Line
+// return, in Style.
+func CSS() string {
+	var b strings.Builder
+	// Writing to a strings.Builder can't fail.
+	html.New(html.WithClasses(true), html.WithLineNumbers(true), html.TabWidth(4)).WriteCSS(&b, styles.Get(Style))
+	return b.String()
+}
+
+func format(code, language string, opts ...html.Option) (string, error) {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := html.New(opts...).Format(&b, styles.Get(Style), iterator); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,299 @@
+// Package leader elects one replica of a Kubernetes deployment to do work
+// that must only be done once, using a coordination.k8s.io Lease the way
+// client-go's leader election does, with nothing but the API server's REST
+// API and the pod's service account.
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account
+// credentials.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// The timings client-go uses by default: a lease lasts 15 seconds, its
+// holder renews it every 2 seconds and gives up leading if it hasn't managed
+// to for 10, and the others check every 2 seconds whether it has lapsed.
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// microTime is the format of the Lease's timestamps.
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// ErrNotInCluster is returned by InCluster outside a Kubernetes pod.
+var ErrNotInCluster = errors.New("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST is unset")
+
+// Elector campaigns for a Lease and reports whether this replica holds it.
+type Elector struct {
+	client    *http.Client
+	leaseURL  string
+	tokenFile string
+	lease     string
+	namespace string
+	identity  string
+
+	leading atomic.Bool
+}
+
+// InCluster returns an Elector for the Lease named lease in the pod's
+// namespace, talking to the API server with the pod's service account,
+// which needs permission to get, create and update it. identity names this
+// replica in the Lease; it should be unique, such as the pod name.
+func InCluster(lease, identity string) (*Elector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return nil, ErrNotInCluster
+	}
+	if port == "" {
+		port = "443"
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("read the pod's namespace: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read the cluster's CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the cluster's CA file")
+	}
+	ns := strings.TrimSpace(string(namespace))
+	return &Elector{
+		client: &http.Client{
+			Timeout:   renewDeadline / 2,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		leaseURL:  fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/", net.JoinHostPort(host, port), ns),
+		tokenFile: serviceAccountDir + "/token",
+		lease:     lease,
+		namespace: ns,
+		identity:  identity,
+	}, nil
+}
+
+// Leading reports whether this replica holds the Lease.
+func (e *Elector) Leading() bool {
+	return e.leading.Load()
+}
+
+// Run campaigns for the Lease until ctx is done, renewing it while it is
+// held, and then gives it up so another replica can take over at once.
+func (e *Elector) Run(ctx context.Context) {
+	lastRenew := time.Time{}
+	ticker := time.NewTicker(retryPeriod)
+	defer ticker.Stop()
+	for {
+		acquired, err := e.tryAcquire(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			slog.Warn("Error renewing leader lease", "lease", e.lease, "err", err)
+		case acquired:
+			lastRenew = time.Now()
+		}
+		// Stop leading once the lease can't be renewed for a while, before
+		// it lapses and another replica takes over.
+		leading := acquired || e.Leading() && time.Since(lastRenew) < renewDeadline
+		if leading != e.Leading() {
+			e.leading.Store(leading)
+			if leading {
+				slog.Info("Became the leader", "lease", e.lease, "identity", e.identity)
+			} else {
+				slog.Info("Stopped being the leader", "lease", e.lease, "identity", e.identity)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if e.Leading() {
+				e.leading.Store(false)
+				e.release()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lease is the part of a coordination.k8s.io/v1 Lease the Elector uses.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string  `json:"acquireTime,omitempty"`
+	RenewTime            string  `json:"renewTime,omitempty"`
+	LeaseTransitions     int     `json:"leaseTransitions,omitempty"`
+}
+
+// tryAcquire creates the Lease, renews it if this replica holds it, or
+// takes it over if its holder let it lapse. It reports whether this
+// replica holds it afterwards.
+func (e *Elector) tryAcquire(ctx context.Context) (bool, error) {
+	now := time.Now()
+	current, err := e.get(ctx)
+	if errors.Is(err, errNotFound) {
+		l := e.newLease(now)
+		l.Spec.AcquireTime = now.UTC().Format(microTime)
+		return e.write(ctx, http.MethodPost, e.leaseURL, l)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if holder != "" && holder != e.identity && !expired(current.Spec, now) {
+		return false, nil
+	}
+	l := e.newLease(now)
+	l.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	l.Spec.AcquireTime = current.Spec.AcquireTime
+	l.Spec.LeaseTransitions = current.Spec.LeaseTransitions
+	if holder != e.identity {
+		l.Spec.AcquireTime = now.UTC().Format(microTime)
+		l.Spec.LeaseTransitions++
+	}
+	// The resourceVersion makes the update fail if another replica got
+	// there first.
+	return e.write(ctx, http.MethodPut, e.leaseURL+e.lease, l)
+}
+
+// release gives up the Lease, leaving it expired so the next replica to
+// check takes it over.
+func (e *Elector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), retryPeriod)
+	defer cancel()
+	current, err := e.get(ctx)
+	if err != nil || current.Spec.HolderIdentity == nil || *current.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l := e.newLease(time.Now())
+	none, second := "", 1
+	l.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	l.Spec.HolderIdentity, l.Spec.LeaseDurationSeconds = &none, &second
+	l.Spec.LeaseTransitions = current.Spec.LeaseTransitions
+	if _, err := e.write(ctx, http.MethodPut, e.leaseURL+e.lease, l); err != nil {
+		slog.Warn("Error releasing leader lease", "lease", e.lease, "err", err)
+	}
+}
+
+func (e *Elector) newLease(now time.Time) lease {
+	identity, seconds := e.identity, int(leaseDuration.Seconds())
+	return lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: e.lease, Namespace: e.namespace},
+		Spec: leaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            now.UTC().Format(microTime),
+		},
+	}
+}
+
+// expired reports whether the lease's holder has failed to renew it in
+// time.
+func expired(spec leaseSpec, now time.Time) bool {
+	renewed, err := time.Parse(microTime, spec.RenewTime)
+	if err != nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+var (
+	errNotFound = errors.New("lease not found")
+	errConflict = errors.New("lease changed concurrently")
+)
+
+func (e *Elector) get(ctx context.Context) (lease, error) {
+	var l lease
+	resp, err := e.do(ctx, http.MethodGet, e.leaseURL+e.lease, nil)
+	if err != nil {
+		return l, err
+	}
+	defer resp.Body.Close()
+	return l, json.NewDecoder(resp.Body).Decode(&l)
+}
+
+// write creates or updates the Lease. Losing a race to another replica
+// isn't an error; it just means this one doesn't hold the Lease.
+func (e *Elector) write(ctx context.Context, method, url string, l lease) (bool, error) {
+	body, err := json.Marshal(l)
+	if err != nil {
+		return false, err
+	}
+	resp, err := e.do(ctx, method, url, body)
+	if errors.Is(err, errConflict) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (e *Elector) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	// Service account tokens are rotated, so read it afresh each time.
+	token, err := os.ReadFile(e.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("read the service account token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errNotFound
+	case resp.StatusCode == http.StatusConflict:
+		resp.Body.Close()
+		return nil, errConflict
+	case resp.StatusCode >= 300:
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(data))
+	}
+	return resp, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/redact"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setupLogging sends the log output of every package, including the log
+// package, through a handler in config.LogFormat, filtered at
+// config.LogLevel, that masks credentials, config's secrets among them, and
+// tags records logged with a request's context with its ID. The returned
+// level can be changed while running.
+func setupLogging(config Config) *slog.LevelVar {
+	redact.Secrets(config.SourcegraphToken, config.ExtensionSecret, config.AnalyticsSalt)
+	for key := range config.APIKeys {
+		redact.Secrets(key)
+	}
+	for key := range config.AdminKeys {
+		redact.Secrets(key)
+	}
+
+	level := new(slog.LevelVar)
+	level.Set(config.LogLevel)
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if config.LogFormat == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(middleware.LogHandler(redact.Handler(handler))))
+	return level
+}
+
+// parseLogLevel parses debug, info, warn or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid LOG_LEVEL: %q is not debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// logTransport logs each request to Sourcegraph at debug level: its method,
+// path, status, size and duration, and the ID of the API request it was made
+// for. Query strings, headers and bodies are never logged, as they can carry
+// tokens and user content.
+type logTransport struct {
+	base http.RoundTripper
+}
+
+func (t logTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return t.base.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	attrs := []any{
+		"method", req.Method,
+		"host", req.URL.Host,
+		"path", req.URL.Path,
+		"duration_ms", time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		slog.DebugContext(ctx, "Upstream request failed", append(attrs, "err", err)...)
+		return nil, err
+	}
+	attrs = append(attrs, "status", resp.StatusCode, "bytes", resp.ContentLength, "content_type", resp.Header.Get("Content-Type"))
+	slog.DebugContext(ctx, "Upstream request", attrs...)
+	return resp, nil
+}
+
+// traceIDHeader carries the ID of the API request each request to
+// Sourcegraph is made for, so the instance's admins can match their logs to
+// ours.
+const traceIDHeader = "X-Trace-ID"
+
+// traceTransport sends the request ID in each request's context to
+// Sourcegraph as X-Trace-ID.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := middleware.RequestIDFrom(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(traceIDHeader, id)
+	}
+	return t.base.RoundTrip(req)
+}
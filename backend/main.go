@@ -2,311 +2,394 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/joho/godotenv"
+	// Embeds the time zone database, so DEFAULT_TIMEZONE and the timezone
+	// of requests resolve on hosts and images without one.
+	_ "time/tzdata"
+
+	"github.com/nlsearch/backend/analytics"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/errreport"
+	"github.com/nlsearch/backend/leader"
+	"github.com/nlsearch/backend/metrics"
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/redis"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/server"
+	"github.com/nlsearch/backend/sourcegraph"
+	"github.com/nlsearch/backend/translate"
 )
 
-const clientIdentifier = "nlsearch 1.0.0"
-
-type Config struct {
-	SourcegraphURL   string
-	SourcegraphToken string
-	Port             string
-}
-
-type DeepSearchClient struct {
-	baseURL     string
-	accessToken string
-	httpClient  *http.Client
-}
-
-type CreateConversationRequest struct {
-	Question string `json:"question"`
-}
-
-type Question struct {
-	ID             int                      `json:"id"`
-	ConversationID int                      `json:"conversation_id"`
-	Question       string                   `json:"question"`
-	Status         string                   `json:"status"`
-	Answer         string                   `json:"answer,omitempty"`
-	Sources        []map[string]interface{} `json:"sources,omitempty"`
-	Stats          map[string]interface{}   `json:"stats"`
-}
-
-type Conversation struct {
-	ID        int        `json:"id"`
-	Questions []Question `json:"questions"`
-}
-
-type QueryRequest struct {
-	Query string `json:"query"`
-}
-
-type QueryResponse struct {
-	Answer  string                   `json:"answer"`
-	Sources []map[string]interface{} `json:"sources,omitempty"`
-	Error   string                   `json:"error,omitempty"`
-}
-
-func NewDeepSearchClient(baseURL, accessToken string) *DeepSearchClient {
-	return &DeepSearchClient{
-		baseURL:     strings.TrimRight(baseURL, "/"),
-		accessToken: accessToken,
-		httpClient:  &http.Client{Timeout: 30 * time.Second},
+func main() {
+	if err := newRootCommand().execute(os.Args[1:]); err != nil {
+		log.Fatal(err)
 	}
 }
 
-func (c *DeepSearchClient) createConversation(ctx context.Context, question string) (*Conversation, error) {
-	reqBody := CreateConversationRequest{Question: question}
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("marshal request: %w", err)
+// runServer serves the API until SIGINT or SIGTERM, then shuts down
+// gracefully within config.ShutdownTimeout. After SIGTERM, which is how
+// Kubernetes stops a pod, it first reports itself draining for
+// config.DrainDelay while still serving, so load balancers have stopped
+// routing to it by the time it stops listening. A second signal exits at
+// once.
+func runServer(config Config, logLevel *slog.LevelVar) error {
+	var elector *leader.Elector
+	if config.LeaderLease != "" {
+		identity := os.Getenv("POD_NAME")
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		var err error
+		if elector, err = leader.InCluster(config.LeaderLease, identity); err != nil {
+			return fmt.Errorf("LEADER_ELECTION_LEASE: %w", err)
+		}
 	}
-
-	apiURL := fmt.Sprintf("%s/.api/deepsearch/v1", c.baseURL)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(string(jsonData)))
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+	var lead server.Leader
+	if elector != nil {
+		// As with the stores, a nil elector must not end up in the
+		// interface.
+		lead = elector
 	}
-
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", c.accessToken))
-	req.Header.Set("X-Requested-With", clientIdentifier)
-
-	resp, err := c.httpClient.Do(req)
+	srv, err := newServer(config, logLevel, lead)
 	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	electorDone := make(chan struct{})
+	go func() {
+		defer close(electorDone)
+		if elector != nil {
+			// It gives up the lease when stopped, so another replica
+			// takes over at once.
+			elector.Run(background)
+		}
+	}()
+	go srv.RunJanitor(background, janitorInterval)
+	go watchSettings(background, config, logLevel)
+	if err := srv.ResumeJobs(background); err != nil {
+		return fmt.Errorf("resume jobs: %w", err)
 	}
-
-	var conv Conversation
-	if err := json.NewDecoder(resp.Body).Decode(&conv); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	workersDone := make(chan struct{})
+	if config.QueueURL != "" {
+		go func() {
+			defer close(workersDone)
+			srv.RunWorkers(background, config.QueueWorkers)
+		}()
+	} else {
+		close(workersDone)
 	}
-
-	return &conv, nil
-}
-
-func (c *DeepSearchClient) getConversation(ctx context.Context, conversationID int) (*Conversation, error) {
-	apiURL := fmt.Sprintf("%s/.api/deepsearch/v1/%d", c.baseURL, conversationID)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("create request: %w", err)
+	if config.DebugAddr != "" {
+		go func() {
+			slog.Info("Serving pprof and expvar", "url", "http://"+config.DebugAddr+"/debug/")
+			if err := http.ListenAndServe(config.DebugAddr, debugHandler()); err != nil {
+				slog.Error("Debug listener stopped", "err", err)
+			}
+		}()
 	}
 
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", c.accessToken))
-	req.Header.Set("X-Requested-With", clientIdentifier)
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("send request: %w", err)
+	slog.Info("Server starting", "url", "http://localhost:"+config.Port)
+	slog.Info("Using Sourcegraph instance", "url", config.SourcegraphURL)
+	if len(config.ExtensionOrigins) > 0 {
+		slog.Info("Allowing browser extension origins", "origins", strings.Join(config.ExtensionOrigins, ", "))
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	if config.UpstreamRPS > 0 {
+		slog.Info("Limiting requests to Sourcegraph", "rps", config.UpstreamRPS, "burst", config.UpstreamBurst)
+	}
+	if len(config.APIKeys) > 0 {
+		slog.Info("API key authentication enabled", "keys", len(config.APIKeys))
+	}
+	if config.IPFilter.Enabled() {
+		slog.Info("Filtering client addresses", "allowed", len(config.IPFilter.Allow), "denied", len(config.IPFilter.Deny), "proxies", len(config.IPFilter.Proxies))
+	}
+	if len(config.ProxyAuth.Trusted) > 0 {
+		slog.Info("Accepting users named by trusted proxies", "networks", len(config.ProxyAuth.Trusted))
+	}
+	if len(config.AdminKeys) > 0 {
+		slog.Info("Admin API enabled", "keys", len(config.AdminKeys))
+	}
+	if config.Retention > 0 {
+		slog.Info("Pruning history and tracked conversations", "retention_days", int(config.Retention.Hours()/24))
+	}
+	if config.RateLimitRPS > 0 {
+		slog.Info("Rate limiting API requests per client", "rps", config.RateLimitRPS, "burst", config.RateLimitBurst)
+	}
+	if len(config.TenantLimits.Tenants) > 0 {
+		slog.Info("Applying per-tenant limits", "tenants", len(config.TenantLimits.Tenants))
+	}
+	if len(config.NoStoreTenants) > 0 {
+		slog.Info("Not storing requests of tenants", "tenants", strings.Join(config.NoStoreTenants, ", "))
+	}
+	if !config.QueryPolicies.IsZero() {
+		slog.Info("Enforcing query policies", "tenants", len(config.QueryPolicies.Tenants))
+	}
+	if config.StateURL != "" {
+		slog.Info("Keeping caches, history and rate limits in Redis")
+	}
+	if config.QueueURL != "" {
+		slog.Info("Queueing jobs in Redis", "workers", config.QueueWorkers)
+	}
+	if elector != nil {
+		slog.Info("Electing a leader to prune shared state", "lease", config.LeaderLease)
 	}
 
-	var conv Conversation
-	if err := json.NewDecoder(resp.Body).Decode(&conv); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	httpServer := &http.Server{Addr: ":" + config.Port, Handler: srv.Handler()}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- httpServer.ListenAndServe() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var sig os.Signal
+	select {
+	case err := <-serveErr:
+		return err
+	case sig = <-signals:
 	}
+	// Let another signal kill the process.
+	signal.Stop(signals)
+	deadline := time.Now().Add(config.ShutdownTimeout)
+	srv.Drain()
+	if sig == syscall.SIGTERM && config.DrainDelay > 0 {
+		slog.Info("Server draining", "signal", sig.String(), "delay_seconds", int(config.DrainDelay.Seconds()))
+		time.Sleep(config.DrainDelay)
+	}
+	slog.Info("Server stopping; finishing in-flight requests and jobs", "signal", sig.String())
 
-	return &conv, nil
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Warn("Shutdown timed out; closing open connections", "err", err)
+		httpServer.Close()
+	}
+	stopBackground()
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		slog.Warn("Shutdown timed out; queued jobs still running will be run again by another worker")
+	}
+	select {
+	case <-electorDone:
+	case <-ctx.Done():
+	}
+	slog.Info("Server stopped")
+	return nil
 }
 
-func (c *DeepSearchClient) waitForCompletion(ctx context.Context, conversationID int, maxWait time.Duration) (*Question, error) {
-	deadline := time.Now().Add(maxWait)
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+// runWorker runs queued jobs without serving HTTP, until SIGINT or SIGTERM.
+// It then stops taking jobs and finishes those it is running, for up to
+// config.ShutdownTimeout; a second signal exits at once. Jobs it doesn't
+// finish are run again by another worker.
+func runWorker(config Config, logLevel *slog.LevelVar) error {
+	if config.QueueURL == "" {
+		return fmt.Errorf("QUEUE_URL is required to run a worker")
+	}
+	if config.QueueWorkers == 0 {
+		return fmt.Errorf("QUEUE_WORKERS must be positive to run a worker")
+	}
+	srv, err := newServer(config, logLevel, nil)
+	if err != nil {
+		return err
+	}
 
-	for {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		// Let another signal kill the process.
+		stop()
+		slog.Info("Worker stopping; finishing running jobs")
 		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-ticker.C:
-			if time.Now().After(deadline) {
-				return nil, fmt.Errorf("timeout waiting for response")
-			}
-
-			conv, err := c.getConversation(ctx, conversationID)
-			if err != nil {
-				return nil, err
-			}
-
-			if len(conv.Questions) > 0 {
-				q := conv.Questions[len(conv.Questions)-1]
-				switch q.Status {
-				case "completed":
-					return &q, nil
-				case "failed":
-					return nil, fmt.Errorf("question processing failed")
-				case "cancelled":
-					return nil, fmt.Errorf("question was cancelled")
-				}
-			}
+		case <-done:
+		case <-time.After(config.ShutdownTimeout):
+			slog.Warn("Shutdown timed out; running jobs will be run again by another worker")
+			os.Exit(1)
 		}
-	}
+	}()
+	go watchSettings(ctx, config, logLevel)
+	slog.Info("Worker starting", "workers", config.QueueWorkers)
+	slog.Info("Using Sourcegraph instance", "url", config.SourcegraphURL)
+	srv.RunWorkers(ctx, config.QueueWorkers)
+	close(done)
+	slog.Info("Worker stopped")
+	return nil
 }
 
-func enableCORS(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+// newServer builds the server and the stores, caches and clients it uses
+// from config. lead, if not nil, says whether this replica is the leader.
+func newServer(config Config, logLevel *slog.LevelVar, lead server.Leader) (*server.Server, error) {
+	var state *redis.Client
+	if config.StateURL != "" {
+		var err error
+		if state, err = redis.Open(config.StateURL); err != nil {
+			return nil, fmt.Errorf("invalid STATE_URL: %w", err)
 		}
-
-		next(w, r)
 	}
-}
 
-func main() {
-	godotenv.Load("../.env")
-	
-	config := Config{
-		SourcegraphURL:   getEnv("SOURCEGRAPH_URL", "https://sourcegraph.com"),
-		SourcegraphToken: getEnv("SOURCEGRAPH_TOKEN", ""),
-		Port:             getEnv("PORT", "8080"),
+	var cache server.Cache
+	switch {
+	case config.CacheTTL > 0 && state != nil:
+		cache = server.NewRedisCache(state, config.CacheTTL)
+	case config.CacheTTL > 0:
+		cache = server.NewMemoryCache(translationCacheSize, config.CacheTTL)
 	}
 
-	if config.SourcegraphToken == "" {
-		log.Fatal("SOURCEGRAPH_TOKEN environment variable is required")
+	var failureCache server.FailureCache
+	switch {
+	case config.FailureTTL > 0 && state != nil:
+		failureCache = server.NewRedisFailureCache(state, config.FailureTTL)
+	case config.FailureTTL > 0:
+		failureCache = server.NewMemoryFailureCache(translationCacheSize, config.FailureTTL)
 	}
 
-	parsedURL, err := url.Parse(config.SourcegraphURL)
-	if err != nil {
-		log.Fatalf("Invalid SOURCEGRAPH_URL: %v", err)
+	var searchCache server.SearchCache
+	switch {
+	case config.SearchCacheTTL > 0 && state != nil:
+		searchCache = server.NewRedisSearchCache(state, config.SearchCacheTTL)
+	case config.SearchCacheTTL > 0:
+		searchCache = server.NewMemorySearchCache(searchCacheSize, config.SearchCacheTTL)
 	}
-	config.SourcegraphURL = fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host)
-
-	client := NewDeepSearchClient(config.SourcegraphURL, config.SourcegraphToken)
-
-	http.HandleFunc("/api/query", enableCORS(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
 
-		var req QueryRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			json.NewEncoder(w).Encode(QueryResponse{Error: "Invalid request body"})
-			return
-		}
+	// Keep nil stores out of the interfaces, where they wouldn't compare
+	// equal to nil.
+	var history server.Store
+	var limiter middleware.Limiter
+	var quota middleware.Quota
+	if state != nil {
+		history = server.NewRedisStore(state, storedHistory)
+		limiter = server.NewRedisLimiter(state)
+		quota = server.NewRedisQuota(state)
+	}
 
-		if req.Query == "" {
-			json.NewEncoder(w).Encode(QueryResponse{Error: "Query is required"})
-			return
+	var offline server.Translator
+	if config.OfflineFallback {
+		rules := translate.NewRules().WithRepoScope(config.RepoScope).WithDefaultFilters(config.DefaultFilters)
+		if config.Rewrites != nil {
+			rules = rules.WithRewriter(config.Rewrites)
 		}
+		offline = rules
+	}
 
-		ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
-		defer cancel()
-
-		prompt := fmt.Sprintf(`Convert this natural language request into a valid Sourcegraph search query. 
-
-For guidance on proper syntax, refer to these files in github.com/sourcegraph/sourcegraph:
-- internal/search/query/parser.go
-- internal/search/query/validate.go
-- internal/search/query/parser_test.go
-- internal/search/query/validate_test.go
-- client/branded/src/search-ui/components/QueryExamples.constants.ts
-
-CRITICAL: Your response must be ONLY the search query itself. No explanations, no markdown, no code blocks, no additional text. Just the raw query string.
-
-Request: %s`, req.Query)
-		conv, err := client.createConversation(ctx, prompt)
-		if err != nil {
-			log.Printf("Error creating conversation: %v", err)
-			json.NewEncoder(w).Encode(QueryResponse{Error: fmt.Sprintf("Failed to create conversation: %v", err)})
-			return
-		}
+	// As above, nil stores must not end up in the interfaces.
+	exampleStore, err := newExampleStore(config)
+	if err != nil {
+		return nil, err
+	}
+	var retriever translate.ExampleRetriever
+	var adminExamples server.ExampleStore
+	if exampleStore != nil {
+		retriever, adminExamples = exampleStore, exampleStore
+	}
+	prompt, err := newPrompt(config)
+	if err != nil {
+		return nil, err
+	}
+	watchConfigFiles(context.Background(), config, prompt, exampleStore)
 
-		question, err := client.waitForCompletion(ctx, conv.ID, 60*time.Second)
+	// As above, a nil client must not end up in the interface.
+	var reporter server.ErrorReporter
+	if config.SentryDSN != "" {
+		client, err := errreport.New(config.SentryDSN, config.SentryEnvironment, strings.TrimPrefix(deepsearch.ClientIdentifier, "nlsearch "))
 		if err != nil {
-			log.Printf("Error waiting for completion: %v", err)
-			json.NewEncoder(w).Encode(QueryResponse{Error: fmt.Sprintf("Failed to get response: %v", err)})
-			return
+			return nil, err
 		}
+		reporter = client
+	}
 
-		query := extractQuery(question.Answer)
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(QueryResponse{
-			Answer:  query,
-			Sources: question.Sources,
-		})
-	}))
-
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
-
-	fs := http.FileServer(http.Dir("../frontend"))
-	http.Handle("/", fs)
-
-	log.Printf("Server starting on http://localhost:%s", config.Port)
-	log.Printf("Using Sourcegraph instance: %s", config.SourcegraphURL)
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
-		log.Fatal(err)
+	var recorder server.Analytics
+	if config.AnalyticsSalt != "" {
+		recorder = analytics.New(metrics.Default, config.AnalyticsSalt)
+		slog.Info("Recording anonymized usage metrics")
 	}
-}
 
-func extractQuery(answer string) string {
-	lines := strings.Split(strings.TrimSpace(answer), "\n")
-	
-	for i := len(lines) - 1; i >= 0; i-- {
-		line := strings.TrimSpace(lines[i])
-		if line == "" {
-			continue
-		}
-		if strings.Contains(line, ":") && !strings.HasPrefix(line, "For ") && !strings.HasPrefix(line, "Based ") {
-			line = strings.Trim(line, "`")
-			if (strings.HasPrefix(line, "\"") && strings.HasSuffix(line, "\"")) ||
-			   (strings.HasPrefix(line, "'") && strings.HasSuffix(line, "'")) {
-				line = line[1 : len(line)-1]
-			}
-			return line
+	// As above, a nil store must not end up in the interface.
+	var jobs server.JobStore
+	if config.JobsFile != "" {
+		if jobs, err = server.OpenFileJobStore(config.JobsFile, storedJobs); err != nil {
+			return nil, fmt.Errorf("invalid JOBS_FILE: %w", err)
 		}
 	}
-	
-	if len(lines) > 0 {
-		line := strings.TrimSpace(lines[len(lines)-1])
-		line = strings.Trim(line, "`")
-		if (strings.HasPrefix(line, "\"") && strings.HasSuffix(line, "\"")) ||
-		   (strings.HasPrefix(line, "'") && strings.HasSuffix(line, "'")) {
-			line = line[1 : len(line)-1]
+	var queue server.JobQueue
+	if config.QueueURL != "" {
+		client, err := redis.Open(config.QueueURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUEUE_URL: %w", err)
 		}
-		return line
+		jobs, queue = server.NewRedisJobStore(client), server.NewRedisJobQueue(client, config.QueueVisibility)
 	}
-	
-	return answer
-}
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	up := newUpstream(config)
+	// Only Deep Search looks at the code, so only it answers questions.
+	var questions translate.Backend
+	if slices.Contains(config.Providers, "deepsearch") {
+		questions = providerFactories["deepsearch"](config, up)
+	}
+	sg := sourcegraph.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(up.transport).WithAuth(config.UpstreamAuth)
+	srv := server.New(server.Options{
+		Translator:        newTranslator(config, up, prompt, retriever),
+		OfflineTranslator: offline,
+		ClarifyBelow:      config.ClarifyBelow,
+		Questions:         questions,
+		SourcegraphURL:    config.SourcegraphURL,
+		Revisions:         sg,
+		Snippets:          sg,
+		Searcher:          search.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(up.transport).WithAuth(config.UpstreamAuth),
+		Store:             history,
+		Cache:             cache,
+		Jobs:              jobs,
+		JobQueue:          queue,
+		JobVisibility:     config.QueueVisibility,
+		Retention:         config.Retention,
+		Leader:            lead,
+		FailureCache:      failureCache,
+		SearchCache:       searchCache,
+		DefaultTimeout:    config.DefaultTimeout,
+		MaxTimeout:        config.MaxTimeout,
+		MaxResults:        config.MaxResults,
+		StreamKeepAlive:   config.StreamKeepAlive,
+		ExtensionOrigins:  config.ExtensionOrigins,
+		ExtensionSecret:   config.ExtensionSecret,
+		APIKeys:           config.APIKeys,
+		AdminKeys:         config.AdminKeys,
+		ProxyAuth:         config.ProxyAuth,
+		LogSampler:        config.LogSampler,
+		LogLevel:          logLevel,
+		ErrorReporter:     reporter,
+		Analytics:         recorder,
+		Health:            config.Health,
+		Examples:          adminExamples,
+		Conversations:     up.conversations,
+		DeepSearch:        up.deepSearch(config),
+		RateLimitRPS:      config.RateLimitRPS,
+		RateLimitBurst:    config.RateLimitBurst,
+		SecurityHeaders:   config.SecurityHeaders,
+		IPFilter:          config.IPFilter,
+		TenantLimits:      config.TenantLimits,
+		NoStoreTenants:    config.NoStoreTenants,
+		RequestSecrets:    config.RequestSecrets,
+		OwnCacheTenants:   config.Rewrites.Tenants(),
+		QueryPolicies:     config.QueryPolicies,
+		Timezone:          config.Timezone,
+		RateLimiter:       limiter,
+		Quota:             quota,
+		FrontendDir:       config.FrontendDir,
+	})
+
+	if reporter != nil {
+		slog.Info("Reporting errors to Sentry", "environment", config.SentryEnvironment)
+	}
+	if exampleStore != nil {
+		status := exampleStore.Status()
+		slog.Info("Prompting with few-shot examples", "per_prompt", config.FewShotExamples, "examples", status.Examples)
 	}
-	return defaultValue
+	return srv, nil
 }
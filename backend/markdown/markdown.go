@@ -0,0 +1,65 @@
+// Package markdown renders Markdown, such as Deep Search's answers, as HTML
+// that is safe to show as it is: everything that could run script or load
+// content from elsewhere is removed, for clients such as chat bots and
+// email digests that can't sanitize it themselves.
+package markdown
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+var (
+	renderer = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+	// policy allows what Markdown produces, with links opening elsewhere
+	// and marked nofollow, and keeps the language of code blocks.
+	policy = func() *bluemonday.Policy {
+		p := bluemonday.UGCPolicy()
+		p.AddTargetBlankToFullyQualifiedLinks(true)
+		p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#.-]+$`)).OnElements("code")
+		return p
+	}()
+)
+
+// HTML renders source as sanitized HTML. Links and images relative to the
+// root, such as /github.com/org/repo/-/blob/main.go, are made absolute
+// against baseURL, since the HTML is shown away from the instance.
+func HTML(source, baseURL string) (string, error) {
+	src := []byte(source)
+	doc := renderer.Parser().Parse(text.NewReader(src))
+	if baseURL = strings.TrimSuffix(baseURL, "/"); baseURL != "" {
+		ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+			if !entering {
+				return ast.WalkContinue, nil
+			}
+			switch n := n.(type) {
+			case *ast.Link:
+				n.Destination = absolute(n.Destination, baseURL)
+			case *ast.Image:
+				n.Destination = absolute(n.Destination, baseURL)
+			}
+			return ast.WalkContinue, nil
+		})
+	}
+	var b bytes.Buffer
+	if err := renderer.Renderer().Render(&b, src, doc); err != nil {
+		return "", err
+	}
+	return policy.Sanitize(b.String()), nil
+}
+
+// absolute prefixes baseURL to dest if it is relative to the root.
+func absolute(dest []byte, baseURL string) []byte {
+	if bytes.HasPrefix(dest, []byte("/")) && !bytes.HasPrefix(dest, []byte("//")) {
+		return append([]byte(baseURL), dest...)
+	}
+	return dest
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	// Name identifies the caller in logs and rate limits, e.g. the API key's
+	// name or an extension origin.
+	Name string
+	// Method records how the caller authenticated, e.g. "api-key".
+	Method string
+	// Roles lists what the caller may do, such as RoleUser and RoleAdmin.
+	Roles []string
+}
+
+// Roles checked by RequireRole.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// HasRole reports whether the identity has role.
+func (id *Identity) HasRole(role string) bool {
+	return slices.Contains(id.Roles, role)
+}
+
+// Authenticator inspects a request for credentials. It returns a nil identity
+// and a nil error when the request carries none it recognizes, so the next
+// authenticator can try; a non-nil error rejects the request outright.
+type Authenticator func(r *http.Request) (*Identity, error)
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id as Auth stores it, for
+// work done on a caller's behalf outside their request.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity stored by Auth, if any.
+func IdentityFrom(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// Auth runs authenticators in order and stores the first identity found in
+// the request context. When required is set, requests without one are
+// rejected with 401.
+func Auth(required bool, authenticators ...Authenticator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticate := range authenticators {
+				id, err := authenticate(r)
+				if err != nil {
+					writeError(w, r, apierror.New(apierror.Unauthorized, err.Error()))
+					return
+				}
+				if id != nil {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+					return
+				}
+			}
+			if required {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nlsearch"`)
+				writeError(w, r, apierror.New(apierror.Unauthorized, "Authentication required"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole rejects requests whose identity, stored by Auth, lacks role:
+// with 401 when there is no identity, and 403 otherwise. It must come after
+// Auth in the chain.
+func RequireRole(role string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, ok := IdentityFrom(r.Context())
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nlsearch"`)
+				writeError(w, r, apierror.New(apierror.Unauthorized, "Authentication required"))
+				return
+			}
+			if !id.HasRole(role) {
+				writeError(w, r, apierror.New(apierror.Forbidden, fmt.Sprintf("This requires the %s role", role)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIKey is the caller an API key authenticates as.
+type APIKey struct {
+	Name  string
+	Roles []string
+}
+
+// APIKeys authenticates requests carrying one of keys in an Authorization:
+// Bearer or X-API-Key header. With no keys configured it leaves every
+// request to the other authenticators.
+func APIKeys(keys map[string]APIKey) Authenticator {
+	return func(r *http.Request) (*Identity, error) {
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		presented := r.Header.Get("X-API-Key")
+		if presented == "" {
+			presented = BearerToken(r)
+		}
+		if presented == "" {
+			return nil, nil
+		}
+		for key, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(presented), []byte(key)) == 1 {
+				return &Identity{Name: k.Name, Method: "api-key", Roles: k.Roles}, nil
+			}
+		}
+		return nil, errors.New("Invalid API key")
+	}
+}
+
+// BearerToken returns the token from an Authorization: Bearer header.
+func BearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return strings.TrimSpace(auth[len(prefix):])
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// The double-submit CSRF token: IssueCSRFToken sets it in CSRFCookie, and
+// the frontend echoes it in CSRFHeader, which other sites can neither read
+// nor set.
+const (
+	CSRFCookie = "nlsearch_csrf"
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// IssueCSRFToken gives browsers that don't have a CSRF token one, in a
+// cookie scripts on the same site can read.
+func IssueCSRFToken() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, err := r.Cookie(CSRFCookie); err != nil || c.Value == "" {
+				token := make([]byte, 32)
+				rand.Read(token)
+				http.SetCookie(w, &http.Cookie{
+					Name:     CSRFCookie,
+					Value:    base64.RawURLEncoding.EncodeToString(token),
+					Path:     "/",
+					SameSite: http.SameSiteStrictMode,
+					Secure:   isHTTPS(r),
+				})
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireCSRFToken refuses requests that change something with 403 unless
+// they carry the CSRF token from their cookie in CSRFHeader. It must run
+// after Auth, and only checks requests authenticated by credentials
+// browsers send on their own, which other sites could make them send:
+// those of an SSO proxy, which signs users in with its own cookie. API key
+// and bearer token clients are exempt, since a browser only sends those
+// when a script on this site adds them.
+func RequireCSRFToken() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isSafeMethod(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if id, ok := IdentityFrom(r.Context()); !ok || id.Method != methodProxyHeader {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c, err := r.Cookie(CSRFCookie)
+			header := r.Header.Get(CSRFHeader)
+			if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(header)) != 1 {
+				writeError(w, r, apierror.New(apierror.Forbidden, "Missing or invalid CSRF token; reload the page and try again"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Deprecated marks responses as coming from a deprecated route, following
+// RFC 9745: a Deprecation header with the date it was deprecated and, when
+// successor returns a path, a Link to its replacement.
+func Deprecated(since time.Time, successor func(r *http.Request) string) Middleware {
+	deprecation := fmt.Sprintf("@%d", since.Unix())
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			if successor != nil {
+				if path := successor(r); path != "" {
+					w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// IPFilter configures which client addresses may use the server.
+type IPFilter struct {
+	// Allow, when not empty, lists the only networks clients may connect
+	// from.
+	Allow []netip.Prefix
+	// Deny lists networks whose clients are refused, even within Allow.
+	Deny []netip.Prefix
+	// Proxies lists the load balancers and reverse proxies in front of the
+	// server. The client address is read from the X-Forwarded-For header
+	// of requests from them, and from no others, since clients could forge
+	// it.
+	Proxies []netip.Prefix
+	// Exempt lists paths served to every address, such as health checks.
+	Exempt []string
+}
+
+// Enabled reports whether the filter refuses any address.
+func (f IPFilter) Enabled() bool {
+	return len(f.Allow) > 0 || len(f.Deny) > 0
+}
+
+// FilterIPs refuses requests from clients whose address the filter doesn't
+// allow with 403, before they reach any handler. Requests whose client
+// address can't be determined are refused too.
+func FilterIPs(f IPFilter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(f.Exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			addr, ok := f.ClientAddr(r)
+			if !ok || !f.allows(addr) {
+				writeError(w, r, apierror.New(apierror.Forbidden, "Requests from your address are not allowed"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (f IPFilter) allows(addr netip.Addr) bool {
+	if containsAddr(f.Deny, addr) {
+		return false
+	}
+	return len(f.Allow) == 0 || containsAddr(f.Allow, addr)
+}
+
+// ClientAddr returns the address of the client that made r. That is the
+// address r came from, unless it came from one of Proxies, in which case
+// X-Forwarded-For is read from the right, skipping the proxies, up to the
+// address that connected to the first of them.
+func (f IPFilter) ClientAddr(r *http.Request) (netip.Addr, bool) {
+	addr, ok := remoteAddr(r.RemoteAddr)
+	if !ok {
+		return addr, false
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && containsAddr(f.Proxies, addr); i-- {
+		if addr, ok = remoteAddr(strings.TrimSpace(hops[i])); !ok {
+			return addr, false
+		}
+	}
+	return addr, true
+}
+
+// remoteAddr parses an address as found in http.Request.RemoteAddr or
+// X-Forwarded-For, with or without a port.
+func remoteAddr(s string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return addr, false
+	}
+	return addr.Unmap(), true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// LogSampler decides which requests Logging logs. Failed requests, with a
+// status of 400 or more, are always logged; successful ones are logged at
+// Rate, a fraction between 0 and 1, or at the rate Routes gives for their
+// route pattern, such as /health.
+type LogSampler struct {
+	Rate   float64
+	Routes map[string]float64
+}
+
+func (s *LogSampler) keep(r *http.Request, status int) bool {
+	if s == nil || status >= http.StatusBadRequest {
+		return true
+	}
+	rate := s.Rate
+	if routeRate, ok := s.Routes[r.Pattern]; ok {
+		rate = routeRate
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// Logging logs one line per request with its status, duration and request
+// ID. A nil sampler logs every request. The route pattern sampler looks at
+// is only known when Logging wraps the mux.
+func Logging(sampler *LogSampler) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := newResponseRecorder(w)
+			next.ServeHTTP(rec, r)
+			if sampler.keep(r, rec.Status()) {
+				slog.Info(r.Method+" "+r.URL.Path, "status", rec.Status(), "bytes", rec.bytes, "duration_ms", time.Since(start).Milliseconds(), "request_id", RequestIDFrom(r.Context()))
+			}
+		})
+	}
+}
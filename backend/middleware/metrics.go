@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nlsearch/backend/metrics"
+)
+
+// Metrics records request counts and latencies per route. The route label is
+// the ServeMux pattern that matched, so it must wrap the mux rather than
+// individual handlers.
+func Metrics(registry *metrics.Registry) Middleware {
+	requests := registry.Counter("nlsearch_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	duration := registry.Histogram("nlsearch_http_request_duration_seconds", "HTTP request latency by route.", nil, "route")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := newResponseRecorder(w)
+			next.ServeHTTP(rec, r)
+
+			route := r.Pattern
+			if route == "" {
+				route = "other"
+			}
+			requests.Inc(route, r.Method, strconv.Itoa(rec.Status()))
+			duration.Observe(time.Since(start).Seconds(), route)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Package middleware provides the HTTP middleware applied to nlsearch routes:
+// recovery, logging, metrics, security headers, IP filtering, CORS,
+// authentication, CSRF protection and rate limiting.
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// Middleware wraps a handler with additional behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Chain applies middlewares to h so that the first one listed is the
+// outermost, i.e. it sees the request first and the response last.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// responseRecorder captures the status code and size of a response while
+// still supporting streaming through http.Flusher.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the response status, defaulting to 200 if the handler never
+// wrote anything.
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apierror.Error) {
+	apierror.Write(w, RequestIDFrom(r.Context()), e)
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// DefaultProxyHeaders are the headers oauth2-proxy and similar SSO proxies
+// put the signed-in user in, in order of preference.
+var DefaultProxyHeaders = []string{"X-Forwarded-User", "X-Auth-Request-User", "X-Auth-Request-Email", "X-Forwarded-Email"}
+
+// methodProxyHeader is the Identity.Method of users authenticated by
+// ProxyHeaders.
+const methodProxyHeader = "proxy-header"
+
+// ProxyAuth configures authentication by a reverse proxy that has already
+// signed the user in.
+type ProxyAuth struct {
+	// Trusted lists the networks the proxy connects from. Headers on
+	// requests from anywhere else are ignored, since clients could forge
+	// them.
+	Trusted []netip.Prefix
+	// Headers are checked in order for the user name.
+	Headers []string
+	// Admins lists the users given the admin role as well as the user role.
+	Admins []string
+}
+
+// ProxyHeaders authenticates requests from a trusted proxy as the user
+// named in the first of its headers that is set.
+func ProxyHeaders(auth ProxyAuth) Authenticator {
+	return func(r *http.Request) (*Identity, error) {
+		if !auth.trusts(r.RemoteAddr) {
+			return nil, nil
+		}
+		for _, header := range auth.Headers {
+			user := strings.TrimSpace(r.Header.Get(header))
+			if user == "" {
+				continue
+			}
+			roles := []string{RoleUser}
+			if slices.Contains(auth.Admins, user) {
+				roles = append(roles, RoleAdmin)
+			}
+			return &Identity{Name: user, Method: methodProxyHeader, Roles: roles}, nil
+		}
+		return nil, nil
+	}
+}
+
+func (a ProxyAuth) trusts(from string) bool {
+	addr, ok := remoteAddr(from)
+	return ok && containsAddr(a.Trusted, addr)
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// RateLimit limits each client to rps requests per second with bursts of up
+// to burst. Clients are identified by their authenticated identity when Auth
+// runs first, otherwise by remote IP.
+//
+// Every response carries X-RateLimit-Limit (the burst size) and
+// X-RateLimit-Remaining; once a client has no requests left, Retry-After
+// says how many seconds until it has one again.
+func RateLimit(rps float64, burst int) Middleware {
+	return RateLimitWith(NewMemoryLimiter(), rps, burst, "")
+}
+
+// Limiter keeps the token buckets of RateLimitWith, such as in a store
+// shared by every replica so clients get the same limit from all of them.
+type Limiter interface {
+	// Allow takes a token from key's bucket, which refills at rps tokens a
+	// second up to burst. It returns the whole tokens left and, if none
+	// are, how long until the next one.
+	Allow(ctx context.Context, key string, rps float64, burst int, now time.Time) (remaining int, wait time.Duration, ok bool, err error)
+}
+
+// RateLimitWith is RateLimit with the buckets kept by limiter. scope
+// prefixes the bucket keys, so routes sharing a Limiter can still be
+// limited separately. Requests are let through when limiter fails, rather
+// than failing the API with it.
+func RateLimitWith(limiter Limiter, rps float64, burst int, scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowRate(w, r, limiter, scope+clientKey(r), rps, burst) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// allowRate takes a token from key's bucket and sets the rate limit
+// headers, or answers 429 and returns false if the bucket is empty.
+func allowRate(w http.ResponseWriter, r *http.Request, limiter Limiter, key string, rps float64, burst int) bool {
+	burst = max(burst, 1)
+	remaining, wait, ok, err := limiter.Allow(r.Context(), key, rps, burst, time.Now())
+	if err != nil {
+		slog.Error("Error checking rate limit", "err", err)
+		return true
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	if !ok {
+		writeError(w, r, apierror.New(apierror.RateLimited, "Rate limit exceeded"))
+	}
+	return ok
+}
+
+// NewMemoryLimiter returns a Limiter keeping the buckets in memory, for a
+// single replica.
+func NewMemoryLimiter() Limiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// staleBucketAge is how long an idle client's bucket is kept. By then it has
+// refilled anyway, so dropping it changes nothing but memory use.
+const staleBucketAge = 10 * time.Minute
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) Allow(ctx context.Context, key string, rps float64, burst int, now time.Time) (int, time.Duration, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > staleBucketAge {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > staleBucketAge {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rps)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / rps * float64(time.Second))
+	}
+	return int(b.tokens), wait, allowed, nil
+}
+
+func clientKey(r *http.Request) string {
+	if id, ok := IdentityFrom(r.Context()); ok {
+		return "id:" + id.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
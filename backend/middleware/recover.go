@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/metrics"
+)
+
+// Recover turns a panicking handler into a JSON 500 carrying the request ID,
+// logs the stack, counts the panic and passes it to onPanic, if non-nil. If
+// the handler had already started its response (a stream, for example) the
+// connection is simply closed.
+func Recover(registry *metrics.Registry, onPanic func(r *http.Request, value any, stack []byte)) Middleware {
+	panics := registry.Counter("nlsearch_http_panics_total", "Handler panics recovered, by route.", "route")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := newResponseRecorder(w)
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				requestID := RequestIDFrom(r.Context())
+				stack := debug.Stack()
+				slog.Error("Panic serving request", "method", r.Method, "path", r.URL.Path, "request_id", requestID, "panic", err, "stack", string(stack))
+				if onPanic != nil {
+					onPanic(r, err, stack)
+				}
+				route := r.Pattern
+				if route == "" {
+					route = "other"
+				}
+				panics.Inc(route)
+
+				if rec.status != 0 {
+					// Too late for an error response; abort so the client
+					// sees a broken response rather than a truncated one.
+					panic(http.ErrAbortHandler)
+				}
+				apierror.Write(w, requestID, apierror.New(apierror.Internal, "Internal server error"))
+			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// TenantLimit bounds one tenant's use of the API. Zero fields are
+// unlimited.
+type TenantLimit struct {
+	// RPS and Burst size the tenant's token bucket, as for RateLimit.
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+	// DailyQuota is how many requests the tenant may make per UTC day.
+	DailyQuota int `json:"daily_quota"`
+	// Concurrency is how many of the tenant's requests may be in flight at
+	// once, counting the work they leave running with KeepSlot, such as
+	// jobs.
+	Concurrency int `json:"concurrency"`
+}
+
+// TenantLimits assigns limits to tenants: the callers authenticated under a
+// name, such as an API key's. Every other caller, including each
+// unauthenticated client address, gets its own allowance of Default.
+type TenantLimits struct {
+	Default TenantLimit
+	Tenants map[string]TenantLimit
+}
+
+// For returns the limit of the tenant named name.
+func (l TenantLimits) For(name string) TenantLimit {
+	if limit, ok := l.Tenants[name]; ok {
+		return limit
+	}
+	return l.Default
+}
+
+// IsZero reports whether no caller is limited.
+func (l TenantLimits) IsZero() bool {
+	if l.Default != (TenantLimit{}) {
+		return false
+	}
+	for _, limit := range l.Tenants {
+		if limit != (TenantLimit{}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Quota counts the requests each tenant makes per day, such as in a store
+// shared by every replica.
+type Quota interface {
+	// Use counts a request by key on now's UTC day and returns how many key
+	// has made that day, including it.
+	Use(ctx context.Context, key string, now time.Time) (int, error)
+}
+
+// Tenants enforces TenantLimits on the routes it limits. Rate limits are
+// counted per route, while quotas and concurrency caps cover all of them.
+// Concurrency is counted per process; the rate limits and quotas are
+// shared wherever the Limiter and Quota are.
+type Tenants struct {
+	limits  TenantLimits
+	limiter Limiter
+	quota   Quota
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// NewTenants returns a Tenants enforcing limits with the given limiter and
+// quota. Either may be nil to keep its counts in memory.
+func NewTenants(limits TenantLimits, limiter Limiter, quota Quota) *Tenants {
+	if limiter == nil {
+		limiter = NewMemoryLimiter()
+	}
+	if quota == nil {
+		quota = NewMemoryQuota()
+	}
+	return &Tenants{limits: limits, limiter: limiter, quota: quota, inFlight: map[string]int{}}
+}
+
+// Limit returns middleware applying each caller's limits to a route; scope
+// prefixes its rate limit buckets, as for RateLimitWith. It must run after
+// Auth to tell tenants apart. A request that exceeds a limit is refused
+// with 429 and a Retry-After. Every response carries the X-RateLimit
+// headers of RateLimit when the caller is rate limited, and
+// X-Quota-Limit and X-Quota-Remaining when they have a quota. Requests are
+// let through when the limiter or quota fail.
+func (t *Tenants) Limit(scope string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := clientKey(r)
+			limit := t.limits.Default
+			if id, ok := IdentityFrom(r.Context()); ok {
+				limit = t.limits.For(id.Name)
+			}
+
+			if limit.RPS > 0 && !allowRate(w, r, t.limiter, scope+key, limit.RPS, limit.Burst) {
+				return
+			}
+			if limit.Concurrency > 0 {
+				if !t.acquire(key, limit.Concurrency) {
+					w.Header().Set("Retry-After", "1")
+					writeError(w, r, apierror.New(apierror.RateLimited, "Too many concurrent requests"))
+					return
+				}
+				s := &slot{release: sync.OnceFunc(func() { t.release(key) })}
+				r = r.WithContext(context.WithValue(r.Context(), slotKey{}, s))
+				defer func() {
+					if !s.kept {
+						s.release()
+					}
+				}()
+			}
+			if limit.DailyQuota > 0 && !t.useQuota(w, r, key, limit.DailyQuota) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type slotKey struct{}
+
+// slot is the concurrency slot a request holds.
+type slot struct {
+	kept    bool
+	release func()
+}
+
+// KeepSlot keeps the concurrency slot Tenants.Limit gave the request ctx
+// is from once its handler returns, for work the handler leaves running,
+// such as a job, and returns the func that releases it when the work is
+// done. Without a slot the func does nothing. It must be called before the
+// handler returns.
+func KeepSlot(ctx context.Context) func() {
+	s, ok := ctx.Value(slotKey{}).(*slot)
+	if !ok {
+		return func() {}
+	}
+	s.kept = true
+	return s.release
+}
+
+// useQuota counts the request against key's daily quota and sets the quota
+// headers, or answers 429 and returns false if the quota is used up.
+func (t *Tenants) useQuota(w http.ResponseWriter, r *http.Request, key string, quota int) bool {
+	now := time.Now()
+	used, err := t.quota.Use(r.Context(), key, now)
+	if err != nil {
+		slog.Error("Error checking quota", "err", err)
+		return true
+	}
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(quota))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(max(quota-used, 0)))
+	if used <= quota {
+		return true
+	}
+	tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	w.Header().Set("Retry-After", strconv.Itoa(int(tomorrow.Sub(now).Seconds())+1))
+	writeError(w, r, apierror.New(apierror.RateLimited, "Daily quota exceeded"))
+	return false
+}
+
+func (t *Tenants) acquire(key string, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inFlight[key] >= limit {
+		return false
+	}
+	t.inFlight[key]++
+	return true
+}
+
+func (t *Tenants) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inFlight[key]--; t.inFlight[key] <= 0 {
+		delete(t.inFlight, key)
+	}
+}
+
+// NewMemoryQuota returns a Quota counting in memory, for a single replica.
+func NewMemoryQuota() Quota {
+	return &memoryQuota{used: map[string]int{}}
+}
+
+type memoryQuota struct {
+	mu   sync.Mutex
+	day  string
+	used map[string]int
+}
+
+func (q *memoryQuota) Use(ctx context.Context, key string, now time.Time) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// Yesterday's counts are no longer needed.
+	if day := now.UTC().Format(time.DateOnly); day != q.day {
+		q.day = day
+		clear(q.used)
+	}
+	q.used[key]++
+	return q.used[key], nil
+}
@@ -0,0 +1,35 @@
+// Package output renders generated queries in the formats clients ask for.
+package output
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Output formats for a generated query.
+const (
+	Query  = "query"   // the bare search query
+	SrcCLI = "src-cli" // a complete src-cli invocation
+)
+
+// Formats lists every supported format.
+var Formats = []string{Query, SrcCLI}
+
+// Format renders a generated query in the requested output format. An empty
+// format is treated as Query.
+func Format(query, format string) (string, error) {
+	switch format {
+	case "", Query:
+		return query, nil
+	case SrcCLI:
+		return "src search -json " + ShellQuote(query), nil
+	default:
+		return "", fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(Formats, ", "))
+	}
+}
+
+// ShellQuote quotes s for POSIX shells using single quotes, which disable all
+// expansion; embedded single quotes are closed, escaped and reopened.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
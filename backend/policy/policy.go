@@ -0,0 +1,291 @@
+// Package policy limits the filters of the queries each tenant runs: it
+// denies filters an instance can't afford, such as type:diff on a huge
+// monorepo, and keeps repo: filters within the repositories a tenant may
+// search. Queries that break a tenant's policy are rewritten to follow it,
+// or rejected.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/query"
+)
+
+// Actions taken on queries that break a policy.
+const (
+	// Rewrite removes the filters the policy doesn't allow.
+	Rewrite = "rewrite"
+	// Reject fails the request with a Violation.
+	Reject = "reject"
+)
+
+// Policy is what one tenant's queries may use.
+type Policy struct {
+	// Deny lists the fields, such as timeout, or field:value filters, such
+	// as type:diff, queries may not have, negated or not.
+	Deny []string `json:"deny,omitempty"`
+	// AllowRepos lists the prefixes of the repository names, such as
+	// github.com/acme/, queries may search. repo: filters must be anchored
+	// patterns starting with one of them, and queries without one that
+	// applies to the whole query, outside any group and any or, are
+	// limited to them. context: filters aren't allowed with it, since what
+	// they search can't be checked.
+	AllowRepos []string `json:"allow_repos,omitempty"`
+	// Action is Rewrite, the default, or Reject. Queries that can't be
+	// rewritten, such as those whose only filter in a group is denied, are
+	// rejected either way.
+	Action string `json:"action,omitempty"`
+}
+
+// IsZero reports whether p allows every query.
+func (p Policy) IsZero() bool {
+	return len(p.Deny) == 0 && len(p.AllowRepos) == 0
+}
+
+// Policies assigns policies to tenants: the callers authenticated under a
+// name, such as an API key's, with Default for everyone else.
+type Policies struct {
+	Default Policy
+	Tenants map[string]Policy
+}
+
+// For returns the policy of the tenant named name.
+func (p Policies) For(name string) Policy {
+	if policy, ok := p.Tenants[name]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+// IsZero reports whether p allows every tenant every query.
+func (p Policies) IsZero() bool {
+	if !p.Default.IsZero() {
+		return false
+	}
+	for _, policy := range p.Tenants {
+		if !policy.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse reads a JSON object of policies keyed by tenant, with "default"
+// for everyone else, such as
+//
+//	{"default": {"deny": ["type:diff"]},
+//	 "acme": {"allow_repos": ["github.com/acme/"], "action": "reject"}}
+//
+// The fields a tenant doesn't set come from the default.
+func Parse(data string) (Policies, error) {
+	var policies Policies
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return policies, fmt.Errorf("not a JSON object of policies keyed by tenant")
+	}
+	parse := func(name string, policy *Policy) error {
+		dec := json.NewDecoder(bytes.NewReader(raw[name]))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(policy); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := policy.check(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+	if _, ok := raw["default"]; ok {
+		if err := parse("default", &policies.Default); err != nil {
+			return policies, err
+		}
+	}
+	policies.Tenants = map[string]Policy{}
+	for name := range raw {
+		if name == "default" {
+			continue
+		}
+		policy := policies.Default
+		if err := parse(name, &policy); err != nil {
+			return policies, err
+		}
+		policies.Tenants[name] = policy
+	}
+	return policies, nil
+}
+
+func (p Policy) check() error {
+	if p.Action != "" && p.Action != Rewrite && p.Action != Reject {
+		return fmt.Errorf("action must be %s or %s", Rewrite, Reject)
+	}
+	for _, deny := range p.Deny {
+		field, value, hasValue := strings.Cut(deny, ":")
+		if !query.KnownField(field) || hasValue && value == "" {
+			return fmt.Errorf("%q is not a field or a filter", deny)
+		}
+	}
+	for _, prefix := range p.AllowRepos {
+		if prefix == "" || strings.Contains(prefix, "://") {
+			return fmt.Errorf("%q is not a repository name prefix", prefix)
+		}
+	}
+	return nil
+}
+
+// Violation is the error queries that break a policy are rejected with.
+type Violation struct {
+	// Filters are the filters of the query the policy doesn't allow.
+	Filters []string
+	// Unparsed is set instead when the query doesn't parse, so what it
+	// searches can't be checked.
+	Unparsed bool
+}
+
+func (v *Violation) Error() string {
+	if v.Unparsed {
+		return "the query doesn't parse, so it can't be checked against this instance's policy"
+	}
+	return "the query uses filters this instance doesn't allow: " + strings.Join(v.Filters, " ")
+}
+
+// Enforce applies the policy of the caller in ctx to q. It returns q
+// rewritten to follow the policy, or a *Violation if the policy rejects
+// it. Queries that don't parse are rejected unless the caller's policy
+// allows every query, since Sourcegraph may read them differently.
+func (p Policies) Enforce(ctx context.Context, q string) (string, error) {
+	tenant := ""
+	if id, ok := middleware.IdentityFrom(ctx); ok {
+		tenant = id.Name
+	}
+	policy := p.For(tenant)
+	if policy.IsZero() {
+		return q, nil
+	}
+	parsed, err := query.Parse(q)
+	if err != nil {
+		slog.WarnContext(ctx, "Rejecting query the policy can't be checked against", "tenant", tenant, "err", err)
+		return q, &Violation{Unparsed: true}
+	}
+
+	var violations []query.Token
+	denied := policy.denied(parsed)
+	// A repo: filter only limits the whole query outside any group, and
+	// only if no or at that level lets another operand search elsewhere.
+	depth, named, or := 0, false, false
+	for i, tok := range parsed.Tokens {
+		negated := tok.Negated || i > 0 && parsed.Tokens[i-1].Kind == query.Operator && parsed.Tokens[i-1].Value == "not"
+		switch {
+		case tok.Kind == query.LeftParen:
+			depth++
+		case tok.Kind == query.RightParen:
+			depth--
+		case tok.Kind == query.Operator:
+			or = or || tok.Value == "or" && depth == 0
+		case tok.Kind != query.Field:
+		case denied[tok.Pos]:
+			violations = append(violations, tok)
+		case len(policy.AllowRepos) == 0 || negated:
+		case tok.Field == "context":
+			violations = append(violations, tok)
+		case tok.Field == "repo" && !strings.HasPrefix(tok.Value, "has."):
+			if !policy.allows(tok.Value) {
+				violations = append(violations, tok)
+				continue
+			}
+			named = named || depth == 0
+		}
+	}
+	if len(violations) > 0 {
+		filters := make([]string, len(violations))
+		for i, tok := range violations {
+			filters[i] = q[tok.Pos:tok.End]
+		}
+		if policy.Action == Reject {
+			slog.WarnContext(ctx, "Rejecting query the policy doesn't allow", "tenant", tenant, "filters", strings.Join(filters, " "))
+			return q, &Violation{Filters: filters}
+		}
+		// Removing from the end keeps the offsets of earlier filters valid.
+		for i := len(violations) - 1; i >= 0; i-- {
+			tok := violations[i]
+			q = strings.TrimRight(q[:tok.Pos], " \t\n") + q[tok.End:]
+		}
+		q = strings.TrimSpace(q)
+		if _, err := query.Parse(q); err != nil || q == "" {
+			slog.WarnContext(ctx, "Rejecting query the policy doesn't allow and removing its filters would break", "tenant", tenant, "filters", strings.Join(filters, " "))
+			return parsed.Raw, &Violation{Filters: filters}
+		}
+		slog.InfoContext(ctx, "Removed filters the policy doesn't allow from the query", "tenant", tenant, "filters", strings.Join(filters, " "))
+	}
+	if len(policy.AllowRepos) > 0 && (or || !named) {
+		// The filter binds tighter than or, so it needs the rest grouped
+		// to limit every operand.
+		if or {
+			q = "(" + q + ")"
+		}
+		q = strings.TrimSpace(q + " repo:" + policy.scope())
+	}
+	return q, nil
+}
+
+// denied returns the positions of the filters of q that p denies.
+func (p Policy) denied(q *query.Query) map[int]bool {
+	denied := map[int]bool{}
+	for _, deny := range p.Deny {
+		field, value, hasValue := strings.Cut(deny, ":")
+		for _, tok := range q.Fields(field) {
+			if !hasValue || strings.EqualFold(tok.Value, value) {
+				denied[tok.Pos] = true
+			}
+		}
+	}
+	return denied
+}
+
+// allows reports whether the repo: filter value only matches repositories
+// under p's prefixes: it is anchored, and what it spells out before any
+// other regular expression syntax starts with one of them.
+func (p Policy) allows(value string) bool {
+	value, _, _ = strings.Cut(value, "@")
+	rest, anchored := strings.CutPrefix(value, "^")
+	if !anchored {
+		return false
+	}
+	var literal strings.Builder
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		if c == '\\' && i+1 < len(rest) && strings.IndexByte("./-", rest[i+1]) >= 0 {
+			literal.WriteByte(rest[i+1])
+			i++
+			continue
+		}
+		if strings.IndexByte(`\^$.*+?()[]{}|`, c) >= 0 {
+			break
+		}
+		literal.WriteByte(c)
+	}
+	for _, prefix := range p.AllowRepos {
+		if strings.HasPrefix(strings.ToLower(literal.String()), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scope returns a repo: filter value matching the repositories under p's
+// prefixes.
+func (p Policy) scope() string {
+	quoted := make([]string, len(p.AllowRepos))
+	for i, prefix := range p.AllowRepos {
+		quoted[i] = regexp.QuoteMeta(prefix)
+	}
+	if len(quoted) == 1 {
+		return "^" + quoted[0]
+	}
+	return "^(?:" + strings.Join(quoted, "|") + ")"
+}
@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nlsearch/backend/middleware"
+)
+
+func TestEnforceAllowRepos(t *testing.T) {
+	policies := Policies{Default: Policy{AllowRepos: []string{"github.com/acme/"}}}
+	const scope = `repo:^github\.com/acme/`
+
+	tests := []struct {
+		name string
+		q    string
+		want string
+	}{
+		{"no repository", "password", "password " + scope},
+		{"allowed repository", `password repo:^github\.com/acme/api$`, `password repo:^github\.com/acme/api$`},
+		{"other repository", `password repo:^github\.com/evil/`, "password " + scope},
+		{"unanchored repository", `password repo:acme`, "password " + scope},
+		{"negated repository", `password -repo:^github\.com/acme/`, `password -repo:^github\.com/acme/ ` + scope},
+		{"not repository", `password not repo:^github\.com/acme/`, `password not repo:^github\.com/acme/ ` + scope},
+		{"or without repositories", "foo or bar", "(foo or bar) " + scope},
+		{"or after allowed repository", `repo:^github\.com/acme/ foo or bar`, `(repo:^github\.com/acme/ foo or bar) ` + scope},
+		{"or in a group", `(foo or bar) repo:^github\.com/acme/`, `(foo or bar) repo:^github\.com/acme/`},
+		{"allowed repository in one operand", `(repo:^github\.com/acme/ x) or (password)`, `((repo:^github\.com/acme/ x) or (password)) ` + scope},
+		{"allowed repository in every operand", `(repo:^github\.com/acme/a x) or (repo:^github\.com/acme/b y)`, `((repo:^github\.com/acme/a x) or (repo:^github\.com/acme/b y)) ` + scope},
+		{"allowed repository only in a group", `(repo:^github\.com/acme/ x or password)`, `(repo:^github\.com/acme/ x or password) ` + scope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policies.Enforce(context.Background(), tt.q)
+			if err != nil || got != tt.want {
+				t.Fatalf("Enforce(%q) = %q, %v, want %q", tt.q, got, err, tt.want)
+			}
+			if again, err := policies.Enforce(context.Background(), got); err != nil || again != got {
+				t.Errorf("Enforce(%q) = %q, %v, want it unchanged", got, again, err)
+			}
+		})
+	}
+}
+
+func TestEnforceReject(t *testing.T) {
+	policies := Policies{Tenants: map[string]Policy{
+		"acme": {AllowRepos: []string{"github.com/acme/"}, Deny: []string{"type:diff"}, Action: Reject},
+	}}
+	ctx := middleware.WithIdentity(context.Background(), &middleware.Identity{Name: "acme"})
+
+	for _, q := range []string{
+		`password repo:^github\.com/evil/`,
+		`(repo:^github\.com/acme/ x) or (repo:^github\.com/evil/ password)`,
+		`password context:global`,
+		`password type:diff`,
+	} {
+		var violation *Violation
+		if _, err := policies.Enforce(ctx, q); !errors.As(err, &violation) {
+			t.Errorf("Enforce(%q) = %v, want a *Violation", q, err)
+		}
+	}
+
+	for _, p := range []Policies{policies, {Default: Policy{Deny: []string{"type:diff"}}}} {
+		for _, q := range []string{`(password repo:^github\.com/evil/`, `"password type:diff`} {
+			var violation *Violation
+			if _, err := p.Enforce(ctx, q); !errors.As(err, &violation) || !violation.Unparsed {
+				t.Errorf("Enforce(%q) = %v, want an unparsed *Violation", q, err)
+			}
+		}
+	}
+
+	const q = `foo or bar`
+	if got, err := policies.Enforce(ctx, q); err != nil || got != `(foo or bar) repo:^github\.com/acme/` {
+		t.Errorf("Enforce(%q) = %q, %v", q, got, err)
+	}
+	if got, err := policies.Enforce(context.Background(), q); err != nil || got != q {
+		t.Errorf("Enforce(%q) without a tenant = %q, %v, want it unchanged", q, got, err)
+	}
+}
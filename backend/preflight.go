@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/sourcegraph"
+)
+
+const preflightTimeout = 10 * time.Second
+
+// preflight checks the configured token against Sourcegraph before serving,
+// so a bad token is reported at startup rather than on the first query, and
+// then resolves the translation providers from what the instance offers. An
+// unreachable instance is only logged: it may come back by the time users
+// arrive.
+func preflight(config *Config, transport http.RoundTripper) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+
+	client := sourcegraph.NewClient(config.SourcegraphURL, config.SourcegraphToken).WithTransport(transport).WithAuth(config.UpstreamAuth)
+	identity, err := client.CurrentUser(ctx)
+	if errors.Is(err, sourcegraph.ErrInvalidToken) {
+		return fmt.Errorf("SOURCEGRAPH_TOKEN was rejected by %s: %v; create a new access token under Settings > Access tokens", config.SourcegraphURL, err)
+	}
+	if err != nil {
+		slog.Warn("Could not verify SOURCEGRAPH_TOKEN", "url", config.SourcegraphURL, "err", err)
+		return resolveProviders(config, nil)
+	}
+
+	version := identity.ProductVersion
+	if version == "" {
+		version = "unknown version"
+	}
+	slog.Info("Authenticated to Sourcegraph", "url", config.SourcegraphURL, "version", version, "user", identity.Username)
+
+	caps, err := client.DetectCapabilities(ctx)
+	if err != nil {
+		slog.Warn("Could not detect the APIs Sourcegraph offers", "url", config.SourcegraphURL, "err", err)
+		return resolveProviders(config, nil)
+	}
+	slog.Info("Detected Sourcegraph APIs", "apis", caps.String(), "version", caps.Version)
+	return resolveProviders(config, &caps)
+}
+
+// providerCapabilities reports whether an instance offers what each
+// translation provider needs.
+var providerCapabilities = map[string]func(sourcegraph.Capabilities) bool{
+	"deepsearch": func(c sourcegraph.Capabilities) bool { return c.DeepSearch || c.DeepSearchV2 },
+	"cody":       func(c sourcegraph.Capabilities) bool { return c.Cody },
+}
+
+// resolveProviders settles config.Providers. With TRANSLATION_PROVIDERS=auto
+// it keeps the default providers the instance offers, in order, or all of
+// them when caps is nil because detection was skipped or failed; the
+// fallback chain still skips any that turn out to be missing. An explicit
+// list is kept as configured, with a warning for providers the instance
+// lacks. The Deep Search API revision is settled the same way.
+func resolveProviders(config *Config, caps *sourcegraph.Capabilities) error {
+	resolveDeepSearchAPI(config, caps)
+	if !config.autoProviders() {
+		if caps != nil {
+			for _, name := range config.Providers {
+				if !providerCapabilities[name](*caps) {
+					slog.Warn("Translation provider is configured but Sourcegraph doesn't appear to offer it", "provider", name, "url", config.SourcegraphURL)
+				}
+			}
+		}
+		return nil
+	}
+
+	config.Providers = splitList(defaultProviders)
+	if caps != nil {
+		var available []string
+		for _, name := range config.Providers {
+			if providerCapabilities[name](*caps) {
+				available = append(available, name)
+			}
+		}
+		if len(available) == 0 {
+			return fmt.Errorf("%s offers no translation API (detected: %s); enable Deep Search or Cody, or set TRANSLATION_PROVIDERS explicitly", config.SourcegraphURL, caps)
+		}
+		config.Providers = available
+	}
+	if err := config.validateProviders(); err != nil {
+		return fmt.Errorf("%w (TRANSLATION_PROVIDERS=auto resolved to %s)", err, strings.Join(config.Providers, ","))
+	}
+	slog.Info("Using translation providers", "providers", strings.Join(config.Providers, " → "))
+	return nil
+}
+
+// resolveDeepSearchAPI settles config.DeepSearchAPI. With DEEPSEARCH_API=auto
+// it picks the revision caps says the instance offers, or v1 when caps is
+// nil. An explicit revision is kept, with a warning if the instance lacks
+// it.
+func resolveDeepSearchAPI(config *Config, caps *sourcegraph.Capabilities) {
+	if config.DeepSearchAPI != providersAuto {
+		if caps != nil && (config.DeepSearchAPI == deepsearch.APIv1.Name && !caps.DeepSearch || config.DeepSearchAPI == deepsearch.APIv2.Name && !caps.DeepSearchV2) {
+			slog.Warn("Deep Search API revision is configured but Sourcegraph doesn't appear to offer it", "api", config.DeepSearchAPI, "url", config.SourcegraphURL)
+		}
+		return
+	}
+	config.DeepSearchAPI = deepsearch.APIv1.Name
+	if caps == nil {
+		return
+	}
+	if api, ok := caps.API(); ok {
+		config.DeepSearchAPI = api.Name
+		if api != deepsearch.APIv1 {
+			slog.Info("Speaking the Deep Search API revision the instance offers", "api", api.Name, "version", caps.Version)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+// Package query parses and validates Sourcegraph search queries well enough
+// to catch the mistakes a language model makes: unknown or misspelled
+// filters, invalid filter values, unbalanced parentheses and quotes, and
+// commit-only filters used outside commit searches.
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Pattern Kind = iota
+	Field
+	Operator
+	LeftParen
+	RightParen
+)
+
+// Token is one element of a query. Pos and End are byte offsets into the raw
+// query.
+type Token struct {
+	Kind Kind
+	// Field is the canonical (lowercased, unaliased) filter name for Field
+	// tokens.
+	Field   string
+	Value   string
+	Negated bool
+	Quoted  bool
+	Pos     int
+	End     int
+}
+
+type Query struct {
+	Raw    string
+	Tokens []Token
+}
+
+// Parse tokenizes raw. It only fails on structural problems, unterminated
+// quotes and unbalanced parentheses; use Validate to check filters.
+func Parse(raw string) (*Query, error) {
+	q := &Query{Raw: raw}
+	depth := 0
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			depth++
+			q.Tokens = append(q.Tokens, Token{Kind: LeftParen, Pos: i, End: i + 1})
+			i++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses: unexpected ')' at position %d", i)
+			}
+			q.Tokens = append(q.Tokens, Token{Kind: RightParen, Pos: i, End: i + 1})
+			i++
+		case c == '"' || c == '\'':
+			value, end, err := scanQuoted(raw, i)
+			if err != nil {
+				return nil, err
+			}
+			q.Tokens = append(q.Tokens, Token{Kind: Pattern, Value: value, Quoted: true, Pos: i, End: end})
+			i = end
+		default:
+			tok, err := scanWord(raw, i)
+			if err != nil {
+				return nil, err
+			}
+			q.Tokens = append(q.Tokens, tok)
+			i = tok.End
+		}
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unbalanced parentheses: %d unclosed '('", depth)
+	}
+	return q, nil
+}
+
+// scanQuoted reads a quoted string starting at raw[start], honoring
+// backslash escapes.
+func scanQuoted(raw string, start int) (string, int, error) {
+	quote := raw[start]
+	var b strings.Builder
+	for i := start + 1; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			if i+1 < len(raw) {
+				i++
+				b.WriteByte(raw[i])
+			}
+		case quote:
+			return b.String(), i + 1, nil
+		default:
+			b.WriteByte(raw[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated quote starting at position %d", start)
+}
+
+// scanWord reads a bare pattern, operator or field:value. Field values may
+// be quoted and may contain balanced parentheses, as in
+// repo:has.file(path:README).
+func scanWord(raw string, start int) (Token, error) {
+	i := start
+	for i < len(raw) && !isSpace(raw[i]) && raw[i] != '(' && raw[i] != ')' && raw[i] != ':' {
+		i++
+	}
+	word := raw[start:i]
+
+	if i < len(raw) && raw[i] == ':' && isFieldName(strings.TrimPrefix(word, "-")) && !looksLikePattern(raw[i+1:]) {
+		tok := Token{Kind: Field, Pos: start}
+		name := word
+		if strings.HasPrefix(name, "-") {
+			tok.Negated = true
+			name = name[1:]
+		}
+		tok.Field = canonical(name)
+		i++ // ':'
+
+		if i < len(raw) && (raw[i] == '"' || raw[i] == '\'') {
+			value, end, err := scanQuoted(raw, i)
+			if err != nil {
+				return tok, err
+			}
+			tok.Value, tok.Quoted, tok.End = value, true, end
+			return tok, nil
+		}
+		valueStart, depth := i, 0
+		for i < len(raw) && !isSpace(raw[i]) {
+			if raw[i] == '(' {
+				depth++
+			} else if raw[i] == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+			i++
+		}
+		tok.Value, tok.End = raw[valueStart:i], i
+		return tok, nil
+	}
+
+	// Not a field: extend to the end of the word, colons included.
+	for i < len(raw) && !isSpace(raw[i]) && raw[i] != '(' && raw[i] != ')' {
+		i++
+	}
+	word = raw[start:i]
+	switch strings.ToLower(word) {
+	case "and", "or", "not":
+		return Token{Kind: Operator, Value: strings.ToLower(word), Pos: start, End: i}, nil
+	}
+	return Token{Kind: Pattern, Value: word, Pos: start, End: i}, nil
+}
+
+// looksLikePattern reports whether the text after a colon means the word is
+// a URL or a C++ scope rather than a filter.
+func looksLikePattern(rest string) bool {
+	return strings.HasPrefix(rest, "//") || strings.HasPrefix(rest, ":")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// isFieldName reports whether s could name a filter. Anything else followed
+// by a colon is part of a pattern.
+func isFieldName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Fields returns the field tokens for name, which may be an alias.
+func (q *Query) Fields(name string) []Token {
+	name = canonical(name)
+	var out []Token
+	for _, t := range q.Tokens {
+		if t.Kind == Field && t.Field == name {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// TopLevelOr reports whether q has an or outside any group, which gives
+// each of its operands filters of their own.
+func (q *Query) TopLevelOr() bool {
+	depth := 0
+	for _, t := range q.Tokens {
+		switch {
+		case t.Kind == LeftParen:
+			depth++
+		case t.Kind == RightParen:
+			depth--
+		case t.Kind == Operator && t.Value == "or" && depth == 0:
+			return true
+		}
+	}
+	return false
+}
+
+// TopLevelFields returns the field tokens for name, which may be an alias,
+// that apply to the whole query: those outside any group, in a query
+// without a top-level or. Fields negated with not are returned with Negated
+// set, like those negated with -.
+func (q *Query) TopLevelFields(name string) []Token {
+	if q.TopLevelOr() {
+		return nil
+	}
+	name = canonical(name)
+	var out []Token
+	depth := 0
+	for i, t := range q.Tokens {
+		switch {
+		case t.Kind == LeftParen:
+			depth++
+		case t.Kind == RightParen:
+			depth--
+		case t.Kind == Field && t.Field == name && depth == 0:
+			if i > 0 && q.Tokens[i-1].Kind == Operator && q.Tokens[i-1].Value == "not" {
+				t.Negated = true
+			}
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Patterns returns the bare and quoted search patterns.
+func (q *Query) Patterns() []Token {
+	var out []Token
+	for _, t := range q.Tokens {
+		if t.Kind == Pattern {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// Pattern returns the query without its filters: its patterns with the
+// operators and parentheses between them, as written. Operators and groups
+// left with nothing to apply to, as in "(repo:a or repo:b) foo", are
+// dropped.
+func (q *Query) Pattern() string {
+	var toks []Token
+	for _, t := range q.Tokens {
+		if t.Kind != Field {
+			toks = append(toks, t)
+		}
+	}
+	for i := 0; i < len(toks); {
+		t := toks[i]
+		prev, next := Kind(-1), Kind(-1)
+		if i > 0 {
+			prev = toks[i-1].Kind
+		}
+		if i+1 < len(toks) {
+			next = toks[i+1].Kind
+		}
+		switch {
+		case t.Kind == LeftParen && next == RightParen:
+			toks = append(toks[:i], toks[i+2:]...)
+		case t.Kind == Operator && t.Value != "not" && (prev == -1 || prev == LeftParen || prev == Operator):
+			toks = append(toks[:i], toks[i+1:]...)
+		case t.Kind == Operator && (next == -1 || next == RightParen):
+			toks = append(toks[:i], toks[i+1:]...)
+		default:
+			i++
+			continue
+		}
+		// Dropping a token can leave the one before it with nothing to
+		// apply to, so look at it again.
+		i = max(i-1, 0)
+	}
+	var b strings.Builder
+	for i, t := range toks {
+		if i > 0 && t.Kind != RightParen && toks[i-1].Kind != LeftParen {
+			b.WriteByte(' ')
+		}
+		b.WriteString(q.Raw[t.Pos:t.End])
+	}
+	return b.String()
+}
+
+// AppendFilter returns raw with filter appended so that it applies to the
+// whole query: filters bind tighter than or, so raw is grouped first if it
+// has a top-level or. raw is only trimmed if it does not parse.
+func AppendFilter(raw, filter string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return filter
+	}
+	if q, err := Parse(raw); err == nil && q.TopLevelOr() {
+		raw = "(" + raw + ")"
+	}
+	return raw + " " + filter
+}
+
+// WithFilter returns raw with field set to value, replacing the first
+// existing occurrence or appending one. raw is returned unchanged if it does
+// not parse.
+func WithFilter(raw, field, value string) string {
+	q, err := Parse(raw)
+	if err != nil {
+		return raw
+	}
+	filter := field + ":" + value
+	if existing := q.Fields(field); len(existing) > 0 {
+		t := existing[0]
+		return raw[:t.Pos] + filter + raw[t.End:]
+	}
+	if strings.TrimSpace(raw) == "" {
+		return filter
+	}
+	return strings.TrimRight(raw, " \t\n") + " " + filter
+}
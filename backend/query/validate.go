@@ -0,0 +1,243 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Severity string
+
+const (
+	// Error problems make Sourcegraph reject the query or search for
+	// something other than what was meant.
+	Error Severity = "error"
+	// Warning problems are legal but suspicious.
+	Warning Severity = "warning"
+)
+
+type Problem struct {
+	Severity Severity
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+}
+
+// HasErrors reports whether any problem is an Error.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// aliases maps alternative filter names to their canonical form.
+var aliases = map[string]string{
+	"r":        "repo",
+	"f":        "file",
+	"path":     "file",
+	"l":        "lang",
+	"language": "lang",
+	"m":        "message",
+	"msg":      "message",
+	"until":    "before",
+	"since":    "after",
+	"revision": "rev",
+}
+
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if c, ok := aliases[name]; ok {
+		return c
+	}
+	return name
+}
+
+// KnownField reports whether name, or the filter it is an alias for, is a
+// Sourcegraph filter.
+func KnownField(name string) bool {
+	_, ok := fields[canonical(name)]
+	return ok
+}
+
+// fieldSpec describes one filter.
+type fieldSpec struct {
+	// values, if set, lists every accepted value.
+	values []string
+	// check, if set, validates the value.
+	check func(value string) error
+	// single fields may appear at most once.
+	single bool
+	// commitOnly fields require type:commit or type:diff.
+	commitOnly bool
+	// regex values are regular expressions whatever the pattern type.
+	regex bool
+}
+
+var yesNoOnly = []string{"yes", "no", "only"}
+
+var fields = map[string]fieldSpec{
+	"repo":               {regex: true},
+	"file":               {regex: true},
+	"lang":               {},
+	"content":            {},
+	"type":               {values: []string{"repo", "file", "path", "commit", "diff", "symbol"}},
+	"case":               {values: []string{"yes", "no"}, single: true},
+	"patterntype":        {values: []string{"standard", "literal", "regexp", "structural", "keyword"}, single: true},
+	"count":              {check: checkCount, single: true},
+	"timeout":            {check: checkTimeout, single: true},
+	"select":             {check: checkSelect, single: true},
+	"fork":               {values: yesNoOnly, single: true},
+	"archived":           {values: yesNoOnly, single: true},
+	"visibility":         {values: []string{"any", "public", "private"}, single: true},
+	"rev":                {},
+	"context":            {single: true},
+	"author":             {commitOnly: true},
+	"committer":          {commitOnly: true},
+	"message":            {commitOnly: true},
+	"before":             {commitOnly: true},
+	"after":              {commitOnly: true},
+	"repohasfile":        {},
+	"repohascommitafter": {single: true},
+	"has":                {},
+	"has.file":           {},
+	"has.path":           {},
+	"has.content":        {},
+	"has.commit.after":   {},
+	"has.description":    {},
+	"has.topic":          {},
+	"has.key":            {},
+	"has.tag":            {},
+	"has.owner":          {},
+	"stable":             {values: []string{"yes", "no"}, single: true},
+	"index":              {values: yesNoOnly, single: true},
+}
+
+var selectValues = []string{
+	"repo", "file", "file.directories", "file.path", "file.owners",
+	"content", "commit", "commit.diff.added", "commit.diff.removed", "symbol",
+}
+
+func checkCount(value string) error {
+	if value == "all" {
+		return nil
+	}
+	if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+		return fmt.Errorf("must be a positive integer or \"all\"")
+	}
+	return nil
+}
+
+func checkTimeout(value string) error {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("must be a duration such as 30s")
+	}
+	return nil
+}
+
+func checkSelect(value string) error {
+	for _, v := range selectValues {
+		if value == v {
+			return nil
+		}
+	}
+	// select:symbol.function and friends.
+	if kind, ok := strings.CutPrefix(value, "symbol."); ok && kind != "" {
+		return nil
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(selectValues, ", "))
+}
+
+// Validate parses and validates raw.
+func Validate(raw string) []Problem {
+	if strings.TrimSpace(raw) == "" {
+		return []Problem{{Severity: Error, Message: "query is empty"}}
+	}
+	q, err := Parse(raw)
+	if err != nil {
+		return []Problem{{Severity: Error, Message: err.Error()}}
+	}
+	return q.Validate()
+}
+
+// Validate checks filters and operators.
+func (q *Query) Validate() []Problem {
+	var problems []Problem
+	add := func(severity Severity, format string, args ...interface{}) {
+		problems = append(problems, Problem{Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	commitSearch := false
+	for _, t := range q.Fields("type") {
+		commitSearch = commitSearch || t.Value == "commit" || t.Value == "diff"
+	}
+
+	seen := map[string]bool{}
+	for i, t := range q.Tokens {
+		switch t.Kind {
+		case Operator:
+			if t.Value == "not" {
+				if i == len(q.Tokens)-1 {
+					add(Error, "operator NOT is missing an operand")
+				}
+				continue
+			}
+			if i == 0 || i == len(q.Tokens)-1 || q.Tokens[i-1].Kind == Operator || q.Tokens[i-1].Kind == LeftParen {
+				add(Error, "operator %s is missing an operand", strings.ToUpper(t.Value))
+			}
+		case Field:
+			spec, ok := fields[t.Field]
+			if !ok {
+				add(Warning, "unknown filter %q will be searched for as text", t.Field)
+				continue
+			}
+			if t.Value == "" && !t.Quoted {
+				add(Error, "filter %s: has no value", t.Field)
+				continue
+			}
+			if spec.single && seen[t.Field] {
+				add(Error, "filter %s: may only appear once", t.Field)
+			}
+			seen[t.Field] = true
+			if spec.values != nil && !contains(spec.values, strings.ToLower(t.Value)) {
+				add(Error, "filter %s:%s: value must be one of %s", t.Field, t.Value, strings.Join(spec.values, ", "))
+			}
+			if spec.check != nil {
+				if err := spec.check(t.Value); err != nil {
+					add(Error, "filter %s:%s: %v", t.Field, t.Value, err)
+				}
+			}
+			if spec.commitOnly && !commitSearch {
+				add(Error, "filter %s: requires type:commit or type:diff", t.Field)
+			}
+			if spec.regex && !isPredicate(t.Value) {
+				if _, err := regexp.Compile(t.Value); err != nil {
+					add(Error, "filter %s:%s: invalid regular expression", t.Field, t.Value)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// isPredicate reports whether value is a filter predicate such as
+// has.file(path:README) rather than a regular expression.
+func isPredicate(value string) bool {
+	open := strings.IndexByte(value, '(')
+	return open > 0 && strings.HasSuffix(value, ")") && isFieldName(value[:open])
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
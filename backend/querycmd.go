@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/output"
+	"github.com/nlsearch/backend/policy"
+	"github.com/nlsearch/backend/server"
+	"github.com/nlsearch/backend/translate"
+)
+
+// Values of query's -output flag.
+const (
+	queryOutputText = "text"
+	queryOutputJSON = "json"
+	queryOutputURL  = "url"
+)
+
+var queryOutputs = []string{queryOutputText, queryOutputJSON, queryOutputURL}
+
+// queryResult is what `query -output json` prints, with fields named as in
+// the API's QueryResponse.
+type queryResult struct {
+	Request    string                 `json:"request"`
+	Answer     string                 `json:"answer"`
+	Output     string                 `json:"output,omitempty"`
+	URL        string                 `json:"url"`
+	Extraction string                 `json:"extraction,omitempty"`
+	Fallback   bool                   `json:"fallback,omitempty"`
+	Sources    []translate.Source     `json:"sources,omitempty"`
+	Stats      map[string]interface{} `json:"stats,omitempty"`
+}
+
+func newQueryCommand() *command {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 60*time.Second, "maximum time to wait for the translation")
+	format := fs.String("format", output.Query, "output format of the query: "+strings.Join(output.Formats, ", "))
+	out := fs.String("output", queryOutputText, "what to print: "+strings.Join(queryOutputs, ", "))
+	addConfigFlags(fs)
+
+	return &command{
+		name:    "query",
+		args:    "<request>|-",
+		summary: "Translate one request, given as arguments or on stdin with -",
+		flags:   fs,
+		run: func(args []string) error {
+			if _, err := output.Format("", *format); err != nil {
+				return err
+			}
+			switch *out {
+			case queryOutputText, queryOutputJSON, queryOutputURL:
+			default:
+				return fmt.Errorf("unknown output %q (want one of %s)", *out, strings.Join(queryOutputs, ", "))
+			}
+			request, err := readRequest(args, os.Stdin)
+			if err != nil {
+				return err
+			}
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			setupLogging(config)
+			translator, err := newCLITranslator(&config)
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+			defer stop()
+			translation, err := translator.Translate(ctx, request, nil)
+			if err != nil {
+				return fmt.Errorf("translate: %w", err)
+			}
+			return printQuery(os.Stdout, config, request, translation, *format, *out)
+		},
+	}
+}
+
+// readRequest returns the request in args, or read from stdin if args is
+// just "-", such as text an editor pipes in.
+func readRequest(args []string, stdin io.Reader) (string, error) {
+	request := strings.Join(args, " ")
+	if len(args) == 1 && args[0] == "-" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", fmt.Errorf("read stdin: %w", err)
+		}
+		request = string(b)
+	}
+	if request = strings.TrimSpace(request); request == "" {
+		return "", errors.New("missing request: give it as arguments, or - to read it from stdin")
+	}
+	return request, nil
+}
+
+// printQuery prints translation as out says: the query in format, the
+// Sourcegraph search URL for it, or everything as JSON.
+func printQuery(w io.Writer, config Config, request string, translation *translate.Translation, format, out string) error {
+	formatted, err := output.Format(translation.Query, format)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimSuffix(config.SourcegraphURL, "/") + "/search?q=" + url.QueryEscape(translation.Query)
+	switch out {
+	case queryOutputURL:
+		_, err = fmt.Fprintln(w, link)
+	case queryOutputJSON:
+		result := queryResult{
+			Request:    request,
+			Answer:     translation.Query,
+			URL:        link,
+			Extraction: translation.Extraction,
+			Fallback:   translation.Fallback,
+			Sources:    translation.Sources,
+			Stats:      translation.Stats,
+		}
+		if formatted != translation.Query {
+			result.Output = formatted
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(result)
+	default:
+		_, err = fmt.Fprintln(w, formatted)
+	}
+	return err
+}
+
+// newCLITranslator checks config against Sourcegraph and builds the
+// translation pipeline the server would, for commands that translate
+// in-process.
+func newCLITranslator(config *Config) (translate.Strategy, error) {
+	up := newUpstream(*config)
+	if err := preflight(config, up.transport); err != nil {
+		return nil, err
+	}
+	exampleStore, err := newExampleStore(*config)
+	if err != nil {
+		return nil, err
+	}
+	var retriever translate.ExampleRetriever
+	if exampleStore != nil {
+		retriever = exampleStore
+	}
+	prompt, err := newPrompt(*config)
+	if err != nil {
+		return nil, err
+	}
+	return guardedStrategy{Strategy: newTranslator(*config, up, prompt, retriever), secrets: config.RequestSecrets, policies: config.QueryPolicies}, nil
+}
+
+// guardedStrategy screens requests for credentials, as REQUEST_SECRETS
+// says, before translating them, and applies the default query policy of
+// QUERY_POLICY to the translations, as the server does for callers without
+// a tenant.
+type guardedStrategy struct {
+	translate.Strategy
+	secrets  string
+	policies policy.Policies
+}
+
+func (s guardedStrategy) Translate(ctx context.Context, request string, progress func(translate.Progress)) (*translate.Translation, error) {
+	masked, apiErr := server.ScreenSecrets(ctx, s.secrets, request)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	translation, err := s.Strategy.Translate(ctx, masked, progress)
+	if err != nil {
+		return nil, err
+	}
+	q, err := s.policies.Enforce(ctx, translation.Query)
+	if err != nil {
+		return nil, err
+	}
+	if q != translation.Query {
+		copy := *translation
+		copy.Query = q
+		translation = &copy
+	}
+	return translation, nil
+}
@@ -0,0 +1,177 @@
+// Package redact removes credentials from text before it is logged or put
+// in an error, such as an upstream error body that echoes the request's
+// headers. It masks the secrets it has been told about with Secrets, and
+// anything that looks like a credential: Authorization and similar headers,
+// bearer and token schemes, access tokens and keys in well-known formats,
+// private keys, passwords in URLs and tokens in query strings.
+package redact
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces each secret.
+const Mask = "[REDACTED]"
+
+// minSecretLength is the length below which Secrets ignores values, since
+// masking every occurrence of a short string would mangle ordinary text.
+const minSecretLength = 8
+
+var patterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Header lines and JSON or form fields named like credentials.
+	{regexp.MustCompile(`(?i)((?:proxy-)?authorization|x-api-key|x-sentry-auth|x-csrf-token|cookie|set-cookie|access_token|api_key|password|secret)("?\s*[:=]\s*"?)[^\s",;&]+(?:\s+[^\s",;&]+)?`), "${1}${2}" + Mask},
+	// Credentials in an authorization scheme wherever they appear. They
+	// must have a digit, so prose such as "token expired" is left alone.
+	{regexp.MustCompile(`(?i)\b(bearer|token|basic)\s+[A-Za-z0-9._~+/=-]*[0-9][A-Za-z0-9._~+/=-]*`), "${1} " + Mask},
+	// Tokens in query strings.
+	{regexp.MustCompile(`(?i)([?&](?:access_)?(?:token|key)=)[^&\s"]+`), "${1}" + Mask},
+}
+
+// credentials are the secrets Credentials finds: those that can't be taken
+// for prose or code, as the names of credentials in patterns can.
+var credentials = []struct {
+	kind string
+	re   *regexp.Regexp
+	repl string
+}{
+	// Private keys, up to the end of the text if it was cut short.
+	{"private key", regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----.*?(-----END [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----|\z)`), Mask},
+	// Sourcegraph access tokens: sgp_ and 40 hex digits, with the instance's
+	// 16 hex digit ID or local between them in newer ones.
+	{"Sourcegraph access token", regexp.MustCompile(`\bsgp_(?:(?:[0-9a-f]{16}|local)_)?[0-9a-f]{40}\b`), Mask},
+	{"GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})`), Mask},
+	{"GitLab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`), Mask},
+	{"Slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`), Mask},
+	{"AWS access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), Mask},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`), Mask},
+	{"Stripe key", regexp.MustCompile(`\b[rs]k_(live|test)_[0-9A-Za-z]{16,}`), Mask},
+	{"JSON Web Token", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`), Mask},
+	// Passwords in URLs, e.g. redis://:password@host.
+	{"password in a URL", regexp.MustCompile(`(://[^\s:/@]*:)[^\s@/]+@`), "${1}" + Mask + "@"},
+	// Bearer credentials, which must have a digit, as in patterns.
+	{"bearer token", regexp.MustCompile(`(?i)\b(bearer)\s+[A-Za-z0-9._~+/=-]*[0-9][A-Za-z0-9._~+/=-]*`), "${1} " + Mask},
+}
+
+var (
+	mu       sync.RWMutex
+	secrets  []string
+	replacer *strings.Replacer
+)
+
+// Secrets adds values to mask wherever they appear, such as the configured
+// access token and API keys. Values shorter than 8 bytes are ignored.
+func Secrets(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		if len(v) >= minSecretLength {
+			secrets = append(secrets, v, Mask)
+		}
+	}
+	replacer = strings.NewReplacer(secrets...)
+}
+
+// String returns s with the credentials in it masked.
+func String(s string) string {
+	mu.RLock()
+	r := replacer
+	mu.RUnlock()
+	if r != nil {
+		s = r.Replace(s)
+	}
+	for _, c := range credentials {
+		s = c.re.ReplaceAllString(s, c.repl)
+	}
+	for _, p := range patterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// Credentials returns text with the credentials in it masked, and the
+// kinds of credential it found, such as "private key". It is meant for
+// text people write, such as search requests, which may well mention
+// passwords and tokens without giving any away, so unlike String it only
+// masks the secrets it has been told about and those in formats that
+// can't be mistaken for anything else.
+func Credentials(text string) (string, []string) {
+	mu.RLock()
+	r := replacer
+	mu.RUnlock()
+	var kinds []string
+	if r != nil {
+		if masked := r.Replace(text); masked != text {
+			text = masked
+			kinds = append(kinds, "secret of this server")
+		}
+	}
+	for _, c := range credentials {
+		if c.re.MatchString(text) {
+			text = c.re.ReplaceAllString(text, c.repl)
+			kinds = append(kinds, c.kind)
+		}
+	}
+	return text, kinds
+}
+
+// Handler wraps h so that the messages and attribute values it logs have
+// their credentials masked, errors included.
+func Handler(h slog.Handler) slog.Handler {
+	return handler{h}
+}
+
+type handler struct {
+	slog.Handler
+}
+
+func (h handler) Handle(ctx context.Context, r slog.Record) error {
+	clean := slog.NewRecord(r.Time, r.Level, String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		clean.AddAttrs(attr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, clean)
+}
+
+func (h handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		clean[i] = attr(a)
+	}
+	return handler{h.Handler.WithAttrs(clean)}
+}
+
+func (h handler) WithGroup(name string) slog.Handler {
+	return handler{h.Handler.WithGroup(name)}
+}
+
+// attr masks the credentials in a's value.
+func attr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, String(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		clean := make([]any, len(group))
+		for i, g := range group {
+			clean[i] = attr(g)
+		}
+		return slog.Group(a.Key, clean...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, String(x.Error()))
+		case []byte:
+			return slog.String(a.Key, String(string(x)))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -0,0 +1,28 @@
+package redact
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCredentialsSourcegraphToken(t *testing.T) {
+	const hex40 = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		text   string
+		masked bool
+	}{
+		{"token sgp_" + hex40 + " stopped working", true},
+		{"token sgp_0123456789abcdef_" + hex40 + " stopped working", true},
+		{"token sgp_local_" + hex40 + " stopped working", true},
+		{"where is sgx_create_enclave_from_buffer_ex called", false},
+		{"callers of sgemm_batched_strided_kernel", false},
+		{"sgp_0123456789abcdef is too short", false},
+		{"sgp_" + hex40 + "0123 is too long", false},
+	}
+	for _, tt := range tests {
+		got, kinds := Credentials(tt.text)
+		if masked := slices.Contains(kinds, "Sourcegraph access token"); masked != tt.masked {
+			t.Errorf("Credentials(%q) = %q, %v; want masked %v", tt.text, got, kinds, tt.masked)
+		}
+	}
+}
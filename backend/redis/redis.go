@@ -0,0 +1,253 @@
+// Package redis is a minimal Redis client speaking RESP2, with just enough
+// to run commands and read their replies, so the backend needs no client
+// library for its few uses of Redis.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNil is returned by Do for nil replies, such as GET of a missing key.
+var ErrNil = errors.New("redis: nil reply")
+
+// Error is an error reply from the server, such as "BUSYGROUP Consumer
+// Group name already exists".
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// HasPrefix reports whether the error reply starts with code, e.g.
+// "BUSYGROUP".
+func (e Error) HasPrefix(code string) bool {
+	return strings.HasPrefix(string(e), code)
+}
+
+// maxIdleConns is how many connections a Client keeps open for reuse.
+const maxIdleConns = 8
+
+// dialTimeout bounds connecting and authenticating.
+const dialTimeout = 5 * time.Second
+
+// Client runs commands on a Redis server, over a small pool of
+// connections. It is safe for concurrent use.
+type Client struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      *tls.Config
+	idle     chan *conn
+}
+
+// Open returns a client for the server at rawURL, written
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS. No
+// connection is made until the first command.
+func Open(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{idle: make(chan *conn, maxIdleConns)}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q; use redis:// or rediss://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Do runs a command and returns its reply: a string, an int64, a []any of
+// replies, or nil for nil elements of an array. Error replies are returned
+// as Error and a nil reply as ErrNil. ctx's deadline applies to the whole
+// exchange.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	// Unblock a read that outlives ctx, e.g. when shutting down.
+	stop := context.AfterFunc(ctx, func() { cn.SetDeadline(time.Unix(1, 0)) })
+	reply, err := cn.do(args)
+	if !stop() || err != nil && !isReply(err) {
+		// The connection may be mid-reply; don't reuse it.
+		cn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+// isReply reports whether err came from the server's reply, leaving the
+// connection in a usable state.
+func isReply(err error) bool {
+	var e Error
+	return errors.As(err, &e) || errors.Is(err, ErrNil)
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	var nc net.Conn
+	var err error
+	if c.tls != nil {
+		nc, err = (&tls.Dialer{Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		nc, err = (&net.Dialer{}).DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := cn.do(args); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do([]string{"SELECT", strconv.Itoa(c.db)}); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	cn.SetDeadline(time.Time{})
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (cn *conn) do(args []string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(cn.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+func (cn *conn) read() (any, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, ErrNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			item, err := cn.read()
+			switch {
+			case errors.Is(err, ErrNil):
+				item = nil
+			case err != nil && !isReply(err):
+				return nil, err
+			case err != nil:
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
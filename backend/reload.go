@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/examples"
+	"github.com/nlsearch/backend/translate"
+)
+
+// newPrompt loads the prompt template from PROMPT_FILE, or returns nil to
+// use the built-in one.
+func newPrompt(config Config) (*translate.Prompt, error) {
+	if config.PromptFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(config.PromptFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROMPT_FILE: %w", err)
+	}
+	prompt, err := translate.NewPrompt(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROMPT_FILE %s: %w", config.PromptFile, err)
+	}
+	return prompt, nil
+}
+
+// watchConfigFiles reloads the prompt template and the few-shot examples
+// when their files change, until ctx is done, so they can be iterated on
+// without a restart. A file that fails to load is logged and the running
+// version kept. Either of prompt and store may be nil.
+func watchConfigFiles(ctx context.Context, config Config, prompt *translate.Prompt, store *examples.Store) {
+	if config.ReloadInterval <= 0 {
+		return
+	}
+	if prompt != nil {
+		go watchFile(ctx, config.PromptFile, config.ReloadInterval, func() error {
+			data, err := os.ReadFile(config.PromptFile)
+			if err != nil {
+				return err
+			}
+			return prompt.Set(string(data))
+		})
+	}
+	if store != nil && config.ExamplesFile != "" {
+		go watchFile(ctx, config.ExamplesFile, config.ReloadInterval, func() error {
+			_, err := store.Reindex(ctx)
+			return err
+		})
+	}
+}
+
+// watchSettings reloads the settings when CONFIG_FILE or CONFIG_DIR
+// changes, until ctx is done. A new LOG_LEVEL takes effect at once; other
+// settings are read only at startup, so changes to them are logged as
+// needing a restart. Settings that fail to load are logged and the running
+// ones kept.
+func watchSettings(ctx context.Context, config Config, logLevel *slog.LevelVar) {
+	if config.ReloadInterval <= 0 {
+		return
+	}
+	var mu sync.Mutex
+	running, level := currentSettings(), config.LogLevel
+	reload := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		next, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		settings := currentSettings()
+		var changed []string
+		for _, v := range configVars {
+			if settings[v.name] != running[v.name] && v.name != "LOG_LEVEL" {
+				changed = append(changed, v.name)
+			}
+		}
+		running = settings
+		if next.LogLevel != level {
+			logLevel.Set(next.LogLevel)
+			level = next.LogLevel
+			slog.Info("Log level changed", "level", next.LogLevel.String())
+		}
+		if len(changed) > 0 {
+			slog.Warn("Settings changed that take effect after a restart", "settings", strings.Join(changed, ", "))
+		}
+		return nil
+	}
+	for _, name := range []string{"CONFIG_FILE", "CONFIG_DIR"} {
+		// Kubernetes updates a mounted ConfigMap by swapping a symlink in
+		// its directory, which changes the directory's modification time.
+		if path, _, ok := lookupSetting(name); ok {
+			go watchFile(ctx, path, config.ReloadInterval, reload)
+		}
+	}
+}
+
+// currentSettings returns the value of every configuration variable that is
+// set.
+func currentSettings() map[string]string {
+	settings := map[string]string{}
+	for _, v := range configVars {
+		if value, _, ok := lookupSetting(v.name); ok {
+			settings[v.name] = value
+		}
+	}
+	return settings
+}
+
+// watchFile calls reload whenever the modification time or size of path
+// changes, checking every interval until ctx is done. Polling needs no
+// platform support and also notices files replaced by rename, as editors
+// and Kubernetes ConfigMap updates do.
+func watchFile(ctx context.Context, path string, interval time.Duration, reload func() error) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			// Probably mid-replacement; try again next tick.
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		if err := reload(); err != nil {
+			slog.Error("Error reloading file; keeping the previous version", "path", path, "err", err)
+			continue
+		}
+		slog.Info("Reloaded file", "path", path)
+	}
+}
@@ -0,0 +1,241 @@
+// Package rewrite applies operator-defined rules to generated queries, to
+// keep them within what an instance allows or expects: removing filters it
+// disallows, mapping syntax it no longer supports, forcing a pattern type,
+// or limiting some tenants to their own repositories.
+package rewrite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/query"
+)
+
+// Rule is one rewrite, given by exactly one of its actions. Filters are
+// written as in queries, field:value; fields may be aliases, and match
+// negated filters too.
+type Rule struct {
+	// Remove is a field, or a field:value, whose filters are removed.
+	Remove string `json:"remove,omitempty"`
+	// Replace is a field:value whose filters are replaced With another
+	// filter, e.g. to map deprecated syntax.
+	Replace string `json:"replace,omitempty"`
+	With    string `json:"with,omitempty"`
+	// Set is a filter that replaces any filters for its field, or is added
+	// if there are none.
+	Set string `json:"set,omitempty"`
+	// Add is a filter added unless the query already has it outside any
+	// group. Filters are added so they apply to the whole query, grouping
+	// queries with a top-level or first.
+	Add string `json:"add,omitempty"`
+	// Tenants limits the rule to the requests of the callers with these
+	// names; it applies to every request when empty.
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// Engine applies its rules, in order, to queries.
+type Engine struct {
+	rules []Rule
+}
+
+// Parse reads a JSON array of rules, such as
+//
+//	[{"remove": "timeout"}, {"replace": "type:repository", "with": "select:repo"},
+//	 {"set": "patterntype:keyword"}, {"add": "repo:^github\\.com/acme/", "tenants": ["acme"]}]
+//
+// and checks that each has one action with valid filters.
+func Parse(data string) (*Engine, error) {
+	var rules []Rule
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return &Engine{rules: rules}, nil
+}
+
+func (r Rule) check() error {
+	actions := 0
+	for _, a := range []string{r.Remove, r.Replace, r.Set, r.Add} {
+		if a != "" {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("must have exactly one of remove, replace, set and add")
+	}
+	if r.With != "" && r.Replace == "" {
+		return errors.New("with is only for replace")
+	}
+	if r.Remove != "" && !strings.Contains(r.Remove, ":") {
+		if !query.KnownField(strings.TrimPrefix(r.Remove, "-")) {
+			return fmt.Errorf("unknown field %q", r.Remove)
+		}
+		return nil
+	}
+	// Filters that are matched may be invalid, such as deprecated syntax to
+	// replace, but not ones that are written into queries.
+	for _, filter := range []string{r.Remove, r.Replace} {
+		if _, err := parseFilter(filter); filter != "" && err != nil {
+			return err
+		}
+	}
+	for _, filter := range []string{r.With, r.Set, r.Add} {
+		if filter == "" {
+			continue
+		}
+		if _, err := parseFilter(filter); err != nil {
+			return err
+		}
+		for _, p := range query.Validate(filter) {
+			if p.Severity == query.Error {
+				return fmt.Errorf("%q: %s", filter, p.Message)
+			}
+		}
+	}
+	return nil
+}
+
+// parseFilter parses a single field:value filter.
+func parseFilter(filter string) (query.Token, error) {
+	parsed, err := query.Parse(filter)
+	if err != nil {
+		return query.Token{}, err
+	}
+	if len(parsed.Tokens) != 1 || parsed.Tokens[0].Kind != query.Field || !query.KnownField(parsed.Tokens[0].Field) {
+		return query.Token{}, fmt.Errorf("%q is not a single filter", filter)
+	}
+	return parsed.Tokens[0], nil
+}
+
+// Rewrite applies the rules that apply to the caller in ctx to q, in
+// order, and returns the result. Rules that would leave q unparsable, such
+// as removing the only filter in a group, are skipped.
+func (e *Engine) Rewrite(ctx context.Context, q string) string {
+	tenant := ""
+	if id, ok := middleware.IdentityFrom(ctx); ok {
+		tenant = id.Name
+	}
+	var applied []string
+	for _, rule := range e.rules {
+		if len(rule.Tenants) > 0 && !slices.Contains(rule.Tenants, tenant) {
+			continue
+		}
+		rewritten := rule.apply(q)
+		if rewritten == q {
+			continue
+		}
+		if _, err := query.Parse(rewritten); err != nil {
+			slog.WarnContext(ctx, "Skipping query rewrite rule that breaks the query", "rule", rule.String(), "err", err)
+			continue
+		}
+		q = rewritten
+		applied = append(applied, rule.String())
+	}
+	if len(applied) > 0 {
+		slog.InfoContext(ctx, "Rewrote query", "rules", strings.Join(applied, "; "))
+	}
+	return q
+}
+
+// Tenants returns the tenants some rule is limited to, whose queries differ
+// from everyone else's. It returns nil for a nil e.
+func (e *Engine) Tenants() []string {
+	if e == nil {
+		return nil
+	}
+	var tenants []string
+	for _, rule := range e.rules {
+		for _, tenant := range rule.Tenants {
+			if !slices.Contains(tenants, tenant) {
+				tenants = append(tenants, tenant)
+			}
+		}
+	}
+	return tenants
+}
+
+func (r Rule) String() string {
+	switch {
+	case r.Remove != "":
+		return "remove " + r.Remove
+	case r.Replace != "":
+		return "replace " + r.Replace + " with " + r.With
+	case r.Set != "":
+		return "set " + r.Set
+	default:
+		return "add " + r.Add
+	}
+}
+
+// apply returns q rewritten by r, or q itself if it doesn't parse or r
+// doesn't change it.
+func (r Rule) apply(q string) string {
+	parsed, err := query.Parse(q)
+	if err != nil {
+		return q
+	}
+	switch {
+	case r.Remove != "":
+		field, value, hasValue := strings.Cut(r.Remove, ":")
+		if hasValue {
+			tok, _ := parseFilter(r.Remove)
+			field, value = tok.Field, tok.Value
+		}
+		return strings.TrimSpace(replaceTokens(q, parsed.Fields(strings.TrimPrefix(field, "-")), func(t query.Token) bool {
+			return !hasValue || strings.EqualFold(t.Value, value)
+		}, ""))
+	case r.Replace != "":
+		from, _ := parseFilter(r.Replace)
+		return strings.TrimSpace(replaceTokens(q, parsed.Fields(from.Field), func(t query.Token) bool {
+			return t.Negated == from.Negated && strings.EqualFold(t.Value, from.Value)
+		}, r.With))
+	case r.Set != "":
+		set, _ := parseFilter(r.Set)
+		existing := parsed.Fields(set.Field)
+		if len(existing) == 0 {
+			return query.AppendFilter(q, r.Set)
+		}
+		// The first filter for the field becomes the one set, and the rest
+		// go. Removing the rest leaves the first where it was.
+		q = replaceTokens(q, existing[1:], func(query.Token) bool { return true }, "")
+		return strings.TrimSpace(q[:existing[0].Pos] + r.Set + q[existing[0].End:])
+	default:
+		add, _ := parseFilter(r.Add)
+		for _, t := range parsed.TopLevelFields(add.Field) {
+			if t.Negated == add.Negated && t.Value == add.Value {
+				return q
+			}
+		}
+		return query.AppendFilter(q, r.Add)
+	}
+}
+
+// replaceTokens replaces the tokens of q that match with replacement, or
+// removes them along with the space before them if it is empty. tokens
+// must be in the order they appear in q.
+func replaceTokens(q string, tokens []query.Token, match func(query.Token) bool, replacement string) string {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		t := tokens[i]
+		if !match(t) {
+			continue
+		}
+		if replacement != "" {
+			q = q[:t.Pos] + replacement + q[t.End:]
+			continue
+		}
+		q = strings.TrimRight(q[:t.Pos], " \t\n") + q[t.End:]
+	}
+	return q
+}
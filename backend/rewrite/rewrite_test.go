@@ -0,0 +1,41 @@
+package rewrite
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		q     string
+		want  string
+	}{
+		{"add", `[{"add": "repo:^acme/"}]`, "auth", "auth repo:^acme/"},
+		{"add present", `[{"add": "repo:^acme/"}]`, "auth repo:^acme/", "auth repo:^acme/"},
+		{"add to or", `[{"add": "repo:^acme/"}]`, "foo or bar", "(foo or bar) repo:^acme/"},
+		{"add with or after it", `[{"add": "repo:^acme/"}]`, "repo:^acme/ foo or bar", "(repo:^acme/ foo or bar) repo:^acme/"},
+		{"add present in a group", `[{"add": "repo:^acme/"}]`, "(repo:^acme/ foo) or bar", "((repo:^acme/ foo) or bar) repo:^acme/"},
+		{"add with or in a group", `[{"add": "repo:^acme/"}]`, "(foo or bar) lang:go", "(foo or bar) lang:go repo:^acme/"},
+		{"set missing", `[{"set": "patterntype:keyword"}]`, "foo or bar", "(foo or bar) patterntype:keyword"},
+		{"set", `[{"set": "patterntype:keyword"}]`, "foo patterntype:regexp bar patterntype:literal", "foo patterntype:keyword bar"},
+		{"remove", `[{"remove": "timeout"}]`, "foo timeout:30s", "foo"},
+		{"replace", `[{"replace": "type:repository", "with": "select:repo"}]`, "acme type:repository", "acme select:repo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := e.Rewrite(context.Background(), tt.q)
+			if got != tt.want {
+				t.Errorf("Rewrite(%q) = %q, want %q", tt.q, got, tt.want)
+			}
+			if again := e.Rewrite(context.Background(), got); again != got {
+				t.Errorf("Rewrite is not idempotent: %q, then %q", got, again)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+// Package search executes queries against Sourcegraph's streaming search API.
+package search
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/redact"
+)
+
+const defaultDisplayLimit = 500
+
+// Client executes queries against Sourcegraph's streaming search API
+// (/.api/search/stream), the same endpoint src-cli uses.
+type Client struct {
+	baseURL     string
+	accessToken string
+	auth        deepsearch.Auth
+	httpClient  *http.Client
+}
+
+type Options struct {
+	// DisplayLimit caps the number of matches returned; 0 uses the default.
+	DisplayLimit int
+}
+
+type MatchLine struct {
+	LineNumber int    `json:"line_number"`
+	Content    string `json:"content"`
+	// HTML is Content with syntax highlighting, when the caller asked for
+	// it.
+	HTML string `json:"html,omitempty"`
+}
+
+type Match struct {
+	Type       string `json:"type"`
+	Repository string `json:"repository"`
+	Path       string `json:"path,omitempty"`
+	Commit     string `json:"commit,omitempty"`
+	// Language is the language of the file, when the caller asked for
+	// highlighting and it is recognized.
+	Language string      `json:"language,omitempty"`
+	Message  string      `json:"message,omitempty"`
+	Lines    []MatchLine `json:"lines,omitempty"`
+	Symbols  []string    `json:"symbols,omitempty"`
+}
+
+type Progress struct {
+	Done       bool     `json:"done"`
+	MatchCount int      `json:"match_count"`
+	DurationMs int      `json:"duration_ms"`
+	Skipped    []string `json:"skipped,omitempty"`
+}
+
+type Alert struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+type Result struct {
+	Matches  []Match  `json:"matches"`
+	Progress Progress `json:"progress"`
+	Alert    *Alert   `json:"alert,omitempty"`
+}
+
+// streamMatch and streamProgress mirror the wire format of the streaming API's
+// events. Only the fields we aggregate are decoded.
+type streamMatch struct {
+	Type        string `json:"type"`
+	Repository  string `json:"repository"`
+	Path        string `json:"path"`
+	Commit      string `json:"commit"`
+	OID         string `json:"oid"`
+	Message     string `json:"message"`
+	LineMatches []struct {
+		Line       string `json:"line"`
+		LineNumber int    `json:"lineNumber"`
+	} `json:"lineMatches"`
+	ChunkMatches []struct {
+		Content      string `json:"content"`
+		ContentStart struct {
+			Line int `json:"line"`
+		} `json:"contentStart"`
+	} `json:"chunkMatches"`
+	Symbols []struct {
+		Name string `json:"name"`
+	} `json:"symbols"`
+}
+
+type streamProgress struct {
+	Done       bool `json:"done"`
+	MatchCount int  `json:"matchCount"`
+	DurationMs int  `json:"durationMs"`
+	Skipped    []struct {
+		Title string `json:"title"`
+	} `json:"skipped"`
+}
+
+func NewClient(baseURL, accessToken string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		accessToken: accessToken,
+		// Streams can legitimately run for a long time; rely on the context
+		// for cancellation instead of a client-wide timeout.
+		httpClient: &http.Client{},
+	}
+}
+
+// WithTransport sends the client's requests through rt, e.g. to share an
+// outbound rate limit. It returns c for chaining.
+func (c *Client) WithTransport(rt http.RoundTripper) *Client {
+	c.httpClient.Transport = rt
+	return c
+}
+
+// WithAuth sets how the client's requests carry the access token. It
+// returns c for chaining.
+func (c *Client) WithAuth(auth deepsearch.Auth) *Client {
+	c.auth = auth
+	return c
+}
+
+// Search runs query and aggregates the streamed matches. onProgress, if
+// non-nil, is called for every progress event as the search advances.
+func (c *Client) Search(ctx context.Context, query string, opts Options, onProgress func(Progress)) (*Result, error) {
+	limit := opts.DisplayLimit
+	if limit <= 0 {
+		limit = defaultDisplayLimit
+	}
+
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("v", "V3")
+	params.Set("t", "keyword")
+	params.Set("display", strconv.Itoa(limit))
+	apiURL := fmt.Sprintf("%s/.api/search/stream?%s", c.baseURL, params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", deepsearch.ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, redact.String(string(body)))
+	}
+
+	agg := newMatchAggregator(limit)
+	result := &Result{}
+	err = readEventStream(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case "matches":
+			var matches []streamMatch
+			if err := json.Unmarshal(data, &matches); err != nil {
+				return fmt.Errorf("decode matches: %w", err)
+			}
+			agg.add(matches)
+		case "progress":
+			var p streamProgress
+			if err := json.Unmarshal(data, &p); err != nil {
+				return fmt.Errorf("decode progress: %w", err)
+			}
+			result.Progress = Progress{Done: p.Done, MatchCount: p.MatchCount, DurationMs: p.DurationMs}
+			for _, s := range p.Skipped {
+				result.Progress.Skipped = append(result.Progress.Skipped, s.Title)
+			}
+			if onProgress != nil {
+				onProgress(result.Progress)
+			}
+		case "alert":
+			var alert Alert
+			if err := json.Unmarshal(data, &alert); err != nil {
+				return fmt.Errorf("decode alert: %w", err)
+			}
+			result.Alert = &alert
+		case "error":
+			var e struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(data, &e)
+			return fmt.Errorf("search error: %s", e.Message)
+		case "done":
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Matches = agg.matches
+	return result, nil
+}
+
+// readEventStream parses a text/event-stream body and calls handle for each
+// dispatched event. Returning io.EOF from handle stops reading cleanly.
+func readEventStream(r io.Reader, handle func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var event string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event != "" || len(data) > 0 {
+				if event == "" {
+					event = "message"
+				}
+				if err := handle(event, data); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// Comment, used by servers as a keepalive.
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read stream: %w", err)
+	}
+	return nil
+}
+
+// matchAggregator merges matches from successive events, folding repeated
+// matches for the same file (or commit) into one entry.
+type matchAggregator struct {
+	limit   int
+	matches []Match
+	index   map[string]int
+}
+
+func newMatchAggregator(limit int) *matchAggregator {
+	return &matchAggregator{limit: limit, index: map[string]int{}}
+}
+
+func (a *matchAggregator) add(matches []streamMatch) {
+	for _, m := range matches {
+		commit := m.Commit
+		if commit == "" {
+			commit = m.OID
+		}
+		key := strings.Join([]string{m.Type, m.Repository, commit, m.Path}, "\x00")
+
+		i, ok := a.index[key]
+		if !ok {
+			if len(a.matches) >= a.limit {
+				continue
+			}
+			a.matches = append(a.matches, Match{
+				Type:       m.Type,
+				Repository: m.Repository,
+				Path:       m.Path,
+				Commit:     commit,
+				Message:    m.Message,
+			})
+			i = len(a.matches) - 1
+			a.index[key] = i
+		}
+
+		match := &a.matches[i]
+		for _, l := range m.LineMatches {
+			match.Lines = append(match.Lines, MatchLine{LineNumber: l.LineNumber + 1, Content: l.Line})
+		}
+		for _, c := range m.ChunkMatches {
+			for offset, line := range strings.Split(strings.TrimSuffix(c.Content, "\n"), "\n") {
+				match.Lines = append(match.Lines, MatchLine{LineNumber: c.ContentStart.Line + offset + 1, Content: line})
+			}
+		}
+		for _, s := range m.Symbols {
+			match.Symbols = append(match.Symbols, s.Name)
+		}
+	}
+}
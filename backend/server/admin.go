@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/examples"
+	"github.com/nlsearch/backend/middleware"
+)
+
+// ExampleStore holds the few-shot example index used in prompts.
+type ExampleStore interface {
+	Status() examples.Status
+	Reindex(ctx context.Context) (examples.Status, error)
+}
+
+// ConversationTracker lists the Deep Search conversations the server
+// created, such as a deepsearch.Tracker.
+type ConversationTracker interface {
+	List() []deepsearch.TrackedConversation
+	Get(id int) (deepsearch.TrackedConversation, bool)
+}
+
+// ConversationFetcher fetches a conversation from Sourcegraph.
+type ConversationFetcher interface {
+	GetConversation(ctx context.Context, id int) (*deepsearch.Conversation, error)
+}
+
+// adminEnabled reports whether anybody could have the admin role.
+func (s *Server) adminEnabled() bool {
+	proxyAdmins := len(s.opts.ProxyAuth.Trusted) > 0 && len(s.opts.ProxyAuth.Admins) > 0
+	return len(s.opts.AdminKeys) > 0 || proxyAdmins
+}
+
+// registerAdmin mounts the admin routes, which require the admin role. They
+// are not registered when nobody could have it.
+func (s *Server) registerAdmin(mux *http.ServeMux) {
+	if !s.adminEnabled() {
+		return
+	}
+	s.handle(mux, "/admin/export", middleware.RoleAdmin, s.handleExport)
+	s.handle(mux, "/admin/history", middleware.RoleAdmin, s.handleAdminDeleteHistory)
+	if s.opts.Conversations != nil {
+		s.handle(mux, "/admin/conversations", middleware.RoleAdmin, s.handleConversations)
+		s.handle(mux, "/admin/conversations/{id}", middleware.RoleAdmin, s.handleConversation)
+	}
+	if s.opts.LogLevel != nil {
+		s.handle(mux, "/admin/log-level", middleware.RoleAdmin, s.handleLogLevel)
+	}
+	if s.opts.Examples != nil {
+		s.handle(mux, "/admin/examples", middleware.RoleAdmin, s.handleExamples)
+		s.handle(mux, "/admin/examples/reindex", middleware.RoleAdmin, s.handleReindexExamples)
+	}
+}
+
+// handleLogLevel reports the log level, or changes it with PUT.
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req LogLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, errInvalidBody)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+			writeError(w, r, invalidField("level", "level must be debug, info, warn or error"))
+			return
+		}
+		if level != s.opts.LogLevel.Level() {
+			slog.InfoContext(r.Context(), "Changing log level", "from", s.opts.LogLevel.Level(), "to", level)
+			s.opts.LogLevel.Set(level)
+		}
+	default:
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LogLevelRequest{Level: strings.ToLower(s.opts.LogLevel.Level().String())})
+}
+
+func (s *Server) handleExamples(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.opts.Examples.Status())
+}
+
+func (s *Server) handleReindexExamples(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	status, err := s.opts.Examples.Reindex(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reindexing examples", "err", err)
+		apiErr := apierror.New(apierror.Internal, "Failed to reindex examples: "+err.Error())
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+	slog.Info("Reindexed examples", "examples", status.Examples)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleExport writes the translations users gave feedback on as JSON lines,
+// oldest first, for fine-tuning or offline evaluation. With
+// ?unlabeled=true, successful translations without feedback are included
+// too, labeled "unlabeled".
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	unlabeled := false
+	if v := r.URL.Query().Get("unlabeled"); v != "" {
+		var err error
+		if unlabeled, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, invalidField("unlabeled", "unlabeled must be true or false"))
+			return
+		}
+	}
+
+	entries, err := s.opts.Store.ListHistory(r.Context(), HistoryQuery{Limit: math.MaxInt, All: true})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing history", "err", err)
+		s.reportError(r, err, errHistoryFailed)
+		writeError(w, r, errHistoryFailed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="nlsearch-export.jsonl"`)
+	enc := json.NewEncoder(w)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if record, ok := exportRecord(entries[i], unlabeled); ok {
+			enc.Encode(record)
+		}
+	}
+}
+
+func exportRecord(e HistoryEntry, unlabeled bool) (ExportRecord, bool) {
+	// Refinements are left out: the follow-up alone isn't the request.
+	if e.Error != "" || e.Query == "" || e.RefinedFrom != "" {
+		return ExportRecord{}, false
+	}
+	record := ExportRecord{Input: e.Request, Query: e.Query, Label: "unlabeled", Generated: e.Query, Extraction: e.Extraction, CreatedAt: e.CreatedAt}
+	if e.Feedback == nil {
+		return record, unlabeled
+	}
+	record.Label = e.Feedback.Label
+	if e.Feedback.Query != "" {
+		record.Query = e.Feedback.Query
+	}
+	return record, true
+}
+
+// handleConversations lists tracked conversations, most recent first.
+// ?status= keeps only those in one status, and ?waiting=true only those the
+// server is still polling, to find stuck ones. ?deleted=false keeps those
+// still on the instance. Results are paged with ?limit= and ?cursor=.
+func (s *Server) handleConversations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	var waitingOnly bool
+	if v := r.URL.Query().Get("waiting"); v != "" {
+		var err error
+		if waitingOnly, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, invalidField("waiting", "waiting must be true or false"))
+			return
+		}
+	}
+	var deleted *bool
+	if v := r.URL.Query().Get("deleted"); v != "" {
+		d, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, invalidField("deleted", "deleted must be true or false"))
+			return
+		}
+		deleted = &d
+	}
+
+	limit, cursor, apiErr := pageParams(r, defaultPageSize)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	resp := ConversationsResponse{Conversations: []deepsearch.TrackedConversation{}}
+	for _, c := range s.opts.Conversations.List() {
+		if status != "" && c.Status != status || waitingOnly && !c.Waiting || deleted != nil && c.Deleted != *deleted {
+			continue
+		}
+		if !cursor.Follows(c.CreatedAt, conversationKey(c.ID)) {
+			continue
+		}
+		if len(resp.Conversations) == limit {
+			last := resp.Conversations[limit-1]
+			resp.NextCursor = Cursor{CreatedAt: last.CreatedAt, ID: conversationKey(last.ID)}.String()
+			break
+		}
+		resp.Conversations = append(resp.Conversations, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleConversation shows one tracked conversation alongside its current
+// state on Sourcegraph, including every question and raw answer.
+func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, invalidField("id", "id must be a conversation number"))
+		return
+	}
+	tracked, ok := s.opts.Conversations.Get(id)
+	if !ok {
+		writeError(w, r, apierror.New(apierror.NotFound, "This server has no record of that conversation"))
+		return
+	}
+
+	resp := ConversationResponse{Tracked: tracked}
+	if s.opts.DeepSearch != nil {
+		// The local record is still worth showing when Sourcegraph can't be
+		// reached, so a failed fetch is reported alongside it.
+		if resp.Upstream, err = s.opts.DeepSearch.GetConversation(r.Context(), id); err != nil {
+			resp.UpstreamError = err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
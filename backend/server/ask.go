@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/nlsearch/backend/translate"
+)
+
+// handleAsk has Deep Search answer a question about the code, for /ask. The
+// question is passed on as it is, without the prompt that asks for a
+// search query.
+func (s *Server) handleAsk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req AskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	if strings.TrimSpace(req.Question) == "" {
+		writeError(w, r, invalidField("question", "question is required"))
+		return
+	}
+	if req.TimeoutSeconds < 0 {
+		writeError(w, r, invalidField("timeout_seconds", "timeout_seconds must not be negative"))
+		return
+	}
+
+	// Questions go the way of QueryRequests with the question intent, so
+	// they get the same timeouts, privacy and accounting.
+	query := QueryRequest{
+		Query:          req.Question,
+		TimeoutSeconds: req.TimeoutSeconds,
+		NoStore:        req.NoStore,
+		Snippets:       req.Snippets,
+		Highlight:      req.Highlight,
+		HTML:           req.HTML,
+		Intent:         string(translate.IntentQuestion),
+	}
+	if apiErr := s.screenSecrets(r.Context(), &query); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(query))
+	defer cancel()
+
+	resp, err := s.answerQuestion(ctx, query, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error answering question", "err", err)
+		apiErr := translationError(ctx, err, false)
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+
+	// Clients can range over sources without checking for null.
+	if resp.Sources == nil {
+		resp.Sources = []translate.Source{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AskResponse{
+		Answer:     resp.Reply,
+		AnswerHTML: resp.ReplyHTML,
+		Sources:    resp.Sources,
+		Stats:      resp.Stats,
+	})
+}
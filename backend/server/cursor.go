@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// Cursor marks a position in a list ordered most recent first, by creation
+// time and then by ID, so pages stay stable while new items are added. The
+// zero Cursor is the start of the list.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// defaultPageSize is the page size of list endpoints without ?limit=.
+const defaultPageSize = 50
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func (c Cursor) IsZero() bool {
+	return c.CreatedAt.IsZero() && c.ID == ""
+}
+
+// Follows reports whether the item created at createdAt with id comes after
+// c in the list.
+func (c Cursor) Follows(createdAt time.Time, id string) bool {
+	if c.IsZero() {
+		return true
+	}
+	if !createdAt.Equal(c.CreatedAt) {
+		return createdAt.Before(c.CreatedAt)
+	}
+	return id < c.ID
+}
+
+// String encodes the cursor as an opaque token for next_cursor.
+func (c Cursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token produced by Cursor.String. The empty token is
+// the zero Cursor.
+func ParseCursor(token string) (Cursor, error) {
+	if token == "" {
+		return Cursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return Cursor{}, errInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+	return Cursor{CreatedAt: time.Unix(0, n).UTC(), ID: id}, nil
+}
+
+// pageParams reads ?limit= and ?cursor= for a list endpoint.
+func pageParams(r *http.Request, defaultLimit int) (int, Cursor, *apierror.Error) {
+	limit := defaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return 0, Cursor{}, invalidField("limit", "limit must be a positive integer")
+		}
+		limit = n
+	}
+	cursor, err := ParseCursor(r.URL.Query().Get("cursor"))
+	if err != nil {
+		return 0, Cursor{}, invalidField("cursor", "cursor is not one returned as next_cursor")
+	}
+	return limit, cursor, nil
+}
+
+// conversationKey is the ID a tracked conversation is ordered by in cursors.
+// It is zero-padded so that IDs compare as numbers.
+func conversationKey(id int) string {
+	return fmt.Sprintf("%020d", id)
+}
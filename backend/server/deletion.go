@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/middleware"
+)
+
+// HistoryDeleter is implemented by history stores that can delete
+// everything of one user, for privacy requests. DeleteHistory deletes
+// owner's entries, shared ones included, and returns how many it deleted
+// and how many of those had feedback.
+type HistoryDeleter interface {
+	DeleteHistory(ctx context.Context, owner string) (entries, feedback int, err error)
+}
+
+// JobDeleter is implemented by job stores that can delete one user's
+// jobs. DeleteJobs deletes owner's finished jobs and returns how many it
+// deleted; jobs still running are left, since they would be saved again
+// when they finish.
+type JobDeleter interface {
+	DeleteJobs(ctx context.Context, owner string) (int, error)
+}
+
+// ConversationForgetter is implemented by conversation trackers that can
+// forget one user's conversations, such as a deepsearch.Tracker. Forget
+// returns the conversations it forgot.
+type ConversationForgetter interface {
+	Forget(owner string) []deepsearch.TrackedConversation
+}
+
+// ConversationDeleter deletes a conversation from Sourcegraph, such as a
+// deepsearch.Client.
+type ConversationDeleter interface {
+	DeleteConversation(ctx context.Context, id int) error
+}
+
+// handleDeleteHistory deletes the caller's data, for DELETE /history?user=me.
+// Anonymous callers share one history, so they can't delete it.
+func (s *Server) handleDeleteHistory(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("user") != "me" {
+		writeError(w, r, invalidField("user", "user must be me; admins delete other users' data with /api/v1/admin/history"))
+		return
+	}
+	id, ok := middleware.IdentityFrom(r.Context())
+	if !ok || id.Name == "" {
+		writeError(w, r, apierror.New(apierror.Forbidden, "Anonymous history is shared by every anonymous user, so it can't be deleted"))
+		return
+	}
+	s.deleteUserData(w, r, id.Name)
+}
+
+// handleAdminDeleteHistory deletes the data of the user named by ?user=.
+func (s *Server) handleAdminDeleteHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		writeError(w, r, invalidField("user", "user is required"))
+		return
+	}
+	s.deleteUserData(w, r, user)
+}
+
+// deleteUserData deletes user's history entries, with their feedback, and
+// finished jobs from every store, and the Deep Search conversations tracked
+// for them, and answers with a DeletionReport.
+func (s *Server) deleteUserData(w http.ResponseWriter, r *http.Request, user string) {
+	history, ok := s.opts.Store.(HistoryDeleter)
+	if !ok {
+		writeError(w, r, apierror.New(apierror.Internal, "This server's history store can't delete a user's entries"))
+		return
+	}
+	report := DeletionReport{User: user}
+	var err error
+	if report.History, report.Feedback, err = history.DeleteHistory(r.Context(), user); err == nil {
+		if jobs, ok := s.opts.Jobs.(JobDeleter); ok {
+			report.Jobs, err = jobs.DeleteJobs(r.Context(), user)
+		}
+	}
+	if err == nil {
+		report.Conversations, report.RemainingConversations = s.deleteConversations(r.Context(), user)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting user data", "user", user, "err", err)
+		apiErr := apierror.New(apierror.Internal, "Failed to delete the user's data; some of it may remain, so try again")
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted user data", "user", user, "by", owner(r.Context()), "history", report.History, "feedback", report.Feedback, "jobs", report.Jobs, "conversations", report.Conversations, "remaining_conversations", len(report.RemainingConversations))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// deleteConversations forgets the tracked Deep Search conversations of
+// user, deleting those still on the instance, and returns how many it
+// forgot and the IDs of those it couldn't delete.
+func (s *Server) deleteConversations(ctx context.Context, user string) (int, []int) {
+	tracker, ok := s.opts.Conversations.(ConversationForgetter)
+	if !ok {
+		return 0, nil
+	}
+	deleter, _ := s.opts.DeepSearch.(ConversationDeleter)
+	forgotten := tracker.Forget(user)
+	var remaining []int
+	for _, c := range forgotten {
+		if c.Deleted {
+			continue
+		}
+		if deleter == nil {
+			remaining = append(remaining, c.ID)
+			continue
+		}
+		if err := deleter.DeleteConversation(ctx, c.ID); err != nil {
+			slog.WarnContext(ctx, "Error deleting conversation of user whose data is being deleted", "conversation", c.ID, "err", err)
+			remaining = append(remaining, c.ID)
+		}
+	}
+	return len(forgotten), remaining
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/query"
+	"github.com/nlsearch/backend/search"
+)
+
+const (
+	// maxInterpretations caps the interpretations offered for an ambiguous
+	// name; a name matching more is a broad search, not a mistake.
+	maxInterpretations = 5
+	// disambiguationTimeout bounds the searches for what a name matches,
+	// which only add to the response.
+	disambiguationTimeout = 5 * time.Second
+	// maxRepositoryMatches caps the repositories looked at for a name.
+	maxRepositoryMatches = 50
+)
+
+// plainName matches filter values and patterns that are a bare name, such
+// as frontend or NewClient, rather than a path or a regular expression.
+var plainName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// Interpretation is one reading of a query with an ambiguous name, with a
+// query limited to what the name means in it.
+type Interpretation struct {
+	// Label says what the name is taken to mean, e.g. the repository.
+	Label string `json:"label"`
+	Query string `json:"query"`
+}
+
+// interpretations returns the readings of q when a name in it matches
+// several repositories or symbols: a repo: filter that names two to
+// maxInterpretations repositories, or a symbol search for a name defined in
+// as many files. It returns nil if q is unambiguous or the searches fail.
+func (s *Server) interpretations(ctx context.Context, q string) []Interpretation {
+	parsed, err := query.Parse(q)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, disambiguationTimeout)
+	defer cancel()
+
+	for _, tok := range parsed.Fields("repo") {
+		if tok.Negated || !plainName.MatchString(tok.Value) {
+			continue
+		}
+		repos, err := s.namedRepositories(ctx, tok.Value)
+		if err != nil {
+			slog.WarnContext(ctx, "Could not look up repositories to disambiguate", "repo", tok.Value, "err", err)
+			return nil
+		}
+		if len(repos) < 2 || len(repos) > maxInterpretations {
+			continue
+		}
+		interpretations := make([]Interpretation, len(repos))
+		for i, repo := range repos {
+			interpretations[i] = Interpretation{
+				Label: repo,
+				Query: q[:tok.Pos] + "repo:" + anchored(repo) + q[tok.End:],
+			}
+		}
+		return interpretations
+	}
+
+	patterns := parsed.Patterns()
+	symbol := false
+	for _, tok := range parsed.Fields("type") {
+		symbol = symbol || tok.Value == "symbol" && !tok.Negated
+	}
+	if !symbol || len(patterns) != 1 || !plainName.MatchString(patterns[0].Value) {
+		return nil
+	}
+	definitions, err := s.symbolDefinitions(ctx, q, patterns[0].Value)
+	if err != nil {
+		slog.WarnContext(ctx, "Could not look up symbols to disambiguate", "symbol", patterns[0].Value, "err", err)
+		return nil
+	}
+	if len(definitions) < 2 || len(definitions) > maxInterpretations {
+		return nil
+	}
+	interpretations := make([]Interpretation, len(definitions))
+	for i, m := range definitions {
+		interpretations[i] = Interpretation{
+			Label: fmt.Sprintf("%s in %s/%s", patterns[0].Value, m.Repository, m.Path),
+			Query: fmt.Sprintf("repo:%s file:%s %s", anchored(m.Repository), anchored(m.Path), q),
+		}
+	}
+	return interpretations
+}
+
+// namedRepositories returns the repositories whose name ends in name, such
+// as github.com/a/frontend and github.com/b/frontend for frontend. Other
+// repositories repo:name matches, such as github.com/a/frontend-utils,
+// aren't what the name means.
+func (s *Server) namedRepositories(ctx context.Context, name string) ([]string, error) {
+	result, err := s.opts.Searcher.Search(ctx, fmt.Sprintf("repo:%s type:repo count:%d", name, maxRepositoryMatches), search.Options{DisplayLimit: maxRepositoryMatches}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	for _, m := range result.Matches {
+		if m.Type == "repo" && strings.EqualFold(path.Base(m.Repository), name) {
+			repos = append(repos, m.Repository)
+		}
+	}
+	return repos, nil
+}
+
+// symbolDefinitions returns a match for each file in which the symbol
+// search q finds a symbol called name, up to one more than
+// maxInterpretations.
+func (s *Server) symbolDefinitions(ctx context.Context, q, name string) ([]search.Match, error) {
+	result, err := s.opts.Searcher.Search(ctx, q, search.Options{DisplayLimit: maxRepositoryMatches}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var definitions []search.Match
+	for _, m := range result.Matches {
+		for _, symbol := range m.Symbols {
+			if symbol == name {
+				definitions = append(definitions, m)
+				break
+			}
+		}
+		if len(definitions) > maxInterpretations {
+			break
+		}
+	}
+	return definitions, nil
+}
+
+// anchored returns a filter value matching exactly s.
+func anchored(s string) string {
+	return "^" + regexp.QuoteMeta(s) + "$"
+}
@@ -0,0 +1,5 @@
+window.ui = SwaggerUIBundle({
+    url: '/api/openapi.json',
+    dom_id: '#swagger-ui',
+    persistAuthorization: true,
+});
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/errreport"
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/policy"
+)
+
+var (
+	errMethodNotAllowed = apierror.New(apierror.MethodNotAllowed, "Method not allowed")
+	errInvalidBody      = apierror.New(apierror.InvalidRequest, "Invalid request body")
+	errQueryRequired    = apierror.New(apierror.InvalidRequest, "Query is required").WithDetails(map[string]string{"field": "query"})
+	errHistoryFailed    = apierror.New(apierror.Internal, "Failed to list history")
+	errHistoryAnonymous = apierror.New(apierror.Unauthorized, "Authentication required to list history")
+)
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apierror.Error) {
+	apierror.Write(w, middleware.RequestIDFrom(r.Context()), e)
+}
+
+// reportError sends err, which the request failed with, to the error
+// reporter if apiErr is a server-side failure. Client errors and timeouts
+// aren't reported.
+func (s *Server) reportError(r *http.Request, err error, apiErr *apierror.Error) {
+	if s.opts.ErrorReporter == nil || apiErr.Code.Status() < http.StatusInternalServerError || apiErr.Code == apierror.Timeout {
+		return
+	}
+	s.opts.ErrorReporter.Capture(errreport.Event{
+		Message:   apiErr.Message,
+		Err:       err,
+		Request:   r,
+		RequestID: middleware.RequestIDFrom(r.Context()),
+		User:      owner(r.Context()),
+		Tags:      map[string]string{"code": string(apiErr.Code)},
+	})
+}
+
+// reportPanic sends a panic recovered while serving r to the error reporter.
+func (s *Server) reportPanic(r *http.Request, value any, stack []byte) {
+	if s.opts.ErrorReporter == nil {
+		return
+	}
+	s.opts.ErrorReporter.Capture(errreport.Event{
+		Level:     "fatal",
+		Message:   fmt.Sprintf("panic: %v", value),
+		Err:       fmt.Errorf("%v", value),
+		Stack:     stack,
+		Request:   r,
+		RequestID: middleware.RequestIDFrom(r.Context()),
+		User:      owner(r.Context()),
+	})
+}
+
+func invalidField(field, message string) *apierror.Error {
+	return apierror.New(apierror.InvalidRequest, message).WithDetails(map[string]string{"field": field})
+}
+
+// upstreamError maps a failure talking to Sourcegraph to an API error.
+// action describes what failed, e.g. "execute search".
+func upstreamError(ctx context.Context, action string, err error) *apierror.Error {
+	var e *apierror.Error
+	switch {
+	case errors.Is(err, deepsearch.ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return apierror.New(apierror.Timeout, fmt.Sprintf("Failed to %s: timed out", action))
+	case errors.Is(err, deepsearch.ErrRateLimited):
+		// Passed through so clients back off rather than retrying at once.
+		retryAfter := deepsearch.RetryAfter(err)
+		message := fmt.Sprintf("Failed to %s: rate limited by Sourcegraph", action)
+		if retryAfter > 0 {
+			message += fmt.Sprintf(", retry in %ds", int(math.Ceil(retryAfter.Seconds())))
+		}
+		e = apierror.New(apierror.RateLimited, message).WithDetails(map[string]int{
+			"upstream_status":     http.StatusTooManyRequests,
+			"retry_after_seconds": int(math.Ceil(retryAfter.Seconds())),
+		})
+		e.RetryAfter = retryAfter
+		return e
+	case errors.Is(err, deepsearch.ErrUnauthorized):
+		// The server's own token was rejected; the caller can't fix that,
+		// so this is a gateway error rather than a 401.
+		e = apierror.New(apierror.UpstreamError, fmt.Sprintf("Failed to %s: Sourcegraph rejected the access token", action))
+	case errors.Is(err, deepsearch.ErrNotFound):
+		e = apierror.New(apierror.UpstreamError, fmt.Sprintf("Failed to %s: not found (is Deep Search or Cody enabled on this instance?)", action))
+	default:
+		e = apierror.New(apierror.UpstreamError, fmt.Sprintf("Failed to %s: %v", action, err))
+	}
+
+	var statusErr *deepsearch.StatusError
+	if errors.As(err, &statusErr) {
+		e = e.WithDetails(map[string]int{"upstream_status": statusErr.StatusCode})
+	}
+	return e
+}
+
+// translationError maps a translation failure to an API error, noting when
+// the failure was served from the failure cache.
+func translationError(ctx context.Context, err error, cached bool) *apierror.Error {
+	var violation *policy.Violation
+	if errors.As(err, &violation) {
+		return policyError(violation)
+	}
+	e := upstreamError(ctx, "translate", err)
+	if cached {
+		e.Message += " (cached failure; retry later)"
+	}
+	return e
+}
+
+// policyError maps a query the caller's policy rejects to an API error
+// listing the filters it doesn't allow.
+func policyError(violation *policy.Violation) *apierror.Error {
+	if violation.Unparsed {
+		return apierror.New(apierror.PolicyViolation, "The query doesn't parse, so it can't be checked against this instance's policy")
+	}
+	message := fmt.Sprintf("The query uses filters that aren't allowed: %s", strings.Join(violation.Filters, " "))
+	return apierror.New(apierror.PolicyViolation, message).WithDetails(map[string][]string{"filters": violation.Filters})
+}
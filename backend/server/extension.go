@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/middleware"
+)
+
+const extensionTokenTTL = 12 * time.Hour
+
+type ExtensionTokenRequest struct {
+	Secret string `json:"secret"`
+}
+
+type ExtensionTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// extensionTokenIssuer hands out short-lived tokens to browser extensions in
+// exchange for the pairing secret the user entered in the extension options,
+// so the secret itself never has to be sent with every query.
+type extensionTokenIssuer struct {
+	secret     string
+	signingKey []byte
+}
+
+func newExtensionTokenIssuer(secret string) *extensionTokenIssuer {
+	if secret == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("nlsearch extension token"))
+	return &extensionTokenIssuer{secret: secret, signingKey: mac.Sum(nil)}
+}
+
+func (i *extensionTokenIssuer) issue(origin string, now time.Time) (string, time.Time) {
+	expiresAt := now.Add(extensionTokenTTL).UTC().Truncate(time.Second)
+	payload := fmt.Sprintf("%s|%d", origin, expiresAt.Unix())
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(i.sign(payload))
+	return token, expiresAt
+}
+
+func (i *extensionTokenIssuer) verify(token, origin string) error {
+	if token == "" {
+		return fmt.Errorf("missing token")
+	}
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return fmt.Errorf("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, i.sign(string(payload))) {
+		return fmt.Errorf("bad signature")
+	}
+
+	tokenOrigin, expiry, ok := strings.Cut(string(payload), "|")
+	if !ok || tokenOrigin != origin {
+		return fmt.Errorf("token was issued to a different origin")
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return fmt.Errorf("token expired")
+	}
+	return nil
+}
+
+func (i *extensionTokenIssuer) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, i.signingKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (s *Server) handleExtensionToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+	if !isExtensionOrigin(s.opts.ExtensionOrigins, origin) {
+		writeError(w, r, apierror.New(apierror.Forbidden, "Origin is not an allowed extension origin"))
+		return
+	}
+
+	var req ExtensionTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Secret), []byte(s.extensionTokens.secret)) != 1 {
+		writeError(w, r, apierror.New(apierror.Unauthorized, "Invalid extension secret"))
+		return
+	}
+
+	token, expiresAt := s.extensionTokens.issue(origin, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExtensionTokenResponse{Token: token, ExpiresAt: expiresAt})
+}
+
+// isExtensionOrigin reports whether origin is one of the configured browser
+// extension origins. Entries may be exact origins or a scheme wildcard such as
+// "chrome-extension://*" for development builds with unstable IDs.
+func isExtensionOrigin(allowed []string, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, a := range allowed {
+		if a == origin {
+			return true
+		}
+		if scheme, ok := strings.CutSuffix(a, "*"); ok && strings.HasPrefix(origin, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateExtension is a middleware.Authenticator for requests from
+// browser extension origins, which must carry a token from
+// /api/v1/extension/token.
+func (s *Server) authenticateExtension(r *http.Request) (*middleware.Identity, error) {
+	origin := r.Header.Get("Origin")
+	if s.extensionTokens == nil || !isExtensionOrigin(s.opts.ExtensionOrigins, origin) {
+		return nil, nil
+	}
+	if err := s.extensionTokens.verify(middleware.BearerToken(r), origin); err != nil {
+		return nil, fmt.Errorf("Invalid extension token: %v", err)
+	}
+	return &middleware.Identity{Name: origin, Method: "extension-token", Roles: []string{middleware.RoleUser}}, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+)
+
+// textQuery is a parsed full-text search over history. Every term must
+// match a word of the request or the generated query, where a term matches
+// the words it is a prefix of after stemming, so "jwt valid" finds "validate
+// JWT tokens".
+type textQuery []string
+
+func parseTextQuery(s string) textQuery {
+	var terms textQuery
+	for _, word := range words(s) {
+		terms = append(terms, stem(word))
+	}
+	return terms
+}
+
+// matches reports whether every term matches a word in one of texts.
+func (q textQuery) matches(texts ...string) bool {
+	var stems []string
+	for _, text := range texts {
+		for _, word := range words(text) {
+			stems = append(stems, stem(word))
+		}
+	}
+	for _, term := range q {
+		found := false
+		for _, s := range stems {
+			if strings.HasPrefix(s, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// words splits text into lowercase runs of letters and digits, so query
+// syntax like repo:^github\.com/org/jwt$ yields its names.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// suffixes are stripped by stem, longest first.
+var suffixes = []string{"ations", "ation", "ings", "ing", "ers", "er", "ies", "ied", "ed", "es", "ate", "s", "e"}
+
+// stem strips one common English suffix so that inflections of a word share
+// a prefix. It is much cruder than a real stemmer but needs no word lists.
+func stem(word string) string {
+	for _, suffix := range suffixes {
+		if base, ok := strings.CutSuffix(word, suffix); ok && len(base) >= 3 {
+			return base
+		}
+	}
+	return word
+}
@@ -0,0 +1,784 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/output"
+	"github.com/nlsearch/backend/policy"
+	"github.com/nlsearch/backend/query"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/translate"
+)
+
+// handleQuery translates a request given as a JSON body, or with GET as
+// URL parameters, for bookmarks and browser keyword searches.
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var keepAlive bool
+	if v := r.URL.Query().Get("keepalive"); v != "" {
+		var err error
+		if keepAlive, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, invalidField("keepalive", "keepalive must be true or false"))
+			return
+		}
+	}
+	req, apiErr := s.decodeQueryRequest(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(req))
+	defer cancel()
+
+	// With keepalive, a translation that outlasts StreamKeepAlive gets a
+	// 200 and newlines, which JSON parsers skip, until the body is ready,
+	// for clients behind proxies that time out idle requests. Its result
+	// or error envelope then follows under that 200.
+	var body *flushWriter
+	stop := func() {}
+	if keepAlive && s.opts.StreamKeepAlive > 0 {
+		var ok bool
+		if body, ok = newFlushWriter(w); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Accel-Buffering", "no")
+			stop = body.keepAlive(s.opts.StreamKeepAlive, "\n")
+		}
+	}
+	resp, cached, err := s.respond(ctx, req, nil)
+	stop()
+	committed := body != nil && body.wrote()
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Error translating query", "err", err)
+		apiErr := translationError(ctx, err, cached)
+		s.reportError(r, err, apiErr)
+		if committed {
+			json.NewEncoder(w).Encode(apierror.Envelope{Error: apiErr.ForRequest(middleware.RequestIDFrom(r.Context()))})
+			return
+		}
+		writeError(w, r, apiErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleQueryStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	// The body has to be read before the stream starts: writing the
+	// response headers closes the request body on HTTP/1.x.
+	// Validation errors are reported before it starts, with a proper status.
+	req, apiErr := s.decodeQueryRequest(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		writeError(w, r, apierror.New(apierror.Internal, "Streaming unsupported"))
+		return
+	}
+	requestID := middleware.RequestIDFrom(r.Context())
+	if s.opts.StreamKeepAlive > 0 {
+		defer stream.keepAlive(s.opts.StreamKeepAlive, keepAliveComment)()
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(req))
+	defer cancel()
+
+	lastToolCalls := 0
+	resp, cached, err := s.respond(ctx, req, func(p translate.Progress) {
+		stream.send("progress", p)
+		if n, ok := translate.ToolCalls(p.Stats); ok {
+			for ; lastToolCalls < n; lastToolCalls++ {
+				stream.send("step", map[string]interface{}{
+					"type":       "tool_call",
+					"index":      lastToolCalls + 1,
+					"elapsed_ms": p.ElapsedMs,
+				})
+			}
+		}
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error translating query", "err", err)
+		apiErr := translationError(ctx, err, cached)
+		s.reportError(r, err, apiErr)
+		// The 200 has already been sent, so the code travels in the event.
+		stream.send("error", apierror.Envelope{Error: apiErr.ForRequest(requestID)})
+		return
+	}
+
+	stream.send("result", resp)
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req SearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+
+	if req.Query == "" {
+		writeError(w, r, errQueryRequired)
+		return
+	}
+	if apiErr := s.validateMaxResults(req.MaxResults); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	q, err := s.opts.QueryPolicies.Enforce(ctx, req.Query)
+	var violation *policy.Violation
+	if errors.As(err, &violation) {
+		writeError(w, r, policyError(violation))
+		return
+	}
+	req.Query = q
+
+	result, cached, err := s.cachedSearch(ctx, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error executing search", "err", err)
+		apiErr := upstreamError(ctx, "execute search", err)
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+
+	if req.Highlight {
+		result = highlightMatches(result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SearchResponse{Result: result, Cached: cached})
+}
+
+// handleHistory lists the history visible to the caller, or deletes the
+// caller's own with DELETE. Anonymous callers can't list it: their entries
+// are shared with anyone who can reach the server.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if owner(r.Context()) == "" {
+			writeError(w, r, errHistoryAnonymous)
+			return
+		}
+	case http.MethodDelete:
+		s.handleDeleteHistory(w, r)
+		return
+	default:
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	limit, cursor, apiErr := pageParams(r, defaultPageSize)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	var mine bool
+	if v := r.URL.Query().Get("mine"); v != "" {
+		var err error
+		if mine, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, invalidField("mine", "mine must be true or false"))
+			return
+		}
+	}
+
+	// Fetch one more entry than asked for to know whether there are more.
+	entries, err := s.opts.Store.ListHistory(r.Context(), HistoryQuery{
+		Limit:  limit + 1,
+		After:  cursor,
+		Viewer: owner(r.Context()),
+		Mine:   mine,
+		Search: r.URL.Query().Get("q"),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing history", "err", err)
+		s.reportError(r, err, errHistoryFailed)
+		writeError(w, r, errHistoryFailed)
+		return
+	}
+
+	resp := HistoryResponse{Entries: entries}
+	if len(entries) > limit {
+		resp.Entries = entries[:limit]
+		last := resp.Entries[limit-1]
+		resp.NextCursor = Cursor{CreatedAt: last.CreatedAt, ID: last.ID}.String()
+	}
+	if resp.Entries == nil {
+		resp.Entries = []HistoryEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	if req.ID == "" {
+		writeError(w, r, invalidField("id", "id is required"))
+		return
+	}
+	switch req.Label {
+	case FeedbackAccepted, FeedbackRejected:
+		req.Query = ""
+	case FeedbackCorrected:
+		if strings.TrimSpace(req.Query) == "" {
+			writeError(w, r, invalidField("query", "query is required for corrected feedback"))
+			return
+		}
+	default:
+		writeError(w, r, invalidField("label", fmt.Sprintf("label must be %s, %s or %s", FeedbackAccepted, FeedbackRejected, FeedbackCorrected)))
+		return
+	}
+
+	feedback := Feedback{Label: req.Label, Query: strings.TrimSpace(req.Query), CreatedAt: time.Now().UTC()}
+	if err := s.opts.Store.SetFeedback(r.Context(), owner(r.Context()), req.ID, feedback); err != nil {
+		if errors.Is(err, ErrHistoryNotFound) {
+			writeError(w, r, apierror.New(apierror.NotFound, "No translation with that id").WithDetails(map[string]string{"field": "id"}))
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error recording feedback", "err", err)
+		apiErr := apierror.New(apierror.Internal, "Failed to record feedback")
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+	if s.opts.Analytics != nil {
+		s.opts.Analytics.Feedback(owner(r.Context()), feedback.Label)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleShareHistory shares one of the caller's history entries with every
+// user, or stops sharing it.
+func (s *Server) handleShareHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	var req ShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, errInvalidBody)
+		return
+	}
+	entry, err := s.opts.Store.SetShared(r.Context(), owner(r.Context()), r.PathValue("id"), req.Shared)
+	if err != nil {
+		if errors.Is(err, ErrHistoryNotFound) {
+			writeError(w, r, apierror.New(apierror.NotFound, "No translation of yours with that id"))
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error sharing history entry", "err", err)
+		apiErr := apierror.New(apierror.Internal, "Failed to update the history entry")
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// observe returns ctx with observers that record the stage timings and
+// quality events of translations run in it.
+func (s *Server) observe(ctx context.Context) context.Context {
+	ctx = translate.WithStageObserver(ctx, s.observeStage)
+	return translate.WithQualityObserver(ctx, s.observeQuality)
+}
+
+// observeStage records how long a stage of the pipeline took.
+func (s *Server) observeStage(stage string, d time.Duration) {
+	s.stageDuration.Observe(d.Seconds(), stage)
+}
+
+// observeQuality counts a quality event of a translation.
+func (s *Server) observeQuality(event, label string) {
+	switch event {
+	case translate.QualityExtractionMiss:
+		s.extractionMisses.Inc(label)
+	case translate.QualityValidation:
+		s.validations.Inc(label)
+	case translate.QualityHeuristic:
+		s.heuristics.Inc(label)
+	}
+}
+
+// owner returns the name history entries of the authenticated caller are
+// recorded under; anonymous callers share the empty owner.
+func owner(ctx context.Context) string {
+	if id, ok := middleware.IdentityFrom(ctx); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// noStore reports whether nothing of req may be kept once it is answered:
+// it sets no_store, or the caller's tenant is one of NoStoreTenants.
+func (s *Server) noStore(ctx context.Context, req QueryRequest) bool {
+	if req.NoStore {
+		return true
+	}
+	return slices.Contains(s.opts.NoStoreTenants, "*") || slices.Contains(s.opts.NoStoreTenants, owner(ctx))
+}
+
+// private applies no_store to req, when noStore says it must be, and marks
+// ctx so its Deep Search conversations aren't kept either. Those that are
+// kept are tracked as the caller's, to be deleted with their data.
+func (s *Server) private(ctx context.Context, req QueryRequest) (context.Context, QueryRequest) {
+	ctx = deepsearch.WithOwner(ctx, owner(ctx))
+	if !s.noStore(ctx, req) {
+		return ctx, req
+	}
+	req.NoStore = true
+	return deepsearch.Private(ctx), req
+}
+
+// translate runs a request through the cache and the translator, recording
+// the outcome in the history store. It returns the history entry's ID and
+// reports whether the translation was served from the cache. Requests with
+// no_store are neither cached nor recorded, and get no ID, and neither do
+// unrecorded ones.
+func (s *Server) translate(ctx context.Context, req QueryRequest, progress func(translate.Progress)) (string, *translate.Translation, bool, error) {
+	ctx = s.inTimezone(s.observe(ctx), req)
+	ctx, req = s.private(ctx, req)
+	translation, cached, err := s.cachedTranslate(ctx, req, progress)
+	if err != nil && s.opts.OfflineTranslator != nil && !errors.Is(ctx.Err(), context.Canceled) {
+		if offline, oerr := s.opts.OfflineTranslator.Translate(ctx, req.Query, progress); oerr == nil {
+			slog.WarnContext(ctx, "Translation failed; answering with the offline translator", "err", err)
+			s.observeQuality(translate.QualityHeuristic, translate.HeuristicOffline)
+			translation, cached, err = offline, false, nil
+		}
+	}
+	translation, err = s.enforcePolicy(ctx, limitResults(translation, req.MaxResults), err)
+
+	s.recordAnalytics(ctx, req.Query, translation, cached, err)
+	if req.NoStore || req.unrecorded {
+		return "", translation, cached, err
+	}
+	id := s.recordHistory(ctx, HistoryEntry{Request: req.Query, Shared: req.Share}, translation, err)
+	return id, translation, cached, err
+}
+
+// recordAnalytics records the outcome of a translation of request, if
+// analytics are enabled: how it was answered, or the error code.
+func (s *Server) recordAnalytics(ctx context.Context, request string, translation *translate.Translation, cached bool, err error) {
+	if s.opts.Analytics == nil {
+		return
+	}
+	var outcome, generated string
+	switch {
+	case err != nil:
+		outcome = string(translationError(ctx, err, cached).Code)
+	case cached:
+		outcome, generated = "cached", translation.Query
+	case translation.Fallback:
+		outcome, generated = "fallback", translation.Query
+	default:
+		outcome, generated = "translated", translation.Query
+	}
+	s.opts.Analytics.Translation(owner(ctx), outcome, request, generated)
+}
+
+// recordHistory fills in entry with the outcome of a translation, adds it
+// to the history store and returns its ID. Unless the caller set one, the
+// clarifying question the user is asked about entry.Request is recorded
+// too.
+func (s *Server) recordHistory(ctx context.Context, entry HistoryEntry, translation *translate.Translation, err error) string {
+	entry.ID, entry.CreatedAt, entry.Owner = newID(), time.Now().UTC(), owner(ctx)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Query = translation.Query
+		entry.Extraction = translation.Extraction
+		entry.Conversation = translation.Conversation
+		if c := s.clarify(entry.Request, translation); c != nil && entry.Clarification == "" {
+			entry.Clarification = c.Question
+		}
+	}
+	// Use a fresh context so a request that timed out is still recorded.
+	if herr := s.opts.Store.AddHistory(context.Background(), entry); herr != nil {
+		slog.ErrorContext(ctx, "Error recording history", "err", herr)
+	}
+	return entry.ID
+}
+
+func (s *Server) cachedTranslate(ctx context.Context, req QueryRequest, progress func(translate.Progress)) (*translate.Translation, bool, error) {
+	key := s.cacheKey(ctx, req.Query)
+	if s.opts.Cache != nil {
+		if t, ok := s.opts.Cache.Get(ctx, key); ok {
+			return t, true, nil
+		}
+	}
+	if s.opts.FailureCache != nil {
+		if err, ok := s.opts.FailureCache.GetFailure(ctx, key); ok {
+			return nil, true, err
+		}
+	}
+
+	translation, err := s.opts.Translator.Translate(ctx, req.Query, progress)
+	s.health.record(err)
+	if err != nil {
+		if s.opts.FailureCache != nil && !req.NoStore && isPersistentFailure(err) {
+			s.opts.FailureCache.SetFailure(ctx, key, err)
+		}
+		return nil, false, err
+	}
+	if s.opts.Cache != nil && !req.NoStore {
+		s.opts.Cache.Set(ctx, key, translation)
+	}
+	return translation, false, nil
+}
+
+// limitResults sets the count: filter of translation's query to
+// maxResults, unless it is 0 or translating failed. Translations are shared
+// through the cache, so the limited query is returned in a copy.
+func limitResults(translation *translate.Translation, maxResults int) *translate.Translation {
+	if translation == nil || maxResults == 0 {
+		return translation
+	}
+	copy := *translation
+	copy.Query = query.WithFilter(translation.Query, "count", strconv.Itoa(maxResults))
+	return &copy
+}
+
+// enforcePolicy applies the caller's query policy to translation, unless
+// translating failed with err. Translations are shared through the cache,
+// so a rewritten query is returned in a copy.
+func (s *Server) enforcePolicy(ctx context.Context, translation *translate.Translation, err error) (*translate.Translation, error) {
+	if err != nil {
+		return translation, err
+	}
+	q, err := s.opts.QueryPolicies.Enforce(ctx, translation.Query)
+	if err != nil {
+		return nil, err
+	}
+	if q != translation.Query {
+		copy := *translation
+		copy.Query = q
+		translation = &copy
+	}
+	return translation, nil
+}
+
+// isPersistentFailure reports whether retrying err straight away would fail
+// the same way: Deep Search is missing or disabled, the token is rejected,
+// or Deep Search gave up on the question. Timeouts and rate limits are
+// transient and handled elsewhere.
+func isPersistentFailure(err error) bool {
+	return errors.Is(err, deepsearch.ErrNotFound) ||
+		errors.Is(err, deepsearch.ErrUnauthorized) ||
+		errors.Is(err, deepsearch.ErrQuestionFailed)
+}
+
+// execute runs a search, recording how long it took.
+func (s *Server) execute(ctx context.Context, query string, opts search.Options) (*search.Result, error) {
+	start := time.Now()
+	defer func() { s.observeStage(translate.StageExecution, time.Since(start)) }()
+	return s.opts.Searcher.Search(ctx, query, opts, nil)
+}
+
+// cachedSearch runs a search through the search cache. Results are cached
+// only when the search completed, so a timed-out partial result isn't
+// served to later callers.
+func (s *Server) cachedSearch(ctx context.Context, req SearchRequest) (*search.Result, bool, error) {
+	opts := search.Options{DisplayLimit: req.MaxResults}
+	if s.opts.SearchCache == nil {
+		result, err := s.execute(ctx, req.Query, opts)
+		return result, false, err
+	}
+
+	key := searchCacheKey(req)
+	if result, ok := s.opts.SearchCache.Get(ctx, key); ok {
+		return result, true, nil
+	}
+	result, err := s.execute(ctx, req.Query, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if result.Progress.Done {
+		s.opts.SearchCache.Set(ctx, key, result)
+	}
+	return result, false, nil
+}
+
+// decodeQueryRequest parses and validates a query request body, or for GET
+// requests the URL parameters, and screens it for credentials. GET
+// requests aren't CSRF-protected, since links and browser keyword searches
+// can't send a token, so they aren't recorded in the history: any site
+// could add entries to it with an <img>.
+func (s *Server) decodeQueryRequest(r *http.Request) (QueryRequest, *apierror.Error) {
+	var req QueryRequest
+	if r.Method == http.MethodGet {
+		var apiErr *apierror.Error
+		if req, apiErr = queryRequestFromURL(r.URL.Query()); apiErr != nil {
+			return req, apiErr
+		}
+		if req.Share {
+			return req, invalidField("share", "share needs POST, since GET requests aren't recorded in the history")
+		}
+		req.unrecorded = true
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, errInvalidBody
+	}
+	timezoneHeader(r, &req)
+
+	if apiErr := s.validateQueryRequest(req); apiErr != nil {
+		return req, apiErr
+	}
+	return req, s.screenSecrets(r.Context(), &req)
+}
+
+// validateQueryRequest checks the fields of req.
+func (s *Server) validateQueryRequest(req QueryRequest) *apierror.Error {
+	if req.Query == "" {
+		return errQueryRequired
+	}
+
+	if req.TimeoutSeconds < 0 {
+		return invalidField("timeout_seconds", "timeout_seconds must not be negative")
+	}
+
+	if apiErr := s.validateMaxResults(req.MaxResults); apiErr != nil {
+		return apiErr
+	}
+
+	if _, err := output.Format("", req.Format); err != nil {
+		return invalidField("format", err.Error())
+	}
+
+	switch req.Intent {
+	case "", string(translate.IntentSearch), string(translate.IntentQuestion), intentAuto:
+	default:
+		return invalidField("intent", "intent must be search, question or auto")
+	}
+
+	if _, err := time.LoadLocation(req.Timezone); err != nil {
+		return invalidField("timezone", "timezone must be an IANA time zone, such as Europe/Berlin")
+	}
+
+	return nil
+}
+
+// validateMaxResults checks the max_results of a request against
+// MaxResults.
+func (s *Server) validateMaxResults(n int) *apierror.Error {
+	switch {
+	case n < 0:
+		return invalidField("max_results", "max_results must not be negative")
+	case n > s.opts.MaxResults:
+		return invalidField("max_results", fmt.Sprintf("max_results must not exceed %d", s.opts.MaxResults))
+	}
+	return nil
+}
+
+// queryRequestFromURL reads a QueryRequest from URL parameters named like
+// its JSON fields, except that the request is q.
+func queryRequestFromURL(params url.Values) (QueryRequest, *apierror.Error) {
+	req := QueryRequest{Query: params.Get("q")}
+	if req.Query == "" {
+		return req, invalidField("q", "q is required")
+	}
+	return req, queryParams(params, &req)
+}
+
+// queryParams sets the fields of req other than the request itself from
+// URL parameters named like them.
+func queryParams(params url.Values, req *QueryRequest) *apierror.Error {
+	req.Format, req.Intent, req.Timezone = params.Get("format"), params.Get("intent"), params.Get("timezone")
+	if v := params.Get("timeout_seconds"); v != "" {
+		var err error
+		if req.TimeoutSeconds, err = strconv.Atoi(v); err != nil {
+			return invalidField("timeout_seconds", "timeout_seconds must be a number of seconds")
+		}
+	}
+	if v := params.Get("max_results"); v != "" {
+		var err error
+		if req.MaxResults, err = strconv.Atoi(v); err != nil {
+			return invalidField("max_results", "max_results must be a number of results")
+		}
+	}
+	for _, flag := range []struct {
+		name  string
+		value *bool
+	}{
+		{"share", &req.Share},
+		{"no_store", &req.NoStore},
+		{"snippets", &req.Snippets},
+		{"highlight", &req.Highlight},
+		{"html", &req.HTML},
+		{"disambiguate", &req.Disambiguate},
+	} {
+		if v := params.Get(flag.name); v != "" {
+			var err error
+			if *flag.value, err = strconv.ParseBool(v); err != nil {
+				return invalidField(flag.name, flag.name+" must be true or false")
+			}
+		}
+	}
+	return nil
+}
+
+// timezoneHeader sets the time zone of req from the X-Timezone header, for
+// clients that send it with every request, if req doesn't give one.
+func timezoneHeader(r *http.Request, req *QueryRequest) {
+	if req.Timezone == "" {
+		req.Timezone = strings.TrimSpace(r.Header.Get("X-Timezone"))
+	}
+}
+
+// inTimezone returns ctx with the time zone of req, or the server's
+// default, to resolve the dates in it in.
+func (s *Server) inTimezone(ctx context.Context, req QueryRequest) context.Context {
+	loc := s.opts.Timezone
+	if req.Timezone != "" {
+		if l, err := time.LoadLocation(req.Timezone); err == nil {
+			loc = l
+		}
+	}
+	if loc == nil {
+		return ctx
+	}
+	return translate.WithLocation(ctx, loc)
+}
+
+// requestTimeout returns how long a translation may take: the request's own
+// timeout_seconds if set, bounded by the server maximum, or the server default.
+func (s *Server) requestTimeout(req QueryRequest) time.Duration {
+	if req.TimeoutSeconds == 0 {
+		return s.opts.DefaultTimeout
+	}
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+	if timeout > s.opts.MaxTimeout {
+		return s.opts.MaxTimeout
+	}
+	return timeout
+}
+
+func (s *Server) newQueryResponse(ctx context.Context, req QueryRequest, id string, translation *translate.Translation, cached bool) QueryResponse {
+	resp := QueryResponse{
+		ID:           id,
+		Intent:       string(translate.IntentSearch),
+		Answer:       translation.Query,
+		Sources:      s.linkSources(ctx, translation.Sources, req),
+		Stats:        translation.Stats,
+		Extraction:   translation.Extraction,
+		Cached:       cached,
+		Candidates:   translation.Candidates,
+		Disagreement: translation.Disagreement,
+		Fallback:     translation.Fallback,
+	}
+	confidence := translation.Confidence()
+	resp.Confidence = &confidence
+	if c := s.clarify(req.Query, translation); c != nil {
+		resp.Answer, resp.NeedsClarification = "", true
+		resp.Clarification, resp.ClarificationOptions = c.Question, c.Options
+		return resp
+	}
+	if req.Format != "" && req.Format != output.Query {
+		resp.Output, _ = output.Format(translation.Query, req.Format)
+	}
+	resp.Filters, resp.Pattern = breakDown(translation.Query)
+	if req.Disambiguate && s.opts.Searcher != nil {
+		resp.Interpretations = s.interpretations(ctx, translation.Query)
+	}
+	return resp
+}
+
+// clarify returns what to ask the user who made request instead of giving
+// them translation, or nil if its confidence isn't below
+// Options.ClarifyBelow.
+func (s *Server) clarify(request string, translation *translate.Translation) *translate.Clarification {
+	// A query this likely to miss is worse than asking.
+	if translation.Confidence() >= s.opts.ClarifyBelow {
+		return nil
+	}
+	c := translate.Clarify(request, translation)
+	return &c
+}
+
+// breakDown returns the filters of q and what is left without them, or
+// nothing if q doesn't parse.
+func breakDown(q string) ([]Filter, string) {
+	parsed, err := query.Parse(q)
+	if err != nil {
+		return nil, ""
+	}
+	var filters []Filter
+	for _, tok := range parsed.Tokens {
+		if tok.Kind == query.Field {
+			filters = append(filters, Filter{Field: tok.Field, Value: tok.Value, Negated: tok.Negated})
+		}
+	}
+	return filters, parsed.Pattern()
+}
+
+// cacheKey normalizes request text so trivially different spellings of the
+// same request share a cache entry. The caller's translations are kept
+// apart if their tenant is one of OwnCacheTenants, and those of requests
+// with dates relative to today only last that day in the caller's time
+// zone.
+func (s *Server) cacheKey(ctx context.Context, request string) string {
+	key := strings.ToLower(strings.Join(strings.Fields(request), " "))
+	if day := translate.DateKey(ctx, request); day != "" {
+		key += "\n" + day
+	}
+	if tenant := owner(ctx); slices.Contains(s.opts.OwnCacheTenants, tenant) {
+		key = tenant + "\n" + key
+	}
+	return key
+}
+
+// searchCacheKey normalizes whitespace in the query but not case, which is
+// significant in Sourcegraph patterns, and includes the result limit.
+func searchCacheKey(req SearchRequest) string {
+	return fmt.Sprintf("%d:%s", req.MaxResults, strings.Join(strings.Fields(req.Query), " "))
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nlsearch/backend/metrics"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/translate"
+)
+
+// fakeTranslator answers every request with query and counts the calls.
+type fakeTranslator struct {
+	query string
+	calls atomic.Int32
+}
+
+func (f *fakeTranslator) Translate(ctx context.Context, request string, progress func(translate.Progress)) (*translate.Translation, error) {
+	f.calls.Add(1)
+	return &translate.Translation{Query: f.query}, nil
+}
+
+// fakeSearcher finds nothing.
+type fakeSearcher struct{}
+
+func (fakeSearcher) Search(ctx context.Context, query string, opts search.Options, onProgress func(search.Progress)) (*search.Result, error) {
+	return &search.Result{}, nil
+}
+
+func newTestServer(t *testing.T, opts Options) http.Handler {
+	t.Helper()
+	if opts.Translator == nil {
+		opts.Translator = &fakeTranslator{query: "repo:^github\\.com/acme/api$ auth"}
+	}
+	opts.Metrics = metrics.NewRegistry()
+	return New(opts).Handler()
+}
+
+func serve(h http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		r.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestQuery(t *testing.T) {
+	h := newTestServer(t, Options{})
+
+	w := serve(h, "POST", "/api/v1/query", "", `{"query": "auth code in the api repo"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp QueryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != "repo:^github\\.com/acme/api$ auth" || resp.ID == "" || resp.Cached {
+		t.Errorf("response = %+v", resp)
+	}
+
+	if w := serve(h, "POST", "/api/v1/query", "", `{"query": ""}`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty query: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serve(h, "DELETE", "/api/v1/query", "", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		cache Cache
+		calls int32
+	}{
+		{"without cache", nil, 2},
+		{"with cache", NewMemoryCache(10, time.Minute), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			translator := &fakeTranslator{query: "auth"}
+			h := newTestServer(t, Options{Translator: translator, Cache: tt.cache})
+			var cached bool
+			for range 2 {
+				w := serve(h, "POST", "/api/v1/query", "", `{"query": "auth code"}`)
+				var resp QueryResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+					t.Fatalf("status = %d, %v", w.Code, err)
+				}
+				cached = resp.Cached
+			}
+			if got := translator.calls.Load(); got != tt.calls || cached != (tt.cache != nil) {
+				t.Errorf("translated %d times, cached %v; want %d times", got, cached, tt.calls)
+			}
+		})
+	}
+}
+
+func TestHistoryRequiresAuthentication(t *testing.T) {
+	h := newTestServer(t, Options{})
+	serve(h, "POST", "/api/v1/query", "", `{"query": "auth code"}`)
+	if w := serve(h, "GET", "/api/v1/history", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	h = newTestServer(t, Options{APIKeys: map[string]string{"alice-key": "alice", "bob-key": "bob"}})
+	if w := serve(h, "GET", "/api/v1/history", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	serve(h, "POST", "/api/v1/query", "alice-key", `{"query": "auth code"}`)
+	for key, want := range map[string]int{"alice-key": 1, "bob-key": 0} {
+		w := serve(h, "GET", "/api/v1/history", key, "")
+		var resp HistoryResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, %v", key, w.Code, err)
+		}
+		if len(resp.Entries) != want {
+			t.Errorf("%s: %d entries, want %d", key, len(resp.Entries), want)
+		}
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	h := newTestServer(t, Options{Searcher: fakeSearcher{}, MaxResults: 100})
+	tests := []struct {
+		path string
+		body string
+		want int
+	}{
+		{"/api/v1/query", `{"query": "auth code", "max_results": 100}`, http.StatusOK},
+		{"/api/v1/query", `{"query": "auth code", "max_results": 101}`, http.StatusBadRequest},
+		{"/api/v1/query", `{"query": "auth code", "max_results": -1}`, http.StatusBadRequest},
+		{"/api/v1/query?q=auth+code&max_results=101", "", http.StatusBadRequest},
+		{"/api/v1/search", `{"query": "auth", "max_results": 100}`, http.StatusOK},
+		{"/api/v1/search", `{"query": "auth", "max_results": 101}`, http.StatusBadRequest},
+		{"/api/v1/search", `{"query": "auth", "max_results": -1}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		method := "POST"
+		if tt.body == "" {
+			method = "GET"
+		}
+		if w := serve(h, method, tt.path, "", tt.body); w.Code != tt.want {
+			t.Errorf("%s %s %s: status = %d, want %d", method, tt.path, tt.body, w.Code, tt.want)
+		}
+	}
+}
+
+func TestQueryGETUnrecorded(t *testing.T) {
+	h := newTestServer(t, Options{APIKeys: map[string]string{"alice-key": "alice"}})
+
+	w := serve(h, "GET", "/api/v1/query?q=auth+code", "alice-key", "")
+	var resp QueryResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d, %v", w.Code, err)
+	}
+	if resp.Answer == "" || resp.ID != "" {
+		t.Errorf("response = %+v, want an answer without an id", resp)
+	}
+	if w := serve(h, "GET", "/api/v1/query?q=auth+code&share=true", "alice-key", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("share: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = serve(h, "GET", "/api/v1/history", "alice-key", "")
+	var history HistoryResponse
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil || len(history.Entries) != 0 {
+		t.Errorf("history = %+v, %v, want no entries", history, err)
+	}
+}
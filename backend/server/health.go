@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health statuses reported by /health and /readyz.
+const (
+	HealthOK        = "ok"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+	// HealthDraining is reported once the server is shutting down.
+	HealthDraining = "draining"
+)
+
+// HealthOptions sets how failing upstream calls affect the reported health.
+type HealthOptions struct {
+	// Window is how far back calls are counted. Defaults to 5 minutes.
+	Window time.Duration
+	// DegradedRate and UnhealthyRate are the fractions of failed calls in
+	// the window at which the server reports itself degraded or unhealthy.
+	// They default to 0.5 and 0.9.
+	DegradedRate  float64
+	UnhealthyRate float64
+}
+
+const (
+	defaultHealthWindow  = 5 * time.Minute
+	defaultDegradedRate  = 0.5
+	defaultUnhealthyRate = 0.9
+
+	// healthBuckets is how many slices the window is counted in; calls
+	// age out one slice at a time.
+	healthBuckets = 10
+	// minHealthCalls is how many calls the window needs before failures
+	// count, so one bad request after a quiet spell doesn't flip the
+	// status.
+	minHealthCalls = 5
+)
+
+// HealthResponse is the body of /health and /readyz.
+type HealthResponse struct {
+	Status   string         `json:"status"`
+	Upstream UpstreamHealth `json:"upstream"`
+}
+
+// UpstreamHealth counts the translation calls to Sourcegraph in the health
+// window.
+type UpstreamHealth struct {
+	Calls     int     `json:"calls"`
+	Failures  int     `json:"failures"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// healthBucket counts the calls made in one slice of the window, starting
+// at start.
+type healthBucket struct {
+	start    time.Time
+	calls    int
+	failures int
+}
+
+// upstreamHealth keeps a rolling count of upstream calls and failures.
+type upstreamHealth struct {
+	opts HealthOptions
+
+	mu      sync.Mutex
+	buckets [healthBuckets]healthBucket
+}
+
+func newUpstreamHealth(opts HealthOptions) *upstreamHealth {
+	if opts.Window <= 0 {
+		opts.Window = defaultHealthWindow
+	}
+	if opts.DegradedRate <= 0 {
+		opts.DegradedRate = defaultDegradedRate
+	}
+	if opts.UnhealthyRate <= 0 {
+		opts.UnhealthyRate = defaultUnhealthyRate
+	}
+	return &upstreamHealth{opts: opts}
+}
+
+// record counts a call that ended with err. Calls abandoned by the client
+// say nothing about Sourcegraph and aren't counted.
+func (h *upstreamHealth) record(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.bucket(time.Now())
+	b.calls++
+	if err != nil {
+		b.failures++
+	}
+}
+
+// bucket returns the bucket for now, clearing it if it last counted an
+// earlier slice.
+func (h *upstreamHealth) bucket(now time.Time) *healthBucket {
+	slice := h.opts.Window / healthBuckets
+	start := now.Truncate(slice)
+	b := &h.buckets[start.UnixNano()/int64(slice)%healthBuckets]
+	if !b.start.Equal(start) {
+		*b = healthBucket{start: start}
+	}
+	return b
+}
+
+// status sums the buckets still inside the window and grades the error
+// rate.
+func (h *upstreamHealth) status() HealthResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cutoff := time.Now().Add(-h.opts.Window)
+	var u UpstreamHealth
+	for _, b := range h.buckets {
+		if b.start.After(cutoff) {
+			u.Calls += b.calls
+			u.Failures += b.failures
+		}
+	}
+	resp := HealthResponse{Status: HealthOK, Upstream: u}
+	if u.Calls == 0 {
+		return resp
+	}
+	resp.Upstream.ErrorRate = float64(u.Failures) / float64(u.Calls)
+	switch {
+	case u.Calls < minHealthCalls:
+	case resp.Upstream.ErrorRate >= h.opts.UnhealthyRate:
+		resp.Status = HealthUnhealthy
+	case resp.Upstream.ErrorRate >= h.opts.DegradedRate:
+		resp.Status = HealthDegraded
+	}
+	return resp
+}
+
+// Drain marks the server as shutting down: /readyz answers 503 from then
+// on, so load balancers stop sending it new requests while it finishes the
+// ones it has. Requests are still served.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// status is the health reported by /health and /readyz.
+func (s *Server) status() HealthResponse {
+	resp := s.health.status()
+	if s.draining.Load() {
+		resp.Status = HealthDraining
+	}
+	return resp
+}
+
+// handleHealth reports the server's health. It always answers 200, since
+// the process itself is alive; use /readyz to take an instance out of a
+// load balancer.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+// handleReady answers 503 while the server is unhealthy or draining, so
+// load balancers send traffic to instances whose Sourcegraph calls are
+// succeeding and that aren't about to stop. A degraded server is still
+// ready.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	resp := s.status()
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status == HealthUnhealthy || resp.Status == HealthDraining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/nlsearch/backend/highlight"
+	"github.com/nlsearch/backend/search"
+)
+
+// highlightMatches returns result with the language of each match's file
+// and its lines as highlighted HTML. The matches are copied, so a cached
+// result is left as it was.
+func highlightMatches(result *search.Result) *search.Result {
+	highlighted := *result
+	highlighted.Matches = slices.Clone(result.Matches)
+	for i := range highlighted.Matches {
+		m := &highlighted.Matches[i]
+		if len(m.Lines) == 0 {
+			continue
+		}
+		m.Language = highlight.Language(m.Path)
+		m.Lines = slices.Clone(m.Lines)
+		for j := range m.Lines {
+			html, err := highlight.Line(m.Lines[j].Content, m.Language)
+			if err != nil {
+				slog.Warn("Could not highlight match", "repo", m.Repository, "path", m.Path, "err", err)
+				break
+			}
+			m.Lines[j].HTML = html
+		}
+	}
+	return &highlighted
+}
+
+// handleHighlightCSS serves the stylesheet for the classes of highlighted
+// HTML, which pages showing it include.
+func (s *Server) handleHighlightCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	io.WriteString(w, highlight.CSS())
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileJobStore keeps jobs in memory like MemoryJobStore, and also in a
+// JSON file, so unfinished jobs can be resumed after a restart. The file is
+// rewritten whenever a job is added, changes status, or starts waiting on a
+// Deep Search conversation; progress updates in between are not persisted.
+type FileJobStore struct {
+	*MemoryJobStore
+	path string
+
+	// mu serializes writes to the file.
+	mu sync.Mutex
+}
+
+// jobRecord is a job as saved in the file, including the fields the API
+// doesn't show.
+type jobRecord struct {
+	Job
+	Owner        string       `json:"owner,omitempty"`
+	RequestID    string       `json:"request_id,omitempty"`
+	Params       QueryRequest `json:"params"`
+	Conversation int          `json:"conversation,omitempty"`
+	Question     int          `json:"question,omitempty"`
+	Attempts     int          `json:"attempts,omitempty"`
+}
+
+func newJobRecord(job Job) jobRecord {
+	return jobRecord{Job: job, Owner: job.Owner, RequestID: job.RequestID, Params: job.Params, Conversation: job.Conversation, Question: job.Question, Attempts: job.Attempts}
+}
+
+// job returns the job the record was made from.
+func (rec jobRecord) job() Job {
+	job := rec.Job
+	job.Owner, job.RequestID, job.Params, job.Conversation, job.Question, job.Attempts = rec.Owner, rec.RequestID, rec.Params, rec.Conversation, rec.Question, rec.Attempts
+	return job
+}
+
+// OpenFileJobStore returns a store keeping at most limit jobs in the file
+// at path, loading the jobs already there. The file is created when the
+// first job is saved.
+func OpenFileJobStore(path string, limit int) (*FileJobStore, error) {
+	s := &FileJobStore{MemoryJobStore: NewMemoryJobStore(limit), path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []jobRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, rec := range records {
+		s.MemoryJobStore.SaveJob(context.Background(), rec.job())
+	}
+	return s, nil
+}
+
+func (s *FileJobStore) SaveJob(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, err := s.MemoryJobStore.GetJob(ctx, job.ID)
+	s.MemoryJobStore.SaveJob(ctx, job)
+	if err == nil && prev.Status == job.Status && prev.Conversation == job.Conversation && prev.Question == job.Question {
+		return nil
+	}
+	return s.write()
+}
+
+func (s *FileJobStore) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed, _ := s.MemoryJobStore.Prune(ctx, cutoff)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.write()
+}
+
+func (s *FileJobStore) DeleteJobs(ctx context.Context, owner string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed, _ := s.MemoryJobStore.DeleteJobs(ctx, owner)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.write()
+}
+
+// write saves every job to a temporary file and renames it into place, so
+// a crash never leaves a truncated file behind.
+func (s *FileJobStore) write() error {
+	s.MemoryJobStore.mu.Lock()
+	records := make([]jobRecord, 0, len(s.order))
+	for _, id := range s.order {
+		records = append(records, newJobRecord(s.jobs[id]))
+	}
+	s.MemoryJobStore.mu.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+)
+
+// JobQueue hands job IDs to workers, which may run in any process sharing
+// the queue. Delivery is at least once: a job whose worker doesn't
+// acknowledge it, or keep it, within the visibility timeout is delivered
+// again, so a worker that dies loses nothing but may leave a job run twice.
+type JobQueue interface {
+	Enqueue(ctx context.Context, id string) error
+	// Dequeue blocks until a job is available or ctx is done. receipt
+	// identifies the delivery to Extend and Ack.
+	Dequeue(ctx context.Context) (id, receipt string, err error)
+	// Extend restarts the visibility timeout of a delivery whose job is
+	// still running.
+	Extend(ctx context.Context, receipt string) error
+	// Ack removes a delivered job from the queue.
+	Ack(ctx context.Context, receipt string) error
+}
+
+const (
+	// maxJobAttempts is how many times a queued job is started before it
+	// is failed, so a job that crashes its workers can't take them all
+	// down in turn.
+	maxJobAttempts = 3
+	// queueRetryDelay is how long a worker waits after the queue fails.
+	queueRetryDelay = 5 * time.Second
+)
+
+// RunWorkers runs n workers that take jobs off the JobQueue and run them,
+// until ctx is done. Jobs already running are then finished before it
+// returns; a process killed before that leaves them to be delivered to
+// another worker, which resumes them from where they were. It returns at
+// once without a JobQueue.
+func (s *Server) RunWorkers(ctx context.Context, n int) {
+	if s.opts.JobQueue == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		id, receipt, err := s.opts.JobQueue.Dequeue(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Error taking a job off the queue", "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(queueRetryDelay):
+			}
+			continue
+		}
+		s.runQueuedJob(context.WithoutCancel(ctx), id, receipt)
+	}
+}
+
+// runQueuedJob runs a job delivered by the queue, keeping the delivery
+// alive while it runs, and acknowledges it once the job has finished.
+func (s *Server) runQueuedJob(ctx context.Context, id, receipt string) {
+	queue := s.opts.JobQueue
+	ack := func() {
+		if err := queue.Ack(ctx, receipt); err != nil {
+			slog.Error("Error acknowledging job", "job", id, "err", err)
+		}
+	}
+
+	job, err := s.opts.Jobs.GetJob(ctx, id)
+	if errors.Is(err, ErrJobNotFound) {
+		// It expired before any worker got to it.
+		slog.Warn("Dropping queued job that no longer exists", "job", id)
+		ack()
+		return
+	}
+	if err != nil {
+		// Leave it to be delivered again.
+		slog.Error("Error reading job", "job", id, "err", err)
+		return
+	}
+	if job.finished() {
+		// Delivered again after it finished, but before it was
+		// acknowledged.
+		ack()
+		return
+	}
+	job.Attempts++
+	if job.Attempts > maxJobAttempts {
+		slog.Error("Giving up on job", "job", id, "attempts", job.Attempts-1)
+		job.Status, job.Stage, job.UpdatedAt = JobFailed, "", time.Now().UTC()
+		job.Error = apierror.New(apierror.Internal, "The job was interrupted too many times; try again")
+		if err := s.opts.Jobs.SaveJob(ctx, job); err != nil {
+			slog.Error("Error saving job", "job", id, "err", err)
+			return
+		}
+		ack()
+		return
+	}
+	if job.Attempts > 1 {
+		slog.Info("Picking up interrupted job", "job", id, "attempt", job.Attempts, "conversation", job.Conversation)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(s.opts.JobVisibility / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := queue.Extend(ctx, receipt); err != nil {
+					slog.Error("Error extending job delivery", "job", id, "err", err)
+				}
+			}
+		}
+	}()
+
+	s.runningJobs.Add(1)
+	s.runJob(jobRequest(ctx, job), job)
+	close(done)
+	wg.Wait()
+	ack()
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/redis"
+)
+
+// Keys the Redis job store and queue use.
+const (
+	redisJobPrefix = "nlsearch:job:"
+	redisJobStream = "nlsearch:jobs"
+	redisJobGroup  = "workers"
+)
+
+const (
+	// unfinishedJobTTL is how long Redis keeps a job that hasn't finished,
+	// in case every worker dies before finishing it.
+	unfinishedJobTTL = 24 * time.Hour
+	// redisStreamLength roughly bounds the job stream, whose entries are
+	// only job IDs.
+	redisStreamLength = 10000
+	// redisBlock is how long a Dequeue waits for new jobs before checking
+	// again for deliveries whose worker went silent.
+	redisBlock = 5 * time.Second
+)
+
+// RedisJobStore keeps jobs in Redis, where every replica sharing it sees
+// them. Finished jobs expire after jobTTL, so it needs no pruning.
+type RedisJobStore struct {
+	client *redis.Client
+}
+
+func NewRedisJobStore(client *redis.Client) *RedisJobStore {
+	return &RedisJobStore{client: client}
+}
+
+func (s *RedisJobStore) SaveJob(ctx context.Context, job Job) error {
+	data, err := json.Marshal(newJobRecord(job))
+	if err != nil {
+		return err
+	}
+	ttl := unfinishedJobTTL
+	if job.finished() {
+		ttl = jobTTL
+	}
+	_, err = s.client.Do(ctx, "SET", redisJobPrefix+job.ID, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (s *RedisJobStore) GetJob(ctx context.Context, id string) (Job, error) {
+	reply, err := s.client.Do(ctx, "GET", redisJobPrefix+id)
+	if errors.Is(err, redis.ErrNil) {
+		return Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	data, _ := reply.(string)
+	var rec jobRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return Job{}, fmt.Errorf("job %s: %w", id, err)
+	}
+	return rec.job(), nil
+}
+
+// DeleteJobs scans every job for owner's finished ones.
+func (s *RedisJobStore) DeleteJobs(ctx context.Context, owner string) (int, error) {
+	removed := 0
+	cursor := "0"
+	for {
+		reply, err := s.client.Do(ctx, "SCAN", cursor, "MATCH", redisJobPrefix+"*", "COUNT", "200")
+		if err != nil {
+			return removed, err
+		}
+		// [next cursor, [key, ...]]
+		fields, _ := reply.([]any)
+		if len(fields) < 2 {
+			return removed, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = fields[0].(string)
+		keys, _ := fields[1].([]any)
+		for _, key := range keys {
+			key, _ := key.(string)
+			job, err := s.GetJob(ctx, strings.TrimPrefix(key, redisJobPrefix))
+			if errors.Is(err, ErrJobNotFound) {
+				continue
+			}
+			if err != nil {
+				return removed, err
+			}
+			if !job.finished() || job.Owner != owner {
+				continue
+			}
+			if _, err := s.client.Do(ctx, "DEL", key); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if cursor == "0" {
+			return removed, nil
+		}
+	}
+}
+
+// UnfinishedJobs returns none: the queue delivers unfinished jobs again by
+// itself.
+func (s *RedisJobStore) UnfinishedJobs(ctx context.Context) ([]Job, error) {
+	return nil, nil
+}
+
+// RedisJobQueue is a JobQueue on a Redis stream (Redis 6.2 or later), read
+// by a consumer group so each job goes to one worker. Deliveries left
+// pending longer than the visibility timeout are claimed by the next
+// worker to ask for a job.
+type RedisJobQueue struct {
+	client     *redis.Client
+	visibility time.Duration
+	consumer   string
+
+	mu      sync.Mutex
+	created bool   // whether the consumer group is known to exist
+	cursor  string // where to continue scanning for stale deliveries
+}
+
+// NewRedisJobQueue returns a queue whose deliveries are given to another
+// worker when not extended or acknowledged within visibility.
+func NewRedisJobQueue(client *redis.Client, visibility time.Duration) *RedisJobQueue {
+	host, _ := os.Hostname()
+	return &RedisJobQueue{
+		client:     client,
+		visibility: visibility,
+		consumer:   fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID()[:8]),
+		cursor:     "0-0",
+	}
+}
+
+func (q *RedisJobQueue) Enqueue(ctx context.Context, id string) error {
+	_, err := q.client.Do(ctx, "XADD", redisJobStream, "MAXLEN", "~", strconv.Itoa(redisStreamLength), "*", "job", id)
+	return err
+}
+
+func (q *RedisJobQueue) Dequeue(ctx context.Context) (string, string, error) {
+	if err := q.createGroup(ctx); err != nil {
+		return "", "", err
+	}
+	for {
+		id, receipt, err := q.claimStale(ctx)
+		if err != nil || receipt != "" {
+			return id, receipt, err
+		}
+		reply, err := q.client.Do(ctx, "XREADGROUP", "GROUP", redisJobGroup, q.consumer,
+			"COUNT", "1", "BLOCK", strconv.FormatInt(redisBlock.Milliseconds(), 10),
+			"STREAMS", redisJobStream, ">")
+		if errors.Is(err, redis.ErrNil) {
+			continue
+		}
+		if err != nil {
+			q.forgetGroup(err)
+			return "", "", err
+		}
+		// [[stream, [entry]]]
+		streams, _ := reply.([]any)
+		if len(streams) == 0 {
+			continue
+		}
+		stream, _ := streams[0].([]any)
+		if len(stream) < 2 {
+			continue
+		}
+		entries, _ := stream[1].([]any)
+		if len(entries) == 0 {
+			continue
+		}
+		if id, receipt, ok := parseStreamEntry(entries[0]); ok {
+			return id, receipt, nil
+		} else if receipt != "" {
+			q.Ack(ctx, receipt)
+		}
+	}
+}
+
+// claimStale takes over a delivery that has been pending longer than the
+// visibility timeout, if there is one.
+func (q *RedisJobQueue) claimStale(ctx context.Context) (string, string, error) {
+	q.mu.Lock()
+	cursor := q.cursor
+	q.mu.Unlock()
+	reply, err := q.client.Do(ctx, "XAUTOCLAIM", redisJobStream, redisJobGroup, q.consumer,
+		strconv.FormatInt(q.visibility.Milliseconds(), 10), cursor, "COUNT", "1")
+	if err != nil {
+		q.forgetGroup(err)
+		return "", "", err
+	}
+	// [next cursor, [entry], deleted IDs (Redis 7)]
+	fields, _ := reply.([]any)
+	if len(fields) < 2 {
+		return "", "", fmt.Errorf("unexpected XAUTOCLAIM reply %v", reply)
+	}
+	next, _ := fields[0].(string)
+	q.mu.Lock()
+	q.cursor = next
+	q.mu.Unlock()
+	entries, _ := fields[1].([]any)
+	for _, entry := range entries {
+		// Redis 6.2 lists entries trimmed from the stream as nil.
+		if id, receipt, ok := parseStreamEntry(entry); ok {
+			return id, receipt, nil
+		} else if receipt != "" {
+			q.Ack(ctx, receipt)
+		}
+	}
+	return "", "", nil
+}
+
+// parseStreamEntry returns the job ID of a stream entry, [id, [field,
+// value, ...]], and the entry ID as the receipt. ok is false when the entry
+// has no job.
+func parseStreamEntry(entry any) (id, receipt string, ok bool) {
+	parts, _ := entry.([]any)
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	receipt, _ = parts[0].(string)
+	fields, _ := parts[1].([]any)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if name, _ := fields[i].(string); name == "job" {
+			id, _ = fields[i+1].(string)
+		}
+	}
+	return id, receipt, id != "" && receipt != ""
+}
+
+// createGroup creates the stream and consumer group unless they already
+// exist. The group starts at the beginning of the stream so no job
+// enqueued before any worker started is missed.
+func (q *RedisJobQueue) createGroup(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.created {
+		return nil
+	}
+	_, err := q.client.Do(ctx, "XGROUP", "CREATE", redisJobStream, redisJobGroup, "0", "MKSTREAM")
+	var redisErr redis.Error
+	if err != nil && !(errors.As(err, &redisErr) && redisErr.HasPrefix("BUSYGROUP")) {
+		return err
+	}
+	q.created = true
+	return nil
+}
+
+// forgetGroup makes the next Dequeue create the consumer group again if
+// err says it is gone, as after Redis restarted without persistence.
+func (q *RedisJobQueue) forgetGroup(err error) {
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) && redisErr.HasPrefix("NOGROUP") {
+		q.mu.Lock()
+		q.created = false
+		q.mu.Unlock()
+	}
+}
+
+// Extend claims the delivery again for this worker, which resets how long
+// it has been pending.
+func (q *RedisJobQueue) Extend(ctx context.Context, receipt string) error {
+	_, err := q.client.Do(ctx, "XCLAIM", redisJobStream, redisJobGroup, q.consumer, "0", receipt, "JUSTID")
+	return err
+}
+
+func (q *RedisJobQueue) Ack(ctx context.Context, receipt string) error {
+	_, err := q.client.Do(ctx, "XACK", redisJobStream, redisJobGroup, receipt)
+	return err
+}
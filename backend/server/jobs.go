@@ -0,0 +1,413 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/translate"
+)
+
+// Job statuses.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Job is a translation run in the background for clients that can't hold
+// a connection open while Deep Search works.
+type Job struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Request string `json:"request"`
+	// Progress is a rough percentage of the work done, estimated from the
+	// stage and, while waiting for Deep Search, the time elapsed.
+	Progress int    `json:"progress"`
+	Stage    string `json:"stage,omitempty"`
+	// Result is set once the job has completed, and Error once it has
+	// failed.
+	Result    *QueryResponse  `json:"result,omitempty"`
+	Error     *apierror.Error `json:"error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	// Owner is who submitted the job; only they can see it.
+	Owner string `json:"-"`
+	// RequestID is the ID of the request that submitted the job, which
+	// its logs and upstream requests keep wherever it runs.
+	RequestID string `json:"-"`
+	// Params is the request as submitted, and Conversation and Question
+	// the Deep Search conversation and question the job is waiting on, so
+	// a job interrupted by a restart can be picked up again.
+	Params       QueryRequest `json:"-"`
+	Conversation int          `json:"-"`
+	Question     int          `json:"-"`
+	// Attempts counts the times a queue worker has started the job.
+	Attempts int `json:"-"`
+}
+
+// finished reports whether the job has stopped running.
+func (j Job) finished() bool {
+	return j.Status == JobCompleted || j.Status == JobFailed
+}
+
+// JobStore keeps the state of jobs.
+type JobStore interface {
+	SaveJob(ctx context.Context, job Job) error
+	// GetJob returns ErrJobNotFound for unknown IDs.
+	GetJob(ctx context.Context, id string) (Job, error)
+	// UnfinishedJobs returns the jobs that haven't completed or failed,
+	// oldest first.
+	UnfinishedJobs(ctx context.Context) ([]Job, error)
+}
+
+// Resumer is a Translator that can finish a translation whose Deep Search
+// conversation an earlier process was waiting on, such as
+// translate.Translator.
+type Resumer interface {
+	Resume(ctx context.Context, conversation, question int, request string, progress func(translate.Progress)) (*translate.Translation, error)
+}
+
+// ErrJobNotFound is returned by JobStore methods for unknown job IDs.
+var ErrJobNotFound = errors.New("job not found")
+
+const (
+	// maxRunningJobs bounds the translations running in the background,
+	// which have no connection to hold them back.
+	maxRunningJobs = 64
+	// defaultJobLimit is how many jobs MemoryJobStore remembers.
+	defaultJobLimit = 1000
+	// jobTTL is how long finished jobs can still be fetched.
+	jobTTL = time.Hour
+	// jobsRetryAfter is when to try again when too many jobs are running.
+	jobsRetryAfter = 5 * time.Second
+)
+
+// handleJobs starts a job translating the QueryRequest in the body and
+// answers 202 with the job, whose Location is polled for the result.
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	req, apiErr := s.decodeQueryRequest(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	// Jobs are kept in the job store until they are collected, which only
+	// the in-memory one forgets on restart.
+	noStore := s.noStore(r.Context(), req)
+	if _, inMemory := s.opts.Jobs.(*MemoryJobStore); noStore && !inMemory {
+		writeError(w, r, invalidField("no_store", "Jobs are persisted on this server, so requests with no_store must use /query or /query/stream"))
+		return
+	}
+	// Queued jobs wait their turn for a worker instead.
+	queued := s.opts.JobQueue != nil
+	if !queued && s.runningJobs.Add(1) > maxRunningJobs {
+		s.runningJobs.Add(-1)
+		apiErr := apierror.New(apierror.RateLimited, "Too many jobs are running; try again later")
+		apiErr.RetryAfter = jobsRetryAfter
+		writeError(w, r, apiErr)
+		return
+	}
+
+	now := time.Now().UTC()
+	job := Job{ID: newID(), Status: JobQueued, Request: req.Query, CreatedAt: now, UpdatedAt: now, Owner: owner(r.Context()), RequestID: middleware.RequestIDFrom(r.Context()), Params: req}
+	if noStore {
+		job.Request = ""
+	}
+	err := s.opts.Jobs.SaveJob(r.Context(), job)
+	if err == nil && queued {
+		err = s.opts.JobQueue.Enqueue(r.Context(), job.ID)
+	}
+	if err != nil {
+		if !queued {
+			s.runningJobs.Add(-1)
+		}
+		slog.ErrorContext(r.Context(), "Error saving job", "err", err)
+		apiErr := apierror.New(apierror.Internal, "Failed to start the job")
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+	if !queued {
+		// The job outlives the request, but keeps its identity and request
+		// ID for history and error reports, and its place in the caller's
+		// concurrency limit.
+		jobReq, release := r.Clone(context.WithoutCancel(r.Context())), middleware.KeepSlot(r.Context())
+		go func() {
+			defer release()
+			s.runJob(jobReq, job)
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", apiPrefix+"/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleJob reports the state of one of the caller's jobs.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	job, err := s.opts.Jobs.GetJob(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrJobNotFound) || err == nil && job.Owner != owner(r.Context()) {
+		writeError(w, r, apierror.New(apierror.NotFound, "No job of yours with that id; finished jobs are kept for an hour"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading job", "err", err)
+		apiErr := apierror.New(apierror.Internal, "Failed to read the job")
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// ResumeJobs picks up the jobs that were still unfinished when the server
+// last stopped, as recorded by a durable JobStore: those already waiting on
+// Deep Search go on waiting for the same conversation, and the rest start
+// over. Call it once at startup.
+func (s *Server) ResumeJobs(ctx context.Context) error {
+	jobs, err := s.opts.Jobs.UnfinishedJobs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		s.runningJobs.Add(1)
+		go s.runJob(jobRequest(ctx, job), job)
+	}
+	if len(jobs) > 0 {
+		slog.Info("Resumed unfinished jobs", "jobs", len(jobs))
+	}
+	return nil
+}
+
+// jobRequest stands in for the request that started job, carrying its
+// owner's identity and request ID, for jobs run by another process or after
+// a restart.
+func jobRequest(ctx context.Context, job Job) *http.Request {
+	ctx = context.WithoutCancel(ctx)
+	if job.RequestID != "" {
+		ctx = middleware.WithRequestID(ctx, job.RequestID)
+	}
+	if job.Owner != "" {
+		ctx = middleware.WithIdentity(ctx, &middleware.Identity{Name: job.Owner, Roles: []string{middleware.RoleUser}})
+	}
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, apiPrefix+"/jobs", nil)
+	return r
+}
+
+// runJob translates the job's request, saving its progress as it goes. r
+// is the request that started it.
+func (s *Server) runJob(r *http.Request, job Job) {
+	defer s.runningJobs.Add(-1)
+	req := job.Params
+	timeout := s.requestTimeout(req)
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	save := func() {
+		job.UpdatedAt = time.Now().UTC()
+		if err := s.opts.Jobs.SaveJob(context.Background(), job); err != nil {
+			slog.Error("Error saving job", "job", job.ID, "err", err)
+		}
+	}
+	job.Status = JobRunning
+	save()
+
+	var mu sync.Mutex
+	progress := func(p translate.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		percent := max(job.Progress, jobProgress(p, timeout))
+		conversation, question := job.Conversation, job.Question
+		switch {
+		case p.Conversation > conversation:
+			conversation, question = p.Conversation, p.Question
+		case p.Conversation == conversation && p.Question != 0:
+			question = p.Question
+		}
+		if p.Stage == job.Stage && percent == job.Progress && conversation == job.Conversation && question == job.Question {
+			return
+		}
+		job.Stage, job.Progress, job.Conversation, job.Question = p.Stage, percent, conversation, question
+		save()
+	}
+	var resp QueryResponse
+	var cached bool
+	err := translate.ErrCannotResume
+	// Questions start over, since resuming would extract a query from the
+	// answer.
+	if resumer, ok := s.opts.Translator.(Resumer); ok && job.Conversation != 0 && s.intent(req) == translate.IntentSearch {
+		var id string
+		var translation *translate.Translation
+		id, translation, err = s.resumeTranslation(ctx, resumer, job.Conversation, job.Question, req, progress)
+		if err == nil {
+			resp = s.newQueryResponse(ctx, req, id, translation, false)
+		}
+		if errors.Is(err, deepsearch.ErrNotFound) {
+			slog.WarnContext(ctx, "Job's conversation is gone; starting over", "job", job.ID, "conversation", job.Conversation)
+		}
+	}
+	if errors.Is(err, translate.ErrCannotResume) || errors.Is(err, deepsearch.ErrNotFound) {
+		resp, cached, err = s.respond(ctx, req, progress)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	job.Stage = ""
+	if err != nil {
+		slog.ErrorContext(ctx, "Error translating query", "job", job.ID, "err", err)
+		apiErr := translationError(ctx, err, cached)
+		s.reportError(r, err, apiErr)
+		job.Status, job.Error = JobFailed, apiErr.ForRequest(middleware.RequestIDFrom(ctx))
+	} else {
+		job.Status, job.Progress, job.Result = JobCompleted, 100, &resp
+	}
+	save()
+}
+
+// resumeTranslation finishes translating req, which was waiting on
+// question in conversation, like translate would have: the result is
+// cached and recorded in the history.
+func (s *Server) resumeTranslation(ctx context.Context, resumer Resumer, conversation, question int, req QueryRequest, progress func(translate.Progress)) (string, *translate.Translation, error) {
+	ctx = s.inTimezone(s.observe(ctx), req)
+	translation, err := resumer.Resume(ctx, conversation, question, req.Query, progress)
+	if errors.Is(err, translate.ErrCannotResume) || errors.Is(err, deepsearch.ErrNotFound) {
+		return "", nil, err
+	}
+	s.health.record(err)
+	if err == nil && s.opts.Cache != nil {
+		s.opts.Cache.Set(ctx, s.cacheKey(ctx, req.Query), translation)
+	}
+	translation, err = s.enforcePolicy(ctx, limitResults(translation, req.MaxResults), err)
+	s.recordAnalytics(ctx, req.Query, translation, false, err)
+	id := s.recordHistory(ctx, HistoryEntry{Request: req.Query, Shared: req.Share}, translation, err)
+	return id, translation, err
+}
+
+// jobProgress estimates how far along a translation is from its progress
+// report. Deep Search doesn't say how much is left, so waiting for it
+// counts up with the time spent, as a share of the timeout.
+func jobProgress(p translate.Progress, timeout time.Duration) int {
+	switch p.Stage {
+	case "creating conversation", "asking follow-up":
+		return 5
+	case "waiting for Deep Search":
+		if timeout <= 0 {
+			return 10
+		}
+		elapsed := time.Duration(p.ElapsedMs) * time.Millisecond
+		return 10 + int(min(80*float64(elapsed)/float64(timeout), 80))
+	case "extracting query":
+		return 95
+	default:
+		return 0
+	}
+}
+
+// MemoryJobStore keeps the most recent jobs in memory. Jobs are lost on
+// restart.
+type MemoryJobStore struct {
+	mu    sync.Mutex
+	limit int
+	order []string // oldest first
+	jobs  map[string]Job
+}
+
+// NewMemoryJobStore returns a store that retains at most limit jobs.
+func NewMemoryJobStore(limit int) *MemoryJobStore {
+	return &MemoryJobStore{limit: limit, jobs: map[string]Job{}}
+}
+
+func (s *MemoryJobStore) SaveJob(ctx context.Context, job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.ID]; !ok {
+		s.order = append(s.order, job.ID)
+	}
+	s.jobs[job.ID] = job
+	if len(s.order) > s.limit {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+func (s *MemoryJobStore) UnfinishedJobs(ctx context.Context) ([]Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []Job
+	for _, id := range s.order {
+		if job := s.jobs[id]; !job.finished() {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (s *MemoryJobStore) GetJob(ctx context.Context, id string) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (s *MemoryJobStore) DeleteJobs(ctx context.Context, owner string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if job := s.jobs[id]; job.finished() && job.Owner == owner {
+			delete(s.jobs, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	removed := len(s.order) - len(kept)
+	clear(s.order[len(kept):])
+	s.order = kept
+	return removed, nil
+}
+
+// Prune removes the finished jobs last updated before cutoff or more than
+// jobTTL ago.
+func (s *MemoryJobStore) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expired := time.Now().Add(-jobTTL); cutoff.Before(expired) {
+		cutoff = expired
+	}
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if job := s.jobs[id]; job.finished() && job.UpdatedAt.Before(cutoff) {
+			delete(s.jobs, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	removed := len(s.order) - len(kept)
+	clear(s.order[len(kept):])
+	s.order = kept
+	return removed, nil
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/translate"
+)
+
+const defaultHistoryLimit = 1000
+
+// MemoryStore keeps the most recent history entries in memory. Entries are
+// lost on restart.
+type MemoryStore struct {
+	mu      sync.Mutex
+	limit   int
+	entries []HistoryEntry
+}
+
+// NewMemoryStore returns a store that retains at most limit entries.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{limit: limit}
+}
+
+func (s *MemoryStore) AddHistory(ctx context.Context, entry HistoryEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	if len(s.entries) > s.limit {
+		s.entries = s.entries[len(s.entries)-s.limit:]
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, error) {
+	s.mu.Lock()
+	sorted := slices.Clone(s.entries)
+	s.mu.Unlock()
+
+	// Entries are added in roughly the order they were created; sort them
+	// so cursors see the same order every time.
+	slices.SortFunc(sorted, func(a, b HistoryEntry) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.ID, a.ID)
+	})
+	search := parseTextQuery(q.Search)
+	var out []HistoryEntry
+	for _, entry := range sorted {
+		if len(out) == q.Limit {
+			break
+		}
+		if q.visible(entry) && q.After.Follows(entry.CreatedAt, entry.ID) && matchesSearch(search, entry) {
+			out = append(out, entry)
+		}
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) SetFeedback(ctx context.Context, owner, id string, feedback Feedback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.entries {
+		if s.entries[i].ID == id && s.entries[i].Owner == owner {
+			s.entries[i].Feedback = &feedback
+			return nil
+		}
+	}
+	return ErrHistoryNotFound
+}
+
+func (s *MemoryStore) SetShared(ctx context.Context, owner, id string, shared bool) (HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.entries {
+		if s.entries[i].ID == id && s.entries[i].Owner == owner {
+			s.entries[i].Shared = shared
+			return s.entries[i], nil
+		}
+	}
+	return HistoryEntry{}, ErrHistoryNotFound
+}
+
+func (s *MemoryStore) DeleteHistory(ctx context.Context, owner string) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	feedback := 0
+	kept := s.entries[:0]
+	for _, entry := range s.entries {
+		if entry.Owner != owner {
+			kept = append(kept, entry)
+		} else if entry.Feedback != nil {
+			feedback++
+		}
+	}
+	removed := len(s.entries) - len(kept)
+	clear(s.entries[len(kept):])
+	s.entries = kept
+	return removed, feedback, nil
+}
+
+// visible reports whether the viewer of q can see entry.
+func (q HistoryQuery) visible(entry HistoryEntry) bool {
+	switch {
+	case q.All || entry.Owner == q.Viewer:
+		return true
+	case q.Mine:
+		return false
+	default:
+		return entry.Shared
+	}
+}
+
+// matchesSearch reports whether the request, generated query or corrected
+// query of entry matches search.
+func matchesSearch(search textQuery, entry HistoryEntry) bool {
+	texts := []string{entry.Request, entry.Query}
+	if entry.Feedback != nil {
+		texts = append(texts, entry.Feedback.Query)
+	}
+	return search.matches(texts...)
+}
+
+// Prune removes the entries created before cutoff.
+func (s *MemoryStore) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.entries[:0]
+	for _, entry := range s.entries {
+		if !entry.CreatedAt.Before(cutoff) {
+			kept = append(kept, entry)
+		}
+	}
+	removed := len(s.entries) - len(kept)
+	clear(s.entries[len(kept):])
+	s.entries = kept
+	return removed, nil
+}
+
+// lru is a size-bounded LRU cache whose entries expire after a TTL.
+type lru[V any] struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+func newLRU[V any](size int, ttl time.Duration) *lru[V] {
+	return &lru[V]{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *lru[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[V])
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return entry.value, true
+}
+
+func (c *lru[V]) set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expiresAt: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// prune removes the entries that have expired or were set before cutoff.
+// get only notices expired entries when they are looked up again.
+func (c *lru[V]) prune(cutoff time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var removed int
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*lruEntry[V])
+		if now.After(entry.expiresAt) || entry.expiresAt.Add(-c.ttl).Before(cutoff) {
+			c.order.Remove(el)
+			delete(c.entries, entry.key)
+			removed++
+		}
+		el = next
+	}
+	return removed
+}
+
+// MemoryCache is a size-bounded LRU cache of translations whose entries
+// expire after a TTL.
+type MemoryCache struct {
+	lru *lru[*translate.Translation]
+}
+
+func NewMemoryCache(size int, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{lru: newLRU[*translate.Translation](size, ttl)}
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) (*translate.Translation, bool) {
+	return c.lru.get(key)
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, translation *translate.Translation) {
+	c.lru.set(key, translation)
+}
+
+func (c *MemoryCache) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	return c.lru.prune(cutoff), nil
+}
+
+// MemorySearchCache is a size-bounded LRU cache of search results whose
+// entries expire after a TTL.
+type MemorySearchCache struct {
+	lru *lru[*search.Result]
+}
+
+func NewMemorySearchCache(size int, ttl time.Duration) *MemorySearchCache {
+	return &MemorySearchCache{lru: newLRU[*search.Result](size, ttl)}
+}
+
+func (c *MemorySearchCache) Get(ctx context.Context, key string) (*search.Result, bool) {
+	return c.lru.get(key)
+}
+
+func (c *MemorySearchCache) Set(ctx context.Context, key string, result *search.Result) {
+	c.lru.set(key, result)
+}
+
+func (c *MemorySearchCache) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	return c.lru.prune(cutoff), nil
+}
+
+// MemoryFailureCache remembers recent translation failures for a short TTL.
+type MemoryFailureCache struct {
+	lru *lru[error]
+}
+
+func NewMemoryFailureCache(size int, ttl time.Duration) *MemoryFailureCache {
+	return &MemoryFailureCache{lru: newLRU[error](size, ttl)}
+}
+
+func (c *MemoryFailureCache) GetFailure(ctx context.Context, key string) (error, bool) {
+	return c.lru.get(key)
+}
+
+func (c *MemoryFailureCache) SetFailure(ctx context.Context, key string, err error) {
+	c.lru.set(key, err)
+}
+
+func (c *MemoryFailureCache) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	return c.lru.prune(cutoff), nil
+}
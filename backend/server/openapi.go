@@ -0,0 +1,350 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/examples"
+)
+
+// apiOperation describes one route for the OpenAPI document. Request and
+// response bodies are given as values of their Go types, whose schemas are
+// generated from their JSON encoding, so they can't drift from the code.
+type apiOperation struct {
+	method  string
+	path    string // relative to apiPrefix
+	summary string
+	admin   bool
+	params  []apiParam
+	request any
+	// response is the body of a successful response, or nil if there is
+	// none; it is sent with status and contentType, which default to 200
+	// and JSON.
+	response    any
+	status      int
+	contentType string
+}
+
+// apiParam is a query parameter. Path parameters are found in the path.
+type apiParam struct {
+	name        string
+	kind        string // OpenAPI type: string, integer or boolean
+	description string
+}
+
+// pagingParams are the query parameters of paginated lists.
+var pagingParams = []apiParam{
+	{"limit", "integer", "Maximum number of items to return."},
+	{"cursor", "string", "next_cursor from the previous page."},
+}
+
+// operations lists the routes s registers.
+func (s *Server) operations() []apiOperation {
+	ops := []apiOperation{
+		{method: "POST", path: "/query", summary: "Translate a natural language request into a search query", request: QueryRequest{}, response: QueryResponse{}, params: []apiParam{
+			{"keepalive", "boolean", "If the translation takes a while, respond 200 at once and send newlines until the body is ready, which may then be an error envelope."},
+		}},
+		{method: "GET", path: "/query", summary: "Translate a request given in the URL, for bookmarks and browser keyword searches, without recording it in the history", response: QueryResponse{}, params: []apiParam{
+			{"q", "string", "The natural language request. Required."},
+			{"format", "string", "As in the POST body."},
+			{"intent", "string", "As in the POST body."},
+			{"timeout_seconds", "integer", "As in the POST body."},
+			{"no_store", "boolean", "As in the POST body."},
+			{"snippets", "boolean", "As in the POST body."},
+			{"highlight", "boolean", "As in the POST body."},
+			{"html", "boolean", "As in the POST body."},
+			{"disambiguate", "boolean", "As in the POST body."},
+			{"max_results", "integer", "As in the POST body."},
+			{"timezone", "string", "As in the POST body."},
+			{"keepalive", "boolean", "As for POST."},
+		}},
+		{method: "POST", path: "/query/stream", summary: "Translate a request, streaming progress as server-sent events: progress, step, then result or error", request: QueryRequest{}, response: "", contentType: "text/event-stream"},
+		{method: "POST", path: "/query/raw", summary: "Translate the request in a plain text body, answering with just the query as text, for shell pipelines; errors are a line of text", response: "", contentType: "text/plain", params: []apiParam{
+			{"format", "string", "As in the /query body."},
+			{"intent", "string", "As in the /query body."},
+			{"timeout_seconds", "integer", "As in the /query body."},
+			{"share", "boolean", "As in the /query body."},
+			{"no_store", "boolean", "As in the /query body."},
+			{"max_results", "integer", "As in the /query body."},
+			{"timezone", "string", "As in the /query body."},
+		}},
+		{method: "POST", path: "/query/{id}/refine", summary: "Revise an earlier translation with a follow-up, given as the query", request: QueryRequest{}, response: QueryResponse{}},
+		{method: "POST", path: "/query/{id}/clarify", summary: "Complete a translation that asked a clarifying question, given the user's answer as the query", request: QueryRequest{}, response: QueryResponse{}},
+		{method: "POST", path: "/jobs", summary: "Start translating a request in the background; poll the job for the result", request: QueryRequest{}, response: Job{}, status: http.StatusAccepted},
+		{method: "GET", path: "/jobs/{id}", summary: "Show the status, progress and result of one of your jobs", response: Job{}},
+		{method: "GET", path: "/history", summary: "List past translations visible to the authenticated caller, most recent first", response: HistoryResponse{}, params: append([]apiParam{
+			{"q", "string", "Only entries whose request, query or correction contain every word."},
+			{"mine", "boolean", "Leave out other users' shared entries."},
+		}, pagingParams...)},
+		{method: "DELETE", path: "/history", summary: "Delete your history, feedback and finished jobs", response: DeletionReport{}, params: []apiParam{
+			{"user", "string", "Must be me."},
+		}},
+		{method: "POST", path: "/history/{id}/share", summary: "Share one of your translations with every user, or stop sharing it", request: ShareRequest{}, response: HistoryEntry{}},
+		{method: "POST", path: "/feedback", summary: "Record feedback on a translation", request: FeedbackRequest{}, status: http.StatusNoContent},
+	}
+	if s.opts.Questions != nil {
+		ops = append(ops, apiOperation{method: "POST", path: "/ask", summary: "Have Deep Search answer a question about the code, in Markdown with its sources", request: AskRequest{}, response: AskResponse{}})
+	}
+	if s.opts.Searcher != nil {
+		ops = append(ops, apiOperation{method: "POST", path: "/search", summary: "Run a search query on Sourcegraph", request: SearchRequest{}, response: SearchResponse{}})
+	}
+	if s.extensionTokens != nil {
+		ops = append(ops, apiOperation{method: "POST", path: "/extension/token", summary: "Exchange the pairing secret for a browser extension token", request: ExtensionTokenRequest{}, response: ExtensionTokenResponse{}})
+	}
+	if !s.adminEnabled() {
+		return ops
+	}
+	ops = append(ops, apiOperation{method: "GET", path: "/admin/export", summary: "Download translations with feedback as JSON lines, one record per line", admin: true, response: ExportRecord{}, contentType: "application/x-ndjson", params: []apiParam{
+		{"unlabeled", "boolean", "Include successful translations without feedback."},
+	}})
+	ops = append(ops, apiOperation{method: "DELETE", path: "/admin/history", summary: "Delete a user's history, feedback and finished jobs", admin: true, response: DeletionReport{}, params: []apiParam{
+		{"user", "string", "Name of the user or API key."},
+	}})
+	if s.opts.Conversations != nil {
+		ops = append(ops,
+			apiOperation{method: "GET", path: "/admin/conversations", summary: "List the Deep Search conversations this server created", admin: true, response: ConversationsResponse{}, params: append([]apiParam{
+				{"waiting", "boolean", "Only conversations still waiting for an answer, or only answered ones."},
+				{"deleted", "boolean", "Only conversations deleted from Sourcegraph, or only ones that weren't."},
+			}, pagingParams...)},
+			apiOperation{method: "GET", path: "/admin/conversations/{id}", summary: "Show a conversation and its current state on Sourcegraph", admin: true, response: ConversationResponse{}},
+		)
+	}
+	if s.opts.LogLevel != nil {
+		ops = append(ops,
+			apiOperation{method: "GET", path: "/admin/log-level", summary: "Show the log level", admin: true, response: LogLevelRequest{}},
+			apiOperation{method: "PUT", path: "/admin/log-level", summary: "Change the log level", admin: true, request: LogLevelRequest{}, response: LogLevelRequest{}},
+		)
+	}
+	if s.opts.Examples != nil {
+		ops = append(ops,
+			apiOperation{method: "GET", path: "/admin/examples", summary: "Describe the few-shot example index", admin: true, response: examples.Status{}},
+			apiOperation{method: "POST", path: "/admin/examples/reindex", summary: "Reload the examples and rebuild the index", admin: true, response: examples.Status{}},
+		)
+	}
+	return ops
+}
+
+// openAPI builds the OpenAPI 3 document describing the routes s registers.
+func (s *Server) openAPI() map[string]any {
+	g := &schemaGenerator{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+	errorResponse := map[string]any{
+		"description": "Error; see the code for what went wrong.",
+		"content":     map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(apierror.Envelope{}))}},
+	}
+	security := []any{map[string]any{"bearer": []any{}}, map[string]any{"apiKey": []any{}}}
+
+	paths := map[string]any{}
+	for _, op := range s.operations() {
+		o := map[string]any{
+			"summary":   op.summary,
+			"responses": map[string]any{"default": map[string]any{"$ref": "#/components/responses/Error"}},
+		}
+		var params []any
+		for _, segment := range strings.Split(op.path, "/") {
+			if name, ok := strings.CutPrefix(segment, "{"); ok {
+				params = append(params, map[string]any{"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+			}
+		}
+		for _, p := range op.params {
+			params = append(params, map[string]any{"name": p.name, "in": "query", "description": p.description, "schema": map[string]any{"type": p.kind}})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.request != nil {
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(op.request))}},
+			}
+		}
+		status, contentType := op.status, op.contentType
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		if op.response != nil {
+			success["content"] = map[string]any{contentType: map[string]any{"schema": g.schema(reflect.TypeOf(op.response))}}
+		}
+		o["responses"].(map[string]any)[strconv.Itoa(status)] = success
+		if op.admin {
+			o["tags"] = []string{"admin"}
+			o["security"] = security
+		} else if len(s.opts.APIKeys) > 0 {
+			o["security"] = security
+		}
+
+		path := apiPrefix + op.path
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path].(map[string]any)[strings.ToLower(op.method)] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "nlsearch",
+			"description": "Converts natural language into Sourcegraph code search queries. Errors use the envelope described by the Error response. The unversioned /api paths are deprecated aliases of /api/v1.",
+			"version":     strings.TrimPrefix(apiPrefix, "/api/"),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":   g.schemas,
+			"responses": map[string]any{"Error": errorResponse},
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer", "description": "An API key, or a token from /api/v1/extension/token."},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+// schemaGenerator derives JSON schemas from Go types the way encoding/json
+// would encode them. Named structs become components, referenced by name.
+type schemaGenerator struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct:
+		return map[string]any{"$ref": "#/components/schemas/" + g.component(t)}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	default:
+		// interface{} and anything else encoding/json accepts as is.
+		return map[string]any{}
+	}
+}
+
+// component adds the schema of struct type t to the components, if it
+// isn't there yet, and returns its name: the type's name, prefixed with its
+// package if another type took the name first.
+func (g *schemaGenerator) component(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := g.schemas[name]; taken || name == "" {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	g.names[t] = name
+	g.schemas[name] = nil // reserve the name while the fields refer back to it
+
+	properties := map[string]any{}
+	var required []string
+	g.fields(t, properties, &required)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	g.schemas[name] = schema
+	return name
+}
+
+// fields adds the JSON fields of struct t to properties, inlining embedded
+// structs as encoding/json does. Fields without omitempty are required.
+func (g *schemaGenerator) fields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, properties, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+// docsScript starts Swagger UI on docsPage. It is served on its own, not
+// inline, so the page's Content-Security-Policy needn't allow inline
+// scripts.
+//
+//go:embed docs.js
+var docsScript []byte
+
+// swaggerUI is where docsPage loads Swagger UI from; its
+// Content-Security-Policy allows nothing else from unpkg.com.
+const swaggerUI = "https://unpkg.com/swagger-ui-dist@5.17.14/"
+
+// docsCSP is the Content-Security-Policy of docsPage, which the server's
+// own, for the frontend, would block.
+const docsCSP = "default-src 'none'; script-src 'self' " + swaggerUI + "; style-src " + swaggerUI + "; img-src 'self' data:; connect-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+// handleOpenAPI serves the OpenAPI document for the routes s registers.
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.openAPI())
+}
+
+// handleDocs serves Swagger UI pointed at the OpenAPI document. Unless
+// CONTENT_SECURITY_POLICY is off, it replaces the policy with docsCSP.
+func (s *Server) handleDocs(w http.ResponseWriter, r *http.Request) {
+	if w.Header().Get("Content-Security-Policy") != "" {
+		w.Header().Set("Content-Security-Policy", docsCSP)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
+
+// handleDocsScript serves docsScript.
+func (s *Server) handleDocsScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Write(docsScript)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/translate"
+)
+
+// permalinkTimeout bounds resolving the revisions of one response's sources
+// and reading their snippets. Sources left unresolved when it runs out are
+// linked to their branches, and those left unread have no snippet.
+const permalinkTimeout = 5 * time.Second
+
+// maxPermalinkRevisions caps the revisions resolved for one response, so an
+// answer citing many repositories doesn't cost as many requests.
+const maxPermalinkRevisions = 10
+
+// commitID matches full commit IDs, which need no resolving.
+var commitID = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// RevisionResolver resolves a revision of a repository, such as a branch,
+// or HEAD if it is empty, to the commit it points at, so links to sources
+// keep pointing at the code that was looked at. *sourcegraph.Client
+// implements it.
+type RevisionResolver interface {
+	ResolveRevision(ctx context.Context, repo, rev string) (string, error)
+}
+
+// linkSources returns sources with their URLs made into absolute links on
+// Options.SourcegraphURL, pinned to a commit where Options.Revisions can
+// resolve one. Sources that aren't in a repository keep the link they came
+// with. If req asks for snippets, files are given the text of the lines they
+// cite, read at the commit they link to.
+func (s *Server) linkSources(ctx context.Context, sources []translate.Source, req QueryRequest) []translate.Source {
+	if len(sources) == 0 {
+		return sources
+	}
+	ctx, cancel := context.WithTimeout(ctx, permalinkTimeout)
+	defer cancel()
+
+	commits := make(map[string]string)
+	revisions := make([]string, len(sources))
+	linked := make([]translate.Source, len(sources))
+	for i, src := range sources {
+		if src.Repository != "" {
+			revisions[i] = s.commit(ctx, commits, src.Repository, src.Revision)
+			src.URL = src.Link(revisions[i])
+		}
+		if strings.HasPrefix(src.URL, "/") && s.opts.SourcegraphURL != "" {
+			src.URL = strings.TrimSuffix(s.opts.SourcegraphURL, "/") + src.URL
+		}
+		linked[i] = src
+	}
+	if req.Snippets && s.opts.Snippets != nil {
+		s.addSnippets(ctx, linked, revisions, req.Highlight)
+	}
+	return linked
+}
+
+// commit returns the commit rev of repo points at, or rev itself if it
+// can't be resolved, remembering each in commits.
+func (s *Server) commit(ctx context.Context, commits map[string]string, repo, rev string) string {
+	if s.opts.Revisions == nil || commitID.MatchString(rev) {
+		return rev
+	}
+	key := repo + "@" + rev
+	if commit, ok := commits[key]; ok {
+		return commit
+	}
+	commit := rev
+	if len(commits) < maxPermalinkRevisions && ctx.Err() == nil {
+		resolved, err := s.opts.Revisions.ResolveRevision(ctx, repo, rev)
+		if err != nil {
+			slog.WarnContext(ctx, "Could not resolve source revision; linking to it unpinned", "repo", repo, "rev", rev, "err", err)
+		} else {
+			commit = resolved
+		}
+	}
+	commits[key] = commit
+	return commit
+}
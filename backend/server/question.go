@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nlsearch/backend/markdown"
+	"github.com/nlsearch/backend/translate"
+)
+
+// intentAuto, as QueryRequest.Intent, has the server tell from the request
+// whether it is a question.
+const intentAuto = "auto"
+
+// intent returns how req is handled. Questions are only answered when the
+// server has Options.Questions; otherwise every request is translated.
+func (s *Server) intent(req QueryRequest) translate.Intent {
+	if s.opts.Questions == nil {
+		return translate.IntentSearch
+	}
+	switch req.Intent {
+	case string(translate.IntentQuestion):
+		return translate.IntentQuestion
+	case intentAuto:
+		return translate.ClassifyIntent(req.Query)
+	}
+	return translate.IntentSearch
+}
+
+// respond handles req as its intent says: questions are answered in prose,
+// and everything else translated into a query, recorded in the history. It
+// reports whether the translation was served from the cache.
+func (s *Server) respond(ctx context.Context, req QueryRequest, progress func(translate.Progress)) (QueryResponse, bool, error) {
+	if s.intent(req) == translate.IntentQuestion {
+		resp, err := s.answerQuestion(ctx, req, progress)
+		return resp, false, err
+	}
+	id, translation, cached, err := s.translate(ctx, req, progress)
+	if err != nil {
+		return QueryResponse{}, cached, err
+	}
+	return s.newQueryResponse(ctx, req, id, translation, cached), cached, nil
+}
+
+// answerQuestion has Options.Questions answer req. Answers are neither
+// cached nor recorded in the history, which holds translations.
+func (s *Server) answerQuestion(ctx context.Context, req QueryRequest, progress func(translate.Progress)) (QueryResponse, error) {
+	ctx = s.observe(ctx)
+	ctx, req = s.private(ctx, req)
+	start := time.Now()
+	answer, err := s.opts.Questions.Ask(ctx, req.Query, func(p translate.Progress) {
+		if progress != nil {
+			p.ElapsedMs = time.Since(start).Milliseconds()
+			progress(p)
+		}
+	})
+	s.health.record(err)
+	if s.opts.Analytics != nil {
+		outcome := "answered"
+		if err != nil {
+			outcome = string(translationError(ctx, err, false).Code)
+		}
+		s.opts.Analytics.Translation(owner(ctx), outcome, req.Query, "")
+	}
+	if err != nil {
+		return QueryResponse{}, err
+	}
+	resp := QueryResponse{
+		Intent:  string(translate.IntentQuestion),
+		Reply:   answer.Text,
+		Sources: s.linkSources(ctx, answer.Sources, req),
+		Stats:   answer.Stats,
+	}
+	if req.HTML {
+		// Without HTML the Markdown is still there to show, so a
+		// rendering failure doesn't fail the request.
+		if resp.ReplyHTML, err = markdown.HTML(answer.Text, s.opts.SourcegraphURL); err != nil {
+			slog.WarnContext(ctx, "Could not render answer as HTML", "err", err)
+		}
+	}
+	return resp, nil
+}
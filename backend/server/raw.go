@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/translate"
+)
+
+// maxRawRequest bounds the body of /query/raw.
+const maxRawRequest = 64 << 10
+
+// handleQueryRaw translates the request in a plain text body and answers
+// with just the query, or the output of the requested format, for shell
+// pipelines. Errors are a line of text with the status of their code, so
+// scripts can branch on curl's exit code and the status instead of
+// parsing JSON.
+func (s *Server) handleQueryRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeTextError(w, errMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRawRequest))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeTextError(w, apierror.New(apierror.InvalidRequest, fmt.Sprintf("Request is longer than %d bytes", maxRawRequest)))
+		return
+	}
+	if err != nil {
+		writeTextError(w, errInvalidBody)
+		return
+	}
+	req := QueryRequest{Query: strings.TrimSpace(string(body))}
+	if apiErr := queryParams(r.URL.Query(), &req); apiErr != nil {
+		writeTextError(w, apiErr)
+		return
+	}
+	timezoneHeader(r, &req)
+	if apiErr := s.validateQueryRequest(req); apiErr != nil {
+		writeTextError(w, apiErr)
+		return
+	}
+	if apiErr := s.screenSecrets(r.Context(), &req); apiErr != nil {
+		writeTextError(w, apiErr)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(req))
+	defer cancel()
+
+	resp, cached, err := s.respond(ctx, req, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error translating query", "err", err)
+		apiErr := translationError(ctx, err, cached)
+		s.reportError(r, err, apiErr)
+		writeTextError(w, apiErr)
+		return
+	}
+
+	if resp.NeedsClarification {
+		writeTextError(w, apierror.New(apierror.NeedsClarification, resp.Clarification))
+		return
+	}
+	text := resp.Answer
+	switch {
+	case resp.Output != "":
+		text = resp.Output
+	case resp.Intent == string(translate.IntentQuestion):
+		text = resp.Reply
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if resp.Fallback {
+		w.Header().Set("X-Fallback", "true")
+	}
+	fmt.Fprintln(w, strings.TrimRight(text, "\n"))
+}
+
+// writeTextError sends e as one line of text, "code: message", with its
+// status. The request ID is in the X-Request-ID header already.
+func writeTextError(w http.ResponseWriter, e *apierror.Error) {
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(e.Code.Status())
+	fmt.Fprintln(w, e.Error())
+}
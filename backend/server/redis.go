@@ -0,0 +1,475 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/redis"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/translate"
+)
+
+// Keys the Redis stores use, besides the job store's and queue's.
+const (
+	redisHistory       = "nlsearch:history"       // hash of entry ID to historyRecord
+	redisHistoryOrder  = "nlsearch:history:order" // entry IDs scored by creation time
+	redisCachePrefix   = "nlsearch:cache:"
+	redisSearchPrefix  = "nlsearch:search:"
+	redisFailurePrefix = "nlsearch:failure:"
+	redisLimitPrefix   = "nlsearch:ratelimit:"
+	redisQuotaPrefix   = "nlsearch:quota:" // followed by the day and client
+)
+
+// redisHistoryBatch is how many entries ListHistory reads at a time.
+const redisHistoryBatch = 200
+
+// RedisStore keeps the history in Redis, where every replica sharing it
+// sees the same entries.
+type RedisStore struct {
+	client *redis.Client
+	limit  int
+}
+
+// historyRecord is a history entry as saved in Redis, including the fields
+// the API doesn't show.
+type historyRecord struct {
+	HistoryEntry
+	Conversation int `json:"conversation,omitempty"`
+}
+
+// NewRedisStore returns a store that retains at most limit entries.
+func NewRedisStore(client *redis.Client, limit int) *RedisStore {
+	return &RedisStore{client: client, limit: limit}
+}
+
+// addHistoryScript adds an entry and drops the oldest ones past the limit,
+// in one step so no replica sees the history half updated.
+const addHistoryScript = `
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+local excess = redis.call('ZCARD', KEYS[2]) - tonumber(ARGV[4])
+if excess > 0 then
+	local old = redis.call('ZRANGE', KEYS[2], 0, excess - 1)
+	redis.call('ZREMRANGEBYRANK', KEYS[2], 0, excess - 1)
+	redis.call('HDEL', KEYS[1], unpack(old))
+end
+return excess`
+
+// pruneHistoryScript removes the entries scored before ARGV[1].
+const pruneHistoryScript = `
+local old = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', '(' .. ARGV[1])
+if #old == 0 then
+	return 0
+end
+redis.call('ZREM', KEYS[2], unpack(old))
+redis.call('HDEL', KEYS[1], unpack(old))
+return #old`
+
+// updateHistoryScript replaces an entry only if it is still there, rather
+// than bringing back one that was just pruned.
+const updateHistoryScript = `
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1`
+
+// deleteHistoryScript removes the entries with the IDs in ARGV.
+const deleteHistoryScript = `
+redis.call('ZREM', KEYS[2], unpack(ARGV))
+return redis.call('HDEL', KEYS[1], unpack(ARGV))`
+
+// historyScore orders entries by creation time. Microseconds fit in a
+// float64 exactly; ties are broken by ID, as in MemoryStore.
+func historyScore(t time.Time) string {
+	return strconv.FormatInt(t.UnixMicro(), 10)
+}
+
+func (s *RedisStore) AddHistory(ctx context.Context, entry HistoryEntry) error {
+	data, err := json.Marshal(historyRecord{HistoryEntry: entry, Conversation: entry.Conversation})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Do(ctx, "EVAL", addHistoryScript, "2", redisHistory, redisHistoryOrder,
+		entry.ID, string(data), historyScore(entry.CreatedAt), strconv.Itoa(s.limit))
+	return err
+}
+
+// ListHistory reads entries most recent first, a batch at a time, until it
+// has found q.Limit that q selects.
+func (s *RedisStore) ListHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, error) {
+	max := "+inf"
+	if !q.After.IsZero() {
+		max = historyScore(q.After.CreatedAt)
+	}
+	search := parseTextQuery(q.Search)
+	var out []HistoryEntry
+	for offset := 0; len(out) < q.Limit; offset += redisHistoryBatch {
+		reply, err := s.client.Do(ctx, "ZREVRANGEBYSCORE", redisHistoryOrder, max, "-inf",
+			"LIMIT", strconv.Itoa(offset), strconv.Itoa(redisHistoryBatch))
+		if err != nil {
+			return nil, err
+		}
+		ids, _ := reply.([]any)
+		if len(ids) == 0 {
+			break
+		}
+		entries, err := s.getEntries(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if len(out) == q.Limit {
+				break
+			}
+			if q.visible(entry) && q.After.Follows(entry.CreatedAt, entry.ID) && matchesSearch(search, entry) {
+				out = append(out, entry)
+			}
+		}
+		if len(ids) < redisHistoryBatch {
+			break
+		}
+	}
+	return out, nil
+}
+
+// getEntries reads the entries with ids, skipping any removed since.
+func (s *RedisStore) getEntries(ctx context.Context, ids []any) ([]HistoryEntry, error) {
+	args := []string{"HMGET", redisHistory}
+	for _, id := range ids {
+		id, _ := id.(string)
+		args = append(args, id)
+	}
+	reply, err := s.client.Do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	entries := make([]HistoryEntry, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var rec historyRecord
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return nil, err
+		}
+		rec.HistoryEntry.Conversation = rec.Conversation
+		entries = append(entries, rec.HistoryEntry)
+	}
+	return entries, nil
+}
+
+// update applies f to owner's entry id and saves it.
+func (s *RedisStore) update(ctx context.Context, owner, id string, f func(*HistoryEntry)) (HistoryEntry, error) {
+	entries, err := s.getEntries(ctx, []any{id})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	if len(entries) == 0 || entries[0].Owner != owner {
+		return HistoryEntry{}, ErrHistoryNotFound
+	}
+	entry := entries[0]
+	f(&entry)
+	data, err := json.Marshal(historyRecord{HistoryEntry: entry, Conversation: entry.Conversation})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	reply, err := s.client.Do(ctx, "EVAL", updateHistoryScript, "1", redisHistory, id, string(data))
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		// The janitor removed it meanwhile.
+		return HistoryEntry{}, ErrHistoryNotFound
+	}
+	return entry, nil
+}
+
+func (s *RedisStore) SetFeedback(ctx context.Context, owner, id string, feedback Feedback) error {
+	_, err := s.update(ctx, owner, id, func(entry *HistoryEntry) { entry.Feedback = &feedback })
+	return err
+}
+
+func (s *RedisStore) SetShared(ctx context.Context, owner, id string, shared bool) (HistoryEntry, error) {
+	return s.update(ctx, owner, id, func(entry *HistoryEntry) { entry.Shared = shared })
+}
+
+// DeleteHistory reads every entry to find owner's, then deletes them a
+// batch at a time.
+func (s *RedisStore) DeleteHistory(ctx context.Context, owner string) (int, int, error) {
+	var ids []string
+	feedback := 0
+	for offset := 0; ; offset += redisHistoryBatch {
+		reply, err := s.client.Do(ctx, "ZRANGE", redisHistoryOrder, strconv.Itoa(offset), strconv.Itoa(offset+redisHistoryBatch-1))
+		if err != nil {
+			return 0, 0, err
+		}
+		batch, _ := reply.([]any)
+		if len(batch) == 0 {
+			break
+		}
+		entries, err := s.getEntries(ctx, batch)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			if entry.Owner != owner {
+				continue
+			}
+			ids = append(ids, entry.ID)
+			if entry.Feedback != nil {
+				feedback++
+			}
+		}
+		if len(batch) < redisHistoryBatch {
+			break
+		}
+	}
+
+	removed := 0
+	for start := 0; start < len(ids); start += redisHistoryBatch {
+		batch := ids[start:min(start+redisHistoryBatch, len(ids))]
+		args := append([]string{"EVAL", deleteHistoryScript, "2", redisHistory, redisHistoryOrder}, batch...)
+		reply, err := s.client.Do(ctx, args...)
+		if err != nil {
+			return removed, feedback, err
+		}
+		n, _ := reply.(int64)
+		removed += int(n)
+	}
+	return removed, feedback, nil
+}
+
+func (s *RedisStore) shared() {}
+
+// Prune removes the entries created before cutoff.
+func (s *RedisStore) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	reply, err := s.client.Do(ctx, "EVAL", pruneHistoryScript, "2", redisHistory, redisHistoryOrder, historyScore(cutoff))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+// redisCache stores values as JSON under a hash of their key, expiring
+// after a TTL. Redis errors are logged and count as misses, like a cache
+// that forgot the value.
+type redisCache[V any] struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func (c redisCache[V]) key(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return c.prefix + hex.EncodeToString(sum[:])
+}
+
+func (c redisCache[V]) get(ctx context.Context, key string) (V, bool) {
+	var value V
+	reply, err := c.client.Do(ctx, "GET", c.key(key))
+	if err != nil {
+		if !errors.Is(err, redis.ErrNil) {
+			slog.Error("Error reading cache", "cache", c.prefix, "err", err)
+		}
+		return value, false
+	}
+	data, _ := reply.(string)
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		slog.Error("Error decoding cached value", "cache", c.prefix, "err", err)
+		return value, false
+	}
+	return value, true
+}
+
+func (c redisCache[V]) set(ctx context.Context, key string, value V) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		_, err = c.client.Do(ctx, "SET", c.key(key), string(data), "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+	}
+	if err != nil {
+		slog.Error("Error writing cache", "cache", c.prefix, "err", err)
+	}
+}
+
+// RedisCache is a Cache of translations in Redis, shared by every replica.
+// Entries expire after a TTL.
+type RedisCache struct {
+	cache redisCache[*translate.Translation]
+}
+
+func NewRedisCache(client *redis.Client, ttl time.Duration) *RedisCache {
+	return &RedisCache{redisCache[*translate.Translation]{client, redisCachePrefix, ttl}}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) (*translate.Translation, bool) {
+	return c.cache.get(ctx, key)
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, translation *translate.Translation) {
+	c.cache.set(ctx, key, translation)
+}
+
+// RedisSearchCache is a SearchCache in Redis, shared by every replica.
+// Entries expire after a TTL.
+type RedisSearchCache struct {
+	cache redisCache[*search.Result]
+}
+
+func NewRedisSearchCache(client *redis.Client, ttl time.Duration) *RedisSearchCache {
+	return &RedisSearchCache{redisCache[*search.Result]{client, redisSearchPrefix, ttl}}
+}
+
+func (c *RedisSearchCache) Get(ctx context.Context, key string) (*search.Result, bool) {
+	return c.cache.get(ctx, key)
+}
+
+func (c *RedisSearchCache) Set(ctx context.Context, key string, result *search.Result) {
+	c.cache.set(ctx, key, result)
+}
+
+// persistentFailures names the errors isPersistentFailure accepts, which
+// are all a RedisFailureCache needs to store.
+var persistentFailures = map[string]error{
+	"not_found":       deepsearch.ErrNotFound,
+	"unauthorized":    deepsearch.ErrUnauthorized,
+	"question_failed": deepsearch.ErrQuestionFailed,
+}
+
+// cachedFailure is a failure read back from Redis: its message, wrapping
+// the sentinel error it was caused by.
+type cachedFailure struct {
+	Message string `json:"message"`
+	Kind    string `json:"kind"`
+}
+
+func (f cachedFailure) Error() string { return f.Message }
+
+func (f cachedFailure) Unwrap() error { return persistentFailures[f.Kind] }
+
+// RedisFailureCache is a FailureCache in Redis, shared by every replica.
+// Entries expire after a TTL.
+type RedisFailureCache struct {
+	cache redisCache[cachedFailure]
+}
+
+func NewRedisFailureCache(client *redis.Client, ttl time.Duration) *RedisFailureCache {
+	return &RedisFailureCache{redisCache[cachedFailure]{client, redisFailurePrefix, ttl}}
+}
+
+func (c *RedisFailureCache) GetFailure(ctx context.Context, key string) (error, bool) {
+	f, ok := c.cache.get(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	return f, true
+}
+
+func (c *RedisFailureCache) SetFailure(ctx context.Context, key string, err error) {
+	for kind, sentinel := range persistentFailures {
+		if errors.Is(err, sentinel) {
+			c.cache.set(ctx, key, cachedFailure{Message: err.Error(), Kind: kind})
+			return
+		}
+	}
+}
+
+// RedisLimiter is a middleware.Limiter keeping token buckets in Redis, so
+// a client's requests are limited the same whichever replica they reach.
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+// NewRedisLimiter returns a limiter keeping its buckets in client.
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{client: client}
+}
+
+// rateLimitScript refills the bucket in KEYS[1] at ARGV[1] tokens a second
+// up to ARGV[2] since it was last used, takes a token if it has one, and
+// returns whether it did and the tokens left. Tokens are returned as a
+// string since Redis truncates numbers to integers. Idle buckets expire
+// after ARGV[4] milliseconds, once they would have refilled anyway.
+const rateLimitScript = `
+local rps, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens, last = tonumber(bucket[1]) or burst, tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) / 1000 * rps)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}`
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, rps float64, burst int, now time.Time) (int, time.Duration, bool, error) {
+	refill := time.Duration(float64(burst) / rps * float64(time.Second))
+	reply, err := l.client.Do(ctx, "EVAL", rateLimitScript, "1", redisLimitPrefix+key,
+		strconv.FormatFloat(rps, 'g', -1, 64), strconv.Itoa(burst),
+		strconv.FormatInt(now.UnixMilli(), 10), strconv.FormatInt(refill.Milliseconds()+1000, 10))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	fields, _ := reply.([]any)
+	if len(fields) != 2 {
+		return 0, 0, false, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := fields[0].(int64)
+	text, _ := fields[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	var wait time.Duration
+	if tokens < 1 {
+		wait = time.Duration((1 - tokens) / rps * float64(time.Second))
+	}
+	return int(tokens), wait, allowed == 1, nil
+}
+
+// RedisQuota is a middleware.Quota counting requests in Redis, so a
+// tenant's quota covers every replica.
+type RedisQuota struct {
+	client *redis.Client
+}
+
+// NewRedisQuota returns a quota keeping its counts in client.
+func NewRedisQuota(client *redis.Client) *RedisQuota {
+	return &RedisQuota{client: client}
+}
+
+// quotaScript counts a request in KEYS[1], which expires after ARGV[1]
+// seconds, once its day is over everywhere.
+const quotaScript = `
+local used = redis.call('INCR', KEYS[1])
+if used == 1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return used`
+
+func (q *RedisQuota) Use(ctx context.Context, key string, now time.Time) (int, error) {
+	day := now.UTC().Format(time.DateOnly)
+	reply, err := q.client.Do(ctx, "EVAL", quotaScript, "1", redisQuotaPrefix+day+":"+key,
+		strconv.Itoa(int((48 * time.Hour).Seconds())))
+	if err != nil {
+		return 0, err
+	}
+	used, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected quota reply %v", reply)
+	}
+	return int(used), nil
+}
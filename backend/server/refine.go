@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/translate"
+)
+
+// handleRefine revises an earlier translation with a follow-up such as
+// "exclude tests", given as the query of a QueryRequest. The revision is
+// recorded as a new history entry, whose ID is returned.
+func (s *Server) handleRefine(w http.ResponseWriter, r *http.Request) {
+	s.serveRevision(w, r, false)
+}
+
+// handleClarify revises an earlier translation that was answered with a
+// clarifying question, given the user's answer as the query of a
+// QueryRequest. The answer is sent as a follow-up, in the same
+// conversation when it is still kept, so the translation completes with
+// the original request and the answer together.
+func (s *Server) handleClarify(w http.ResponseWriter, r *http.Request) {
+	s.serveRevision(w, r, true)
+}
+
+// clarificationFollowUp is the follow-up an answer to a clarifying
+// question is sent as. The question is left out: filters and quoted
+// strings in it would be restored into the query as if the user had asked
+// for them.
+const clarificationFollowUp = "To clarify the request: %s"
+
+// serveRevision revises the translation named in the path with the
+// follow-up in the body, or with the answer to its clarifying question if
+// clarifying is set.
+func (s *Server) serveRevision(w http.ResponseWriter, r *http.Request, clarifying bool) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	req, apiErr := s.decodeQueryRequest(r)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	from, err := s.findHistory(r.Context(), r.PathValue("id"))
+	switch {
+	case errors.Is(err, ErrHistoryNotFound):
+		writeError(w, r, apierror.New(apierror.NotFound, "No translation visible to you with that id"))
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Error reading history", "err", err)
+		s.reportError(r, err, errHistoryFailed)
+		writeError(w, r, errHistoryFailed)
+		return
+	case from.Error != "":
+		writeError(w, r, apierror.New(apierror.InvalidRequest, "That translation failed, so there is no query to refine"))
+		return
+	case clarifying && from.Clarification == "":
+		writeError(w, r, apierror.New(apierror.InvalidRequest, "That translation didn't ask for clarification"))
+		return
+	}
+	if clarifying {
+		req.Query = fmt.Sprintf(clarificationFollowUp, req.Query)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout(req))
+	defer cancel()
+
+	id, translation, cached, err := s.refine(ctx, from, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error refining query", "err", err)
+		apiErr := translationError(ctx, err, cached)
+		s.reportError(r, err, apiErr)
+		writeError(w, r, apiErr)
+		return
+	}
+
+	req.Query = refinedRequest(from, req.Query)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.newQueryResponse(ctx, req, id, translation, cached))
+}
+
+// refinedRequest is what a clarifying question about the revision of from
+// with followUp is asked about: the request as refined, not just the
+// follow-up.
+func refinedRequest(from HistoryEntry, followUp string) string {
+	return strings.TrimSpace(from.Request + " " + followUp)
+}
+
+// refine revises the translation recorded in from. The caller's own
+// translations are followed up in their Deep Search conversation, if it
+// still exists; otherwise the original request is translated afresh with
+// the follow-ups appended, which keeps the user's intent but not what the
+// model learned looking at the code. Revisions with no_store aren't
+// recorded, as for translate.
+func (s *Server) refine(ctx context.Context, from HistoryEntry, req QueryRequest) (string, *translate.Translation, bool, error) {
+	ctx = s.inTimezone(s.observe(ctx), req)
+	ctx, req = s.private(ctx, req)
+
+	var translation *translate.Translation
+	var cached bool
+	err := translate.ErrCannotFollowUp
+	if refiner, ok := s.opts.Translator.(Refiner); ok && from.Conversation != 0 && from.Owner == owner(ctx) {
+		translation, err = refiner.Refine(ctx, from.Conversation, req.Query, nil)
+		s.health.record(err)
+		if errors.Is(err, deepsearch.ErrNotFound) {
+			slog.InfoContext(ctx, "Conversation to refine is gone; starting a new one", "conversation", from.Conversation)
+		}
+	}
+	if errors.Is(err, translate.ErrCannotFollowUp) || errors.Is(err, deepsearch.ErrNotFound) {
+		translation, cached, err = s.cachedTranslate(ctx, QueryRequest{Query: s.refinementRequest(ctx, from, req.Query), NoStore: req.NoStore}, nil)
+	}
+	translation, err = s.enforcePolicy(ctx, limitResults(translation, req.MaxResults), err)
+
+	s.recordAnalytics(ctx, req.Query, translation, cached, err)
+	if req.NoStore {
+		return "", translation, cached, err
+	}
+	entry := HistoryEntry{Request: req.Query, Shared: req.Share, RefinedFrom: from.ID}
+	if err == nil {
+		if c := s.clarify(refinedRequest(from, req.Query), translation); c != nil {
+			entry.Clarification = c.Question
+		}
+	}
+	id := s.recordHistory(ctx, entry, translation, err)
+	return id, translation, cached, err
+}
+
+// maxRefinements bounds how far back refinementRequest follows a chain of
+// refinements.
+const maxRefinements = 10
+
+// refinementRequest restates the request behind from and a follow-up to
+// it as a single request. When from is itself a refinement, the original
+// request and the follow-ups since are included. The generated query is
+// left out: its filters would be restored as if the user had asked for
+// them, even ones the follow-up drops.
+func (s *Server) refinementRequest(ctx context.Context, from HistoryEntry, followUp string) string {
+	followUps := []string{followUp}
+	for from.RefinedFrom != "" && len(followUps) < maxRefinements {
+		prev, err := s.findHistory(ctx, from.RefinedFrom)
+		if err != nil {
+			break
+		}
+		followUps = append(followUps, from.Request)
+		from = prev
+	}
+	slices.Reverse(followUps)
+	return fmt.Sprintf("%s\n\nThen revise the query as follows: %s", from.Request, strings.Join(followUps, "; "))
+}
+
+// findHistory returns the history entry id if the caller can see it.
+func (s *Server) findHistory(ctx context.Context, id string) (HistoryEntry, error) {
+	entries, err := s.opts.Store.ListHistory(ctx, HistoryQuery{Limit: math.MaxInt, Viewer: owner(ctx)})
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.ID == id {
+			return entry, nil
+		}
+	}
+	return HistoryEntry{}, ErrHistoryNotFound
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Pruner is implemented by stores that can discard old records. Prune
+// removes the records written before cutoff, and any that have expired, and
+// returns how many it removed.
+type Pruner interface {
+	Prune(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// conversationPruner is implemented by conversation trackers that can
+// forget old conversations.
+type conversationPruner interface {
+	Prune(cutoff time.Time) int
+}
+
+// Leader reports whether this replica is the one that should do the work
+// that must only be done once across replicas, such as a leader.Elector.
+type Leader interface {
+	Leading() bool
+}
+
+// sharedStore is implemented by stores every replica shares, which only
+// the Leader prunes.
+type sharedStore interface {
+	shared()
+}
+
+// RunJanitor prunes old records every interval until ctx is done: history
+// entries and tracked conversations older than Options.Retention, and
+// expired cache entries. Stores that can't be pruned are skipped, as are
+// shared stores while another replica is the Options.Leader.
+func (s *Server) RunJanitor(ctx context.Context, interval time.Duration) {
+	pruned := s.opts.Metrics.Counter("nlsearch_retention_pruned_total", "Records removed by the retention janitor, by store.", "store")
+	lastRun := s.opts.Metrics.Gauge("nlsearch_retention_last_run_timestamp_seconds", "When the retention janitor last finished, in seconds since the epoch.")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for store, n := range s.prune(ctx) {
+			pruned.Add(float64(n), store)
+		}
+		lastRun.Set(float64(time.Now().Unix()))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune runs one pass of the janitor and returns how many records it
+// removed from each store.
+func (s *Server) prune(ctx context.Context) map[string]int {
+	now := time.Now()
+	// Without a retention period only expired cache entries are removed.
+	cutoff := time.Time{}
+	if s.opts.Retention > 0 {
+		cutoff = now.Add(-s.opts.Retention)
+	}
+
+	pruners := map[string]Pruner{}
+	if s.opts.Retention > 0 {
+		if p, ok := s.opts.Store.(Pruner); ok {
+			pruners["history"] = p
+		}
+	}
+	if p, ok := s.opts.Cache.(Pruner); ok {
+		pruners["translation_cache"] = p
+	}
+	if p, ok := s.opts.FailureCache.(Pruner); ok {
+		pruners["failure_cache"] = p
+	}
+	if p, ok := s.opts.SearchCache.(Pruner); ok {
+		pruners["search_cache"] = p
+	}
+	if p, ok := s.opts.Jobs.(Pruner); ok {
+		pruners["jobs"] = p
+	}
+
+	if s.opts.Leader != nil && !s.opts.Leader.Leading() {
+		for store, p := range pruners {
+			if _, ok := p.(sharedStore); ok {
+				delete(pruners, store)
+			}
+		}
+	}
+
+	removed := map[string]int{}
+	for store, p := range pruners {
+		n, err := p.Prune(ctx, cutoff)
+		if err != nil {
+			slog.Error("Error pruning records", "store", store, "err", err)
+		}
+		removed[store] = n
+	}
+	if p, ok := s.opts.Conversations.(conversationPruner); ok && s.opts.Retention > 0 {
+		removed["conversations"] = p.Prune(cutoff)
+	}
+
+	var total int
+	for _, n := range removed {
+		total += n
+	}
+	if total > 0 {
+		slog.Info("Retention janitor removed records", "records", total, "duration_ms", time.Since(now).Milliseconds())
+	}
+	return removed
+}
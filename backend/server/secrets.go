@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nlsearch/backend/apierror"
+	"github.com/nlsearch/backend/redact"
+)
+
+// What is done with requests that contain credentials, such as a token in
+// a pasted error log, as Options.RequestSecrets says.
+const (
+	// SecretsRedact masks the credentials before the request goes any
+	// further.
+	SecretsRedact = "redact"
+	// SecretsReject refuses the request, so the user can take them out.
+	SecretsReject = "reject"
+	// SecretsAllow leaves the request as it is.
+	SecretsAllow = "allow"
+)
+
+// screenSecrets looks for credentials in the text of req before it is sent
+// to a language model, queued or recorded, as ScreenSecrets does with
+// RequestSecrets.
+func (s *Server) screenSecrets(ctx context.Context, req *QueryRequest) *apierror.Error {
+	masked, apiErr := ScreenSecrets(ctx, s.opts.RequestSecrets, req.Query)
+	if apiErr != nil {
+		return apiErr
+	}
+	req.Query = masked
+	return nil
+}
+
+// ScreenSecrets looks for credentials in text, as redact.Credentials finds
+// them, and returns it with them masked, or an error naming what was found
+// if mode is SecretsReject. Everything that translates requests, the CLI
+// commands included, screens them with it first.
+func ScreenSecrets(ctx context.Context, mode, text string) (string, *apierror.Error) {
+	if mode == "" || mode == SecretsAllow {
+		return text, nil
+	}
+	masked, kinds := redact.Credentials(text)
+	if len(kinds) == 0 {
+		return text, nil
+	}
+	if mode == SecretsReject {
+		slog.WarnContext(ctx, "Rejecting request with credentials in it", "credentials", strings.Join(kinds, ", "))
+		message := fmt.Sprintf("The request looks like it contains a credential (%s); remove it and try again", strings.Join(kinds, ", "))
+		return text, apierror.New(apierror.InvalidRequest, message).WithDetails(map[string]any{"field": "query", "credentials": kinds})
+	}
+	slog.WarnContext(ctx, "Masked credentials in the request", "credentials", strings.Join(kinds, ", "))
+	return masked, nil
+}
@@ -0,0 +1,444 @@
+// Package server implements the nlsearch HTTP API. Handlers are built from
+// small interfaces so they can be tested with fakes and mounted into any
+// http.ServeMux.
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/nlsearch/backend/errreport"
+	"github.com/nlsearch/backend/metrics"
+	"github.com/nlsearch/backend/middleware"
+	"github.com/nlsearch/backend/policy"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/translate"
+)
+
+// Translator converts a natural language request into a search query.
+// progress, if non-nil, is called as the translation advances.
+type Translator interface {
+	Translate(ctx context.Context, request string, progress func(translate.Progress)) (*translate.Translation, error)
+}
+
+// Refiner is a Translator that can revise a translation by following up in
+// the Deep Search conversation it came from, such as translate.Translator.
+type Refiner interface {
+	Refine(ctx context.Context, conversation int, followUp string, progress func(translate.Progress)) (*translate.Translation, error)
+}
+
+// Searcher executes a search query.
+type Searcher interface {
+	Search(ctx context.Context, query string, opts search.Options, onProgress func(search.Progress)) (*search.Result, error)
+}
+
+// Store persists the history of translations.
+type Store interface {
+	AddHistory(ctx context.Context, entry HistoryEntry) error
+	// ListHistory returns the entries selected by q, most recent first.
+	ListHistory(ctx context.Context, q HistoryQuery) ([]HistoryEntry, error)
+	// SetFeedback records feedback on owner's entry id, replacing any
+	// earlier feedback. It returns ErrHistoryNotFound if owner has no such
+	// entry.
+	SetFeedback(ctx context.Context, owner, id string, feedback Feedback) error
+	// SetShared shares owner's entry id with every user, or stops sharing
+	// it, and returns the updated entry. It returns ErrHistoryNotFound if
+	// owner has no such entry.
+	SetShared(ctx context.Context, owner, id string, shared bool) (HistoryEntry, error)
+}
+
+// HistoryQuery selects history entries.
+type HistoryQuery struct {
+	// Limit is the most entries to return.
+	Limit int
+	// After skips the entries up to a cursor; the zero Cursor starts at
+	// the most recent entry.
+	After Cursor
+	// Viewer keeps only the entries owned by that user or shared; Mine
+	// leaves out the shared ones of other users. The admin export leaves
+	// Viewer empty with All set to see every entry.
+	Viewer string
+	Mine   bool
+	All    bool
+	// Search keeps only the entries whose request or query contains every
+	// word, or a word starting with it, ignoring case and common suffixes.
+	Search string
+}
+
+// ErrHistoryNotFound is returned by Store methods for unknown entry IDs.
+var ErrHistoryNotFound = errors.New("history entry not found")
+
+// Analytics records anonymized usage, such as an analytics.Recorder.
+// user is the caller's name, and request and generated the text of the
+// translation, which it mustn't keep.
+type Analytics interface {
+	Translation(user, outcome, request, generated string)
+	Feedback(user, label string)
+}
+
+// ErrorReporter sends errors to an error tracking service, such as an
+// errreport.Client.
+type ErrorReporter interface {
+	Capture(event errreport.Event)
+}
+
+// SearchCache holds recent search results keyed by normalized query and
+// result limit.
+type SearchCache interface {
+	Get(ctx context.Context, key string) (*search.Result, bool)
+	Set(ctx context.Context, key string, result *search.Result)
+}
+
+// Cache holds recent translations keyed by normalized request text.
+type Cache interface {
+	Get(ctx context.Context, key string) (*translate.Translation, bool)
+	Set(ctx context.Context, key string, translation *translate.Translation)
+}
+
+// FailureCache briefly remembers translations that failed in ways that
+// would fail again, so repeated requests don't hammer Sourcegraph.
+type FailureCache interface {
+	GetFailure(ctx context.Context, key string) (error, bool)
+	SetFailure(ctx context.Context, key string, err error)
+}
+
+type Options struct {
+	Translator Translator
+	// OfflineTranslator answers when Translator fails, typically without a
+	// language model. Its translations are never cached. Requests fail
+	// outright when it is nil.
+	OfflineTranslator Translator
+	// ClarifyBelow is the confidence below which translations are answered
+	// with a question for the user instead of their query. Every query is
+	// returned when it is zero.
+	ClarifyBelow float64
+	// Questions answers requests asking about the code rather than for it,
+	// such as a translate.DeepSearch, which is given them as they are.
+	// Every request is translated when it is nil.
+	Questions translate.Backend
+	// SourcegraphURL is the instance's address, which the links of
+	// sources are made absolute against.
+	SourcegraphURL string
+	// Revisions resolves the revisions of sources to commits, for links
+	// that don't move as branches do. Sources are linked to their branches
+	// when it is nil.
+	Revisions RevisionResolver
+	// Snippets reads the lines sources cite, for requests asking for
+	// snippets. Requests get none when it is nil.
+	Snippets SnippetFetcher
+	// Searcher executes queries for /api/v1/search. The route is not
+	// registered when it is nil.
+	Searcher Searcher
+	// Store records translation history. Defaults to an in-memory store.
+	Store Store
+	// Jobs keeps the state of background translations. Defaults to an
+	// in-memory store.
+	Jobs JobStore
+	// JobQueue hands jobs to workers, which may run in other processes,
+	// instead of running them in the process that accepted them. Jobs then
+	// need a JobStore every process shares. JobVisibility is how long a
+	// worker may go silent before its job is given to another worker.
+	JobQueue      JobQueue
+	JobVisibility time.Duration
+	// Retention is how long RunJanitor keeps history entries and tracked
+	// conversations. They are only evicted to bound memory when it is zero.
+	Retention time.Duration
+	// Leader, when set, leaves pruning the stores replicas share to the
+	// replica that is leading.
+	Leader Leader
+	// Cache caches translations. Caching is disabled when it is nil.
+	Cache Cache
+	// FailureCache caches deterministic translation failures. Negative
+	// caching is disabled when it is nil.
+	FailureCache FailureCache
+	// SearchCache caches /api/v1/search results. Caching is disabled when it
+	// is nil.
+	SearchCache SearchCache
+	// Examples is the few-shot example index, which admins can inspect and
+	// rebuild. Its routes are not registered when it is nil.
+	Examples ExampleStore
+	// Conversations lists the Deep Search conversations the server created,
+	// and DeepSearch fetches their current state for admins. The routes are
+	// not registered when Conversations is nil.
+	Conversations ConversationTracker
+	DeepSearch    ConversationFetcher
+
+	// StreamKeepAlive is how long a streamed response may go without
+	// writing before a keepalive comment is sent. Keepalives are disabled
+	// when it is zero.
+	StreamKeepAlive time.Duration
+
+	// DefaultTimeout applies to requests that don't set timeout_seconds;
+	// MaxTimeout caps the ones that do.
+	DefaultTimeout time.Duration
+	MaxTimeout     time.Duration
+	// MaxResults is the largest max_results a request may ask for.
+	MaxResults int
+
+	ExtensionOrigins []string
+	ExtensionSecret  string
+
+	// APIKeys maps accepted API keys to the names they are known by. When
+	// any are set, API routes require a key or an extension token.
+	APIKeys map[string]string
+	// RateLimitRPS limits each client's API requests per second, with bursts
+	// of up to RateLimitBurst. Rate limiting is disabled when it is zero.
+	// TenantLimits replaces them when set.
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// SecurityHeaders are set on every response, the frontend's included.
+	SecurityHeaders middleware.SecurityHeaders
+	// IPFilter refuses requests from addresses it doesn't allow, except to
+	// /health and /readyz. Every address is allowed when it is empty.
+	IPFilter middleware.IPFilter
+	// TenantLimits sets rate limits, daily quotas and concurrency caps per
+	// tenant, with a default for everyone else.
+	TenantLimits middleware.TenantLimits
+	// RateLimiter and Quota keep the rate limit and quota counters in place
+	// of in-memory ones, such as a RedisLimiter and RedisQuota shared by
+	// every replica.
+	RateLimiter middleware.Limiter
+	Quota       middleware.Quota
+	// NoStoreTenants names the tenants whose requests are all handled as
+	// if they set no_store, or is ["*"] for every caller's.
+	NoStoreTenants []string
+	// OwnCacheTenants names the tenants whose translations differ from
+	// everyone else's, such as those QUERY_REWRITE_RULES has rules for.
+	// Their translations are cached apart.
+	OwnCacheTenants []string
+	// RequestSecrets is SecretsRedact, SecretsReject or SecretsAllow, what
+	// is done with requests with credentials in them; empty allows them.
+	RequestSecrets string
+	// QueryPolicies limits the filters each tenant's queries may use.
+	// Translations and searches that break the caller's policy are
+	// rewritten to follow it, or fail with a policy.Violation.
+	QueryPolicies policy.Policies
+	// Timezone is where dates relative to today, such as "yesterday", are
+	// resolved for requests that give no timezone; nil is the server's.
+	Timezone *time.Location
+	// AdminKeys maps the API keys with the admin role, which /api/v1/admin
+	// routes require, to the names they are known by. They are accepted on
+	// every other route too. Admin routes are not registered without any.
+	AdminKeys map[string]string
+	// ProxyAuth accepts the users named by trusted SSO proxies; it is
+	// disabled when ProxyAuth.Trusted is empty. ProxyAuth.Admins have the
+	// admin role.
+	ProxyAuth middleware.ProxyAuth
+
+	// Health sets when failing translations make /health and /readyz
+	// report the server degraded or unhealthy.
+	Health HealthOptions
+
+	// LogSampler picks the successful requests that are logged; every
+	// request is logged when it is nil.
+	LogSampler *middleware.LogSampler
+
+	// ErrorReporter receives server-side failures and panics, with the
+	// request they happened in. Errors are only logged when it is nil.
+	ErrorReporter ErrorReporter
+
+	// Analytics receives every translation and feedback, to record usage
+	// without identifying users. Nothing is recorded when it is nil.
+	Analytics Analytics
+
+	// LogLevel is the level of the default logger, which admins can read
+	// and change. The route is not registered when it is nil.
+	LogLevel *slog.LevelVar
+
+	// Metrics receives request metrics and is served at /metrics by
+	// Handler. Defaults to metrics.Default.
+	Metrics *metrics.Registry
+
+	// FrontendDir is served at / by Handler when set.
+	FrontendDir string
+}
+
+type Server struct {
+	opts            Options
+	extensionTokens *extensionTokenIssuer
+	stageDuration   *metrics.HistogramVec
+	// extractionMisses, validations and heuristics count the quality
+	// events of translations.
+	extractionMisses *metrics.CounterVec
+	validations      *metrics.CounterVec
+	heuristics       *metrics.CounterVec
+	health           *upstreamHealth
+	tenants          *middleware.Tenants
+	draining         atomic.Bool
+	runningJobs      atomic.Int64
+}
+
+// stageBuckets are histogram buckets in seconds for pipeline stages, which
+// range from microseconds of validation to minutes of Deep Search polling.
+var stageBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+const (
+	defaultTimeout    = 60 * time.Second
+	defaultMaxTimeout = 300 * time.Second
+	defaultMaxResults = 1000
+	defaultVisibility = time.Minute
+)
+
+func New(opts Options) *Server {
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore(defaultHistoryLimit)
+	}
+	if opts.Jobs == nil {
+		opts.Jobs = NewMemoryJobStore(defaultJobLimit)
+	}
+	if opts.JobVisibility == 0 {
+		opts.JobVisibility = defaultVisibility
+	}
+	if opts.DefaultTimeout == 0 {
+		opts.DefaultTimeout = defaultTimeout
+	}
+	if opts.MaxTimeout == 0 {
+		opts.MaxTimeout = defaultMaxTimeout
+	}
+	if opts.MaxResults == 0 {
+		opts.MaxResults = defaultMaxResults
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.Default
+	}
+	if opts.TenantLimits.IsZero() {
+		opts.TenantLimits.Default = middleware.TenantLimit{RPS: opts.RateLimitRPS, Burst: opts.RateLimitBurst}
+	}
+	s := &Server{
+		opts:             opts,
+		extensionTokens:  newExtensionTokenIssuer(opts.ExtensionSecret),
+		health:           newUpstreamHealth(opts.Health),
+		stageDuration:    opts.Metrics.Histogram("nlsearch_stage_duration_seconds", "Latency of each stage of the translation and search pipeline.", stageBuckets, "stage"),
+		extractionMisses: opts.Metrics.Counter("nlsearch_extraction_misses_total", "Answers an extraction strategy found no query in, by strategy; \"none\" when no strategy did.", "strategy"),
+		validations:      opts.Metrics.Counter("nlsearch_validations_total", "Extracted queries by validation result: valid, warning or rejected.", "result"),
+		heuristics:       opts.Metrics.Counter("nlsearch_fallback_heuristics_total", "Times a fallback heuristic rescued a translation, by heuristic.", "heuristic"),
+	}
+	if !opts.TenantLimits.IsZero() {
+		s.tenants = middleware.NewTenants(opts.TenantLimits, opts.RateLimiter, opts.Quota)
+	}
+	return s
+}
+
+// Register mounts the API routes on mux under /api/v1, each requiring the
+// user or admin role, with deprecated aliases under /api; Handler adds the
+// middleware that applies to every route.
+func (s *Server) Register(mux *http.ServeMux) {
+	s.handle(mux, "/query", middleware.RoleUser, s.handleQuery)
+	s.handle(mux, "/query/stream", middleware.RoleUser, s.handleQueryStream)
+	s.handle(mux, "/query/raw", middleware.RoleUser, s.handleQueryRaw)
+	s.handle(mux, "/query/{id}/refine", middleware.RoleUser, s.handleRefine)
+	s.handle(mux, "/query/{id}/clarify", middleware.RoleUser, s.handleClarify)
+	s.handle(mux, "/jobs", middleware.RoleUser, s.handleJobs)
+	s.handle(mux, "/jobs/{id}", middleware.RoleUser, s.handleJob)
+	s.handle(mux, "/history", middleware.RoleUser, s.handleHistory)
+	s.handle(mux, "/history/{id}/share", middleware.RoleUser, s.handleShareHistory)
+	s.handle(mux, "/feedback", middleware.RoleUser, s.handleFeedback)
+	if s.opts.Questions != nil {
+		s.handle(mux, "/ask", middleware.RoleUser, s.handleAsk)
+	}
+	if s.opts.Searcher != nil {
+		s.handle(mux, "/search", middleware.RoleUser, s.handleSearch)
+	}
+	if s.extensionTokens != nil {
+		// Extensions call this to obtain a token, so it cannot require one.
+		mountVersioned(mux, "/extension/token", middleware.Chain(http.HandlerFunc(s.handleExtensionToken), s.cors()))
+	}
+	s.registerAdmin(mux)
+
+	// The API description is public, like the API's shape in the README.
+	mux.Handle("/api/openapi.json", middleware.Chain(http.HandlerFunc(s.handleOpenAPI), s.cors()))
+	mux.HandleFunc("/api/docs", s.handleDocs)
+	mux.HandleFunc("/api/docs.js", s.handleDocsScript)
+	// Pages showing highlighted code need the stylesheet for it.
+	mux.Handle("/api/highlight.css", middleware.Chain(http.HandlerFunc(s.handleHighlightCSS), s.cors()))
+}
+
+// Handler returns a complete handler: the API routes, /health, /readyz,
+// /metrics, and the frontend if FrontendDir is set, wrapped in request IDs,
+// recovery, logging and metrics.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.Register(mux)
+
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.Handle("/metrics", s.opts.Metrics.Handler())
+
+	if s.opts.FrontendDir != "" {
+		mux.Handle("/", http.FileServer(http.Dir(s.opts.FrontendDir)))
+	}
+
+	// Metrics must wrap the mux directly, and Logging must not replace the
+	// request: they read the matched route from the request the mux was
+	// given. Refused addresses are logged but reach nothing else.
+	mws := []middleware.Middleware{
+		middleware.RequestID(),
+		middleware.Secure(s.opts.SecurityHeaders),
+		middleware.Recover(s.opts.Metrics, s.reportPanic),
+		middleware.Logging(s.opts.LogSampler),
+	}
+	if s.opts.IPFilter.Enabled() {
+		filter := s.opts.IPFilter
+		// Probes come from the cluster, not the clients the lists are for.
+		filter.Exempt = append(slices.Clip(filter.Exempt), "/health", "/readyz")
+		mws = append(mws, middleware.FilterIPs(filter))
+	}
+	if len(s.opts.ProxyAuth.Trusted) > 0 {
+		// Users signed in by the proxy need a CSRF token, which the
+		// frontend reads from the cookie set when it is loaded.
+		mws = append(mws, middleware.IssueCSRFToken())
+	}
+	mws = append(mws, middleware.Metrics(s.opts.Metrics))
+	return middleware.Chain(mux, mws...)
+}
+
+// handle mounts h at path, relative to the API prefix, for callers with
+// role. User routes get CORS, authentication, CSRF protection and rate
+// limiting, and are open to anonymous callers when no API keys are
+// configured. Admin routes, which browsers don't call, only get
+// authentication and CSRF protection.
+func (s *Server) handle(mux *http.ServeMux, path, role string, h http.HandlerFunc) {
+	var mws []middleware.Middleware
+	if role == middleware.RoleUser {
+		required := len(s.opts.APIKeys) > 0
+		mws = append(mws, s.cors(), middleware.Auth(required, s.authenticators()...), middleware.RequireCSRFToken())
+		if required {
+			mws = append(mws, middleware.RequireRole(role))
+		}
+		if s.tenants != nil {
+			mws = append(mws, s.tenants.Limit(path+":"))
+		}
+	} else {
+		mws = append(mws, middleware.Auth(true, s.authenticators()...), middleware.RequireCSRFToken(), middleware.RequireRole(role))
+	}
+	mountVersioned(mux, path, middleware.Chain(h, mws...))
+}
+
+// authenticators identifies callers by trusted proxy header, extension token
+// or API key. Keys in APIKeys have the user role; those in AdminKeys have the
+// admin role too.
+func (s *Server) authenticators() []middleware.Authenticator {
+	keys := map[string]middleware.APIKey{}
+	for key, name := range s.opts.APIKeys {
+		keys[key] = middleware.APIKey{Name: name, Roles: []string{middleware.RoleUser}}
+	}
+	for key, name := range s.opts.AdminKeys {
+		keys[key] = middleware.APIKey{Name: name, Roles: []string{middleware.RoleUser, middleware.RoleAdmin}}
+	}
+	authenticators := []middleware.Authenticator{s.authenticateExtension, middleware.APIKeys(keys)}
+	if len(s.opts.ProxyAuth.Trusted) > 0 {
+		authenticators = append([]middleware.Authenticator{middleware.ProxyHeaders(s.opts.ProxyAuth)}, authenticators...)
+	}
+	return authenticators
+}
+
+func (s *Server) cors() middleware.Middleware {
+	return middleware.CORS(func(origin string) bool {
+		return isExtensionOrigin(s.opts.ExtensionOrigins, origin)
+	})
+}
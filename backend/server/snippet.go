@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/nlsearch/backend/highlight"
+	"github.com/nlsearch/backend/translate"
+)
+
+const (
+	// maxSnippets caps the sources of one response given snippets.
+	maxSnippets = 10
+	// snippetConcurrency caps the files read at once for one response.
+	snippetConcurrency = 4
+	// maxSnippetLines caps the lines of each snippet; longer ranges are cut
+	// short, and files cited without a range get their first lines.
+	maxSnippetLines = 40
+)
+
+// SnippetFetcher reads lines start to end, counting from 1, of a file in a
+// repository at a revision. *sourcegraph.Client implements it.
+type SnippetFetcher interface {
+	FileLines(ctx context.Context, repo, rev, path string, start, end int) (string, error)
+}
+
+// addSnippets sets the snippets of the sources that are files, in place,
+// reading each at the revision of the same index, and with withHTML their
+// HTML. Sources whose file can't be read are left without one.
+func (s *Server) addSnippets(ctx context.Context, sources []translate.Source, revisions []string, withHTML bool) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, snippetConcurrency)
+	fetched := 0
+	for i := range sources {
+		src := &sources[i]
+		if src.Repository == "" || src.Path == "" || fetched == maxSnippets {
+			continue
+		}
+		fetched++
+		start, end := max(src.StartLine, 1), src.EndLine
+		if end < start || end-start >= maxSnippetLines {
+			end = start + maxSnippetLines - 1
+		}
+		wg.Add(1)
+		go func(rev string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			snippet, err := s.opts.Snippets.FileLines(ctx, src.Repository, rev, src.Path, start, end)
+			if err != nil {
+				slog.WarnContext(ctx, "Could not read source snippet", "repo", src.Repository, "path", src.Path, "err", err)
+				return
+			}
+			src.Snippet = snippet
+			src.Language = highlight.Language(src.Path)
+			if !withHTML {
+				return
+			}
+			if src.SnippetHTML, err = highlight.Block(snippet, src.Language, start); err != nil {
+				slog.WarnContext(ctx, "Could not highlight source snippet", "path", src.Path, "err", err)
+			}
+		}(revisions[i])
+	}
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushWriter writes to an HTTP response, flushing after each write so the
+// client sees it at once, and can fill idle time with keepalive bytes. It
+// is safe for concurrent use.
+type flushWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	written   bool
+}
+
+func newFlushWriter(w http.ResponseWriter) (*flushWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+	return &flushWriter{w: w, flusher: flusher, lastWrite: time.Now()}, true
+}
+
+func (f *flushWriter) write(text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = true
+	if _, err := fmt.Fprint(f.w, text); err != nil {
+		return err
+	}
+	f.flusher.Flush()
+	f.lastWrite = time.Now()
+	return nil
+}
+
+// wrote reports whether anything has been written, after which the status
+// and headers can no longer change.
+func (f *flushWriter) wrote() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
+
+// keepAlive writes filler whenever nothing has been written for interval,
+// so proxies and load balancers that close idle connections don't cut the
+// response off while Deep Search is still working. It stops when a write
+// fails or stop is called, which waits for it so nothing is written once
+// the handler returns.
+func (f *flushWriter) keepAlive(interval time.Duration, filler string) (stop func()) {
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				f.mu.Lock()
+				idle := now.Sub(f.lastWrite)
+				f.mu.Unlock()
+				if idle < interval {
+					continue
+				}
+				if err := f.write(filler); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-exited
+	}
+}
+
+// eventStream writes server-sent events to an HTTP response, flushing after
+// each event so clients see progress as it happens. It is safe for
+// concurrent use.
+type eventStream struct {
+	*flushWriter
+}
+
+// keepAliveComment is sent on idle event streams. Clients ignore comments.
+const keepAliveComment = ": keepalive\n\n"
+
+func newEventStream(w http.ResponseWriter) (*eventStream, bool) {
+	f, ok := newFlushWriter(w)
+	if !ok {
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.flusher.Flush()
+
+	return &eventStream{f}, true
+}
+
+func (s *eventStream) send(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	return s.write(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/search"
+	"github.com/nlsearch/backend/translate"
+)
+
+type QueryRequest struct {
+	Query  string `json:"query"`
+	Format string `json:"format,omitempty"`
+	// TimeoutSeconds overrides the server's default translation timeout. It
+	// is capped at the server's configured maximum.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// Share makes the history entry visible to every user of the server,
+	// not just the one who made the request.
+	Share bool `json:"share,omitempty"`
+	// NoStore keeps the request and the query generated for it out of the
+	// history, the translation cache and Deep Search, so the response has
+	// no ID to give feedback on or refine.
+	NoStore bool `json:"no_store,omitempty"`
+	// Intent is "search" to translate the request into a search query,
+	// the default; "question" to have Deep Search answer it in prose; or
+	// "auto" to tell which from the request.
+	Intent string `json:"intent,omitempty"`
+	// Snippets adds the text of the lines each source cites to it, so
+	// clients can show previews without fetching the files.
+	Snippets bool `json:"snippets,omitempty"`
+	// Highlight adds each snippet as HTML with syntax highlighting.
+	Highlight bool `json:"highlight,omitempty"`
+	// HTML adds answers to questions as sanitized HTML, for clients that
+	// can't render Markdown.
+	HTML bool `json:"html,omitempty"`
+	// Disambiguate looks up whether a name in the query matches several
+	// repositories or symbols, and if so lists a query for each in the
+	// response's Interpretations.
+	Disambiguate bool `json:"disambiguate,omitempty"`
+	// MaxResults sets the count: filter of the generated query, whatever
+	// the model chose, so the search returns at most that many results.
+	// 0 leaves it to the model.
+	MaxResults int `json:"max_results,omitempty"`
+	// Timezone is the IANA time zone, such as America/New_York, the user
+	// is in, for resolving dates relative to today such as "yesterday".
+	// Without it the X-Timezone header is used, or the server's default.
+	Timezone string `json:"timezone,omitempty"`
+
+	// unrecorded keeps the translation out of the history, for GET
+	// requests, which other sites can make in the user's name.
+	unrecorded bool
+}
+
+type QueryResponse struct {
+	// ID identifies the history entry for the translation, for feedback.
+	ID string `json:"id,omitempty"`
+	// Intent says how the request was handled: "search", with the query in
+	// Answer, or "question", with Deep Search's answer in Reply.
+	Intent string `json:"intent,omitempty"`
+	Answer string `json:"answer"`
+	Reply  string `json:"reply,omitempty"`
+	// ReplyHTML is Reply rendered as sanitized HTML, if requested.
+	ReplyHTML string                 `json:"reply_html,omitempty"`
+	Output    string                 `json:"output,omitempty"`
+	Sources   []translate.Source     `json:"sources,omitempty"`
+	Stats     map[string]interface{} `json:"stats,omitempty"`
+	// Filters and Pattern break the query in Answer down, for clients that
+	// show or act on its parts. Both are empty if it doesn't parse.
+	Filters []Filter `json:"filters,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	// Extraction names the strategy that pulled the query out of the answer.
+	Extraction string `json:"extraction,omitempty"`
+	Cached     bool   `json:"cached,omitempty"`
+	// Candidates lists every attempt when the server runs the best-of-n or
+	// ensemble strategy.
+	Candidates []translate.Candidate `json:"candidates,omitempty"`
+	// Disagreement is set when ensemble providers failed to reach a quorum.
+	Disagreement bool `json:"disagreement,omitempty"`
+	// Fallback is set when no provider could answer and the query came from
+	// the offline rule-based translator instead.
+	Fallback bool `json:"fallback,omitempty"`
+	// Confidence estimates, between 0 and 1, how likely the query is to
+	// find what was asked for. It is not set on answers to questions.
+	Confidence *float64 `json:"confidence,omitempty"`
+	// NeedsClarification is set instead of Answer when Confidence is below
+	// the server's threshold, with a question to ask the user in
+	// Clarification, and the answers to offer in ClarificationOptions, if
+	// there are a few obvious ones. The answer is sent to
+	// /query/{id}/clarify.
+	NeedsClarification   bool     `json:"needs_clarification,omitempty"`
+	Clarification        string   `json:"clarification,omitempty"`
+	ClarificationOptions []string `json:"clarification_options,omitempty"`
+	// Interpretations lists the readings of Answer when a name in it is
+	// ambiguous, if the request asked to disambiguate, so the user can
+	// choose one.
+	Interpretations []Interpretation `json:"interpretations,omitempty"`
+}
+
+// Filter is one filter of a query, such as lang:go or -file:test. Field is
+// the filter's canonical name, so l: and language: are both lang.
+type Filter struct {
+	Field   string `json:"field"`
+	Value   string `json:"value"`
+	Negated bool   `json:"negated"`
+}
+
+// AskRequest is a question about the code for Deep Search to answer.
+type AskRequest struct {
+	Question string `json:"question"`
+	// TimeoutSeconds, NoStore, Snippets, Highlight and HTML are as in
+	// QueryRequest.
+	TimeoutSeconds int  `json:"timeout_seconds,omitempty"`
+	NoStore        bool `json:"no_store,omitempty"`
+	Snippets       bool `json:"snippets,omitempty"`
+	Highlight      bool `json:"highlight,omitempty"`
+	HTML           bool `json:"html,omitempty"`
+}
+
+// AskResponse is Deep Search's answer to an AskRequest.
+type AskResponse struct {
+	// Answer is in Markdown.
+	Answer string `json:"answer"`
+	// AnswerHTML is Answer rendered as sanitized HTML, if requested.
+	AnswerHTML string                 `json:"answer_html,omitempty"`
+	Sources    []translate.Source     `json:"sources"`
+	Stats      map[string]interface{} `json:"stats,omitempty"`
+}
+
+type SearchRequest struct {
+	Query      string `json:"query"`
+	MaxResults int    `json:"max_results,omitempty"`
+	// Highlight adds each matched line as HTML with syntax highlighting.
+	Highlight bool `json:"highlight,omitempty"`
+}
+
+type SearchResponse struct {
+	*search.Result
+	Cached bool `json:"cached,omitempty"`
+}
+
+// HistoryEntry records one translation request and its outcome.
+type HistoryEntry struct {
+	ID         string    `json:"id"`
+	Request    string    `json:"request"`
+	Query      string    `json:"query,omitempty"`
+	Extraction string    `json:"extraction,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Feedback   *Feedback `json:"feedback,omitempty"`
+	// Owner is the name of the authenticated user who made the request,
+	// empty when the server doesn't require authentication. Shared entries
+	// are visible to every user; the rest only to their owner.
+	Owner  string `json:"owner,omitempty"`
+	Shared bool   `json:"shared"`
+	// RefinedFrom is the ID of the entry this one revised, with Request
+	// holding the follow-up.
+	RefinedFrom string `json:"refined_from,omitempty"`
+	// Clarification is the question the user was asked instead of being
+	// given Query, which they can answer to have it revised.
+	Clarification string `json:"clarification,omitempty"`
+	// Conversation is the Deep Search conversation the query came from,
+	// while it is kept on the instance for follow-ups.
+	Conversation int `json:"-"`
+}
+
+// Feedback labels for translations.
+const (
+	FeedbackAccepted  = "accepted"
+	FeedbackRejected  = "rejected"
+	FeedbackCorrected = "corrected"
+)
+
+// Feedback is a user's verdict on a translation.
+type Feedback struct {
+	Label string `json:"label"`
+	// Query is the user's own query for the corrected label.
+	Query     string    `json:"query,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type FeedbackRequest struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Query string `json:"query,omitempty"`
+}
+
+type ShareRequest struct {
+	Shared bool `json:"shared"`
+}
+
+// LogLevelRequest sets the log level; responses to it report the level in
+// the same form.
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type ConversationsResponse struct {
+	Conversations []deepsearch.TrackedConversation `json:"conversations"`
+	NextCursor    string                           `json:"next_cursor,omitempty"`
+}
+
+// ConversationResponse pairs what the server recorded about a conversation
+// with its current state on Sourcegraph.
+type ConversationResponse struct {
+	Tracked       deepsearch.TrackedConversation `json:"tracked"`
+	Upstream      *deepsearch.Conversation       `json:"upstream,omitempty"`
+	UpstreamError string                         `json:"upstream_error,omitempty"`
+}
+
+// ExportRecord is one line of the training data export.
+type ExportRecord struct {
+	Input string `json:"input"`
+	// Query is the accepted query: the user's correction if there is one,
+	// otherwise the generated query.
+	Query      string    `json:"query"`
+	Label      string    `json:"label"`
+	Generated  string    `json:"generated"`
+	Extraction string    `json:"extraction,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type HistoryResponse struct {
+	Entries []HistoryEntry `json:"entries"`
+	// NextCursor fetches the next page when passed as ?cursor=. It is
+	// omitted on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// DeletionReport counts what was deleted of a user's data.
+type DeletionReport struct {
+	User string `json:"user"`
+	// History counts the deleted history entries, and Feedback those of
+	// them that had feedback.
+	History  int `json:"history"`
+	Feedback int `json:"feedback"`
+	// Jobs counts the deleted finished jobs.
+	Jobs int `json:"jobs"`
+	// Conversations counts the Deep Search conversations tracked for the
+	// user that were forgotten, and deleted from the instance if they were
+	// still on it. RemainingConversations lists the IDs of those that
+	// couldn't be deleted from it, for an admin of the instance to delete.
+	Conversations          int   `json:"conversations"`
+	RemainingConversations []int `json:"remaining_conversations,omitempty"`
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/middleware"
+)
+
+// API versioning policy: routes live under a version prefix, of which v1 is
+// the only one so far. Within a version, responses only change in ways
+// existing clients can ignore: fields are added, never renamed, removed or
+// given a new meaning, and new error codes only appear on new failures. A
+// breaking change gets a new prefix, served alongside the previous one,
+// which is then deprecated.
+//
+// The unversioned /api paths of earlier releases are deprecated aliases of
+// v1.
+const (
+	apiPrefix    = "/api/v1"
+	legacyPrefix = "/api"
+)
+
+// legacyDeprecated is when the unversioned paths were deprecated.
+var legacyDeprecated = time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+
+// mountVersioned mounts h at path under the current version prefix, and at
+// the legacy unversioned path with deprecation headers pointing at the
+// versioned one. path is relative to the prefix, e.g. /query.
+func mountVersioned(mux *http.ServeMux, path string, h http.Handler) {
+	mux.Handle(apiPrefix+path, h)
+	mux.Handle(legacyPrefix+path, middleware.Chain(h, middleware.Deprecated(legacyDeprecated, successorPath)))
+}
+
+// successorPath maps a legacy request path to its versioned equivalent.
+func successorPath(r *http.Request) string {
+	return apiPrefix + strings.TrimPrefix(r.URL.Path, legacyPrefix)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// Each configuration variable can be set, in order of precedence, by a
+// command-line flag, the environment, the .env file named by ENV_FILE, the
+// directory named by CONFIG_DIR, or the config file named by CONFIG_FILE.
+// loadConfig reads them all through lookupSetting.
+var (
+	flagSettings    = map[string]string{}
+	envFileSettings = map[string]string{}
+	dirSettings     = map[string]string{}
+	fileSettings    = map[string]string{}
+)
+
+// Where lookupSetting found a value, as reported by check-config.
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "environment"
+	sourceEnvFile = ".env file"
+	sourceDir     = "config directory"
+	sourceFile    = "config file"
+)
+
+// defaultEnvFile is where contributors keep their settings: the repository
+// root, when running from the backend directory.
+const defaultEnvFile = "../.env"
+
+// lookupSetting returns the value of configuration variable key and where
+// it came from, or ok false if it isn't set anywhere.
+func lookupSetting(key string) (value, source string, ok bool) {
+	if v, ok := flagSettings[key]; ok {
+		return v, sourceFlag, true
+	}
+	if v := os.Getenv(key); v != "" {
+		return v, sourceEnv, true
+	}
+	if v, ok := envFileSettings[key]; ok {
+		return v, sourceEnvFile, true
+	}
+	if v, ok := dirSettings[key]; ok {
+		return v, sourceDir, true
+	}
+	if v, ok := fileSettings[key]; ok {
+		return v, sourceFile, true
+	}
+	return "", "", false
+}
+
+// flagName is the command-line flag for configuration variable name, e.g.
+// -sourcegraph-url for SOURCEGRAPH_URL.
+func flagName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// addConfigFlags registers a flag for every configuration variable on fs
+// but the secrets, since command lines are visible to every user of the
+// machine, in ps and /proc. applyConfigFlags records the ones given once fs
+// is parsed.
+func addConfigFlags(fs *flag.FlagSet) {
+	for _, v := range configVars {
+		if !isSecretVar(v.name) {
+			fs.String(flagName(v.name), v.defaultValue, v.description)
+		}
+	}
+}
+
+// isConfigFlag reports whether name is one of the flags added by
+// addConfigFlags.
+func isConfigFlag(name string) bool {
+	for _, v := range configVars {
+		if flagName(v.name) == name && !isSecretVar(v.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyConfigFlags records the configuration flags set on fs in
+// flagSettings, where they override the environment.
+func applyConfigFlags(fs *flag.FlagSet) {
+	names := map[string]string{}
+	for _, v := range configVars {
+		names[flagName(v.name)] = v.name
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if name, ok := names[f.Name]; ok {
+			flagSettings[name] = f.Value.String()
+		}
+	})
+}
+
+// loadEnvFile reads the .env file into envFileSettings. It is optional
+// unless ENV_FILE names it, so deployments without one are unaffected. Its
+// location can only be set by a flag or the environment, since the files
+// are read in order of precedence.
+func loadEnvFile() error {
+	path, source, ok := lookupSetting("ENV_FILE")
+	if !ok {
+		path = defaultEnvFile
+	}
+	settings, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) && !ok {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid ENV_FILE (from the %s): %w", source, err)
+	}
+	envFileSettings = settings
+	return nil
+}
+
+// loadConfigFile reads the config file, if CONFIG_FILE names one, into
+// fileSettings. It is a JSON object keyed by variable name; values may be
+// strings, numbers, booleans, arrays for comma-separated lists, or objects
+// and arrays of objects for settings written in JSON, such as TENANT_LIMITS
+// and QUERY_REWRITE_RULES:
+//
+//	{"SOURCEGRAPH_URL": "https://sourcegraph.example.com", "PORT": 9090, "API_KEYS": ["alice:key1", "bob:key2"]}
+func loadConfigFile() error {
+	path, _, ok := lookupSetting("CONFIG_FILE")
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid CONFIG_FILE: %w", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("invalid CONFIG_FILE %s: %w", path, err)
+	}
+
+	known := knownSettings()
+	fileSettings = map[string]string{}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] || key == "CONFIG_FILE" || key == "ENV_FILE" {
+			return fmt.Errorf("invalid CONFIG_FILE %s: unknown setting %q", path, key)
+		}
+		value, err := settingString(raw[key])
+		if err != nil {
+			return fmt.Errorf("invalid CONFIG_FILE %s: %s: %w", path, key, err)
+		}
+		fileSettings[key] = value
+	}
+	return nil
+}
+
+// loadConfigDir reads the directory CONFIG_DIR names, if any, into
+// dirSettings. Each file in it holds the value of the variable it is named
+// after, which is how Kubernetes mounts ConfigMaps and Secrets. Other
+// files, such as a prompt template mounted alongside, and hidden ones are
+// skipped, but a file named like a variable that doesn't exist is an error,
+// since it is probably a typo.
+func loadConfigDir() error {
+	dir, _, ok := lookupSetting("CONFIG_DIR")
+	if !ok {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("invalid CONFIG_DIR: %w", err)
+	}
+	known := knownSettings()
+	settings := map[string]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isVariableName(name) {
+			continue
+		}
+		if !known[name] || name == "CONFIG_DIR" || name == "ENV_FILE" {
+			return fmt.Errorf("invalid CONFIG_DIR %s: unknown setting %q", dir, name)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("invalid CONFIG_DIR: %w", err)
+		}
+		settings[name] = strings.TrimSpace(string(data))
+	}
+	dirSettings = settings
+	return nil
+}
+
+// isVariableName reports whether name looks like a configuration variable:
+// upper case letters, digits and underscores.
+func isVariableName(name string) bool {
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func knownSettings() map[string]bool {
+	known := map[string]bool{}
+	for _, v := range configVars {
+		known[v.name] = true
+	}
+	return known
+}
+
+// settingString formats a JSON value the way it would be written in the
+// environment.
+func settingString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item := item.(type) {
+			case string:
+				items[i] = item
+			case map[string]any:
+				// Lists of objects, such as QUERY_REWRITE_RULES, are
+				// kept as JSON.
+				data, err := json.Marshal(v)
+				return string(data), err
+			default:
+				return "", fmt.Errorf("list items must be strings or objects")
+			}
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		data, err := json.Marshal(v)
+		return string(data), err
+	default:
+		return "", fmt.Errorf("must be a string, number, boolean, list or object")
+	}
+}
@@ -0,0 +1,140 @@
+package sourcegraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nlsearch/backend/deepsearch"
+)
+
+// Capabilities records which APIs an instance offers. They vary with the
+// Sourcegraph version and license tier.
+type Capabilities struct {
+	// Version is the instance's product version, if GraphQL reported it.
+	Version string
+	GraphQL bool
+	// DeepSearch and DeepSearchV2 are the revisions of the Deep Search
+	// API, deepsearch.APIv1 and APIv2.
+	DeepSearch   bool
+	DeepSearchV2 bool
+	// Cody is the chat completions API.
+	Cody bool
+}
+
+func (c Capabilities) String() string {
+	var names []string
+	for _, cap := range []struct {
+		name string
+		ok   bool
+	}{
+		{"graphql", c.GraphQL},
+		{"deepsearch-v1", c.DeepSearch},
+		{"deepsearch-v2", c.DeepSearchV2},
+		{"cody", c.Cody},
+	} {
+		if cap.ok {
+			names = append(names, cap.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// API returns the revision of the Deep Search API to speak to the instance:
+// v1 where it is offered, since it is the one every version has had, or
+// else v2. It reports false if the instance offers neither.
+func (c Capabilities) API() (deepsearch.API, bool) {
+	switch {
+	case c.DeepSearch:
+		return deepsearch.APIv1, true
+	case c.DeepSearchV2:
+		return deepsearch.APIv2, true
+	}
+	return deepsearch.API{}, false
+}
+
+// DetectCapabilities probes the instance's APIs, and asks for its version,
+// in parallel. An API counts as present unless it answers 404. It fails if
+// the token is rejected or no probe got an answer at all.
+func (c *Client) DetectCapabilities(ctx context.Context) (Capabilities, error) {
+	probes := []struct {
+		method, path string
+		found        *bool
+	}{
+		{http.MethodGet, deepsearch.APIv1.Path, nil},
+		{http.MethodGet, deepsearch.APIv2.Path, nil},
+		{http.MethodGet, "/.api/llm/models", nil},
+	}
+	var caps Capabilities
+	probes[0].found, probes[1].found, probes[2].found = &caps.DeepSearch, &caps.DeepSearchV2, &caps.Cody
+
+	errs := make([]error, len(probes)+1)
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			*p.found, errs[i] = c.probe(ctx, p.method, p.path)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var data struct {
+			Site struct {
+				ProductVersion string `json:"productVersion"`
+			} `json:"site"`
+		}
+		errs[len(probes)] = c.GraphQL(ctx, `query NLSearchProbe { site { productVersion } }`, nil, &data)
+		caps.GraphQL = errs[len(probes)] == nil
+		caps.Version = data.Site.ProductVersion
+	}()
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrInvalidToken) {
+			return caps, err
+		}
+		failed++
+	}
+	if failed == len(errs) {
+		return caps, fmt.Errorf("no API answered: %w", errs[0])
+	}
+	return caps, nil
+}
+
+func (c *Client) probe(ctx context.Context, method, path string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return false, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", deepsearch.ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("probe %s: %w", path, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized:
+		return false, fmt.Errorf("%w (status %d)", ErrInvalidToken, resp.StatusCode)
+	}
+	// Anything else, including 403 for a feature the user may not use and
+	// 405 for a method the endpoint doesn't take, means the route exists.
+	return true, nil
+}
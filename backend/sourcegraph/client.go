@@ -0,0 +1,173 @@
+// Package sourcegraph is a client for Sourcegraph's GraphQL API, used for
+// instance metadata such as the current user and product version and for
+// resolving revisions, and for its raw file API.
+package sourcegraph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/redact"
+)
+
+// ErrInvalidToken means Sourcegraph did not accept the access token.
+var ErrInvalidToken = errors.New("access token was not accepted")
+
+type Client struct {
+	baseURL     string
+	accessToken string
+	auth        deepsearch.Auth
+	httpClient  *http.Client
+}
+
+func NewClient(baseURL, accessToken string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		accessToken: accessToken,
+		httpClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// WithTransport sends the client's requests through rt, e.g. to share an
+// outbound rate limit. It returns c for chaining.
+func (c *Client) WithTransport(rt http.RoundTripper) *Client {
+	c.httpClient.Transport = rt
+	return c
+}
+
+// WithAuth sets how the client's requests carry the access token. It
+// returns c for chaining.
+func (c *Client) WithAuth(auth deepsearch.Auth) *Client {
+	c.auth = auth
+	return c
+}
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// GraphQL runs query with variables and decodes the response data into out.
+func (c *Client) GraphQL(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/.api/graphql", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", deepsearch.ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w (status %d)", ErrInvalidToken, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, redact.String(string(b)))
+	}
+
+	var result graphQLResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		messages := make([]string, len(result.Errors))
+		for i, e := range result.Errors {
+			messages[i] = e.Message
+		}
+		return fmt.Errorf("graphql: %s", strings.Join(messages, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+// Identity describes who a token authenticates as, and where.
+type Identity struct {
+	Username       string
+	ProductVersion string
+}
+
+const identityQuery = `query NLSearchIdentity {
+	currentUser { username }
+	site { productVersion }
+}`
+
+// CurrentUser returns the user the access token belongs to, failing with
+// ErrInvalidToken if there is none.
+func (c *Client) CurrentUser(ctx context.Context) (*Identity, error) {
+	var data struct {
+		CurrentUser *struct {
+			Username string `json:"username"`
+		} `json:"currentUser"`
+		Site struct {
+			ProductVersion string `json:"productVersion"`
+		} `json:"site"`
+	}
+	if err := c.GraphQL(ctx, identityQuery, nil, &data); err != nil {
+		return nil, err
+	}
+	if data.CurrentUser == nil {
+		// Sourcegraph answers anonymously rather than rejecting the request
+		// when public access is enabled.
+		return nil, fmt.Errorf("%w (no user is signed in with it)", ErrInvalidToken)
+	}
+	return &Identity{Username: data.CurrentUser.Username, ProductVersion: data.Site.ProductVersion}, nil
+}
+
+const resolveRevisionQuery = `query NLSearchResolveRevision($repo: String!, $rev: String!) {
+	repository(name: $repo) { commit(rev: $rev) { oid } }
+}`
+
+// ResolveRevision returns the commit that rev, a branch, tag or commit, of
+// repo points at, or HEAD's if rev is empty. It fails if Sourcegraph has no
+// such repository or revision.
+func (c *Client) ResolveRevision(ctx context.Context, repo, rev string) (string, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	var data struct {
+		Repository *struct {
+			Commit *struct {
+				OID string `json:"oid"`
+			} `json:"commit"`
+		} `json:"repository"`
+	}
+	if err := c.GraphQL(ctx, resolveRevisionQuery, map[string]interface{}{"repo": repo, "rev": rev}, &data); err != nil {
+		return "", err
+	}
+	if data.Repository == nil {
+		return "", fmt.Errorf("repository %s not found", repo)
+	}
+	if data.Repository.Commit == nil {
+		return "", fmt.Errorf("revision %s of %s not found", rev, repo)
+	}
+	return data.Repository.Commit.OID, nil
+}
@@ -0,0 +1,100 @@
+package sourcegraph
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nlsearch/backend/deepsearch"
+	"github.com/nlsearch/backend/redact"
+)
+
+// maxLineLength bounds each line FileLines reads, so minified files don't
+// make it buffer megabytes; longer lines are cut.
+const maxLineLength = 4096
+
+// FileLines returns lines start to end of path in repo at rev, counting
+// from 1, from Sourcegraph's raw file API. It stops reading at end, so
+// lines near the top of large files are cheap. Lines past the end of the
+// file are left out.
+func (c *Client) FileLines(ctx context.Context, repo, rev, path string, start, end int) (string, error) {
+	if start < 1 || end < start {
+		return "", fmt.Errorf("invalid line range %d-%d", start, end)
+	}
+	link := "/" + escapePath(repo)
+	if rev != "" {
+		link += "@" + url.PathEscape(rev)
+	}
+	link += "/-/raw/" + escapePath(path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+link, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", c.auth.Header(c.accessToken))
+	req.Header.Set("X-Requested-With", deepsearch.ClientIdentifier)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w (status %d)", ErrInvalidToken, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("unexpected status %d: %s", resp.StatusCode, redact.String(string(b)))
+	}
+
+	var lines []string
+	r := bufio.NewReader(resp.Body)
+	for n := 1; n <= end; n++ {
+		line, err := readLine(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("read file: %w", err)
+		}
+		if n >= start {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// readLine reads a line from r without its line ending, keeping at most
+// maxLineLength bytes of it. It returns io.EOF only at the end of input.
+func readLine(r *bufio.Reader) (string, error) {
+	var b strings.Builder
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err == io.EOF && b.Len() > 0 {
+				return b.String(), nil
+			}
+			return "", err
+		}
+		if room := maxLineLength - b.Len(); room > 0 {
+			b.Write(chunk[:min(len(chunk), room)])
+		}
+		if !isPrefix {
+			return b.String(), nil
+		}
+	}
+}
+
+// escapePath escapes each segment of a slash-separated path for a URL.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,95 @@
+package sourcegraph
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const repositoriesQuery = `query Repositories($query: String!, $first: Int!) {
+  repositories(query: $query, first: $first) {
+    nodes { name }
+  }
+}`
+
+// Repositories returns the names of up to first repositories on the
+// instance whose names contain query.
+func (c *Client) Repositories(ctx context.Context, query string, first int) ([]string, error) {
+	var data struct {
+		Repositories struct {
+			Nodes []struct {
+				Name string `json:"name"`
+			} `json:"nodes"`
+		} `json:"repositories"`
+	}
+	if err := c.GraphQL(ctx, repositoriesQuery, map[string]interface{}{"query": query, "first": first}, &data); err != nil {
+		return nil, err
+	}
+	names := make([]string, len(data.Repositories.Nodes))
+	for i, node := range data.Repositories.Nodes {
+		names[i] = node.Name
+	}
+	return names, nil
+}
+
+const (
+	// repoCacheTTL is how long RepoCache remembers a lookup. Repositories
+	// are added and renamed rarely enough that a few minutes is fresh.
+	repoCacheTTL = 10 * time.Minute
+	// maxRepoCacheEntries caps the lookups RepoCache remembers.
+	maxRepoCacheEntries = 1000
+	// maxRepoMatches caps the repositories each lookup returns.
+	maxRepoMatches = 100
+)
+
+// RepoCache looks up the repositories whose names contain a name, and
+// remembers each answer for a while, so resolving the repositories
+// requests mention rarely costs a GraphQL call. It is safe for concurrent
+// use.
+type RepoCache struct {
+	client  *Client
+	mu      sync.Mutex
+	entries map[string]repoCacheEntry
+}
+
+type repoCacheEntry struct {
+	repos   []string
+	expires time.Time
+}
+
+func NewRepoCache(client *Client) *RepoCache {
+	return &RepoCache{client: client, entries: map[string]repoCacheEntry{}}
+}
+
+// Repositories returns the names of the repositories whose names contain
+// name, ignoring case. Failed lookups aren't remembered.
+func (c *RepoCache) Repositories(ctx context.Context, name string) ([]string, error) {
+	key := strings.ToLower(name)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.repos, nil
+	}
+
+	repos, err := c.client.Repositories(ctx, name, maxRepoMatches)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxRepoCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxRepoCacheEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = repoCacheEntry{repos: repos, expires: time.Now().Add(repoCacheTTL)}
+	return repos, nil
+}
@@ -0,0 +1,237 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/query"
+)
+
+// promptVariants are alternative phrasings of prompt. Deep Search has no
+// temperature setting, so varying the prompt is how BestOf gets diverse
+// candidates.
+var promptVariants = []string{
+	prompt,
+	`You are an expert Sourcegraph user. Write the single Sourcegraph search query that best answers the request below.
+
+Prefer precise filters (repo:, file:, lang:, type:, select:) over free text, and only use filters that exist in Sourcegraph's query language. Check internal/search/query in github.com/sourcegraph/sourcegraph if unsure.
+
+Respond with ONLY the query on a single line: no explanation, no markdown, no code fences.
+
+Request: %s`,
+	`Translate the request below into Sourcegraph search syntax.
+
+Think about which repositories, files, languages and result types it is about, then output just the final query string and nothing else. Do not use filters that Sourcegraph does not support.
+
+Request: %s`,
+}
+
+// Candidate is one attempt made by BestOf or Ensemble.
+type Candidate struct {
+	// Provider names the provider that produced the candidate in an
+	// Ensemble.
+	Provider   string   `json:"provider,omitempty"`
+	Query      string   `json:"query"`
+	Extraction string   `json:"extraction,omitempty"`
+	Score      float64  `json:"score"`
+	Problems   []string `json:"problems,omitempty"`
+	// Matches is the dry-run result count, or -1 if no dry run was made.
+	Matches int    `json:"matches"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DryRunFunc runs query with count:1 and returns how many matches it found.
+type DryRunFunc func(ctx context.Context, query string) (int, error)
+
+// BestOf runs several translations in parallel with different prompts,
+// validates each candidate, optionally dry-runs the valid ones, and returns
+// the best-scoring query.
+type BestOf struct {
+	variants []*Translator
+	dryRun   DryRunFunc
+}
+
+// stragglerWait is how long BestOf waits for the remaining candidates once
+// the first has succeeded.
+const stragglerWait = 15 * time.Second
+
+// NewBestOf builds a runner making n attempts with t, cycling through the
+// prompt variants. The first variant is t's own prompt, which is the
+// default one unless it was replaced. dryRun may be nil to skip dry runs.
+func NewBestOf(t *Translator, n int, dryRun DryRunFunc) *BestOf {
+	b := &BestOf{dryRun: dryRun}
+	for i := 0; i < n; i++ {
+		if v := i % len(promptVariants); v == 0 {
+			b.variants = append(b.variants, t)
+		} else {
+			b.variants = append(b.variants, t.WithPrompt(promptVariants[v]))
+		}
+	}
+	return b
+}
+
+func (b *BestOf) Translate(ctx context.Context, request string, progress func(Progress)) (*Translation, error) {
+	// Candidates get their own context so stragglers can be cut off without
+	// affecting the dry runs that follow.
+	candidateCtx, cancelCandidates := context.WithCancel(ctx)
+	defer cancelCandidates()
+
+	report := serialProgress(progress, func(i int) string {
+		return fmt.Sprintf("candidate %d/%d", i+1, len(b.variants))
+	})
+
+	translations := make([]*Translation, len(b.variants))
+	errs := make([]error, len(b.variants))
+	var wg sync.WaitGroup
+	var firstDone sync.Once
+	var stragglerTimer *time.Timer
+	for i, variant := range b.variants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			translations[i], errs[i] = variant.Translate(candidateCtx, request, func(p Progress) { report(i, p) })
+			if errs[i] == nil {
+				firstDone.Do(func() { stragglerTimer = time.AfterFunc(stragglerWait, cancelCandidates) })
+			}
+		}()
+	}
+	wg.Wait()
+	if stragglerTimer != nil {
+		stragglerTimer.Stop()
+	}
+
+	candidates := make([]Candidate, len(b.variants))
+	for i := range candidates {
+		candidates[i].Matches = -1
+		if errs[i] != nil {
+			candidates[i].Error = errs[i].Error()
+			continue
+		}
+		candidates[i].Query = translations[i].Query
+		candidates[i].Extraction = translations[i].Extraction
+	}
+	best := -1
+	for i := range candidates {
+		if errs[i] == nil {
+			best = i
+			break
+		}
+	}
+	if best < 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	b.score(ctx, candidates, func(p Progress) { report(0, p) })
+
+	for i := range candidates {
+		if errs[i] == nil && candidates[i].Score > candidates[best].Score {
+			best = i
+		}
+	}
+	slog.InfoContext(ctx, "Best of n chose a candidate", "n", len(b.variants), "candidate", best+1, "query", candidates[best].Query, "score", candidates[best].Score)
+
+	chosen := *translations[best]
+	ordered := append([]Candidate(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if (ordered[i].Error == "") != (ordered[j].Error == "") {
+			return ordered[i].Error == ""
+		}
+		return ordered[i].Score > ordered[j].Score
+	})
+	chosen.Candidates = ordered
+	return &chosen, nil
+}
+
+// Scoring weights. Validation errors dominate; dry-run results and agreement
+// between candidates break ties among valid queries.
+const (
+	errorPenalty     = 10
+	warningPenalty   = 2
+	matchesBonus     = 5
+	noMatchesPenalty = 3
+	dryRunPenalty    = 5
+	agreementBonus   = 1
+)
+
+// score validates, dry-runs and scores the successful candidates in place.
+func (b *BestOf) score(ctx context.Context, candidates []Candidate, progress func(Progress)) {
+	var wg sync.WaitGroup
+	if b.dryRun != nil {
+		progress(Progress{Stage: "dry-running candidates"})
+	}
+	for i := range candidates {
+		c := &candidates[i]
+		if c.Error != "" {
+			continue
+		}
+		start := time.Now()
+		problems := query.Validate(c.Query)
+		observeStage(ctx, StageValidation, start)
+		for _, p := range problems {
+			c.Problems = append(c.Problems, p.String())
+			if p.Severity == query.Error {
+				c.Score -= errorPenalty
+			} else {
+				c.Score -= warningPenalty
+			}
+		}
+		for j := range candidates {
+			if j != i && candidates[j].Error == "" && normalize(candidates[j].Query) == normalize(c.Query) {
+				c.Score += agreementBonus
+			}
+		}
+
+		if b.dryRun == nil || query.HasErrors(problems) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			matches, err := b.dryRun(ctx, c.Query)
+			observeStage(ctx, StageExecution, start)
+			switch {
+			case err != nil:
+				c.Problems = append(c.Problems, fmt.Sprintf("dry run failed: %v", err))
+				c.Score -= dryRunPenalty
+			case matches == 0:
+				c.Matches = 0
+				c.Score -= noMatchesPenalty
+			default:
+				c.Matches = matches
+				c.Score += matchesBonus
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// serialProgress adapts progress for translations running in parallel. The
+// returned function may be called concurrently, but progress is called in
+// sequence with each stage labelled by its runner. Only runner 0 forwards
+// stats, so counters such as tool calls stay monotonic.
+func serialProgress(progress func(Progress), label func(i int) string) func(i int, p Progress) {
+	var mu sync.Mutex
+	return func(i int, p Progress) {
+		if progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		p.Stage = label(i) + ": " + p.Stage
+		if i != 0 {
+			p.Stats = nil
+		}
+		progress(p)
+	}
+}
+
+func normalize(q string) string {
+	return strings.Join(strings.Fields(q), " ")
+}
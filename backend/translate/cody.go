@@ -0,0 +1,42 @@
+package translate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlsearch/backend/cody"
+)
+
+// Cody is a Backend that uses the Cody chat completions API. It is quicker
+// than Deep Search but cannot look at code, and is available on many
+// instances that don't have Deep Search.
+type Cody struct {
+	client *cody.Client
+}
+
+func NewCody(client *cody.Client) *Cody {
+	return &Cody{client: client}
+}
+
+func (c *Cody) Ask(ctx context.Context, prompt string, progress func(Progress)) (*Answer, error) {
+	if progress != nil {
+		progress(Progress{Stage: "waiting for Cody"})
+	}
+	start := time.Now()
+	completion, err := c.client.Complete(ctx, []cody.Message{{Role: "user", Content: prompt}})
+	observeStage(ctx, StageCompletion, start)
+	if err != nil {
+		return nil, fmt.Errorf("cody completion: %w", err)
+	}
+	return &Answer{
+		Text: completion.Content,
+		Stats: map[string]interface{}{
+			"model":             completion.Model,
+			"prompt_tokens":     completion.Usage.PromptTokens,
+			"completion_tokens": completion.Usage.CompletionTokens,
+			"total_tokens":      completion.Usage.TotalTokens,
+		},
+		Ref: "cody completion (" + completion.Model + ")",
+	}, nil
+}
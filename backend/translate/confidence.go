@@ -0,0 +1,110 @@
+package translate
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/nlsearch/backend/query"
+)
+
+// extractionConfidence is how much each extraction strategy's queries are
+// trusted, before validation: a query the model set apart is more likely
+// to be what it meant than a line picked out of prose.
+var extractionConfidence = map[string]float64{
+	"json":      1,
+	"fenced":    1,
+	"backtick":  0.9,
+	"last-line": 0.75,
+	"rules":     0.6,
+	"none":      0.5,
+}
+
+// Confidence penalties, taken off the extraction's confidence.
+const (
+	errorConfidencePenalty   = 0.35
+	warningConfidencePenalty = 0.1
+	// disagreementConfidence scales the confidence of ensemble answers
+	// too few providers agreed on.
+	disagreementConfidence = 0.8
+)
+
+// Confidence estimates, between 0 and 1, how likely t.Query is to find what
+// was asked for, from how it was extracted and what validating it finds.
+func (t *Translation) Confidence() float64 {
+	c, ok := extractionConfidence[t.Extraction]
+	if !ok {
+		c = 0.8
+	}
+	for _, p := range query.Validate(t.Query) {
+		if p.Severity == query.Error {
+			c -= errorConfidencePenalty
+		} else {
+			c -= warningConfidencePenalty
+		}
+	}
+	if t.Disagreement {
+		c *= disagreementConfidence
+	}
+	return math.Round(max(0, min(c, 1))*100) / 100
+}
+
+// maxClarificationOptions bounds the answers a Clarification offers; past
+// that, listing them doesn't help the user choose.
+const maxClarificationOptions = 5
+
+// Clarification is a question to ask the user for a better translation,
+// with the answers to choose from when there are a few obvious ones.
+type Clarification struct {
+	Question string
+	// Options are the answers to offer, if any; the user may still answer
+	// something else.
+	Options []string
+}
+
+// Clarify suggests what to ask the user who made request to get a better
+// translation than t: what they are after, when the request is only a word
+// or two or t doesn't validate, or else where to look, unless t already
+// limits that. Where to look is asked as a choice between the repositories
+// t's sources are in, when there are a few.
+func Clarify(request string, t *Translation) Clarification {
+	words := strings.Fields(request)
+	scoped := false
+	if parsed, err := query.Parse(t.Query); err == nil {
+		for _, tok := range parsed.Tokens {
+			switch tok.Field {
+			case "repo", "lang", "file", "context":
+				scoped = scoped || tok.Kind == query.Field && !tok.Negated
+			}
+		}
+	}
+	repos := sourceRepositories(t.Sources)
+	switch {
+	case len(words) <= 2:
+		return Clarification{Question: fmt.Sprintf("What are you looking for about %q: code that uses it, its definition, files, commits or diffs?", strings.Join(words, " "))}
+	case query.HasErrors(query.Validate(t.Query)):
+		return Clarification{Question: "Could you say more specifically what to find, such as the function, text or error message the code should contain?"}
+	case !scoped && len(repos) >= 2 && len(repos) <= maxClarificationOptions:
+		return Clarification{
+			Question: fmt.Sprintf("Which repository did you mean: %s or %s?", strings.Join(repos[:len(repos)-1], ", "), repos[len(repos)-1]),
+			Options:  repos,
+		}
+	case !scoped:
+		return Clarification{Question: "Which repositories or languages should the search cover?"}
+	default:
+		return Clarification{Question: "Could you describe more specifically what the code you're looking for does or contains?"}
+	}
+}
+
+// sourceRepositories returns the repositories of sources, in the order
+// they were first looked at.
+func sourceRepositories(sources []Source) []string {
+	var repos []string
+	for _, source := range sources {
+		if source.Repository != "" && !slices.Contains(repos, source.Repository) {
+			repos = append(repos, source.Repository)
+		}
+	}
+	return repos
+}
@@ -0,0 +1,344 @@
+package translate
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sprintDays is how long a sprint is taken to be, for requests such as
+// "since last sprint". Two weeks is the most common length, and sprints
+// are taken to end today, since their real boundaries aren't known.
+const sprintDays = 14
+
+// dateLayout is the form of the dates in after: and before: filters.
+const dateLayout = "2006-01-02"
+
+const (
+	datePeriod = `(day|week|sprint|month|quarter|year)s?`
+	dateCount  = `(\d+|an?|one|two|three|four|five|six|seven|eight|nine|ten|eleven|twelve|(?:a )?couple(?: of)?|(?:a )?few|several)`
+	isoDate    = `(\d{4}-\d{2}-\d{2})`
+	// The names of months, except May, aren't words, so they may be
+	// written in lowercase.
+	monthName = `((?i:jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|jun(?:e)?|jul(?:y)?|aug(?:ust)?|sep(?:t|tember)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?)|May)`
+	weekday   = `(monday|tuesday|wednesday|thursday|friday|saturday|sunday)`
+)
+
+// countWords maps the words people count periods with to numbers.
+var countWords = map[string]int{
+	"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6,
+	"seven": 7, "eight": 8, "nine": 9, "ten": 10, "eleven": 11, "twelve": 12,
+	"couple": 2, "couple of": 2, "a couple": 2, "a couple of": 2,
+	"few": 3, "a few": 3, "several": 3,
+}
+
+// datePhrase is a way of saying when, such as "in the past 3 months".
+type datePhrase struct {
+	re *regexp.Regexp
+	// dates returns the start and end of the time a match means, as of
+	// today, either of which is zero if it is open.
+	dates func(m []string, today time.Time) (time.Time, time.Time)
+}
+
+// datePhrases are tried in order, so phrases that contain others, such as
+// "since last week" and "last week", come first.
+var datePhrases = []datePhrase{
+	// between 2024-01-01 and 2024-03-31
+	{regexp.MustCompile(`(?i)\b(?:between|from) ` + isoDate + ` (?:and|to|until|through) ` + isoDate + `\b`), func(m []string, _ time.Time) (time.Time, time.Time) {
+		from, to := parseDate(m[1]), parseDate(m[2])
+		if to.IsZero() {
+			return from, to
+		}
+		return from, to.AddDate(0, 0, 1)
+	}},
+	// since 2024-03-01, before 2024-03-01
+	{regexp.MustCompile(`(?i)\b(since|after|from|before|until|till|prior to|older than) ` + isoDate + `\b`), func(m []string, _ time.Time) (time.Time, time.Time) {
+		day := parseDate(m[2])
+		if day.IsZero() {
+			return day, day
+		}
+		return bound(m[1], day, day.AddDate(0, 0, 1))
+	}},
+	// in the past 3 months, over the last two weeks, past few days
+	{regexp.MustCompile(`(?i)\b(?:(?:in|over|during|within|for|from|since) )?(?:the )?(?:last|past|previous) ` + dateCount + ` ` + datePeriod + `\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		return addPeriods(today, m[2], -count(m[1])), time.Time{}
+	}},
+	// 3 weeks ago, since a month ago, older than 6 months
+	{regexp.MustCompile(`(?i)\b(?:(since|after|from|before|until|till|prior to) )?` + dateCount + ` ` + datePeriod + ` ago\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		t := addPeriods(today, m[3], -count(m[2]))
+		if m[1] == "" {
+			return t, time.Time{}
+		}
+		return bound(m[1], t, t)
+	}},
+	{regexp.MustCompile(`(?i)\b(older|newer) than ` + dateCount + ` ` + datePeriod + `\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		t := addPeriods(today, m[3], -count(m[2]))
+		if strings.EqualFold(m[1], "older") {
+			return time.Time{}, t
+		}
+		return t, time.Time{}
+	}},
+	// in the past week, over the last month
+	{regexp.MustCompile(`(?i)\b(?:(?:in|over|during|within|for) )?the (?:last|past) ` + datePeriod + `\b|\bpast ` + datePeriod + `\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		return addPeriods(today, m[1]+m[2], -1), time.Time{}
+	}},
+	// last week, since last sprint, before last month
+	{regexp.MustCompile(`(?i)\b(?:(since|from|after|during|in|before|until) )?last ` + datePeriod + `\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		start, end := lastPeriod(today, m[2])
+		switch strings.ToLower(m[1]) {
+		case "since", "from":
+			return start, time.Time{}
+		case "after":
+			return end, time.Time{}
+		case "before", "until":
+			return bound(m[1], start, end)
+		}
+		return start, end
+	}},
+	// this week, since this month
+	{regexp.MustCompile(`(?i)\b(?:(since|from|during|in|before|until) )?this ` + datePeriod + `\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		start := startOf(today, m[2])
+		switch strings.ToLower(m[1]) {
+		case "", "during", "in":
+			// The period isn't over, but nothing is dated after today.
+			return start, time.Time{}
+		}
+		end := addPeriods(start, m[2], 1)
+		if !end.After(today) {
+			// The sprint ends today.
+			end = today.AddDate(0, 0, 1)
+		}
+		return bound(m[1], start, end)
+	}},
+	// since yesterday, today
+	{regexp.MustCompile(`(?i)\b(?:(since|from|after|before|until) )?(yesterday|today)\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		day := today
+		if strings.EqualFold(m[2], "yesterday") {
+			day = today.AddDate(0, 0, -1)
+		}
+		if m[1] == "" {
+			return day, day.AddDate(0, 0, 1)
+		}
+		return bound(m[1], day, day.AddDate(0, 0, 1))
+	}},
+	// since March, in May 2024, before Jan
+	{regexp.MustCompile(`\b((?i:since|from|after|before|until|till|in|during)) ` + monthName + `(?: ((?:19|20)\d{2}))?\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		// "in dec" and "in oct" are more often number bases, and "in mar"
+		// or "in jun" could be anything, so an abbreviation after "in"
+		// needs a capital or a year.
+		if strings.EqualFold(m[1], "in") && m[3] == "" && m[2] == strings.ToLower(m[2]) && !isMonthName(m[2]) {
+			return time.Time{}, time.Time{}
+		}
+		start := monthStart(m[2], m[3], today)
+		return bound(m[1], start, start.AddDate(0, 1, 0))
+	}},
+	// since 2023, in 2024
+	{regexp.MustCompile(`(?i)\b(since|from|after|before|until|till|in|during) ((?:19|20)\d{2})\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		year, _ := strconv.Atoi(m[2])
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, today.Location())
+		return bound(m[1], start, start.AddDate(1, 0, 0))
+	}},
+	// since Monday, since last Friday
+	{regexp.MustCompile(`(?i)\b(since|from|after|before|until) (last )?` + weekday + `\b`), func(m []string, today time.Time) (time.Time, time.Time) {
+		day := lastWeekday(today, m[3], m[2] != "")
+		return bound(m[1], day, day.AddDate(0, 0, 1))
+	}},
+}
+
+// findDates finds the first phrase in text that says when, relative to
+// now, such as "since last sprint" or "in the past 3 months", and returns
+// the after: and before: hints for the dates it means, with the phrase
+// removed from text. A model can only guess today's date, but these can
+// be worked out.
+func findDates(text string, now time.Time) ([]Hint, string) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, p := range datePhrases {
+		loc := p.re.FindStringSubmatchIndex(text)
+		if loc == nil {
+			continue
+		}
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[2*i] >= 0 {
+				m[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		after, before := p.dates(m, today)
+		if after.IsZero() && before.IsZero() {
+			continue
+		}
+		var hints []Hint
+		if !after.IsZero() {
+			hints = append(hints, Hint{Field: "after", Value: strconv.Quote(after.Format(dateLayout)), Dated: true})
+		}
+		if !before.IsZero() {
+			hints = append(hints, Hint{Field: "before", Value: strconv.Quote(before.Format(dateLayout)), Dated: true})
+		}
+		return hints, text[:loc[0]] + " " + text[loc[1]:]
+	}
+	return nil, text
+}
+
+type locationKey struct{}
+
+// WithLocation returns a context in which dates relative to today, such as
+// "yesterday", are worked out in loc, the time zone of the user who made
+// the request, rather than the server's.
+func WithLocation(ctx context.Context, loc *time.Location) context.Context {
+	return context.WithValue(ctx, locationKey{}, loc)
+}
+
+// now returns the time in the time zone ctx has from WithLocation, or the
+// server's.
+func now(ctx context.Context) time.Time {
+	if loc, ok := ctx.Value(locationKey{}).(*time.Location); ok {
+		return time.Now().In(loc)
+	}
+	return time.Now()
+}
+
+// DateKey returns the day, in the time zone of ctx, that the dates request
+// gives relative to today are worked out from, or "" if it gives none. A
+// translation of request depends on it, so is only the same for requests
+// made on the same day in that time zone.
+func DateKey(ctx context.Context, request string) string {
+	t := now(ctx)
+	if hints, _ := findDates(request, t); len(hints) == 0 {
+		return ""
+	}
+	return t.Format(dateLayout)
+}
+
+// bound returns the dates a phrase opened by word means, for a time that
+// starts at start and ends at end: since it started, after it ended,
+// before it started, until it ended, or in it.
+func bound(word string, start, end time.Time) (time.Time, time.Time) {
+	switch strings.ToLower(word) {
+	case "since", "from":
+		return start, time.Time{}
+	case "after":
+		return end, time.Time{}
+	case "before", "prior to", "older than":
+		return time.Time{}, start
+	case "until", "till":
+		return time.Time{}, end
+	}
+	return start, end
+}
+
+func parseDate(s string) time.Time {
+	t, err := time.ParseInLocation(dateLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// count returns the number a dateCount match stands for.
+func count(s string) int {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return countWords[strings.ToLower(s)]
+}
+
+// addPeriods returns t moved by n of the period a datePeriod match names.
+func addPeriods(t time.Time, period string, n int) time.Time {
+	switch strings.TrimSuffix(strings.ToLower(period), "s") {
+	case "day":
+		return t.AddDate(0, 0, n)
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "sprint":
+		return t.AddDate(0, 0, sprintDays*n)
+	case "month":
+		return addMonths(t, n)
+	case "quarter":
+		return addMonths(t, 3*n)
+	default:
+		return addMonths(t, 12*n)
+	}
+}
+
+// addMonths returns t moved by n months, on the last day of the month if it
+// is shorter than t's day: a month before March 31 is February 28, not
+// March 3 as time.AddDate would have it.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, 0, 0, 0, 0, t.Location())
+	return first.AddDate(0, 0, min(t.Day(), first.AddDate(0, 1, -1).Day())-1)
+}
+
+// lastPeriod returns the start and end of the last whole period a
+// datePeriod match names, before the one today is in. Sprints are taken to
+// end today, so the last sprint is the one that ends with today.
+func lastPeriod(today time.Time, period string) (time.Time, time.Time) {
+	current := startOf(today, period)
+	if strings.TrimSuffix(strings.ToLower(period), "s") == "sprint" {
+		return current, today.AddDate(0, 0, 1)
+	}
+	return addPeriods(current, period, -1), current
+}
+
+// startOf returns the day the period a datePeriod match names, that today
+// is in, started. Weeks start on Monday.
+func startOf(today time.Time, period string) time.Time {
+	switch strings.TrimSuffix(strings.ToLower(period), "s") {
+	case "day":
+		return today
+	case "week":
+		return today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	case "sprint":
+		return today.AddDate(0, 0, -sprintDays)
+	case "month":
+		return today.AddDate(0, 0, 1-today.Day())
+	case "quarter":
+		month := time.Month((int(today.Month())-1)/3*3 + 1)
+		return time.Date(today.Year(), month, 1, 0, 0, 0, 0, today.Location())
+	default:
+		return time.Date(today.Year(), time.January, 1, 0, 0, 0, 0, today.Location())
+	}
+}
+
+// monthStart returns the first day of the month named name in year, or
+// without a year the last such month to have started by today.
+func monthStart(name, year string, today time.Time) time.Time {
+	var month time.Month
+	for m := time.January; m <= time.December; m++ {
+		if strings.HasPrefix(strings.ToLower(m.String()), strings.ToLower(name[:3])) {
+			month = m
+		}
+	}
+	y, err := strconv.Atoi(year)
+	if err != nil {
+		y = today.Year()
+		if month > today.Month() {
+			y--
+		}
+	}
+	return time.Date(y, month, 1, 0, 0, 0, 0, today.Location())
+}
+
+// isMonthName reports whether name is the full name of a month.
+func isMonthName(name string) bool {
+	for m := time.January; m <= time.December; m++ {
+		if strings.EqualFold(m.String(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastWeekday returns the last day named name up to today, or before today
+// if strictly is set.
+func lastWeekday(today time.Time, name string, strictly bool) time.Time {
+	day := today
+	if strictly {
+		day = day.AddDate(0, 0, -1)
+	}
+	for !strings.EqualFold(day.Weekday().String(), name) {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day
+}
@@ -0,0 +1,162 @@
+package translate
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFindDates(t *testing.T) {
+	// A Wednesday.
+	wednesday := time.Date(2025, time.March, 12, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		text   string
+		now    time.Time
+		after  string
+		before string
+	}{
+		// between 2024-01-01 and 2024-03-31
+		{text: "commits between 2024-01-01 and 2024-03-31", after: "2024-01-01", before: "2024-04-01"},
+		{text: "diffs from 2024-01-01 to 2024-01-31", after: "2024-01-01", before: "2024-02-01"},
+
+		// since 2024-03-01, before 2024-03-01
+		{text: "commits since 2024-03-01", after: "2024-03-01"},
+		{text: "commits after 2024-03-01", after: "2024-03-02"},
+		{text: "commits before 2024-03-01", before: "2024-03-01"},
+		{text: "commits until 2024-03-01", before: "2024-03-02"},
+		{text: "commits older than 2024-03-01", before: "2024-03-01"},
+
+		// in the past 3 months, over the last two weeks, past few days
+		{text: "commits in the past 3 months", after: "2024-12-12"},
+		{text: "commits over the last two weeks", after: "2025-02-26"},
+		{text: "commits past few days", after: "2025-03-09"},
+		{text: "commits in the last 2 sprints", after: "2025-02-12"},
+
+		// 3 weeks ago, since a month ago
+		{text: "commits 3 weeks ago", after: "2025-02-19"},
+		{text: "commits since a month ago", after: "2025-02-12"},
+		{text: "commits before 2 years ago", before: "2023-03-12"},
+
+		// older than 6 months, newer than two weeks
+		{text: "commits older than 6 months", before: "2024-09-12"},
+		{text: "commits newer than two weeks", after: "2025-02-26"},
+
+		// in the past week, over the last month
+		{text: "commits in the past week", after: "2025-03-05"},
+		{text: "commits over the last month", after: "2025-02-12"},
+		{text: "commits past quarter", after: "2024-12-12"},
+
+		// last week, since last sprint, before last month
+		{text: "commits last week", after: "2025-03-03", before: "2025-03-10"},
+		{text: "commits since last month", after: "2025-02-01"},
+		{text: "commits before last month", before: "2025-02-01"},
+		{text: "commits after last week", after: "2025-03-10"},
+		{text: "commits until last year", before: "2025-01-01"},
+		{text: "commits last quarter", after: "2024-10-01", before: "2025-01-01"},
+		{text: "commits since last sprint", after: "2025-02-26"},
+		{text: "commits last sprint", after: "2025-02-26", before: "2025-03-13"},
+
+		// this week, since this month
+		{text: "commits this week", after: "2025-03-10"},
+		{text: "commits before this month", before: "2025-03-01"},
+		{text: "commits during this week", after: "2025-03-10"},
+		{text: "commits in this month", after: "2025-03-01"},
+		{text: "commits since this month", after: "2025-03-01"},
+		{text: "commits until this month", before: "2025-04-01"},
+		{text: "commits until this sprint", before: "2025-03-13"},
+		{text: "commits this quarter", after: "2025-01-01"},
+		{text: "commits this year", after: "2025-01-01"},
+
+		// since yesterday, today
+		{text: "commits yesterday", after: "2025-03-11", before: "2025-03-12"},
+		{text: "commits since yesterday", after: "2025-03-11"},
+		{text: "commits today", after: "2025-03-12", before: "2025-03-13"},
+		{text: "commits before today", before: "2025-03-12"},
+
+		// since March, in May 2024, before Jan
+		{text: "commits since March", after: "2025-03-01"},
+		{text: "commits in May 2024", after: "2024-05-01", before: "2024-06-01"},
+		{text: "commits before Jan", before: "2025-01-01"},
+		{text: "commits since December", after: "2024-12-01"},
+		{text: "commits in december", after: "2024-12-01", before: "2025-01-01"},
+		{text: "commits in Dec", after: "2024-12-01", before: "2025-01-01"},
+		{text: "commits in oct 2024", after: "2024-10-01", before: "2024-11-01"},
+		{text: "commits since oct", after: "2024-10-01"},
+		{text: "commits that print numbers in dec", after: "", before: ""},
+		{text: "commits that format in oct", after: "", before: ""},
+		{text: "commits that may break in may", after: "", before: ""},
+
+		// since 2023, in 2024
+		{text: "commits since 2023", after: "2023-01-01"},
+		{text: "commits in 2024", after: "2024-01-01", before: "2025-01-01"},
+		{text: "commits before 2020", before: "2020-01-01"},
+
+		// since Monday, since last Friday
+		{text: "commits since Monday", after: "2025-03-10"},
+		{text: "commits since Wednesday", after: "2025-03-12"},
+		{text: "commits since last Wednesday", after: "2025-03-05"},
+		{text: "commits since last friday", after: "2025-03-07"},
+		{text: "commits before Monday", before: "2025-03-10"},
+
+		// Month and year boundaries.
+		{text: "commits yesterday", now: date(2025, time.March, 1), after: "2025-02-28", before: "2025-03-01"},
+		{text: "commits yesterday", now: date(2024, time.March, 1), after: "2024-02-29", before: "2024-03-01"},
+		{text: "commits yesterday", now: date(2025, time.January, 1), after: "2024-12-31", before: "2025-01-01"},
+		{text: "commits in the past month", now: date(2025, time.March, 31), after: "2025-02-28"},
+		{text: "commits in the past month", now: date(2024, time.March, 31), after: "2024-02-29"},
+		{text: "commits in the past quarter", now: date(2025, time.May, 31), after: "2025-02-28"},
+		{text: "commits in the past year", now: date(2024, time.February, 29), after: "2023-02-28"},
+		{text: "commits last month", now: date(2025, time.January, 2), after: "2024-12-01", before: "2025-01-01"},
+		{text: "commits last week", now: date(2025, time.January, 2), after: "2024-12-23", before: "2024-12-30"},
+		{text: "commits last year", now: date(2025, time.January, 2), after: "2024-01-01", before: "2025-01-01"},
+		{text: "commits last quarter", now: date(2025, time.January, 2), after: "2024-10-01", before: "2025-01-01"},
+		{text: "commits since December", now: date(2025, time.January, 2), after: "2024-12-01"},
+		{text: "commits since last sprint", now: date(2025, time.January, 5), after: "2024-12-22"},
+
+		// Weeks start on Monday, and quarters on the first of January,
+		// April, July and October.
+		{text: "commits this week", now: date(2025, time.March, 16), after: "2025-03-10"},
+		{text: "commits this week", now: date(2025, time.March, 10), after: "2025-03-10"},
+		{text: "commits this quarter", now: date(2025, time.December, 31), after: "2025-10-01"},
+		{text: "commits this quarter", now: date(2025, time.April, 1), after: "2025-04-01"},
+		{text: "commits this quarter", now: date(2025, time.June, 30), after: "2025-04-01"},
+
+		{text: "commits that fix the date parser", after: "", before: ""},
+	}
+	for _, tt := range tests {
+		now := tt.now
+		if now.IsZero() {
+			now = wednesday
+		}
+		hints, _ := findDates(tt.text, now)
+		var after, before string
+		for _, h := range hints {
+			value, err := strconv.Unquote(h.Value)
+			if err != nil || !h.Dated {
+				t.Errorf("findDates(%q) gave hint %v", tt.text, h)
+			}
+			switch h.Field {
+			case "after":
+				after = value
+			case "before":
+				before = value
+			}
+		}
+		if after != tt.after || before != tt.before {
+			t.Errorf("findDates(%q) on %s = after %q, before %q; want after %q, before %q",
+				tt.text, now.Format(dateLayout), after, before, tt.after, tt.before)
+		}
+	}
+}
+
+func TestFindDatesRemovesPhrase(t *testing.T) {
+	_, rest := findDates("commits since last sprint touching auth", date(2025, time.March, 12))
+	if rest != "commits   touching auth" {
+		t.Errorf("findDates left %q", rest)
+	}
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 9, 0, 0, 0, time.UTC)
+}
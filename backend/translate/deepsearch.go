@@ -0,0 +1,149 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+)
+
+// cleanupTimeout bounds each background conversation delete.
+const cleanupTimeout = 10 * time.Second
+
+// DeepSearch is a Backend that asks Sourcegraph Deep Search, which can look
+// at the code on the instance before answering.
+type DeepSearch struct {
+	client  *deepsearch.Client
+	cleanup bool
+	// cannotDelete is set once the instance turns out to have no delete
+	// API, so we stop trying.
+	cannotDelete atomic.Bool
+}
+
+func NewDeepSearch(client *deepsearch.Client) *DeepSearch {
+	return &DeepSearch{client: client}
+}
+
+// WithCleanup sets whether conversations are deleted from the instance once
+// answered, so they don't pile up there. It returns d for chaining.
+func (d *DeepSearch) WithCleanup(enabled bool) *DeepSearch {
+	d.cleanup = enabled
+	return d
+}
+
+func (d *DeepSearch) Ask(ctx context.Context, prompt string, progress func(Progress)) (*Answer, error) {
+	report := func(p Progress) {
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	report(Progress{Stage: "creating conversation"})
+	start := time.Now()
+	conv, err := d.client.CreateConversation(ctx, prompt)
+	observeStage(ctx, StageConversation, start)
+	if err != nil {
+		return nil, fmt.Errorf("create conversation: %w", err)
+	}
+
+	defer d.deleteConversation(ctx, conv.ID)
+	return d.wait(ctx, conv.ID, conv.Asked(prompt), report)
+}
+
+// FollowUp asks prompt in conversation, which an earlier answer came from,
+// so Deep Search sees the earlier exchange. It fails with
+// deepsearch.ErrNotFound if the conversation is gone.
+func (d *DeepSearch) FollowUp(ctx context.Context, conversation int, prompt string, progress func(Progress)) (*Answer, error) {
+	report := func(p Progress) {
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	report(Progress{Stage: "asking follow-up"})
+	start := time.Now()
+	conv, err := d.client.AddQuestion(ctx, conversation, prompt)
+	observeStage(ctx, StageConversation, start)
+	if err != nil {
+		return nil, fmt.Errorf("add question: %w", err)
+	}
+
+	defer d.deleteConversation(ctx, conversation)
+	return d.wait(ctx, conversation, conv.Asked(prompt), report)
+}
+
+// Resume waits for the answer to question in conversation, or to its
+// latest question if question is 0, which an earlier process asked but
+// stopped waiting for.
+func (d *DeepSearch) Resume(ctx context.Context, conversation, question int, progress func(Progress)) (*Answer, error) {
+	report := func(p Progress) {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	defer d.deleteConversation(ctx, conversation)
+	return d.wait(ctx, conversation, question, report)
+}
+
+// wait polls conversation until question, or its latest question if
+// question is 0, is answered.
+func (d *DeepSearch) wait(ctx context.Context, conversation, question int, report func(Progress)) (*Answer, error) {
+	maxWait := 60 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = time.Until(deadline)
+	}
+
+	report(Progress{Stage: "waiting for Deep Search", Conversation: conversation, Question: question})
+	start := time.Now()
+	answered, err := d.client.WaitForCompletion(ctx, conversation, question, maxWait, func(q deepsearch.Question) {
+		report(Progress{Stage: "waiting for Deep Search", Status: q.Status, Stats: q.Stats, Conversation: conversation, Question: q.ID})
+	})
+	observeStage(ctx, StagePolling, start)
+	if err != nil {
+		return nil, fmt.Errorf("get response: %w", err)
+	}
+
+	answer := &Answer{
+		Text:    answered.Answer,
+		Sources: NewSources(answered.Sources),
+		Stats:   answered.Stats,
+		Ref:     fmt.Sprintf("conversation %d", conversation),
+	}
+	if d.keepsConversation(ctx) {
+		answer.Conversation = conversation
+	}
+	return answer, nil
+}
+
+// keepsConversation reports whether a conversation answered for ctx stays
+// on the instance, where it can be followed up. Those of private requests,
+// as marked by deepsearch.Private, are deleted even without cleanup.
+func (d *DeepSearch) keepsConversation(ctx context.Context) bool {
+	return (!d.cleanup && !deepsearch.IsPrivate(ctx)) || d.cannotDelete.Load()
+}
+
+// deleteConversation deletes a conversation in the background, unless it is
+// kept, so the caller doesn't wait on it. This also stops Deep Search
+// working on questions the caller gave up on.
+func (d *DeepSearch) deleteConversation(ctx context.Context, id int) {
+	if d.keepsConversation(ctx) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		err := d.client.DeleteConversation(ctx, id)
+		switch {
+		case errors.Is(err, deepsearch.ErrDeleteUnsupported):
+			if d.cannotDelete.CompareAndSwap(false, true) {
+				slog.WarnContext(ctx, "Deep Search conversations can't be deleted on this instance; keeping them", "err", err)
+			}
+		case err != nil:
+			slog.ErrorContext(ctx, "Error deleting conversation", "conversation", id, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nlsearch/backend/query"
+)
+
+// ParseDefaultFilters checks that filters, such as "fork:no archived:no
+// count:50", is a list of valid filters to give every query, and returns
+// it with its whitespace normalized.
+func ParseDefaultFilters(filters string) (string, error) {
+	parsed, err := query.Parse(filters)
+	if err != nil {
+		return "", err
+	}
+	var fields []string
+	for _, tok := range parsed.Tokens {
+		if tok.Kind != query.Field || !query.KnownField(tok.Field) {
+			return "", fmt.Errorf("%q is not a filter", filters[tok.Pos:tok.End])
+		}
+		fields = append(fields, filters[tok.Pos:tok.End])
+	}
+	for _, p := range parsed.Validate() {
+		if p.Severity == query.Error {
+			return "", errors.New(p.String())
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// WithDefaultFilters returns a copy of t that adds each of filters, as
+// checked by ParseDefaultFilters, to queries that don't set its field.
+func (t *Translator) WithDefaultFilters(filters string) *Translator {
+	copy := *t
+	copy.defaultFilters = filters
+	return &copy
+}
+
+// WithDefaultFilters returns a copy of r that adds each of filters to
+// queries that don't set its field, as Translator.WithDefaultFilters.
+func (r *Rules) WithDefaultFilters(filters string) *Rules {
+	copy := *r
+	copy.defaultFilters = filters
+	return &copy
+}
+
+// addDefaultFilters appends each of filters to q unless q already has a
+// filter for its field, negated or not, which may have been the user's
+// choice, that applies to the whole query. Filters in a group, or in a
+// query with a top-level or, only apply to part of it, so q is grouped and
+// given the default. The same q and filters always give the same query. q
+// is returned as it is if it or filters doesn't parse.
+func addDefaultFilters(q, filters string) string {
+	if filters == "" {
+		return q
+	}
+	parsed, err := query.Parse(q)
+	if err != nil {
+		return q
+	}
+	defaults, err := query.Parse(filters)
+	if err != nil {
+		return q
+	}
+	for _, tok := range defaults.Tokens {
+		if tok.Kind == query.Field && len(parsed.TopLevelFields(tok.Field)) == 0 {
+			q = query.AppendFilter(q, filters[tok.Pos:tok.End])
+		}
+	}
+	return q
+}
+
+// QueryRewriter rewrites generated queries as the caller in ctx is allowed
+// them, such as a rewrite.Engine.
+type QueryRewriter interface {
+	Rewrite(ctx context.Context, q string) string
+}
+
+// WithRewriter returns a copy of t that has r rewrite its queries once
+// they are complete, before they are validated.
+func (t *Translator) WithRewriter(r QueryRewriter) *Translator {
+	copy := *t
+	copy.rewriter = r
+	return &copy
+}
+
+// WithRewriter returns a copy of rules that has r rewrite its queries, as
+// Translator.WithRewriter.
+func (r *Rules) WithRewriter(rewriter QueryRewriter) *Rules {
+	copy := *r
+	copy.rewriter = rewriter
+	return &copy
+}
+
+// rewrite has rewriter rewrite q, if there is one.
+func rewrite(ctx context.Context, rewriter QueryRewriter, q string) string {
+	if rewriter == nil {
+		return q
+	}
+	return rewriter.Rewrite(ctx, q)
+}
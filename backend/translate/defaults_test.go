@@ -0,0 +1,90 @@
+package translate
+
+import (
+	"testing"
+
+	"github.com/nlsearch/backend/query"
+)
+
+func TestParseDefaultFilters(t *testing.T) {
+	tests := []struct {
+		filters string
+		want    string
+		wantErr bool
+	}{
+		{filters: "", want: ""},
+		{filters: "fork:no  archived:no\tcount:50", want: "fork:no archived:no count:50"},
+		{filters: "r:^github\\.com/acme/ -file:_test\\.go$", want: "r:^github\\.com/acme/ -file:_test\\.go$"},
+		{filters: "fork:no needle", wantErr: true},
+		{filters: `"needle"`, wantErr: true},
+		{filters: "colour:blue", wantErr: true},
+		{filters: "fork:maybe", wantErr: true},
+		{filters: "count:lots", wantErr: true},
+		{filters: "(fork:no", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDefaultFilters(tt.filters)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseDefaultFilters(%q) = %q, want an error", tt.filters, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDefaultFilters(%q) = %q, %v, want %q", tt.filters, got, err, tt.want)
+		}
+	}
+}
+
+func TestAddDefaultFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       string
+		filters string
+		want    string
+	}{
+		{"no defaults", "needle", "", "needle"},
+		{"adds missing fields", "needle", "fork:no archived:no", "needle fork:no archived:no"},
+		{"field already set", "needle fork:yes", "fork:no archived:no", "needle fork:yes archived:no"},
+		{"negated field", "needle -repo:^github\\.com/acme/legacy$", "repo:^github\\.com/acme/", "needle -repo:^github\\.com/acme/legacy$"},
+		{"alias in query", "needle r:acme", "repo:^github\\.com/acme/", "needle r:acme"},
+		{"alias in defaults", "needle repo:acme", "r:^github\\.com/acme/", "needle repo:acme"},
+		{"language alias", "needle language:go", "lang:rust", "needle language:go"},
+		{"count already set", "needle count:100", "count:50", "needle count:100"},
+		{"count added", "needle", "count:50", "needle count:50"},
+		{"unparsable query", "needle (unclosed", "fork:no", "needle (unclosed"},
+		{"unparsable defaults", "needle", "fork:no (", "needle"},
+		{"trailing space", "needle  ", "fork:no", "needle fork:no"},
+		{"or", "foo or bar", "fork:no archived:no", "(foo or bar) fork:no archived:no"},
+		{"field in an operand", "(foo fork:yes) or bar", "fork:no archived:no", "((foo fork:yes) or bar) fork:no archived:no"},
+		{"field before or", "fork:yes foo or bar", "fork:no", "(fork:yes foo or bar) fork:no"},
+		{"field in a group", "(foo fork:yes) bar", "fork:no", "(foo fork:yes) bar fork:no"},
+		{"or in a group", "(foo or bar) fork:yes", "fork:no", "(foo or bar) fork:yes"},
+		{"not field", "needle not fork:yes", "fork:no", "needle not fork:yes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addDefaultFilters(tt.q, tt.filters)
+			if got != tt.want {
+				t.Errorf("addDefaultFilters(%q, %q) = %q, want %q", tt.q, tt.filters, got, tt.want)
+			}
+			if again := addDefaultFilters(got, tt.filters); again != got {
+				t.Errorf("addDefaultFilters is not idempotent: %q, then %q", got, again)
+			}
+		})
+	}
+}
+
+// TestDefaultCountWithMaxResults checks that a count: default gives way to
+// a request's max_results, which the server sets with query.WithFilter once
+// the query is translated.
+func TestDefaultCountWithMaxResults(t *testing.T) {
+	q := addDefaultFilters("needle", "fork:no count:50")
+	if got, want := query.WithFilter(q, "count", "10"), "needle fork:no count:10"; got != want {
+		t.Errorf("max_results over a count: default = %q, want %q", got, want)
+	}
+	q = addDefaultFilters("needle count:5", "count:50")
+	if got, want := query.WithFilter(q, "count", "10"), "needle count:10"; got != want {
+		t.Errorf("max_results over a generated count: = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// Provider is a named source of translations, such as Deep Search.
+type Provider struct {
+	Name     string
+	Strategy Strategy
+}
+
+// Ensemble asks several providers in parallel and returns the translation
+// most of them agree on. When fewer than quorum agree it still returns the
+// most popular answer, but marks it with Disagreement so automated callers
+// can hold back.
+type Ensemble struct {
+	providers []Provider
+	quorum    int
+}
+
+// NewEnsemble builds an ensemble over providers. A quorum of zero means a
+// strict majority of providers.
+func NewEnsemble(providers []Provider, quorum int) *Ensemble {
+	if quorum <= 0 {
+		quorum = len(providers)/2 + 1
+	}
+	return &Ensemble{providers: providers, quorum: quorum}
+}
+
+func (e *Ensemble) Translate(ctx context.Context, request string, progress func(Progress)) (*Translation, error) {
+	report := serialProgress(progress, func(i int) string { return e.providers[i].Name })
+
+	translations := make([]*Translation, len(e.providers))
+	errs := make([]error, len(e.providers))
+	var wg sync.WaitGroup
+	for i, provider := range e.providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			translations[i], errs[i] = provider.Strategy.Translate(ctx, request, func(p Progress) { report(i, p) })
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", provider.Name, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Count votes per normalized query, remembering the first provider to
+	// propose each so ties go to the earlier-listed provider.
+	votes := map[string]int{}
+	first := map[string]int{}
+	for i, t := range translations {
+		if errs[i] != nil {
+			continue
+		}
+		key := normalize(t.Query)
+		if _, ok := first[key]; !ok {
+			first[key] = i
+		}
+		votes[key]++
+	}
+	if len(votes) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	winner := ""
+	for key, n := range votes {
+		if winner == "" || n > votes[winner] || (n == votes[winner] && first[key] < first[winner]) {
+			winner = key
+		}
+	}
+
+	candidates := make([]Candidate, len(e.providers))
+	for i, provider := range e.providers {
+		candidates[i] = Candidate{Provider: provider.Name, Matches: -1}
+		if errs[i] != nil {
+			candidates[i].Error = errs[i].Error()
+			continue
+		}
+		candidates[i].Query = translations[i].Query
+		candidates[i].Extraction = translations[i].Extraction
+		candidates[i].Score = float64(votes[normalize(translations[i].Query)])
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+
+	chosen := *translations[first[winner]]
+	chosen.Candidates = candidates
+	chosen.Disagreement = votes[winner] < e.quorum
+	if chosen.Disagreement {
+		slog.WarnContext(ctx, "Ensemble disagreement", "query", chosen.Query, "votes", votes[winner], "providers", len(e.providers), "quorum", e.quorum)
+	}
+	return &chosen, nil
+}
@@ -0,0 +1,226 @@
+package translate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// extractionStrategy pulls a search query out of a model answer. extract
+// reports false when the answer doesn't have the shape the strategy expects,
+// so the next strategy in the pipeline gets a chance.
+type extractionStrategy struct {
+	name    string
+	extract func(answer string) (string, bool)
+}
+
+var extractionStrategies = map[string]extractionStrategy{
+	"json":      {name: "json", extract: extractJSONField},
+	"fenced":    {name: "fenced", extract: extractFencedBlock},
+	"backtick":  {name: "backtick", extract: extractBacktickedLine},
+	"last-line": {name: "last-line", extract: extractLastLine},
+}
+
+// DefaultExtractionOrder is the strategy order used when none is configured.
+var DefaultExtractionOrder = []string{"json", "fenced", "backtick", "last-line"}
+
+// Extractor runs extraction strategies in order and returns the first match.
+type Extractor struct {
+	strategies []extractionStrategy
+}
+
+// NewExtractor builds an extractor that tries the named strategies in order.
+// An empty list selects DefaultExtractionOrder.
+func NewExtractor(names []string) (*Extractor, error) {
+	if len(names) == 0 {
+		names = DefaultExtractionOrder
+	}
+	e := &Extractor{}
+	for _, name := range names {
+		s, ok := extractionStrategies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown extraction strategy %q", name)
+		}
+		e.strategies = append(e.strategies, s)
+	}
+	return e, nil
+}
+
+// Extract returns the query and the name of the strategy that produced it.
+// If no strategy matches, the trimmed answer is returned with strategy "none".
+func (e *Extractor) Extract(answer string) (query, strategy string) {
+	query, strategy, _ = e.extract(answer)
+	return query, strategy
+}
+
+// extract is Extract, also returning the strategies tried before the one
+// that matched, which found nothing.
+func (e *Extractor) extract(answer string) (query, strategy string, missed []string) {
+	for _, s := range e.strategies {
+		if q, ok := s.extract(answer); ok && q != "" {
+			return q, s.name, missed
+		}
+		missed = append(missed, s.name)
+	}
+	return strings.TrimSpace(answer), "none", append(missed, "none")
+}
+
+// extractJSONField handles answers that contain a JSON object with a "query"
+// field, optionally surrounded by prose.
+func extractJSONField(answer string) (string, bool) {
+	start := strings.Index(answer, "{")
+	end := strings.LastIndex(answer, "}")
+	if start < 0 || end < start {
+		return "", false
+	}
+	var v struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &v); err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(v.Query), v.Query != ""
+}
+
+// queryLanguageHints are fence info strings that mark a block as holding a
+// search query. Blocks tagged with anything else (go, python, ...) are code
+// samples and only used when nothing better is available.
+var queryLanguageHints = map[string]bool{
+	"":            true,
+	"sourcegraph": true,
+	"sg":          true,
+	"sgquery":     true,
+	"query":       true,
+	"search":      true,
+	"text":        true,
+	"plaintext":   true,
+	"txt":         true,
+}
+
+type fencedBlock struct {
+	language string
+	content  string
+}
+
+// extractFencedBlock returns the contents of the best fenced code block in the
+// answer. Blocks with a query-like language hint win over other blocks, and
+// later blocks win over earlier ones, since models tend to put the final
+// answer last. The fence's language tag is never part of the result.
+func extractFencedBlock(answer string) (string, bool) {
+	blocks := parseFencedBlocks(answer)
+
+	var best *fencedBlock
+	for i := range blocks {
+		b := &blocks[i]
+		if b.content == "" {
+			continue
+		}
+		if best == nil || queryLanguageHints[b.language] || !queryLanguageHints[best.language] {
+			best = b
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.content, true
+}
+
+// parseFencedBlocks finds CommonMark-style fenced code blocks opened by three
+// or more backticks or tildes. The first word of the info string is taken as
+// the language. An unterminated block runs to the end of the answer, which
+// covers truncated model output. A fence opened and closed on the same line
+// ("```lang:go TODO```") is treated as a one-line block.
+func parseFencedBlocks(answer string) []fencedBlock {
+	var blocks []fencedBlock
+	lines := strings.Split(answer, "\n")
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		fence := fencePrefix(line)
+		if fence == "" {
+			continue
+		}
+		info := strings.TrimSpace(line[len(fence):])
+
+		if inline, ok := strings.CutSuffix(info, fence); ok && fence[0] == '`' && inline != "" {
+			blocks = append(blocks, fencedBlock{content: strings.TrimSpace(inline)})
+			continue
+		}
+
+		language := ""
+		if fields := strings.Fields(info); len(fields) > 0 {
+			language = strings.ToLower(fields[0])
+		}
+
+		var body []string
+		for i++; i < len(lines); i++ {
+			closing := strings.TrimSpace(lines[i])
+			if f := fencePrefix(closing); f != "" && f[0] == fence[0] && len(f) >= len(fence) && strings.TrimSpace(closing[len(f):]) == "" {
+				break
+			}
+			if content := strings.TrimSpace(lines[i]); content != "" {
+				body = append(body, content)
+			}
+		}
+		// Sourcegraph queries are a single line; join wrapped content.
+		blocks = append(blocks, fencedBlock{language: language, content: strings.Join(body, " ")})
+	}
+	return blocks
+}
+
+// fencePrefix returns the run of three or more backticks or tildes that line
+// starts with, or "" if it is not a fence.
+func fencePrefix(line string) string {
+	if len(line) < 3 || (line[0] != '`' && line[0] != '~') {
+		return ""
+	}
+	n := 0
+	for n < len(line) && line[n] == line[0] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	return line[:n]
+}
+
+// extractBacktickedLine returns the last line that is entirely wrapped in
+// single backticks, e.g. "`lang:go TODO`".
+func extractBacktickedLine(answer string) (string, bool) {
+	lines := strings.Split(answer, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if len(line) > 2 && strings.HasPrefix(line, "`") && strings.HasSuffix(line, "`") && !strings.HasPrefix(line, "``") {
+			return strings.TrimSpace(line[1 : len(line)-1]), true
+		}
+	}
+	return "", false
+}
+
+// extractLastLine is the original heuristic: prefer the last line that looks
+// like it contains a filter, skipping obvious prose and fence markers,
+// otherwise take the last line. It only fails on an empty answer.
+func extractLastLine(answer string) (string, bool) {
+	lines := strings.Split(strings.TrimSpace(answer), "\n")
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || fencePrefix(line) != "" {
+			continue
+		}
+		if strings.Contains(line, ":") && !strings.HasPrefix(line, "For ") && !strings.HasPrefix(line, "Based ") {
+			return unquote(strings.Trim(line, "`")), true
+		}
+	}
+
+	line := strings.TrimSpace(lines[len(lines)-1])
+	line = unquote(strings.Trim(line, "`"))
+	return line, line != ""
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && ((s[0] == '"' && s[len(s)-1] == '"') || (s[0] == '\'' && s[len(s)-1] == '\'')) {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
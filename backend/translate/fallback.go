@@ -0,0 +1,101 @@
+package translate
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/deepsearch"
+)
+
+// NamedBackend is a Backend with a name for logs.
+type NamedBackend struct {
+	Name    string
+	Backend Backend
+}
+
+// Fallback is a Backend that tries backends in order, moving on when one is
+// not available on the instance (its API answers 404). An unavailable backend
+// is skipped for a while instead of being probed on every request.
+type Fallback struct {
+	backends []NamedBackend
+
+	mu          sync.Mutex
+	unavailable map[string]time.Time // name -> when to try again
+}
+
+// unavailableRecheck is how long a backend that answered 404 is skipped.
+const unavailableRecheck = 10 * time.Minute
+
+func NewFallback(backends ...NamedBackend) *Fallback {
+	return &Fallback{backends: backends, unavailable: map[string]time.Time{}}
+}
+
+func (f *Fallback) Ask(ctx context.Context, prompt string, progress func(Progress)) (*Answer, error) {
+	candidates := f.available(time.Now())
+	var lastErr error
+	for i, b := range candidates {
+		answer, err := b.Backend.Ask(ctx, prompt, progress)
+		if err == nil || !isUnavailable(err) {
+			return answer, err
+		}
+		lastErr = err
+		f.markUnavailable(b.Name, time.Now())
+		if i < len(candidates)-1 {
+			observeQuality(ctx, QualityHeuristic, HeuristicProviderFallback)
+			slog.WarnContext(ctx, "Translation provider is not available on this instance; falling back", "provider", b.Name, "fallback", candidates[i+1].Name, "err", err)
+		}
+	}
+	return nil, lastErr
+}
+
+// FollowUp follows up with the first backend that can, since only a
+// backend that keeps conversations can have answered in one.
+func (f *Fallback) FollowUp(ctx context.Context, conversation int, prompt string, progress func(Progress)) (*Answer, error) {
+	for _, b := range f.backends {
+		if fb, ok := b.Backend.(FollowUpBackend); ok {
+			return fb.FollowUp(ctx, conversation, prompt, progress)
+		}
+	}
+	return nil, ErrCannotFollowUp
+}
+
+// Resume resumes with the first backend that can, since only a backend
+// that keeps conversations can have been waiting on one.
+func (f *Fallback) Resume(ctx context.Context, conversation, question int, progress func(Progress)) (*Answer, error) {
+	for _, b := range f.backends {
+		if rb, ok := b.Backend.(ResumableBackend); ok {
+			return rb.Resume(ctx, conversation, question, progress)
+		}
+	}
+	return nil, ErrCannotResume
+}
+
+// available returns the backends not recently found unavailable, or all of
+// them if every one was, so the instance is re-probed rather than given up on.
+func (f *Fallback) available(now time.Time) []NamedBackend {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []NamedBackend
+	for _, b := range f.backends {
+		if until, ok := f.unavailable[b.Name]; !ok || now.After(until) {
+			out = append(out, b)
+		}
+	}
+	if len(out) == 0 {
+		return f.backends
+	}
+	return out
+}
+
+func (f *Fallback) markUnavailable(name string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unavailable[name] = now.Add(unavailableRecheck)
+}
+
+func isUnavailable(err error) bool {
+	return errors.Is(err, deepsearch.ErrNotFound)
+}
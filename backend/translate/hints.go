@@ -0,0 +1,327 @@
+package translate
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nlsearch/backend/query"
+)
+
+// Hints are the parts of a request whose meaning is unambiguous without a
+// language model: quoted strings, filters written in query syntax,
+// repository URLs, file extensions, dates relative to today, and the names
+// of languages and of frameworks written in only one. They are merged into
+// generated queries so the model can't drop them, and seed the rule-based
+// translator.
+type Hints struct {
+	Filters []Hint
+	// Patterns are quoted strings from the request, with their quotes.
+	Patterns []string
+}
+
+// Hint is one filter found in a request.
+type Hint struct {
+	Field string
+	Value string
+	// Explicit is set when the user wrote the filter in query syntax,
+	// including any leading "-" in Field, so it overrides the model's.
+	Explicit bool
+	// Dated is set for after: and before: filters worked out from a date
+	// relative to today, such as "last month". They replace the model's,
+	// which can only guess today's date, in commit and diff searches, the
+	// only ones dates apply to.
+	Dated bool
+}
+
+func (h Hint) String() string {
+	return h.Field + ":" + h.Value
+}
+
+var (
+	quotedPattern    = regexp.MustCompile("\"([^\"]+)\"|`([^`]+)`")
+	filterPattern    = regexp.MustCompile(`(?:^|\s)((-?[a-zA-Z.]+):(\S+))`)
+	repoURLPattern   = regexp.MustCompile(`(?i)(?:https?://)?((?:github\.com|gitlab\.com|bitbucket\.org)/[\w-]+(?:\.[\w-]+)*/[\w-]+(?:\.[\w-]+)*)\S*`)
+	repoNamePattern  = regexp.MustCompile(`(?i)\b(?:in|from) (?:the )?([\w.-]+/[\w.-]+) (?:repo|repository)\b|\b(?:repo|repository) ([\w.-]+/[\w.-]+)`)
+	extensionPattern = regexp.MustCompile(`(?i)(?:^|\s)\*?\.([a-z0-9]{1,10}) files?\b`)
+	// extensionMention matches extensions mentioned other than as ".ext
+	// files", e.g. "TODOs in *.py".
+	extensionMention = regexp.MustCompile(`(?i)(?:^|\s)\*?\.([a-z0-9]{1,10})\b`)
+)
+
+// languages maps words people use for languages to lang: values.
+var languages = map[string]string{
+	"go": "go", "golang": "go",
+	"python":     "python",
+	"javascript": "javascript", "js": "javascript",
+	"typescript": "typescript", "ts": "typescript",
+	"java": "java", "kotlin": "kotlin", "scala": "scala", "groovy": "groovy",
+	"rust": "rust", "ruby": "ruby", "php": "php", "perl": "perl", "lua": "lua",
+	"c": "c", "c++": "c++", "cpp": "c++", "c#": "c#", "csharp": "c#",
+	"swift": "swift", "objective-c": "objective-c", "dart": "dart",
+	"haskell": "haskell", "elixir": "elixir", "erlang": "erlang", "clojure": "clojure",
+	"ocaml": "ocaml", "f#": "f#", "r": "r", "julia": "julia", "zig": "zig",
+	"shell": "shell", "bash": "shell", "powershell": "powershell",
+	"sql": "sql", "graphql": "graphql", "html": "html", "css": "css", "scss": "scss",
+	"yaml": "yaml", "json": "json", "markdown": "markdown", "dockerfile": "dockerfile",
+	"terraform": "hcl", "hcl": "hcl", "nix": "nix", "vue": "vue", "svelte": "svelte",
+	"solidity": "solidity",
+}
+
+// extensionLanguages maps file extensions, without the dot, to the lang:
+// value of the language files with them are in.
+var extensionLanguages = map[string]string{
+	"go": "go", "py": "python", "js": "javascript", "jsx": "javascript", "mjs": "javascript",
+	"ts": "typescript", "java": "java", "kt": "kotlin", "kts": "kotlin", "scala": "scala",
+	"groovy": "groovy", "rs": "rust", "rb": "ruby", "php": "php", "pl": "perl", "lua": "lua",
+	"c": "c", "cc": "c++", "cpp": "c++", "cxx": "c++", "hpp": "c++", "cs": "c#",
+	"swift": "swift", "dart": "dart", "hs": "haskell", "ex": "elixir", "exs": "elixir",
+	"erl": "erlang", "clj": "clojure", "ml": "ocaml", "fs": "f#", "jl": "julia", "zig": "zig",
+	"sh": "shell", "bash": "shell", "ps1": "powershell", "sql": "sql", "graphql": "graphql",
+	"html": "html", "css": "css", "scss": "scss", "yaml": "yaml", "yml": "yaml", "json": "json",
+	"md": "markdown", "tf": "hcl", "hcl": "hcl", "nix": "nix", "vue": "vue", "svelte": "svelte",
+	"sol": "solidity",
+}
+
+// frameworkLanguages maps frameworks and libraries whose users all write
+// one language to its lang: value. Ones that are used from several
+// languages, such as react, or that are common English words, such as
+// express or spring, are left out; the less common ones are listed in
+// ambiguousFrameworks.
+var frameworkLanguages = map[string]string{
+	"django": "python", "flask": "python", "fastapi": "python", "pytest": "python",
+	"numpy": "python", "pandas": "python", "pytorch": "python",
+	"rails": "ruby", "sinatra": "ruby", "rspec": "ruby",
+	"laravel": "php", "symfony": "php", "wordpress": "php",
+	"junit": "java", "ktor": "kotlin",
+	"angular": "typescript", "nestjs": "typescript", "jquery": "javascript",
+	"actix": "rust", "tokio": "rust",
+	"phoenix": "elixir", "flutter": "dart", "swiftui": "swift",
+	"asp.net": "c#", "blazor": "c#",
+}
+
+// ambiguousLanguages are also ordinary English words, or data formats code
+// in any language handles ("parse JSON"), so they only count as languages
+// next to a word that says so: "in go", "rust code", "yaml files".
+var ambiguousLanguages = map[string]bool{
+	"go": true, "c": true, "r": true, "shell": true,
+	"rust": true, "swift": true, "dart": true,
+	"json": true, "yaml": true, "html": true, "css": true, "sql": true,
+	"markdown": true, "graphql": true, "dockerfile": true,
+}
+
+var languageBefore = wordSet("in using written")
+
+// ambiguousFrameworks are also English words ("rails on the deck", "pandas
+// at the zoo"), so they only count as frameworks when capitalised past the
+// first word, or next to a word that says so: "in flask", "rails app".
+var ambiguousFrameworks = wordSet("rails flask phoenix pandas angular flutter")
+
+var frameworkAfter = wordSet("app apps application applications project projects code controller controllers model models view views route routes dataframe dataframes widget widgets component components plugin plugins")
+
+var languageAfter = wordSet("code files file source sources program programs project projects repo repos repositories tests modules module packages package functions function methods structs interfaces classes")
+
+// ExtractHints finds the hints in request, working out dates relative to
+// today in the time zone of ctx.
+func ExtractHints(ctx context.Context, request string) Hints {
+	h, _ := extractHints(request, now(ctx))
+	return h
+}
+
+// extractHints also returns what is left of request once the hints are
+// removed, for the rule-based translator to read further. Dates are worked
+// out relative to now.
+func extractHints(request string, now time.Time) (Hints, string) {
+	var h Hints
+	have := map[string]bool{}
+	add := func(hint Hint) {
+		if !hint.Explicit && have[hint.Field] {
+			return
+		}
+		have[strings.TrimPrefix(hint.Field, "-")] = true
+		h.Filters = append(h.Filters, hint)
+	}
+
+	rest := quotedPattern.ReplaceAllStringFunc(request, func(m string) string {
+		h.Patterns = append(h.Patterns, `"`+strings.Trim(m, "\"`")+`"`)
+		return " "
+	})
+	rest = filterPattern.ReplaceAllStringFunc(rest, func(m string) string {
+		sub := filterPattern.FindStringSubmatch(m)
+		if !query.KnownField(strings.TrimPrefix(sub[2], "-")) {
+			return m
+		}
+		add(Hint{Field: strings.ToLower(sub[2]), Value: sub[3], Explicit: true})
+		return " "
+	})
+	rest = repoURLPattern.ReplaceAllStringFunc(rest, func(m string) string {
+		repo := strings.TrimSuffix(repoURLPattern.FindStringSubmatch(m)[1], ".git")
+		add(Hint{Field: "repo", Value: "^" + regexp.QuoteMeta(repo) + "$"})
+		return " "
+	})
+	rest = repoNamePattern.ReplaceAllStringFunc(rest, func(m string) string {
+		sub := repoNamePattern.FindStringSubmatch(m)
+		add(Hint{Field: "repo", Value: regexp.QuoteMeta(sub[1] + sub[2])})
+		return " "
+	})
+	rest = extensionPattern.ReplaceAllStringFunc(rest, func(m string) string {
+		ext := extensionPattern.FindStringSubmatch(m)[1]
+		add(Hint{Field: "file", Value: `\.` + strings.ToLower(ext) + "$"})
+		return " "
+	})
+	var dates []Hint
+	dates, rest = findDates(rest, now)
+	for _, hint := range dates {
+		add(hint)
+	}
+
+	if !have["lang"] && !have["language"] {
+		rest = extensionMention.ReplaceAllStringFunc(rest, func(m string) string {
+			lang, ok := extensionLanguages[strings.ToLower(extensionMention.FindStringSubmatch(m)[1])]
+			if !ok {
+				return m
+			}
+			add(Hint{Field: "lang", Value: lang})
+			return " "
+		})
+	}
+	if !have["lang"] && !have["language"] {
+		words := strings.Fields(rest)
+		if i, lang := findLanguage(words); i >= 0 {
+			add(Hint{Field: "lang", Value: lang})
+			rest = strings.Join(append(words[:i:i], words[i+1:]...), " ")
+		} else if lang := findFramework(words); lang != "" {
+			// The framework's name is left in rest, as it is worth
+			// searching for too.
+			add(Hint{Field: "lang", Value: lang})
+		}
+	}
+	return h, rest
+}
+
+// findFramework returns the lang: value of the first word naming a
+// framework, or "".
+func findFramework(words []string) string {
+	lower := make([]string, len(words))
+	for i, w := range words {
+		lower[i] = strings.ToLower(trimWord(w))
+	}
+	for i, w := range lower {
+		lang, ok := frameworkLanguages[w]
+		if !ok {
+			continue
+		}
+		if !ambiguousFrameworks[w] ||
+			i > 0 && unicode.IsUpper([]rune(trimWord(words[i]))[0]) ||
+			i > 0 && languageBefore[lower[i-1]] ||
+			i+1 < len(lower) && (frameworkAfter[lower[i+1]] || languageAfter[lower[i+1]]) {
+			return lang
+		}
+	}
+	return ""
+}
+
+// findLanguage returns the index of the first word naming a language, and
+// its lang: value, or -1.
+func findLanguage(words []string) (int, string) {
+	lower := make([]string, len(words))
+	for i, w := range words {
+		lower[i] = strings.ToLower(trimWord(w))
+	}
+	for i, w := range lower {
+		lang, ok := languages[w]
+		if !ok {
+			continue
+		}
+		if !ambiguousLanguages[w] ||
+			i > 0 && languageBefore[lower[i-1]] ||
+			i+1 < len(lower) && languageAfter[lower[i+1]] {
+			return i, lang
+		}
+	}
+	return -1, ""
+}
+
+// Merge adds the hints that q is missing and returns the result, along with
+// the hints it added. Filters the user wrote, and dates in commit and diff
+// searches, replace the model's for the same field; other hints are only
+// added when q has no filter for the field.
+// Quoted strings are added unless a pattern in q already contains them. q is returned
+// unchanged if it doesn't parse.
+func (h Hints) Merge(q string) (string, []string) {
+	parsed, err := query.Parse(q)
+	if err != nil {
+		return q, nil
+	}
+
+	var added []string
+	for _, hint := range h.Filters {
+		if hint.Dated && !isCommitSearch(parsed) {
+			continue
+		}
+		field := strings.TrimPrefix(hint.Field, "-")
+		negated := field != hint.Field
+		var existing []query.Token
+		for _, t := range parsed.Fields(field) {
+			if t.Negated == negated {
+				existing = append(existing, t)
+			}
+		}
+		if hasValue(existing, hint.Value) || len(existing) > 0 && !hint.Explicit && !hint.Dated {
+			continue
+		}
+		if negated || len(existing) == 0 {
+			q = strings.TrimRight(q, " \t\n") + " " + hint.String()
+		} else {
+			q = query.WithFilter(q, field, hint.Value)
+		}
+		added = append(added, hint.String())
+		if parsed, err = query.Parse(q); err != nil {
+			return q, added
+		}
+	}
+
+	for _, p := range h.Patterns {
+		if hasPattern(parsed.Patterns(), strings.Trim(p, `"`)) {
+			continue
+		}
+		q = strings.TrimRight(q, " \t\n") + " " + p
+		added = append(added, p)
+	}
+	return strings.TrimSpace(q), added
+}
+
+// hasPattern reports whether a single pattern contains text, as a quoted
+// string or regexp would. Matching words spread across several patterns
+// doesn't count: they no longer have to appear together.
+func hasPattern(patterns []query.Token, text string) bool {
+	text = strings.ToLower(text)
+	for _, t := range patterns {
+		if strings.Contains(strings.ToLower(t.Value), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCommitSearch reports whether q searches commits or diffs.
+func isCommitSearch(q *query.Query) bool {
+	for _, t := range q.Fields("type") {
+		if !t.Negated && (t.Value == "commit" || t.Value == "diff") {
+			return true
+		}
+	}
+	return false
+}
+
+func hasValue(tokens []query.Token, value string) bool {
+	value = strings.Trim(value, `"`)
+	for _, t := range tokens {
+		if strings.EqualFold(t.Value, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package translate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindLanguage(t *testing.T) {
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"python scripts that parse logs", "python"},
+		{"error handling in go", "go"},
+		{"go to the login page", ""},
+		{"make the cache eviction swift", ""},
+		{"swift code for networking", "swift"},
+		{"retry loops written in rust", "rust"},
+		{"remove rust from the old pipeline", ""},
+		{"dart files with widgets", "dart"},
+		{"dart board scoring", ""},
+	}
+	for _, tt := range tests {
+		_, got := findLanguage(strings.Fields(tt.request))
+		if got != tt.want {
+			t.Errorf("findLanguage(%q) = %q, want %q", tt.request, got, tt.want)
+		}
+	}
+}
+
+func TestFindFramework(t *testing.T) {
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"django views that return json", "python"},
+		{"where we configure tokio runtimes", "rust"},
+		{"rails app controllers", "ruby"},
+		{"authentication in Rails", "ruby"},
+		{"routes using flask", "python"},
+		{"flask app factory", "python"},
+		{"group by in pandas", "python"},
+		{"code that draws rails and guards", ""},
+		{"convert the flask of water", ""},
+		{"pandas eating bamboo", ""},
+		{"phoenix rising from the ashes", ""},
+		{"angular momentum calculations", ""},
+		{"flutter widgets with state", "dart"},
+	}
+	for _, tt := range tests {
+		if got := findFramework(strings.Fields(tt.request)); got != tt.want {
+			t.Errorf("findFramework(%q) = %q, want %q", tt.request, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package translate
+
+import (
+	"strings"
+)
+
+// Intent is what a natural language request asks for.
+type Intent string
+
+const (
+	// IntentSearch asks for code, to be found with a search query.
+	IntentSearch Intent = "search"
+	// IntentQuestion asks about the code, such as how something works,
+	// which a search query can't answer.
+	IntentQuestion Intent = "question"
+)
+
+// searchOpenings start requests for code, even when phrased as questions,
+// such as "which repos use gRPC?".
+var searchOpenings = []string{
+	"find", "search", "show", "list", "get", "look for", "grep", "locate",
+	"all ", "every", "files", "repos", "repositories", "commits", "diffs",
+	"which", "where", "what files", "what repos", "what repositories",
+	"what code", "what functions", "what commits", "who changed", "who wrote",
+}
+
+// questionOpenings start questions about the code.
+var questionOpenings = []string{
+	"why", "how does", "how do", "how is", "how are", "how can", "how should",
+	"how would", "explain", "describe", "summarize", "summarise",
+	"walk me through", "tell me", "what does", "what is",
+	"what's", "what are", "what happens", "is there a reason", "is it",
+	"does ", "do we", "should", "when should", "when does", "what would",
+}
+
+// ClassifyIntent guesses whether request asks for code or about it, from
+// how it opens: requests to find or list things, and questions about which
+// or where things are, are searches; why and how questions, and requests
+// to explain, are questions. Anything else is a search unless it ends in a
+// question mark.
+func ClassifyIntent(request string) Intent {
+	r := strings.ToLower(strings.TrimSpace(request))
+	for _, prefix := range []string{"please ", "can you ", "could you "} {
+		r = strings.TrimPrefix(r, prefix)
+	}
+	for _, opening := range searchOpenings {
+		if strings.HasPrefix(r, opening) {
+			return IntentSearch
+		}
+	}
+	for _, opening := range questionOpenings {
+		if strings.HasPrefix(r, opening) {
+			return IntentQuestion
+		}
+	}
+	if strings.HasSuffix(r, "?") {
+		return IntentQuestion
+	}
+	return IntentSearch
+}
@@ -0,0 +1,53 @@
+package translate
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Prompt is a prompt template that can be replaced while translations are
+// running, such as one loaded from a file that is being edited. Each
+// translation uses the template that was current when it started.
+type Prompt struct {
+	template atomic.Pointer[string]
+}
+
+// NewPrompt returns a Prompt holding template, which must pass
+// ValidatePrompt.
+func NewPrompt(template string) (*Prompt, error) {
+	p := &Prompt{}
+	if err := p.Set(template); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Set replaces the template. An invalid template is rejected and the
+// current one kept.
+func (p *Prompt) Set(template string) error {
+	if err := ValidatePrompt(template); err != nil {
+		return err
+	}
+	p.template.Store(&template)
+	return nil
+}
+
+// String returns the current template.
+func (p *Prompt) String() string {
+	return *p.template.Load()
+}
+
+// ValidatePrompt checks that template has exactly one %s, where the
+// request goes, and no other formatting verbs; a literal percent sign is
+// written %%.
+func ValidatePrompt(template string) error {
+	if strings.Count(template, "%s") != 1 {
+		return errors.New("prompt template must contain %s exactly once, where the request goes")
+	}
+	rest := strings.ReplaceAll(strings.Replace(template, "%s", "", 1), "%%", "")
+	if strings.Contains(rest, "%") {
+		return errors.New("prompt template may only contain the %s verb; write a literal percent sign as %%")
+	}
+	return nil
+}
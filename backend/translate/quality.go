@@ -0,0 +1,68 @@
+package translate
+
+import (
+	"context"
+
+	"github.com/nlsearch/backend/query"
+)
+
+// Quality events reported to a quality observer, each with a label that
+// says more. Together they show how often the model's answers needed
+// rescuing.
+const (
+	// QualityExtractionMiss means the extraction strategy named by the
+	// label found no query in an answer. The label is "none" when no
+	// strategy did, and the whole answer was taken as the query.
+	QualityExtractionMiss = "extraction_miss"
+	// QualityValidation means an extracted query was validated, with the
+	// label "valid", "warning" when only warnings were found, or "rejected"
+	// when it has errors.
+	QualityValidation = "validation"
+	// QualityHeuristic means a fallback heuristic fired, named by the
+	// label, such as HeuristicRestoredFilters.
+	QualityHeuristic = "heuristic"
+)
+
+// Fallback heuristics reported as QualityHeuristic.
+const (
+	// HeuristicRestoredFilters: filters the request asked for were put
+	// back into a query that dropped them.
+	HeuristicRestoredFilters = "restored_filters"
+	// HeuristicResolvedRepos: repo: filters naming a repository partly or
+	// wrongly were replaced with its exact name.
+	HeuristicResolvedRepos = "resolved_repos"
+	// HeuristicProviderFallback: a provider wasn't available, and the next
+	// one was asked.
+	HeuristicProviderFallback = "provider_fallback"
+	// HeuristicOffline: every provider failed, and the query was made by
+	// the rule-based translator.
+	HeuristicOffline = "offline"
+)
+
+type qualityObserverKey struct{}
+
+// WithQualityObserver returns a context in which translations call observe
+// with each quality event, e.g. to export counters.
+func WithQualityObserver(ctx context.Context, observe func(event, label string)) context.Context {
+	return context.WithValue(ctx, qualityObserverKey{}, observe)
+}
+
+// observeQuality reports event to the observer in ctx, if there is one.
+func observeQuality(ctx context.Context, event, label string) {
+	if observe, ok := ctx.Value(qualityObserverKey{}).(func(string, string)); ok {
+		observe(event, label)
+	}
+}
+
+// validationResult labels a query's validation problems for
+// QualityValidation.
+func validationResult(problems []query.Problem) string {
+	switch {
+	case query.HasErrors(problems):
+		return "rejected"
+	case len(problems) > 0:
+		return "warning"
+	default:
+		return "valid"
+	}
+}
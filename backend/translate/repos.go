@@ -0,0 +1,153 @@
+package translate
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/nlsearch/backend/query"
+)
+
+// RepoResolver lists the repositories on the instance whose names contain
+// a name, such as a sourcegraph.RepoCache.
+type RepoResolver interface {
+	Repositories(ctx context.Context, name string) ([]string, error)
+}
+
+// WithRepoResolver returns a copy of t that checks the repo: filters of its
+// queries against the repositories r knows, and replaces those naming a
+// repository partly, or by a path it doesn't have, with the exact name of
+// the one repository they can mean.
+func (t *Translator) WithRepoResolver(r RepoResolver) *Translator {
+	copy := *t
+	copy.repos = r
+	return &copy
+}
+
+// WithRepoScope returns a copy of t that limits queries saying nothing of
+// which repositories to search to those whose names start with prefix,
+// such as github.com/acme-corp/.
+func (t *Translator) WithRepoScope(prefix string) *Translator {
+	copy := *t
+	copy.repoScope = prefix
+	return &copy
+}
+
+// scopeRepos adds a repo: filter for the repositories whose names start
+// with prefix to q, unless prefix is empty or q already says which
+// repositories the whole query searches with a repo: or context: filter.
+// Filters in a group, or in a query with a top-level or, only apply to
+// part of it, so they don't count. Filters the user named are already in
+// q, restored by Hints.Merge. q is returned as it is if it doesn't parse.
+func scopeRepos(q, prefix string) string {
+	parsed, err := query.Parse(q)
+	if prefix == "" || err != nil {
+		return q
+	}
+	for _, tok := range append(parsed.TopLevelFields("repo"), parsed.TopLevelFields("context")...) {
+		if !tok.Negated {
+			return q
+		}
+	}
+	return query.AppendFilter(q, "repo:^"+regexp.QuoteMeta(prefix))
+}
+
+// escapedPunctuation matches the escapes of characters that may appear in
+// repository names.
+var escapedPunctuation = regexp.MustCompile(`\\([./-])`)
+
+// literalRepo returns the repository name a repo: filter value spells out,
+// with any anchors and escapes removed, and the @revision after it, if it
+// is a name rather than a pattern.
+func literalRepo(value string) (string, string, bool) {
+	name, rev, _ := strings.Cut(value, "@")
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "^"), "$")
+	name = escapedPunctuation.ReplaceAllString(name, "$1")
+	if name == "" || strings.ContainsAny(name, `\^$*+?()[]{}|`) {
+		return "", "", false
+	}
+	return name, rev, true
+}
+
+// resolveRepos replaces the repo: filters of q that resolveRepo can resolve
+// with their repository's exact name. Filters the user wrote in hints are
+// left as they are, and so is q if a lookup fails.
+func (t *Translator) resolveRepos(ctx context.Context, q string, hints Hints) string {
+	parsed, err := query.Parse(q)
+	if t.repos == nil || err != nil {
+		return q
+	}
+	filters := parsed.Fields("repo")
+	var resolved []string
+	// Replacing from the end keeps the offsets of earlier filters valid.
+	for i := len(filters) - 1; i >= 0; i-- {
+		filter := filters[i]
+		name, rev, ok := literalRepo(filter.Value)
+		if filter.Negated || !ok || hints.explicit("repo", filter.Value) {
+			continue
+		}
+		repo, err := resolveRepo(ctx, t.repos, name)
+		if err != nil {
+			slog.WarnContext(ctx, "Could not look up the repositories the query names", "repo", name, "err", err)
+			return q
+		}
+		value := "^" + regexp.QuoteMeta(repo) + "$"
+		if rev != "" {
+			value += "@" + rev
+		}
+		if repo == "" || value == filter.Value {
+			continue
+		}
+		q = q[:filter.Pos] + "repo:" + value + q[filter.End:]
+		resolved = append(resolved, repo)
+	}
+	if len(resolved) > 0 {
+		slog.InfoContext(ctx, "Resolved repositories in the query", "repos", strings.Join(resolved, " "))
+		observeQuality(ctx, QualityHeuristic, HeuristicResolvedRepos)
+	}
+	return q
+}
+
+// resolveRepo returns the repository name means: the one whose name is
+// name, ends with it, such as github.com/acme/widgets for acme/widgets or
+// widgets, or else the one with the same last part, for names whose host
+// or owner the model made up. It returns "" if no repository or several
+// fit, leaving the choice to the user.
+func resolveRepo(ctx context.Context, r RepoResolver, name string) (string, error) {
+	base := path.Base(name)
+	repos, err := r.Repositories(ctx, base)
+	if err != nil {
+		return "", err
+	}
+	var suffixed, sameBase []string
+	for _, repo := range repos {
+		lower := strings.ToLower(repo)
+		switch {
+		case lower == strings.ToLower(name):
+			return repo, nil
+		case strings.HasSuffix(lower, "/"+strings.ToLower(name)):
+			suffixed = append(suffixed, repo)
+		case strings.EqualFold(path.Base(repo), base):
+			sameBase = append(sameBase, repo)
+		}
+	}
+	switch {
+	case len(suffixed) == 1:
+		return suffixed[0], nil
+	case len(suffixed) == 0 && len(sameBase) == 1:
+		return sameBase[0], nil
+	}
+	return "", nil
+}
+
+// explicit reports whether the user wrote field:value in query syntax.
+func (h Hints) explicit(field, value string) bool {
+	for _, hint := range h.Filters {
+		if hint.Explicit && hint.Field == field && hint.Value == value {
+			return true
+		}
+	}
+	return false
+}
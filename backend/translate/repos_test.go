@@ -0,0 +1,32 @@
+package translate
+
+import "testing"
+
+func TestScopeRepos(t *testing.T) {
+	const scope = `repo:^github\.com/acme/`
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"auth", "auth " + scope},
+		{"auth ", "auth " + scope},
+		{`auth repo:^github\.com/x/y$`, `auth repo:^github\.com/x/y$`},
+		{"auth context:global", "auth context:global"},
+		{`auth -repo:^github\.com/x/y$`, `auth -repo:^github\.com/x/y$ ` + scope},
+		{`auth not repo:^github\.com/x/y$`, `auth not repo:^github\.com/x/y$ ` + scope},
+		{"foo or bar", "(foo or bar) " + scope},
+		{`repo:^github\.com/x/y$ foo or bar`, `(repo:^github\.com/x/y$ foo or bar) ` + scope},
+		{`(repo:^github\.com/x/y$ foo) or bar`, `((repo:^github\.com/x/y$ foo) or bar) ` + scope},
+		{`(repo:^github\.com/x/y$ foo) bar`, `(repo:^github\.com/x/y$ foo) bar ` + scope},
+		{`(foo or bar) repo:^github\.com/x/y$`, `(foo or bar) repo:^github\.com/x/y$`},
+		{"(auth", "(auth"},
+	}
+	for _, tt := range tests {
+		if got := scopeRepos(tt.q, "github.com/acme/"); got != tt.want {
+			t.Errorf("scopeRepos(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+	if got := scopeRepos("foo or bar", ""); got != "foo or bar" {
+		t.Errorf("scopeRepos without a prefix = %q, want it unchanged", got)
+	}
+}
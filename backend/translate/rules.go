@@ -0,0 +1,219 @@
+package translate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// RulesExtraction is the Extraction reported for rule-based translations.
+const RulesExtraction = "rules"
+
+// Rules translates requests without a language model, from a fixed
+// vocabulary of languages, result types and phrasings. Its queries are rough,
+// but it needs nothing from Sourcegraph, so it can stand in when every
+// provider is unavailable. Its translations are marked Fallback.
+type Rules struct {
+	repoScope      string
+	defaultFilters string
+	rewriter       QueryRewriter
+}
+
+func NewRules() *Rules {
+	return &Rules{}
+}
+
+// WithRepoScope returns a copy of r that limits queries to the
+// repositories whose names start with prefix, as Translator.WithRepoScope.
+func (r *Rules) WithRepoScope(prefix string) *Rules {
+	copy := *r
+	copy.repoScope = prefix
+	return &copy
+}
+
+func (r *Rules) Translate(ctx context.Context, request string, progress func(Progress)) (*Translation, error) {
+	q := ruleQuery(request, now(ctx))
+	if q == "" {
+		return nil, fmt.Errorf("no search terms found in %q", request)
+	}
+	q = rewrite(ctx, r.rewriter, addDefaultFilters(scopeRepos(q, r.repoScope), r.defaultFilters))
+	return &Translation{Query: q, Extraction: RulesExtraction, Fallback: true}, nil
+}
+
+var (
+	noTestsPattern = regexp.MustCompile(`(?i)\b(?:excluding|except|without|not in|ignoring|ignore|exclude|skip|skipping)(?: the| any)? tests?(?: files?| code| directories)?\b|\bnon-tests?\b`)
+	authorPattern  = regexp.MustCompile(`(?i)\b(?:authored |written |made |committed |pushed )?by @?([\w.-]+)`)
+)
+
+var typeWords = map[string]string{
+	"commit": "commit", "commits": "commit",
+	"diff": "diff", "diffs": "diff",
+	"symbol": "symbol", "symbols": "symbol",
+	"definition": "symbol", "definitions": "symbol", "defined": "symbol",
+	"declaration": "symbol", "declarations": "symbol", "declared": "symbol",
+}
+
+// changeWords turn a commit search into a diff search, which matches the
+// changed lines rather than the commit message.
+var changeWords = wordSet("added adding removed removing deleted deleting introduced introducing changed changing")
+
+var stopWords = wordSet(`a about all an and any are as at be been being but by can could did do does
+	each every example examples find for from get give has have how i in instance instances into is it
+	its just let like list look looking me mention mentioned mentioning mentions my need of on only or
+	our please references referencing search searching should show some than that the their there these
+	this those to usage usages use used uses using want was we were what where which who with within
+	without would you your code codebase file files function functions method methods repo repos
+	repository repositories project projects call calls called contain contains containing written
+	occurrences places go done happen happens handled implement implemented implementation work
+	works`)
+
+// ruleQuery builds a query from request, working out dates relative to
+// now, or returns "" if it finds nothing to search for.
+func ruleQuery(request string, now time.Time) string {
+	hints, rest := extractHints(request, now)
+	var filters []string
+	var dates []Hint
+	have := map[string]bool{}
+	for _, h := range hints.Filters {
+		if h.Dated {
+			dates = append(dates, h)
+			continue
+		}
+		filters = append(filters, h.String())
+		have[strings.TrimPrefix(h.Field, "-")] = true
+	}
+	addFilter := func(field, value string) {
+		if have[field] {
+			return
+		}
+		have[field] = true
+		filters = append(filters, field+":"+value)
+	}
+	patterns := hints.Patterns
+
+	excludeTests := false
+	rest = noTestsPattern.ReplaceAllStringFunc(rest, func(string) string {
+		excludeTests = true
+		return " "
+	})
+
+	words := strings.Fields(rest)
+	lower := make([]string, len(words))
+	for i, w := range words {
+		words[i] = trimWord(w)
+		lower[i] = strings.ToLower(words[i])
+	}
+
+	used := make([]bool, len(words))
+	resultType := ""
+	for i, w := range lower {
+		if t, ok := typeWords[w]; ok {
+			if resultType == "" || t == "diff" {
+				resultType = t
+			}
+			used[i] = true
+		}
+	}
+	if resultType == "commit" {
+		for i, w := range lower {
+			if changeWords[w] {
+				resultType = "diff"
+				used[i] = true
+			}
+		}
+	}
+	if resultType != "" && !have["type"] {
+		addFilter("type", resultType)
+	}
+
+	// Authors and dates only mean something to commit and diff searches;
+	// elsewhere "by" is just a word, and dates are left out.
+	if resultType == "commit" || resultType == "diff" {
+		if m := authorPattern.FindStringSubmatch(rest); m != nil && !stopWords[strings.ToLower(m[1])] {
+			addFilter("author", m[1])
+			markUsed(lower, used, "by", strings.ToLower(m[1]))
+		}
+		for _, h := range dates {
+			addFilter(h.Field, h.Value)
+		}
+	}
+	if excludeTests {
+		filters = append(filters, "-file:test")
+	}
+
+	patterns = append(patterns, keywords(words, lower, used)...)
+	return strings.Join(append(filters, patterns...), " ")
+}
+
+// maxKeywords bounds the plain words kept as patterns: each one narrows the
+// search, and a long tail of them soon matches nothing.
+const maxKeywords = 3
+
+// keywords picks the search terms from the words not consumed by a filter.
+// Identifiers are preferred, since they are what the code will contain.
+func keywords(words, lower []string, used []bool) []string {
+	var identifiers, plain []string
+	seen := map[string]bool{}
+	for i, w := range words {
+		if used[i] || w == "" || seen[lower[i]] {
+			continue
+		}
+		seen[lower[i]] = true
+		switch {
+		case isIdentifier(w):
+			identifiers = append(identifiers, w)
+		case !stopWords[lower[i]] && len(w) > 1:
+			plain = append(plain, lower[i])
+		}
+	}
+	if len(identifiers) > 0 {
+		return identifiers
+	}
+	if len(plain) > maxKeywords {
+		plain = plain[:maxKeywords]
+	}
+	return plain
+}
+
+// isIdentifier reports whether w looks like code rather than English:
+// snake_case, camelCase, a call or a qualified name.
+func isIdentifier(w string) bool {
+	if strings.ContainsAny(w, "_.()[]{}<>=:/") {
+		return true
+	}
+	for i, c := range w {
+		if i > 0 && unicode.IsUpper(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimWord strips sentence punctuation and possessives from w, leaving
+// characters that belong to identifiers such as foo() alone.
+func trimWord(w string) string {
+	w = strings.Trim(w, `,;!?"'`)
+	w = strings.TrimRight(w, ".:")
+	return strings.TrimSuffix(w, "'s")
+}
+
+func markUsed(lower []string, used []bool, targets ...string) {
+	for _, t := range targets {
+		for i, w := range lower {
+			if w == t {
+				used[i] = true
+			}
+		}
+	}
+}
+
+func wordSet(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
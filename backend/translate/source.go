@@ -0,0 +1,219 @@
+package translate
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Source is something a backend looked at for an answer, such as a file, a
+// range of lines in one, or a repository.
+type Source struct {
+	Type string `json:"type,omitempty"`
+	// Label is what to show for the source.
+	Label      string `json:"label"`
+	Repository string `json:"repository,omitempty"`
+	// Revision is the branch, tag or commit the source was read at, if the
+	// backend said.
+	Revision string `json:"revision,omitempty"`
+	Path     string `json:"path,omitempty"`
+	// StartLine and EndLine bound the lines looked at, counting from 1,
+	// when the source is part of a file.
+	StartLine int `json:"start_line,omitempty"`
+	EndLine   int `json:"end_line,omitempty"`
+	// URL links to the source on the Sourcegraph instance. It is relative
+	// to the instance until the server resolves it into a permalink.
+	URL string `json:"url,omitempty"`
+	// Snippet is the text of the lines cited, for previews, when the
+	// caller asked for snippets and the file could be read.
+	Snippet string `json:"snippet,omitempty"`
+	// Language is the language of the file, when it has a snippet and the
+	// language is recognized.
+	Language string `json:"language,omitempty"`
+	// SnippetHTML is Snippet as a <pre> block with syntax highlighting and
+	// line numbers, when the caller asked for highlighting.
+	SnippetHTML string `json:"snippet_html,omitempty"`
+}
+
+// blobLink matches the path of a Sourcegraph link to a repository, file or
+// directory: the repository, an optional revision after @, and the path
+// after /-/blob/ or /-/tree/.
+var blobLink = regexp.MustCompile(`^/([^@]+?)(?:@([^/]+))?(?:/-/(?:blob|tree)/(.+))?/?$`)
+
+// lineRange matches the line fragment or parameter of a Sourcegraph link,
+// e.g. L10 or L10-20.
+var lineRange = regexp.MustCompile(`^L(\d+)(?::\d+)?(?:-L?(\d+)(?::\d+)?)?$`)
+
+// NewSources turns the sources Deep Search reports, whose fields vary with
+// their type and the Sourcegraph version, into Sources. Fields missing from
+// a source are read from its link where possible, and sources with nothing
+// to show are left out.
+func NewSources(raw []map[string]interface{}) []Source {
+	var sources []Source
+	for _, r := range raw {
+		src := Source{
+			Type:       firstString(r, "type", "__typename", "kind"),
+			Label:      firstString(r, "label", "title", "name"),
+			Repository: firstString(r, "repository", "repo", "repoName", "repo_name"),
+			Revision:   firstString(r, "revision", "commit", "rev", "oid"),
+			Path:       firstString(r, "path", "filePath", "file_path", "file"),
+			StartLine:  firstInt(r, "startLine", "start_line", "lineStart"),
+			EndLine:    firstInt(r, "endLine", "end_line", "lineEnd"),
+			URL:        firstString(r, "url", "link", "href"),
+		}
+		if rng, ok := r["range"].(map[string]interface{}); ok && src.StartLine == 0 {
+			src.StartLine, src.EndLine = rangeLine(rng, "start"), rangeLine(rng, "end")
+		}
+		src.fromURL()
+		if src.EndLine < src.StartLine {
+			src.EndLine = src.StartLine
+		}
+		if src.Label == "" {
+			src.Label = src.defaultLabel()
+		}
+		if src.Label == "" {
+			continue
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// fromURL fills in the repository, revision, path and lines of s that are
+// missing from its link, if it is a link to code on Sourcegraph.
+func (s *Source) fromURL() {
+	u, err := url.Parse(s.URL)
+	if err != nil || s.URL == "" {
+		return
+	}
+	// Links to other pages, such as searches and commits, don't name
+	// code.
+	if m := blobLink.FindStringSubmatch(u.Path); m != nil && !strings.HasPrefix(u.Path, "/search") && !strings.Contains(m[1], "/-/") {
+		if s.Repository == "" {
+			s.Repository = m[1]
+		}
+		if s.Revision == "" {
+			s.Revision, _ = url.PathUnescape(m[2])
+		}
+		if s.Path == "" {
+			s.Path = m[3]
+		}
+	}
+	if s.StartLine != 0 {
+		return
+	}
+	for key := range u.Query() {
+		if s.lines(key) {
+			return
+		}
+	}
+	s.lines(u.Fragment)
+}
+
+// lines sets the lines of s from a line range such as L10-20, and reports
+// whether it was one.
+func (s *Source) lines(v string) bool {
+	m := lineRange.FindStringSubmatch(v)
+	if m == nil {
+		return false
+	}
+	s.StartLine, _ = strconv.Atoi(m[1])
+	s.EndLine, _ = strconv.Atoi(m[2])
+	return true
+}
+
+// defaultLabel names s by what it points at, e.g. main.go:10-20.
+func (s Source) defaultLabel() string {
+	label := s.Path
+	if label == "" {
+		label = s.Repository
+	}
+	if label == "" {
+		return s.URL
+	}
+	if s.StartLine != 0 {
+		label += fmt.Sprintf(":%d", s.StartLine)
+		if s.EndLine > s.StartLine {
+			label += fmt.Sprintf("-%d", s.EndLine)
+		}
+	}
+	return label
+}
+
+// Link returns the path, relative to the instance, of a link to s at
+// revision, a permalink if revision is a commit, or on the default branch
+// if it is empty. It returns "" if s isn't in a repository.
+func (s Source) Link(revision string) string {
+	if s.Repository == "" {
+		return ""
+	}
+	link := "/" + s.Repository
+	if revision != "" {
+		link += "@" + revision
+	}
+	if s.Path == "" {
+		return link
+	}
+	link += "/-/blob/" + s.Path
+	if s.StartLine != 0 {
+		link += fmt.Sprintf("?L%d", s.StartLine)
+		if s.EndLine > s.StartLine {
+			link += fmt.Sprintf("-%d", s.EndLine)
+		}
+	}
+	return link
+}
+
+// firstString returns the first of keys that m holds a non-empty string or
+// number under, as a string. Objects holding a name, such as a repository,
+// give their name.
+func firstString(m map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		switch v := m[key].(type) {
+		case string:
+			if v != "" {
+				return v
+			}
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		case map[string]interface{}:
+			if name := firstString(v, "name", "oid"); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// firstInt returns the first of keys that m holds a positive number under.
+func firstInt(m map[string]interface{}, keys ...string) int {
+	for _, key := range keys {
+		switch v := m[key].(type) {
+		case float64:
+			if v > 0 {
+				return int(v)
+			}
+		case string:
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// rangeLine returns the line of the start or end of a range such as
+// {"start": {"line": 9}}, in which lines count from 0.
+func rangeLine(rng map[string]interface{}, end string) int {
+	pos, ok := rng[end].(map[string]interface{})
+	if !ok {
+		return 0
+	}
+	line, ok := pos["line"].(float64)
+	if !ok {
+		return 0
+	}
+	return int(line) + 1
+}
@@ -0,0 +1,36 @@
+package translate
+
+import (
+	"context"
+	"time"
+)
+
+// Pipeline stages reported to a stage observer.
+const (
+	StagePrompt       = "prompt"
+	StageConversation = "conversation_create"
+	StagePolling      = "polling_wait"
+	StageCompletion   = "completion"
+	StageExtraction   = "extraction"
+	StageRepos        = "repo_resolution"
+	StageValidation   = "validation"
+	StageExecution    = "execution"
+)
+
+type stageObserverKey struct{}
+
+// WithStageObserver returns a context in which translations call observe
+// with how long each stage of the pipeline took, e.g. to export latency
+// histograms. Stages that run more than once, such as validating several
+// best-of-n candidates, are observed each time.
+func WithStageObserver(ctx context.Context, observe func(stage string, d time.Duration)) context.Context {
+	return context.WithValue(ctx, stageObserverKey{}, observe)
+}
+
+// observeStage reports that stage ran from start until now to the observer
+// in ctx, if there is one.
+func observeStage(ctx context.Context, stage string, start time.Time) {
+	if observe, ok := ctx.Value(stageObserverKey{}).(func(string, time.Duration)); ok {
+		observe(stage, time.Since(start))
+	}
+}
@@ -0,0 +1,321 @@
+// Package translate turns natural language requests into Sourcegraph search
+// queries.
+package translate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nlsearch/backend/examples"
+	"github.com/nlsearch/backend/query"
+)
+
+const prompt = `Convert this natural language request into a valid Sourcegraph search query.
+
+` + syntaxGuidance + `
+
+CRITICAL: Your response must be ONLY the search query itself. No explanations, no markdown, no code blocks, no additional text. Just the raw query string.
+
+Request: %s`
+
+// syntaxGuidance points the model at Sourcegraph's query parser. Prompts
+// replace it with retrieved examples when there are any, which teach the
+// syntax more directly and take the model no tool calls to read.
+const syntaxGuidance = `For guidance on proper syntax, refer to these files in github.com/sourcegraph/sourcegraph:
+- internal/search/query/parser.go
+- internal/search/query/validate.go
+- internal/search/query/parser_test.go
+- internal/search/query/validate_test.go
+- client/branded/src/search-ui/components/QueryExamples.constants.ts`
+
+// Translation is the result of turning a natural language request into a
+// Sourcegraph search query.
+type Translation struct {
+	Query   string
+	Sources []Source
+	Stats   map[string]interface{}
+	// Extraction names the extraction strategy that produced Query.
+	Extraction string
+	// Candidates lists every attempt when the translation was chosen from
+	// several, best first.
+	Candidates []Candidate
+	// Disagreement is set by Ensemble when too few providers agreed on
+	// Query to reach its quorum.
+	Disagreement bool
+	// Fallback is set on rule-based translations made without a language
+	// model.
+	Fallback bool
+	// Conversation is the Deep Search conversation the translation came
+	// from, if it is kept on the instance so Refine can follow it up.
+	Conversation int
+}
+
+// Strategy is a way of running translations: a single Translator, or a
+// runner such as BestOf built on top of one.
+type Strategy interface {
+	Translate(ctx context.Context, request string, progress func(Progress)) (*Translation, error)
+}
+
+// Backend sends a prompt to a language model on Sourcegraph and returns its
+// answer. progress, if non-nil, is called as the backend advances; Translator
+// fills in ElapsedMs.
+type Backend interface {
+	Ask(ctx context.Context, prompt string, progress func(Progress)) (*Answer, error)
+}
+
+// Answer is a backend's raw response to a prompt.
+type Answer struct {
+	Text    string
+	Sources []Source
+	Stats   map[string]interface{}
+	// Ref identifies the answer upstream, e.g. a Deep Search conversation,
+	// for logging.
+	Ref string
+	// Conversation is the upstream conversation the answer belongs to,
+	// for backends that can follow up on it, or zero.
+	Conversation int
+}
+
+// FollowUpBackend is a Backend that can ask a further question in the
+// conversation an earlier answer came from.
+type FollowUpBackend interface {
+	Backend
+	FollowUp(ctx context.Context, conversation int, prompt string, progress func(Progress)) (*Answer, error)
+}
+
+// ErrCannotFollowUp is returned by Refine when the translation's backend
+// can't ask follow-up questions.
+var ErrCannotFollowUp = errors.New("the translation backend can't ask follow-up questions")
+
+// ExampleRetriever finds curated examples similar to a request, such as an
+// examples.Index.
+type ExampleRetriever interface {
+	Similar(ctx context.Context, request string, k int) ([]examples.Example, error)
+}
+
+// Translator turns natural language into search queries by prompting a
+// backend and pulling the query out of each answer with its own extraction
+// pipeline.
+type Translator struct {
+	backend        Backend
+	extractor      *Extractor
+	prompt         *Prompt
+	examples       ExampleRetriever
+	numExamples    int
+	repos          RepoResolver
+	repoScope      string
+	defaultFilters string
+	rewriter       QueryRewriter
+}
+
+func New(backend Backend, extractor *Extractor) *Translator {
+	return &Translator{backend: backend, extractor: extractor, prompt: defaultPrompt}
+}
+
+// defaultPrompt holds the built-in prompt template.
+var defaultPrompt, _ = NewPrompt(prompt)
+
+// WithPrompt returns a copy of t that prompts the backend using template,
+// which must contain a single %s for the request.
+func (t *Translator) WithPrompt(template string) *Translator {
+	p := &Prompt{}
+	p.template.Store(&template)
+	return t.WithLivePrompt(p)
+}
+
+// WithLivePrompt returns a copy of t that prompts the backend using the
+// current template of p.
+func (t *Translator) WithLivePrompt(p *Prompt) *Translator {
+	copy := *t
+	copy.prompt = p
+	return &copy
+}
+
+// WithExamples returns a copy of t that includes up to k examples similar
+// to each request in its prompt.
+func (t *Translator) WithExamples(r ExampleRetriever, k int) *Translator {
+	copy := *t
+	copy.examples = r
+	copy.numExamples = k
+	return &copy
+}
+
+// buildPrompt fills in the prompt template for request, with retrieved
+// examples in place of the syntax guidance, or ahead of the request if the
+// template has none. Retrieval failures only cost the examples.
+func (t *Translator) buildPrompt(ctx context.Context, request string) string {
+	text := fmt.Sprintf(t.prompt.String(), request)
+	if t.examples == nil || t.numExamples <= 0 {
+		return text
+	}
+	similar, err := t.examples.Similar(ctx, request, t.numExamples)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error retrieving examples", "err", err)
+		return text
+	}
+	if len(similar) == 0 {
+		return text
+	}
+
+	var b strings.Builder
+	b.WriteString("Here are example requests and the Sourcegraph queries they should produce:\n")
+	for _, e := range similar {
+		fmt.Fprintf(&b, "\nRequest: %s\nQuery: %s\n", e.Request, e.Query)
+	}
+	block := strings.TrimRight(b.String(), "\n")
+
+	if strings.Contains(text, syntaxGuidance) {
+		return strings.Replace(text, syntaxGuidance, block, 1)
+	}
+	if i := strings.LastIndex(text, "Request:"); i >= 0 {
+		return text[:i] + block + "\n\n" + text[i:]
+	}
+	return block + "\n\n" + text
+}
+
+// Progress describes how far a translation has got. Status and Stats are
+// only set by backends that report them, such as Deep Search while polling.
+type Progress struct {
+	Stage     string                 `json:"stage"`
+	Status    string                 `json:"status,omitempty"`
+	ElapsedMs int64                  `json:"elapsed_ms"`
+	Stats     map[string]interface{} `json:"stats,omitempty"`
+	// Conversation is the Deep Search conversation being waited on, and
+	// Question the question in it, so callers can resume waiting after a
+	// restart with Resume.
+	Conversation int `json:"-"`
+	Question     int `json:"-"`
+}
+
+// Translate runs the full translation pipeline: it asks the backend to
+// convert request into a search query, waits for the answer, and extracts the
+// query. progress, if non-nil, is called at each stage.
+func (t *Translator) Translate(ctx context.Context, request string, progress func(Progress)) (*Translation, error) {
+	start := time.Now()
+	report := reporter(start, progress)
+
+	prompt := t.buildPrompt(ctx, request)
+	observeStage(ctx, StagePrompt, start)
+	answer, err := t.backend.Ask(ctx, prompt, report)
+	if err != nil {
+		return nil, err
+	}
+	return t.extract(ctx, answer, request, report), nil
+}
+
+// extract pulls the query out of answer, restoring filters that request
+// asked for explicitly but the model dropped, resolving the repositories
+// it names or else limiting it to the default scope, adding the default
+// filters it lacks and applying the rewriter, and reports how well the
+// answer served to the quality observer in ctx.
+func (t *Translator) extract(ctx context.Context, answer *Answer, request string, report func(Progress)) *Translation {
+	report(Progress{Stage: "extracting query", Stats: answer.Stats})
+	extractStart := time.Now()
+	q, strategy, missed := t.extractor.extract(answer.Text)
+	for _, name := range missed {
+		observeQuality(ctx, QualityExtractionMiss, name)
+	}
+	slog.InfoContext(ctx, "Extracted query", "from", answer.Ref, "strategy", strategy)
+	hints := ExtractHints(ctx, request)
+	if merged, added := hints.Merge(q); len(added) > 0 {
+		slog.InfoContext(ctx, "Restored filters from the request in the query", "filters", strings.Join(added, " "), "from", answer.Ref)
+		observeQuality(ctx, QualityHeuristic, HeuristicRestoredFilters)
+		q = merged
+	}
+	if t.repos != nil {
+		// Resolving repositories looks them up on Sourcegraph, so it is
+		// timed apart, with the extraction clock stopped meanwhile.
+		extracting := time.Since(extractStart)
+		reposStart := time.Now()
+		q = t.resolveRepos(ctx, q, hints)
+		observeStage(ctx, StageRepos, reposStart)
+		extractStart = time.Now().Add(-extracting)
+	}
+	q = scopeRepos(q, t.repoScope)
+	q = rewrite(ctx, t.rewriter, addDefaultFilters(q, t.defaultFilters))
+	observeStage(ctx, StageExtraction, extractStart)
+	validateStart := time.Now()
+	problems := query.Validate(q)
+	observeStage(ctx, StageValidation, validateStart)
+	observeQuality(ctx, QualityValidation, validationResult(problems))
+
+	return &Translation{
+		Query:        q,
+		Sources:      answer.Sources,
+		Stats:        answer.Stats,
+		Extraction:   strategy,
+		Conversation: answer.Conversation,
+	}
+}
+
+// reporter returns a progress callback that fills in the time since start,
+// or ignores reports if progress is nil.
+func reporter(start time.Time, progress func(Progress)) func(Progress) {
+	return func(p Progress) {
+		if progress != nil {
+			p.ElapsedMs = time.Since(start).Milliseconds()
+			progress(p)
+		}
+	}
+}
+
+const followUpPrompt = `Revise the search query you gave as follows: %s
+
+As before, respond with ONLY the revised Sourcegraph search query. No explanations, no markdown, no code blocks.`
+
+// Refine revises a translation that came from conversation by asking the
+// backend to apply followUp, such as "exclude tests", in that
+// conversation, which keeps the context of the original request. It fails
+// with ErrCannotFollowUp if the backend can't.
+func (t *Translator) Refine(ctx context.Context, conversation int, followUp string, progress func(Progress)) (*Translation, error) {
+	backend, ok := t.backend.(FollowUpBackend)
+	if !ok {
+		return nil, ErrCannotFollowUp
+	}
+	report := reporter(time.Now(), progress)
+	answer, err := backend.FollowUp(ctx, conversation, fmt.Sprintf(followUpPrompt, followUp), report)
+	if err != nil {
+		return nil, err
+	}
+	// Filters from the original request are left to the model, since the
+	// follow-up may be asking to drop them.
+	return t.extract(ctx, answer, followUp, report), nil
+}
+
+// ResumableBackend is a Backend whose answers can still be collected after
+// the process waiting for them has gone, given the conversation and
+// question reported in Progress. Question may be 0 for the latest one.
+type ResumableBackend interface {
+	Backend
+	Resume(ctx context.Context, conversation, question int, progress func(Progress)) (*Answer, error)
+}
+
+// ErrCannotResume is returned by Resume when the backend can't pick up
+// where an earlier translation left off.
+var ErrCannotResume = errors.New("the translation backend can't resume translations")
+
+// Resume finishes translating request, whose answer was being waited on
+// in conversation, as question, when an earlier process stopped. It fails
+// with ErrCannotResume if the backend can't.
+func (t *Translator) Resume(ctx context.Context, conversation, question int, request string, progress func(Progress)) (*Translation, error) {
+	backend, ok := t.backend.(ResumableBackend)
+	if !ok {
+		return nil, ErrCannotResume
+	}
+	report := reporter(time.Now(), progress)
+	answer, err := backend.Resume(ctx, conversation, question, report)
+	if err != nil {
+		return nil, err
+	}
+	return t.extract(ctx, answer, request, report), nil
+}
+
+// ToolCalls returns the number of tool calls Deep Search reports in stats.
+func ToolCalls(stats map[string]interface{}) (int, bool) {
+	n, ok := stats["tool_calls"].(float64)
+	return int(n), ok
+}
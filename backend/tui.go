@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlsearch/backend/output"
+	"github.com/nlsearch/backend/translate"
+)
+
+const (
+	ansiClear   = "\033[H\033[2J"
+	ansiBold    = "\033[1m"
+	ansiDim     = "\033[2m"
+	ansiRed     = "\033[31m"
+	ansiGreen   = "\033[32m"
+	ansiReset   = "\033[0m"
+	ansiEraseLn = "\r\033[K"
+)
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+type tuiEntry struct {
+	request  string
+	query    string
+	err      error
+	duration time.Duration
+}
+
+// tui is a minimal full-screen terminal interface: a history pane of past
+// translations, a live status line and an input prompt. It only relies on
+// ANSI escape sequences and line-buffered input, so it works in any terminal
+// without putting it into raw mode.
+type tui struct {
+	translator translate.Strategy
+	timeout    time.Duration
+	format     string
+	in         *bufio.Scanner
+	out        io.Writer
+	history    []tuiEntry
+	status     string
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // non-nil while a translation is running
+}
+
+func newTUICommand() *command {
+	fs := flag.NewFlagSet("tui", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 60*time.Second, "maximum time to wait for each translation")
+	format := fs.String("format", output.Query, "output format: "+strings.Join(output.Formats, ", "))
+	addConfigFlags(fs)
+
+	return &command{
+		name:    "tui",
+		summary: "Translate queries interactively in the terminal",
+		flags:   fs,
+		run: func(args []string) error {
+			if _, err := output.Format("", *format); err != nil {
+				return err
+			}
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			setupLogging(config)
+			translator, err := newCLITranslator(&config)
+			if err != nil {
+				return err
+			}
+			t := &tui{
+				translator: translator,
+				timeout:    *timeout,
+				format:     *format,
+				in:         bufio.NewScanner(os.Stdin),
+				out:        os.Stdout,
+				status:     fmt.Sprintf("Connected to %s. Type a request, /help for commands.", config.SourcegraphURL),
+			}
+			return t.run()
+		},
+	}
+}
+
+func (t *tui) run() error {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go t.handleInterrupts(interrupts)
+
+	for {
+		t.render()
+		if !t.in.Scan() {
+			fmt.Fprintln(t.out)
+			return t.in.Err()
+		}
+
+		line := strings.TrimSpace(t.in.Text())
+		switch line {
+		case "":
+			continue
+		case "/quit", "/exit", "/q":
+			fmt.Fprint(t.out, ansiClear)
+			return nil
+		case "/clear":
+			t.history = nil
+			t.status = "History cleared."
+			continue
+		case "/help":
+			t.status = "Commands: /clear resets history, /quit exits. Ctrl-C cancels a running translation."
+			continue
+		}
+
+		t.history = append(t.history, t.translate(line))
+		t.status = ""
+	}
+}
+
+// handleInterrupts cancels the running translation on Ctrl-C, or exits when
+// the user is sitting at the prompt.
+func (t *tui) handleInterrupts(interrupts <-chan os.Signal) {
+	for range interrupts {
+		t.mu.Lock()
+		cancel := t.cancel
+		t.mu.Unlock()
+		if cancel == nil {
+			fmt.Fprint(t.out, ansiClear)
+			os.Exit(0)
+		}
+		cancel()
+	}
+}
+
+// translate runs one request through the pipeline while animating the status
+// line.
+func (t *tui) translate(request string) tuiEntry {
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	t.mu.Lock()
+	t.cancel = cancel
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.cancel = nil
+		t.mu.Unlock()
+	}()
+
+	var mu sync.Mutex
+	stage := "starting"
+	setStage := func(p translate.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		stage = p.Stage
+		if p.Status != "" {
+			stage += " · " + p.Status
+		}
+		if n, ok := translate.ToolCalls(p.Stats); ok {
+			stage += fmt.Sprintf(" · %d tool calls", n)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		start := time.Now()
+		for frame := 0; ; frame++ {
+			mu.Lock()
+			current := stage
+			mu.Unlock()
+			fmt.Fprintf(t.out, "%s%s %s %s(%s, Ctrl-C to cancel)%s",
+				ansiEraseLn, spinnerFrames[frame%len(spinnerFrames)], current,
+				ansiDim, time.Since(start).Truncate(time.Second), ansiReset)
+			select {
+			case <-done:
+				fmt.Fprint(t.out, ansiEraseLn)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	start := time.Now()
+	translation, err := t.translator.Translate(ctx, request, setStage)
+	close(done)
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("cancelled")
+	}
+
+	entry := tuiEntry{request: request, err: err, duration: time.Since(start)}
+	if err == nil {
+		entry.query, _ = output.Format(translation.Query, t.format)
+	}
+	return entry
+}
+
+func (t *tui) render() {
+	var b strings.Builder
+	b.WriteString(ansiClear)
+	fmt.Fprintf(&b, "%snlsearch%s %s— natural language to Sourcegraph queries%s\n\n", ansiBold, ansiReset, ansiDim, ansiReset)
+
+	// Each entry takes three lines; keep the header, status and prompt visible.
+	visible := (terminalHeight() - 6) / 3
+	if visible < 1 {
+		visible = 1
+	}
+	entries := t.history
+	if len(entries) > visible {
+		entries = entries[len(entries)-visible:]
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(&b, "%sNo translations yet.%s\n\n", ansiDim, ansiReset)
+	}
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s› %s%s\n", ansiDim, e.request, ansiReset)
+		if e.err != nil {
+			fmt.Fprintf(&b, "  %s✗ %v%s\n\n", ansiRed, e.err, ansiReset)
+		} else {
+			fmt.Fprintf(&b, "  %s%s%s %s(%s)%s\n\n", ansiGreen, e.query, ansiReset, ansiDim, e.duration.Truncate(100*time.Millisecond), ansiReset)
+		}
+	}
+
+	if t.status != "" {
+		fmt.Fprintf(&b, "%s%s%s\n", ansiDim, t.status, ansiReset)
+	}
+	b.WriteString(ansiBold + "> " + ansiReset)
+	io.WriteString(t.out, b.String())
+}
+
+func terminalHeight() int {
+	if lines, err := strconv.Atoi(os.Getenv("LINES")); err == nil && lines > 0 {
+		return lines
+	}
+	return 24
+}
@@ -2,6 +2,7 @@ const queryInput = document.getElementById('queryInput');
 const searchBtn = document.getElementById('searchBtn');
 const clearBtn = document.getElementById('clearBtn');
 const loadingDiv = document.getElementById('loadingDiv');
+const loadingStatus = document.getElementById('loadingStatus');
 const resultDiv = document.getElementById('resultDiv');
 const examples = document.querySelectorAll('.example-item');
 
@@ -10,24 +11,33 @@ async function performSearch() {
     if (!query) return;
 
     searchBtn.disabled = true;
+    loadingStatus.textContent = '';
     loadingDiv.classList.remove('hidden');
     resultDiv.classList.add('hidden');
 
     try {
-        const response = await fetch('/api/query', {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-            },
-            body: JSON.stringify({ query }),
-        });
+        const response = await postJSON('/api/v1/query/stream', { query, intent: 'auto', snippets: true, highlight: true, disambiguate: true });
+        if (!response.ok) {
+            const data = await response.json().catch(() => ({}));
+            showError(errorMessage(data.error) || `Request failed with status ${response.status}`);
+            return;
+        }
 
-        const data = await response.json();
+        let finished = false;
+        await readEvents(response, (event, data) => {
+            if (event === 'progress') {
+                showProgress(data);
+            } else if (event === 'result') {
+                finished = true;
+                showResult(data);
+            } else if (event === 'error') {
+                finished = true;
+                showError(errorMessage(data.error));
+            }
+        });
 
-        if (data.error) {
-            showError(data.error);
-        } else {
-            showResult(data);
+        if (!finished) {
+            showError('Connection closed before a result was received');
         }
     } catch (error) {
         showError('Network error: ' + error.message);
@@ -37,13 +47,260 @@ async function performSearch() {
     }
 }
 
+// errorMessage formats an API error envelope for display, including the
+// request ID so users can quote it when reporting problems.
+function errorMessage(error) {
+    if (!error) return '';
+    return error.request_id ? `${error.message} (request ${error.request_id})` : error.message;
+}
+
+// postJSON sends a JSON request with the saved API key, if any, and the
+// CSRF token the server sets when users are signed in by an SSO proxy. When
+// the server asks for authentication it prompts for a key and retries once.
+async function postJSON(url, body) {
+    const csrfToken = readCookie('nlsearch_csrf');
+    const send = () => fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+            ...(localStorage.getItem('apiKey') ? { 'Authorization': 'Bearer ' + localStorage.getItem('apiKey') } : {}),
+            ...(csrfToken ? { 'X-CSRF-Token': csrfToken } : {}),
+        },
+        body: JSON.stringify(body),
+    });
+
+    const response = await send();
+    if (response.status !== 401) {
+        return response;
+    }
+    const key = window.prompt('This server requires an API key:');
+    if (!key) {
+        return response;
+    }
+    localStorage.setItem('apiKey', key.trim());
+    return send();
+}
+
+// readCookie returns the value of the named cookie, or null.
+function readCookie(name) {
+    const prefix = name + '=';
+    const cookie = document.cookie.split('; ').find(c => c.startsWith(prefix));
+    return cookie ? decodeURIComponent(cookie.slice(prefix.length)) : null;
+}
+
+// readEvents parses a server-sent event stream from a fetch response and
+// calls onEvent with each event name and its decoded JSON payload.
+async function readEvents(response, onEvent) {
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    let buffer = '';
+
+    while (true) {
+        const { value, done } = await reader.read();
+        if (done) break;
+        buffer += decoder.decode(value, { stream: true });
+
+        let boundary;
+        while ((boundary = buffer.indexOf('\n\n')) !== -1) {
+            const block = buffer.slice(0, boundary);
+            buffer = buffer.slice(boundary + 2);
+
+            let event = 'message';
+            let data = '';
+            for (const line of block.split('\n')) {
+                if (line.startsWith('event:')) event = line.slice(6).trim();
+                else if (line.startsWith('data:')) data += line.slice(5).trim();
+            }
+            if (data) onEvent(event, JSON.parse(data));
+        }
+    }
+}
+
+function showProgress(progress) {
+    let text = `${progress.stage}`;
+    if (progress.status) text += ` · ${progress.status}`;
+    if (progress.stats && progress.stats.tool_calls !== undefined) {
+        text += ` · ${progress.stats.tool_calls} tool calls`;
+    }
+    text += ` · ${Math.round(progress.elapsed_ms / 1000)}s`;
+    loadingStatus.textContent = text;
+}
+
+function formatStats(stats) {
+    const parts = [];
+    if (stats.time_millis !== undefined) parts.push(`${(stats.time_millis / 1000).toFixed(1)}s`);
+    if (stats.tool_calls !== undefined) parts.push(`${stats.tool_calls} tool calls`);
+    if (stats.total_tokens !== undefined) parts.push(`${stats.total_tokens} tokens`);
+    return parts.join(' · ');
+}
+
 function showResult(data) {
+    if (data.intent === 'question') {
+        showReply(data);
+        return;
+    }
+    if (data.needs_clarification) {
+        showClarification(data);
+        return;
+    }
     let html = '<div class="result">';
     html += '<h3>Generated Search Query</h3>';
+    if (data.fallback) {
+        html += '<div class="notice">Sourcegraph\'s AI features are unavailable right now, so this query was built from keywords and may be less precise.</div>';
+    }
     html += `<div class="answer"><code>${escapeHtml(data.answer)}</code></div>`;
+    if (data.interpretations && data.interpretations.length) {
+        html += '<div class="interpretations">This could mean different things. Did you mean: ';
+        for (const [i, interpretation] of data.interpretations.entries()) {
+            html += `<button data-index="${i}">${escapeHtml(interpretation.label)}</button> `;
+        }
+        html += '</div>';
+    }
+    if (data.filters && data.filters.length) {
+        html += '<div class="filters">';
+        for (const filter of data.filters) {
+            const cls = filter.negated ? 'filter negated' : 'filter';
+            html += `<span class="${cls}">${filter.negated ? 'not ' : ''}${escapeHtml(filter.field)}: ${escapeHtml(filter.value)}</span>`;
+        }
+        html += '</div>';
+    }
+    if (data.stats) {
+        const stats = formatStats(data.stats);
+        if (stats) html += `<div class="stats">Deep Search: ${escapeHtml(stats)}</div>`;
+    }
+    if (data.id) {
+        html += '<div class="feedback">Is this query right? ' +
+            '<button data-label="accepted">👍 Yes</button> ' +
+            '<button data-label="rejected">👎 No</button> ' +
+            '<button data-label="corrected">✏️ Correct it</button></div>';
+    }
+    html += '</div>';
+    resultDiv.innerHTML = html;
+    resultDiv.classList.remove('hidden');
+
+    resultDiv.querySelectorAll('.feedback button').forEach(button => {
+        button.addEventListener('click', () => sendFeedback(data, button.dataset.label));
+    });
+    // Choosing an interpretation shows its query in place of the one that
+    // covers them all.
+    resultDiv.querySelectorAll('.interpretations button').forEach(button => {
+        button.addEventListener('click', () => {
+            resultDiv.querySelector('.answer code').textContent = data.interpretations[button.dataset.index].query;
+            resultDiv.querySelectorAll('.interpretations button').forEach(b => b.classList.toggle('chosen', b === button));
+        });
+    });
+}
+
+// showClarification asks the question the server sent instead of a query
+// when it wasn't confident enough in it. The answer, picked from the
+// options or typed in, completes the translation; without an id to answer
+// to, the user adds the details to their request instead.
+function showClarification(data) {
+    let html = '<div class="result">';
+    html += '<h3>Could you tell us more?</h3>';
+    html += `<div class="notice">${escapeHtml(data.clarification)}</div>`;
+    if (data.id) {
+        html += '<div class="clarify">';
+        for (const option of data.clarification_options || []) {
+            html += `<button class="clarify-option" data-answer="${escapeHtml(option).replace(/"/g, '&quot;')}">${escapeHtml(option)}</button> `;
+        }
+        html += '<input type="text" class="clarify-answer" placeholder="Your answer"> <button class="clarify-send">Answer</button></div>';
+    } else {
+        html += '<div class="stats">Add the details to your request and search again.</div>';
+    }
     html += '</div>';
     resultDiv.innerHTML = html;
     resultDiv.classList.remove('hidden');
+
+    if (!data.id) {
+        queryInput.focus();
+        return;
+    }
+    const input = resultDiv.querySelector('.clarify-answer');
+    resultDiv.querySelectorAll('.clarify-option').forEach(button => {
+        button.addEventListener('click', () => sendClarification(data, button.dataset.answer));
+    });
+    resultDiv.querySelector('.clarify-send').addEventListener('click', () => sendClarification(data, input.value));
+    input.addEventListener('keypress', (e) => {
+        if (e.key === 'Enter') sendClarification(data, input.value);
+    });
+    input.focus();
+}
+
+// sendClarification answers a translation's clarifying question, and shows
+// the query it completes with, or the next question.
+async function sendClarification(data, answer) {
+    answer = answer.trim();
+    if (!answer) return;
+    loadingStatus.textContent = '';
+    loadingDiv.classList.remove('hidden');
+    resultDiv.classList.add('hidden');
+    try {
+        const response = await postJSON(`/api/v1/query/${encodeURIComponent(data.id)}/clarify`, { query: answer });
+        const result = await response.json().catch(() => ({}));
+        if (!response.ok) {
+            showError(errorMessage(result.error) || `Request failed with status ${response.status}`);
+            return;
+        }
+        showResult(result);
+    } catch (error) {
+        showError('Network error: ' + error.message);
+    } finally {
+        loadingDiv.classList.add('hidden');
+    }
+}
+
+// showReply shows Deep Search's answer to a question about the code, with
+// the sources it looked at.
+function showReply(data) {
+    let html = '<div class="result">';
+    html += '<h3>Answer</h3>';
+    html += `<div class="reply">${escapeHtml(data.reply)}</div>`;
+    if (data.stats) {
+        const stats = formatStats(data.stats);
+        if (stats) html += `<div class="stats">Deep Search: ${escapeHtml(stats)}</div>`;
+    }
+    if (data.sources && data.sources.length) {
+        html += '<div class="sources"><h4>Sources</h4>';
+        for (const source of data.sources) {
+            const label = escapeHtml(source.label);
+            const link = /^https?:\/\//.test(source.url || '')
+                ? `<a href="${escapeHtml(source.url).replace(/"/g, '&quot;')}" target="_blank" rel="noopener">${label}</a>`
+                : label;
+            html += `<div class="source-item"><span class="source-type">${escapeHtml(source.type || '')}</span>${link}`;
+            // snippet_html is built by the server, which escapes the code.
+            if (source.snippet_html) html += `<div class="source-snippet">${source.snippet_html}</div>`;
+            else if (source.snippet) html += `<pre class="source-snippet">${escapeHtml(source.snippet)}</pre>`;
+            html += '</div>';
+        }
+        html += '</div>';
+    }
+    html += '</div>';
+    resultDiv.innerHTML = html;
+    resultDiv.classList.remove('hidden');
+}
+
+// sendFeedback records the user's verdict on a translation; corrections
+// prompt for the query they would have wanted.
+async function sendFeedback(data, label) {
+    const body = { id: data.id, label };
+    if (label === 'corrected') {
+        const query = window.prompt('What should the query have been?', data.answer);
+        if (!query || !query.trim()) return;
+        body.query = query.trim();
+    }
+    const feedback = resultDiv.querySelector('.feedback');
+    try {
+        const response = await postJSON('/api/v1/feedback', body);
+        if (!response.ok) {
+            const result = await response.json().catch(() => ({}));
+            feedback.textContent = errorMessage(result.error) || 'Could not send feedback';
+            return;
+        }
+        feedback.textContent = 'Thanks for the feedback!';
+    } catch (error) {
+        feedback.textContent = 'Network error: ' + error.message;
+    }
 }
 
 function showError(message) {
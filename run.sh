@@ -1,2 +1,2 @@
 #!/bin/bash
-cd backend && go run main.go
+cd backend && go run .